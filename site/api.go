@@ -0,0 +1,371 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// apiPrefix is where the JSON API is served. The API is described by
+// api/openapi.yaml; changes that break clients go in a new version.
+const apiPrefix = "/api/v1"
+
+// openAPIDocument is the OpenAPI document served at apiPrefix +
+// "/openapi.yaml". It is built into the binary, so it is served wherever the
+// site runs from.
+//
+//go:embed api/openapi.yaml
+var openAPIDocument []byte
+
+// registerAPIHandlers adds the JSON API routes to r.
+func registerAPIHandlers(r *mux.Router) {
+	api := r.PathPrefix(apiPrefix).Subrouter()
+
+	api.Path("/media").Handler(apiMethods{
+		"GET":  apiListHandler,
+		"POST": authorized(canAddMedia, apiCreateHandler),
+	})
+	api.Path("/media/{id:[0-9]+}").Handler(apiMethods{
+		"GET":    apiGetHandler,
+		"PUT":    authorized(canEditMedia, apiReplaceHandler),
+		"PATCH":  authorized(canEditMedia, apiPatchHandler),
+		"DELETE": authorized(canDeleteMedia, apiDeleteHandler),
+	})
+	api.Path("/openapi.yaml").Handler(apiMethods{"GET": openAPIHandler})
+
+	// Unknown API routes get JSON errors too.
+	api.NotFoundHandler = apiStatusHandler(http.StatusNotFound)
+}
+
+// apiMethods routes the requests for one API path by method. Routing methods
+// here rather than with mux.Route.Methods lets other methods get a JSON 405.
+type apiMethods map[string]apiHandler
+
+func (m apiMethods) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h, ok := m[r.Method]; ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+	var allow []string
+	for method := range m {
+		allow = append(allow, method)
+	}
+	sort.Strings(allow)
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	apiStatusHandler(http.StatusMethodNotAllowed).ServeHTTP(w, r)
+}
+
+/*---------------------------  Errors  ---------------------------*/
+
+// apiHandler is an appHandler that answers errors with JSON rather than text.
+type apiHandler func(http.ResponseWriter, *http.Request) error
+
+// apiError is the body of API error responses, wrapped in {"Error": ...}.
+type apiError struct {
+	Code    int
+	Status  string
+	Message string
+}
+
+func (fn apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e := fn(w, r)
+	if e == nil {
+		return
+	}
+	appErr, ok := e.(*appError)
+	if !ok {
+		appErr = &appError{cause: e, message: e.Error(), code: http.StatusInternalServerError}
+	}
+	if appErr.code >= 500 {
+		log.Print(appErr)
+	}
+	writeAPIError(w, appErr.code, appErr.message)
+}
+
+// writeAPIError writes an API error response.
+func writeAPIError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, struct{ Error apiError }{apiError{
+		Code:    code,
+		Status:  http.StatusText(code),
+		Message: message,
+	}})
+}
+
+// apiStatusHandler answers every request with a JSON error with the given
+// code.
+func apiStatusHandler(code int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, code, fmt.Sprintf("%s %s: %s", r.Method, r.URL.Path, http.StatusText(code)))
+	})
+}
+
+// writeJSON writes v as the JSON body of a response with the given code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("could not write JSON response: %v", err)
+	}
+}
+
+/*---------------------------  Media  ---------------------------*/
+
+// apiListHandler lists a page of media with their credits. It takes the
+// query parameters of /media/list (see media-query.go), and links to the
+// first and next pages in the Link header as well as giving the next page's
+// cursor.
+func apiListHandler(w http.ResponseWriter, r *http.Request) error {
+	q, err := mediaQueryFromForm(r)
+	if err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
+	size, err := pageSizeFromForm(r)
+	if err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
+	cursor := r.FormValue("cursor")
+	page, err := DB.PageMedia(q, cursor, size)
+	if errors.Is(err, errBadCursor) {
+		return appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
+	if err != nil {
+		return appErrorf(err, "could not list media: %v", err)
+	}
+	if err := loadCredits(DB, page.Media...); err != nil {
+		return appErrorf(err, "could not list media credits: %v", err)
+	}
+	if page.Media == nil {
+		page.Media = []*Media{}
+	}
+
+	var links []string
+	if cursor != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="first"`, q.pageURL(apiPrefix+"/media", "", size)))
+	}
+	if page.Next != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, q.pageURL(apiPrefix+"/media", page.Next, size)))
+	}
+	if links != nil {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	writeJSON(w, http.StatusOK, page)
+	return nil
+}
+
+// apiGetHandler returns a media item with its credits.
+func apiGetHandler(w http.ResponseWriter, r *http.Request) error {
+	m, err := mediaFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	writeJSON(w, http.StatusOK, m)
+	return nil
+}
+
+// apiCreateHandler submits the media in the request body for moderation (see
+// submitAPIMedia).
+func apiCreateHandler(w http.ResponseWriter, r *http.Request) error {
+	m := &Media{}
+	if err := decodeMedia(r, m); err != nil {
+		return err
+	}
+	m.ID = 0
+	return submitAPIMedia(w, r, m, http.StatusCreated)
+}
+
+// apiReplaceHandler replaces a media item with the request body. Fields left
+// out are cleared, except who created the media and when.
+func apiReplaceHandler(w http.ResponseWriter, r *http.Request) error {
+	old, err := mediaFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	m := &Media{}
+	if err := decodeMedia(r, m); err != nil {
+		return err
+	}
+	m.ID = old.ID
+	return submitAPIMedia(w, r, m, http.StatusOK)
+}
+
+// apiPatchHandler applies the request body to a media item as a JSON merge
+// patch (RFC 7396): fields left out keep their value, fields set to null are
+// cleared, and lists replace the stored lists.
+func apiPatchHandler(w http.ResponseWriter, r *http.Request) error {
+	m, err := mediaFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	id := m.ID
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "could not read request: %v", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "bad media: %v", err)
+	}
+	if _, ok := fields["Credits"]; ok {
+		m.Credits = nil
+	}
+	if _, ok := fields["Assessments"]; ok {
+		m.Assessments = nil
+	}
+	// Decoding null leaves most fields as they were.
+	clearNullFields(reflect.ValueOf(m).Elem(), fields)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err := decodeMedia(r, m); err != nil {
+		return err
+	}
+	m.ID = id
+	return submitAPIMedia(w, r, m, http.StatusOK)
+}
+
+// clearNullFields sets the fields of the struct v that patch sets to null to
+// their zero value, and does the same in the objects patch sets struct
+// fields to. Fields are matched to members as encoding/json matches them.
+func clearNullFields(v reflect.Value, patch map[string]json.RawMessage) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" || f.PkgPath != "" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		raw, ok := patch[name]
+		for k, r := range patch {
+			if !ok && strings.EqualFold(k, name) {
+				raw, ok = r, true
+			}
+		}
+		if !ok {
+			continue
+		}
+		field := v.Field(i)
+		if string(bytes.TrimSpace(raw)) == "null" {
+			field.Set(reflect.Zero(f.Type))
+			continue
+		}
+		if field.Kind() == reflect.Ptr && !field.IsNil() {
+			field = field.Elem()
+		}
+		var nested map[string]json.RawMessage
+		if field.Kind() == reflect.Struct && json.Unmarshal(raw, &nested) == nil {
+			clearNullFields(field, nested)
+		}
+	}
+}
+
+// submitAPIMedia submits m for moderation, justified by the justification
+// query parameter. Changes approved straight away, as moderators' are, are
+// answered with the stored media and the given code. Others are answered with
+// 202 Accepted and the submission, whose page is in the Location header.
+func submitAPIMedia(w http.ResponseWriter, r *http.Request, m *Media, code int) error {
+	user, err := userFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+	s, err := submitMedia(DB, user, m, r.URL.Query().Get("justification"))
+	if err != nil {
+		return submissionErrorf(err)
+	}
+	if s.Status != submissionApproved {
+		w.Header().Set("Location", fmt.Sprintf("/submissions/%d", s.ID))
+		writeJSON(w, http.StatusAccepted, s)
+		return nil
+	}
+	if code == http.StatusCreated {
+		w.Header().Set("Location", fmt.Sprintf("%s/media/%d", apiPrefix, s.MediaID))
+	}
+	writeJSON(w, code, s.Media)
+	return nil
+}
+
+// apiDeleteHandler deletes a media item.
+func apiDeleteHandler(w http.ResponseWriter, r *http.Request) error {
+	m, err := mediaFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	u, err := userFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+	rev := &Revision{MediaID: m.ID, AuthorID: u.ID, Author: u.DisplayName(), Summary: r.FormValue("reason")}
+	if err := deleteMedia(DB, rev); err != nil {
+		return appErrorf(err, "could not delete media: %v", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// decodeMedia reads the JSON media in the request body onto m, checks it and
+// fills in its derived fields. The error is an appError.
+func decodeMedia(r *http.Request, m *Media) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(m); err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "bad media: %v", err)
+	}
+	if strings.TrimSpace(m.Title) == "" {
+		return appErrorCodef(http.StatusBadRequest, nil, "bad media: Title is required")
+	}
+
+	if m.RubricVersion == 0 {
+		m.RubricVersion = currentRubric().Version
+	}
+	rb, ok := rubricVersion(m.RubricVersion)
+	if !ok {
+		return appErrorCodef(http.StatusBadRequest, nil, "bad media: no rubric version %d", m.RubricVersion)
+	}
+	if err := rb.check(m.Assessments); err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "bad media: %v", err)
+	}
+	m.scoreRubric()
+	m.Bechdel = m.Bechdel.normalized()
+	m.Tags = parseTags(strings.Join(m.Tags, ","))
+
+	for _, c := range m.Credits {
+		switch {
+		case c.Role != roleActor && c.Role != roleDirector && c.Role != roleWriter:
+			return appErrorCodef(http.StatusBadRequest, nil, "bad media: credit has bad Role %q", c.Role)
+		case c.Person == nil || strings.TrimSpace(c.Person.Name) == "":
+			return appErrorCodef(http.StatusBadRequest, nil, "bad media: credit has no Person.Name")
+		}
+	}
+	return nil
+}
+
+// openAPIHandler serves the OpenAPI document describing the API.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(openAPIDocument)
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// serveAPI sends a request with the JSON body to the API, as u.
+func serveAPI(t *testing.T, u *User, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, apiPrefix+path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return serveAs(t, req, u)
+}
+
+// decodeAPI decodes the JSON body of the response w into v.
+func decodeAPI(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("bad JSON %q: %v", w.Body.String(), err)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	useDB(t, newMemoryDB())
+	moderator := addTestUser(t, RoleModerator)
+	if _, err := DB.AddMedia(&Media{Title: "Alien"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name, method, path, body string
+		want                     int
+		allow                    string
+	}{
+		{"truncated body", "POST", "/media", `{"Title": "Aliens"`, http.StatusBadRequest, ""},
+		{"unknown field", "POST", "/media", `{"Title": "Aliens", "Rating": 5}`, http.StatusBadRequest, ""},
+		{"no title", "POST", "/media", `{"Description": "Sequel"}`, http.StatusBadRequest, ""},
+		{"bad credit", "POST", "/media", `{"Title": "Aliens", "Credits": [{"Role": "grip"}]}`, http.StatusBadRequest, ""},
+		{"bad patch", "PATCH", "/media/1", `[]`, http.StatusBadRequest, ""},
+		{"bad cursor", "GET", "/media?cursor=garbage", "", http.StatusBadRequest, ""},
+		{"bad page size", "GET", "/media?size=many", "", http.StatusBadRequest, ""},
+		{"unknown media", "GET", "/media/99", "", http.StatusNotFound, ""},
+		{"patch unknown media", "PATCH", "/media/99", `{"Title": "Nope"}`, http.StatusNotFound, ""},
+		{"unknown path", "GET", "/films", "", http.StatusNotFound, ""},
+		{"list method", "DELETE", "/media", "", http.StatusMethodNotAllowed, "GET, POST"},
+		{"media method", "POST", "/media/1", "", http.StatusMethodNotAllowed, "DELETE, GET, PATCH, PUT"},
+	} {
+		w := serveAPI(t, moderator, tt.method, tt.path, tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s: %s %s = %d %s, want %d", tt.name, tt.method, tt.path, w.Code, w.Body.String(), tt.want)
+			continue
+		}
+		if got := w.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("%s: Allow = %q, want %q", tt.name, got, tt.allow)
+		}
+		var body struct{ Error apiError }
+		decodeAPI(t, w, &body)
+		if body.Error.Code != tt.want || body.Error.Message == "" {
+			t.Errorf("%s: error body = %+v, want code %d and a message", tt.name, body.Error, tt.want)
+		}
+	}
+}
+
+func TestAPIChanges(t *testing.T) {
+	useDB(t, newMemoryDB())
+	moderator := addTestUser(t, RoleModerator)
+	contributor := addTestUser(t, RoleContributor)
+
+	// Moderators' changes are applied straight away.
+	w := serveAPI(t, moderator, "POST", "/media",
+		`{"Title": "Alien", "Description": "In space", "Tags": ["space", "horror"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /media = %d %s, want 201", w.Code, w.Body.String())
+	}
+	var m Media
+	decodeAPI(t, w, &m)
+	if loc := w.Header().Get("Location"); m.ID == 0 || loc != apiPrefix+"/media/1" {
+		t.Fatalf("created media %d at %q", m.ID, loc)
+	}
+
+	// Others' wait for moderation.
+	w = serveAPI(t, contributor, "POST", "/media?justification=Ripley", `{"Title": "Aliens"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("POST /media as a contributor = %d %s, want 202", w.Code, w.Body.String())
+	}
+	var s Submission
+	decodeAPI(t, w, &s)
+	if s.Status != submissionPending || w.Header().Get("Location") != fmt.Sprintf("/submissions/%d", s.ID) {
+		t.Errorf("submission = %+v at %q, want pending", s, w.Header().Get("Location"))
+	}
+	if list, _ := DB.ListMedia(); len(list) != 1 {
+		t.Errorf("pending submission added media: %v", list)
+	}
+
+	// PATCH merges: fields left out keep their value, lists are replaced.
+	for _, tt := range []struct {
+		body        string
+		description string
+		tags        []string
+	}{
+		{`{"Description": "In space, no one can hear you scream"}`,
+			"In space, no one can hear you scream", []string{"space", "horror"}},
+		{`{"Tags": ["classic"]}`, "In space, no one can hear you scream", []string{"classic"}},
+		{`{"Description": ""}`, "", []string{"classic"}},
+		{`{"Description": "Again", "Tags": null}`, "Again", nil},
+		{`{"description": null, "Tags": ["classic"]}`, "", []string{"classic"}},
+	} {
+		w = serveAPI(t, moderator, "PATCH", "/media/1", tt.body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("PATCH %s = %d %s", tt.body, w.Code, w.Body.String())
+		}
+		got, err := DB.GetMedia(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Title != "Alien" || got.Description != tt.description || !reflect.DeepEqual(got.Tags, tt.tags) {
+			t.Errorf("after PATCH %s: %q %q %v, want Alien %q %v",
+				tt.body, got.Title, got.Description, got.Tags, tt.description, tt.tags)
+		}
+	}
+
+	// null clears fields, nested ones too.
+	w = serveAPI(t, moderator, "PATCH", "/media/1", `{"Bechdel": {"Rated": true, "TwoWomen": true, "Source": "Ann"}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH Bechdel = %d %s", w.Code, w.Body.String())
+	}
+	w = serveAPI(t, moderator, "PATCH", "/media/1", `{"Bechdel": {"Source": null}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH Bechdel source = %d %s", w.Code, w.Body.String())
+	}
+	if got, _ := DB.GetMedia(1); !got.Bechdel.TwoWomen || got.Bechdel.Source != "" {
+		t.Errorf("after clearing the source, Bechdel = %+v, want two women and no source", got.Bechdel)
+	}
+	if w = serveAPI(t, moderator, "PATCH", "/media/1", `{"Title": null}`); w.Code != http.StatusBadRequest {
+		t.Errorf("PATCH Title to null = %d, want 400", w.Code)
+	}
+
+	w = serveAPI(t, moderator, "DELETE", "/media/1", "")
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Fatalf("DELETE /media/1 = %d %q, want 204 and no body", w.Code, w.Body.String())
+	}
+	if w = serveAPI(t, nil, "GET", "/media/1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET deleted media = %d, want 404", w.Code)
+	}
+}
+
+func TestAPIOpenAPI(t *testing.T) {
+	w := serveAPI(t, nil, "GET", "/openapi.yaml", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "\nopenapi:") {
+		t.Errorf("GET /openapi.yaml = %d %.40q", w.Code, w.Body.String())
+	}
+}
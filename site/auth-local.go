@@ -0,0 +1,219 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// localOIDC is a stand-in OpenID Connect provider for development and tests.
+// Anyone can log in as anyone by typing a name and email; the subject is
+// derived from the email, which it reports as verified so ADMIN_EMAILS works
+// in development. Set AUTH_PROVIDER=local to serve it at /local-oidc;
+// configureAuth refuses to on App Engine.
+type localOIDC struct {
+	issuer string
+
+	mu     sync.Mutex
+	codes  map[string]localGrant
+	tokens map[string]*Identity
+}
+
+// localGrant is an authorization code waiting to be exchanged.
+type localGrant struct {
+	identity    *Identity
+	redirectURI string
+	expires     time.Time
+}
+
+// newLocalOIDC returns a provider whose URLs start with issuer.
+func newLocalOIDC(issuer string) *localOIDC {
+	return &localOIDC{
+		issuer: strings.TrimSuffix(issuer, "/"),
+		codes:  map[string]localGrant{},
+		tokens: map[string]*Identity{},
+	}
+}
+
+// ServeHTTP answers the discovery, authorize, token and userinfo endpoints.
+func (p *localOIDC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path := r.URL.Path; {
+	case strings.HasSuffix(path, "/.well-known/openid-configuration"):
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                p.issuer,
+			"authorization_endpoint":                p.issuer + "/authorize",
+			"token_endpoint":                        p.issuer + "/token",
+			"userinfo_endpoint":                     p.issuer + "/userinfo",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"none"},
+		})
+	case strings.HasSuffix(path, "/authorize") && r.Method == "GET":
+		p.authorizeForm(w, r)
+	case strings.HasSuffix(path, "/authorize") && r.Method == "POST":
+		p.authorize(w, r)
+	case strings.HasSuffix(path, "/token") && r.Method == "POST":
+		p.token(w, r)
+	case strings.HasSuffix(path, "/userinfo"):
+		p.userInfo(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+var localOIDCForm = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<title>Log in</title>
+<h1>Log in</h1>
+<p>This is a stand-in identity provider. Log in as anyone.</p>
+<form method="post">
+  <p><label>Name <input name="name" required></label></p>
+  <p><label>Email <input name="email" type="email" required></label></p>
+  <input type="hidden" name="redirect_uri" value="{{.redirect_uri}}">
+  <input type="hidden" name="state" value="{{.state}}">
+  <button>Log in</button>
+</form>
+`))
+
+// authorizeForm asks who to log in as.
+func (p *localOIDC) authorizeForm(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("response_type") != "code" {
+		http.Error(w, "unsupported response_type", http.StatusBadRequest)
+		return
+	}
+	localOIDCForm.Execute(w, map[string]string{
+		"redirect_uri": r.FormValue("redirect_uri"),
+		"state":        r.FormValue("state"),
+	})
+}
+
+// authorize issues a code for the name and email in the form, and sends the
+// user back to the client with it.
+func (p *localOIDC) authorize(w http.ResponseWriter, r *http.Request) {
+	email := strings.TrimSpace(r.FormValue("email"))
+	redirectURI, err := url.Parse(r.FormValue("redirect_uri"))
+	if email == "" || err != nil || !redirectURI.IsAbs() {
+		http.Error(w, "email and redirect_uri are required", http.StatusBadRequest)
+		return
+	}
+	code, err := randomToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.mu.Lock()
+	p.codes[code] = localGrant{
+		identity: &Identity{
+			Issuer:  p.issuer,
+			Subject: strings.ToLower(email),
+			Name:    strings.TrimSpace(r.FormValue("name")),
+			Email:   email,
+			// Anyone can log in as anyone anyway.
+			EmailVerified: true,
+		},
+		redirectURI: redirectURI.String(),
+		expires:     time.Now().Add(time.Minute),
+	}
+	p.mu.Unlock()
+
+	q := redirectURI.Query()
+	q.Set("code", code)
+	q.Set("state", r.FormValue("state"))
+	redirectURI.RawQuery = q.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token exchanges a code for an access token and an unsigned ID token. Codes
+// can only be used once.
+func (p *localOIDC) token(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	code := r.FormValue("code")
+	p.mu.Lock()
+	grant, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+	if !ok || time.Now().After(grant.expires) ||
+		r.FormValue("redirect_uri") != "" && r.FormValue("redirect_uri") != grant.redirectURI {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.mu.Lock()
+	p.tokens[token] = grant.identity
+	p.mu.Unlock()
+
+	clientID, _, _ := r.BasicAuth()
+	if clientID == "" {
+		clientID = r.FormValue("client_id")
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     p.idToken(grant.identity, clientID),
+	})
+}
+
+// idToken returns an unsigned ("alg": "none") JWT for id.
+func (p *localOIDC) idToken(id *Identity, audience string) string {
+	enc := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	now := time.Now()
+	return enc(map[string]string{"alg": "none", "typ": "JWT"}) + "." + enc(map[string]interface{}{
+		"iss":            p.issuer,
+		"sub":            id.Subject,
+		"aud":            audience,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"name":           id.Name,
+		"email":          id.Email,
+		"email_verified": id.EmailVerified,
+	}) + "."
+}
+
+// userInfo describes the user the bearer token was issued to.
+func (p *localOIDC) userInfo(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	p.mu.Lock()
+	id, ok := p.tokens[token]
+	p.mu.Unlock()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sub":            id.Subject,
+		"name":           id.Name,
+		"email":          id.Email,
+		"email_verified": id.EmailVerified,
+	})
+}
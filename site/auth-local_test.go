@@ -0,0 +1,160 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+// newLocalAuthSite serves logging in through a localOIDC, and answers / with
+// the name of the logged in user. It returns the site's URL and a client
+// that keeps its cookies.
+func newLocalAuthSite(t *testing.T) (string, *http.Client) {
+	t.Helper()
+	useDB(t, newMemoryDB())
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	provider := newLocalOIDC(srv.URL + "/local-oidc")
+	mux.Handle("/local-oidc/", provider)
+	mux.Handle("/login", appHandler(loginHandler))
+	mux.Handle("/auth/callback", appHandler(authCallbackHandler))
+	mux.Handle("/logout", appHandler(logoutHandler))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		u, err := userFromRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if u == nil {
+			fmt.Fprint(w, "nobody")
+			return
+		}
+		fmt.Fprint(w, u.Name)
+	})
+
+	oldProvider, oldStore := AuthProvider, SessionStore
+	AuthProvider = newOIDCProvider(provider.issuer, "flipthescript", "", srv.URL+"/auth/callback")
+	SessionStore = sessions.NewCookieStore([]byte("test session key"))
+	t.Cleanup(func() { AuthProvider, SessionStore = oldProvider, oldStore })
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv.URL, &http.Client{Jar: jar}
+}
+
+// readBody returns the status and body of resp.
+func readBody(t *testing.T, resp *http.Response, err error) (int, string) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+// startLogin follows /login to the provider's form, and returns the form's
+// URL, whose query has the redirect_uri and state to post back.
+func startLogin(t *testing.T, site string, client *http.Client) *url.URL {
+	t.Helper()
+	resp, err := client.Get(site + "/login?redirect=/")
+	if code, body := readBody(t, resp, err); code != http.StatusOK || !strings.Contains(body, "Log in as anyone") {
+		t.Fatalf("GET /login = %d %s, want the login form", code, body)
+	}
+	return resp.Request.URL
+}
+
+func TestLocalOIDCLogin(t *testing.T) {
+	site, client := newLocalAuthSite(t)
+	form := startLogin(t, site, client)
+	if form.Path != "/local-oidc/authorize" || form.Query().Get("state") == "" {
+		t.Fatalf("login sent to %s, want the provider's authorize URL with a state", form)
+	}
+
+	resp, err := client.PostForm(site+"/local-oidc/authorize", url.Values{
+		"name":         {"Ellen Ripley"},
+		"email":        {"Ripley@Example.com"},
+		"redirect_uri": {form.Query().Get("redirect_uri")},
+		"state":        {form.Query().Get("state")},
+	})
+	if code, body := readBody(t, resp, err); code != http.StatusOK || body != "Ellen Ripley" {
+		t.Fatalf("logging in = %d %q, want Ellen Ripley", code, body)
+	}
+	users, err := DB.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Subject != "ripley@example.com" || users[0].Email != "Ripley@Example.com" {
+		t.Errorf("users = %+v, want Ripley", users)
+	}
+
+	// The callback cannot be replayed.
+	resp, err = client.Get(site + "/auth/callback?" + resp.Request.URL.RawQuery)
+	if code, _ := readBody(t, resp, err); code != http.StatusBadRequest {
+		t.Errorf("reusing the callback = %d, want 400", code)
+	}
+
+	resp, err = client.PostForm(site+"/logout", nil)
+	if code, body := readBody(t, resp, err); code != http.StatusOK || body != "nobody" {
+		t.Errorf("after logging out = %d %q, want nobody", code, body)
+	}
+}
+
+func TestLocalOIDCStateMismatch(t *testing.T) {
+	site, client := newLocalAuthSite(t)
+	form := startLogin(t, site, client)
+
+	resp, err := client.PostForm(site+"/local-oidc/authorize", url.Values{
+		"name":         {"Ellen Ripley"},
+		"email":        {"ripley@example.com"},
+		"redirect_uri": {form.Query().Get("redirect_uri")},
+		"state":        {"forged"},
+	})
+	if code, body := readBody(t, resp, err); code != http.StatusBadRequest || !strings.Contains(body, "bad login state") {
+		t.Errorf("callback with another state = %d %q, want 400", code, body)
+	}
+	if users, _ := DB.ListUsers(); len(users) != 0 {
+		t.Errorf("users = %+v, want none", users)
+	}
+	resp, err = client.Get(site + "/")
+	if _, body := readBody(t, resp, err); body != "nobody" {
+		t.Errorf("logged in as %q after a bad state", body)
+	}
+}
+
+func TestConfigureLocalAuthOnAppEngine(t *testing.T) {
+	t.Setenv("GAE_INSTANCE", "00c61b117c")
+	old := LocalOIDC
+	defer func() { LocalOIDC = old }()
+	if p, err := configureAuth("local"); err == nil || p != nil {
+		t.Errorf("configureAuth(local) on App Engine = %v, %v, want an error", p, err)
+	}
+}
@@ -0,0 +1,429 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+/*---------------------------  Identity providers  ---------------------------*/
+
+// Identity is who the identity provider says logged in.
+type Identity struct {
+	Issuer  string
+	Subject string
+	Name    string
+	Email   string
+
+	// EmailVerified is whether the provider checked the user owns Email.
+	EmailVerified bool
+}
+
+// IdentityProvider logs users in with the OAuth 2.0 authorization code flow:
+// users are sent to AuthCodeURL, and come back to /auth/callback with a code
+// that Exchange trades for their identity.
+type IdentityProvider interface {
+	// AuthCodeURL returns the URL to send users to to log in. state is
+	// handed back with the code.
+	AuthCodeURL(ctx context.Context, state string) (string, error)
+
+	// Exchange returns the identity of the user the code was issued for.
+	Exchange(ctx context.Context, code string) (*Identity, error)
+}
+
+// oidcProvider is an OpenID Connect identity provider, found through its
+// discovery document. The user's identity comes from its userinfo endpoint.
+type oidcProvider struct {
+	issuer string
+	config oauth2.Config
+
+	mu          sync.Mutex
+	discovered  bool
+	userInfoURL string
+}
+
+// Ensure oidcProvider conforms to the IdentityProvider interface.
+var _ IdentityProvider = &oidcProvider{}
+
+// newOIDCProvider returns the provider at issuer, with the client registered
+// there. Discovery waits for the first login, so the provider can be served by
+// this site (see auth-local.go).
+func newOIDCProvider(issuer, clientID, clientSecret, redirectURL string) *oidcProvider {
+	return &oidcProvider{
+		issuer: strings.TrimSuffix(issuer, "/"),
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Scopes:       []string{"openid", "profile", "email"},
+		},
+	}
+}
+
+// discover reads the provider's endpoints from its discovery document.
+func (p *oidcProvider) discover(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovered {
+		return nil
+	}
+
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	if err := getJSON(ctx, p.issuer+"/.well-known/openid-configuration", "", &doc); err != nil {
+		return fmt.Errorf("oidc: could not discover %s: %v", p.issuer, err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != p.issuer {
+		return fmt.Errorf("oidc: %s says it is %q", p.issuer, doc.Issuer)
+	}
+	p.config.Endpoint = oauth2.Endpoint{AuthURL: doc.AuthorizationEndpoint, TokenURL: doc.TokenEndpoint}
+	p.userInfoURL = doc.UserInfoEndpoint
+	p.discovered = true
+	return nil
+}
+
+// AuthCodeURL returns the provider's URL for logging in.
+func (p *oidcProvider) AuthCodeURL(ctx context.Context, state string) (string, error) {
+	if err := p.discover(ctx); err != nil {
+		return "", err
+	}
+	return p.config.AuthCodeURL(state), nil
+}
+
+// Exchange trades code for a token, and the token for the user's identity.
+// The identity comes straight from the provider over TLS, so it is trusted
+// without checking the ID token's signature.
+func (p *oidcProvider) Exchange(ctx context.Context, code string) (*Identity, error) {
+	if err := p.discover(ctx); err != nil {
+		return nil, err
+	}
+	tok, err := p.config.Exchange(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: could not exchange code: %v", err)
+	}
+	var info struct {
+		Subject string `json:"sub"`
+		Name    string `json:"name"`
+		Email   string `json:"email"`
+		// Some providers send "true" rather than true.
+		EmailVerified interface{} `json:"email_verified"`
+	}
+	if err := getJSON(ctx, p.userInfoURL, tok.AccessToken, &info); err != nil {
+		return nil, fmt.Errorf("oidc: could not get user info: %v", err)
+	}
+	if info.Subject == "" {
+		return nil, errors.New("oidc: user info has no subject")
+	}
+	return &Identity{
+		Issuer:        p.issuer,
+		Subject:       info.Subject,
+		Name:          info.Name,
+		Email:         info.Email,
+		EmailVerified: info.EmailVerified == true || info.EmailVerified == "true",
+	}, nil
+}
+
+// getJSON decodes the JSON at u into v, authorized by the bearer token if
+// there is one.
+func getJSON(ctx context.Context, u, token string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+/*---------------------------  Sessions  ---------------------------*/
+
+// Session cookie name and the values kept in it.
+const (
+	sessionName         = "fts-session"
+	sessionUserID       = "userID"
+	sessionOAuthState   = "oauthState"
+	sessionAfterLoginTo = "afterLoginTo"
+	sessionCSRFToken    = "csrfToken"
+)
+
+// csrfFormField and csrfHeader are where requests that change anything carry
+// the CSRF token of their session.
+const (
+	csrfFormField = "csrf"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// userFromRequest returns the logged in user, or nil if there is none.
+func userFromRequest(r *http.Request) (*User, error) {
+	if SessionStore == nil {
+		return nil, nil
+	}
+	session, err := SessionStore.Get(r, sessionName)
+	if err != nil {
+		// A cookie from before the key changed; treat it as logged out.
+		return nil, nil
+	}
+	id, ok := session.Values[sessionUserID].(int64)
+	if !ok {
+		return nil, nil
+	}
+	u, err := DB.GetUser(id)
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	return u, err
+}
+
+// csrfToken returns the CSRF token of the logged in user's session, adding
+// one to sessions that have none yet, or "" if nobody is logged in.
+func csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if SessionStore == nil {
+		return "", nil
+	}
+	session, err := SessionStore.Get(r, sessionName)
+	if err != nil {
+		return "", nil
+	}
+	if _, ok := session.Values[sessionUserID].(int64); !ok {
+		return "", nil
+	}
+	if token, ok := session.Values[sessionCSRFToken].(string); ok {
+		return token, nil
+	}
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	session.Values[sessionCSRFToken] = token
+	if err := session.Save(r, w); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// checkCSRF returns an error unless r only reads, or carries the CSRF token
+// of its session in csrfFormField or csrfHeader. Browsers send the session
+// cookie along with requests other sites make too, so it alone does not
+// show the user meant to make r.
+func checkCSRF(r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+	var want string
+	if SessionStore != nil {
+		if session, err := SessionStore.Get(r, sessionName); err == nil {
+			want, _ = session.Values[sessionCSRFToken].(string)
+		}
+	}
+	got := r.Header.Get(csrfHeader)
+	if got == "" {
+		got = r.FormValue(csrfFormField)
+	}
+	if want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return errors.New("bad or missing CSRF token, reload the page and try again")
+	}
+	return nil
+}
+
+// randomToken returns a random string for OAuth state and CSRF tokens.
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// localRedirect returns u if it is a path on this site, "/" otherwise, so
+// logging in cannot send users elsewhere.
+func localRedirect(u string) string {
+	if !strings.HasPrefix(u, "/") || strings.HasPrefix(u, "//") || strings.HasPrefix(u, "/\\") {
+		return "/"
+	}
+	return u
+}
+
+// loginURL returns the URL that logs in and comes back to the given page.
+func loginURL(redirect string) string {
+	return "/login?redirect=" + url.QueryEscape(localRedirect(redirect))
+}
+
+/*---------------------------  Handlers  ---------------------------*/
+
+// loginHandler sends the user to the identity provider, to come back to the
+// redirect parameter once logged in.
+func loginHandler(w http.ResponseWriter, r *http.Request) error {
+	if AuthProvider == nil || SessionStore == nil {
+		return appErrorCodef(http.StatusServiceUnavailable, nil, "logging in is not configured")
+	}
+	state, err := randomToken()
+	if err != nil {
+		return appErrorf(err, "could not log in: %v", err)
+	}
+	authURL, err := AuthProvider.AuthCodeURL(r.Context(), state)
+	if err != nil {
+		return appErrorf(err, "could not log in: %v", err)
+	}
+
+	session, _ := SessionStore.Get(r, sessionName)
+	session.Values[sessionOAuthState] = state
+	session.Values[sessionAfterLoginTo] = localRedirect(r.FormValue("redirect"))
+	if err := session.Save(r, w); err != nil {
+		return appErrorf(err, "could not save session: %v", err)
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+	return nil
+}
+
+// authCallbackHandler completes logging in: it checks the state, exchanges
+// the code for the user's identity, and adds or updates the user.
+func authCallbackHandler(w http.ResponseWriter, r *http.Request) error {
+	if AuthProvider == nil || SessionStore == nil {
+		return appErrorCodef(http.StatusServiceUnavailable, nil, "logging in is not configured")
+	}
+	session, err := SessionStore.Get(r, sessionName)
+	if err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "bad session: %v", err)
+	}
+	state, _ := session.Values[sessionOAuthState].(string)
+	if state == "" || r.FormValue("state") != state {
+		return appErrorCodef(http.StatusBadRequest, nil, "bad login state, try logging in again")
+	}
+	if e := r.FormValue("error"); e != "" {
+		return appErrorCodef(http.StatusUnauthorized, nil, "could not log in: %s", e)
+	}
+
+	id, err := AuthProvider.Exchange(r.Context(), r.FormValue("code"))
+	if err != nil {
+		return appErrorCodef(http.StatusUnauthorized, err, "could not log in: %v", err)
+	}
+	u, err := saveIdentity(DB, id)
+	if err != nil {
+		return appErrorf(err, "could not save user: %v", err)
+	}
+
+	redirect, _ := session.Values[sessionAfterLoginTo].(string)
+	delete(session.Values, sessionOAuthState)
+	delete(session.Values, sessionAfterLoginTo)
+	// The CSRF token is made anew for the user on their first page.
+	delete(session.Values, sessionCSRFToken)
+	session.Values[sessionUserID] = u.ID
+	if err := session.Save(r, w); err != nil {
+		return appErrorf(err, "could not save session: %v", err)
+	}
+	http.Redirect(w, r, localRedirect(redirect), http.StatusFound)
+	return nil
+}
+
+// saveIdentity returns the user with the given identity, adding them on
+// their first login and updating their name and email on later ones. Users
+// with one of the adminEmails are made admins, once the provider has verified
+// it is theirs.
+func saveIdentity(db UserDatabase, id *Identity) (*User, error) {
+	u, err := db.GetUserByIdentity(id.Issuer, id.Subject)
+	if errors.Is(err, errNotFound) {
+		u = &User{
+			Issuer:      id.Issuer,
+			Subject:     id.Subject,
+			Name:        id.Name,
+			Email:       id.Email,
+			CreatedDate: time.Now().Format("02-01-2006"),
+			Role:        defaultRole,
+		}
+		if isAdminIdentity(id) {
+			u.Role = RoleAdmin
+		}
+		if _, err := db.AddUser(u); err != nil {
+			return nil, err
+		}
+		log.Printf("added user %d (%s)", u.ID, u.DisplayName())
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Name != id.Name || u.Email != id.Email || isAdminIdentity(id) && !u.Is(RoleAdmin) {
+		u.Name, u.Email = id.Name, id.Email
+		if isAdminIdentity(id) {
+			u.Role = RoleAdmin
+		}
+		if err := db.UpdateUser(u); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// logoutHandler logs the user out.
+func logoutHandler(w http.ResponseWriter, r *http.Request) error {
+	if SessionStore != nil {
+		session, _ := SessionStore.Get(r, sessionName)
+		delete(session.Values, sessionUserID)
+		session.Options.MaxAge = -1
+		if err := session.Save(r, w); err != nil {
+			return appErrorf(err, "could not save session: %v", err)
+		}
+	}
+	http.Redirect(w, r, localRedirect(r.FormValue("redirect")), http.StatusFound)
+	return nil
+}
+
+// myMediaHandler lists the media the logged in user added.
+func myMediaHandler(w http.ResponseWriter, r *http.Request) error {
+	u, err := userFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+	if u == nil {
+		http.Redirect(w, r, loginURL(r.URL.RequestURI()), http.StatusFound)
+		return nil
+	}
+	media, err := DB.ListMediaCreatedBy(u.ID)
+	if err != nil {
+		return appErrorf(err, "could not list media: %v", err)
+	}
+	if err := loadCredits(DB, media...); err != nil {
+		return appErrorf(err, "could not list media credits: %v", err)
+	}
+	return listTmpl.Execute(w, r, &mediaListPage{Media: media, PageSubTitle: "My Media"})
+}
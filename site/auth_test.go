@@ -0,0 +1,100 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSaveIdentityAdmin(t *testing.T) {
+	old := adminEmails
+	adminEmails = []string{"ripley@example.com"}
+	defer func() { adminEmails = old }()
+
+	for _, tt := range []struct {
+		name string
+		ids  []*Identity // Logins, in order.
+		want Role
+	}{
+		{"verified", []*Identity{{Email: "Ripley@example.com", EmailVerified: true}}, RoleAdmin},
+		{"unverified", []*Identity{{Email: "ripley@example.com"}}, defaultRole},
+		{"other email", []*Identity{{Email: "dallas@example.com", EmailVerified: true}}, defaultRole},
+		{"verified later", []*Identity{
+			{Email: "ripley@example.com"},
+			{Email: "ripley@example.com", EmailVerified: true},
+		}, RoleAdmin},
+		{"changed to unverified", []*Identity{
+			{Email: "dallas@example.com", EmailVerified: true},
+			{Email: "ripley@example.com"},
+		}, defaultRole},
+	} {
+		db := newMemoryDB()
+		var u *User
+		for _, id := range tt.ids {
+			id.Issuer, id.Subject = "https://accounts.example.com", "1234"
+			var err error
+			if u, err = saveIdentity(db, id); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		if u.Role != tt.want {
+			t.Errorf("%s: role = %s, want %s", tt.name, u.Role, tt.want)
+		}
+	}
+}
+
+// TestCSRF deletes media with and without the CSRF token of the session.
+func TestCSRF(t *testing.T) {
+	useDB(t, newMemoryDB())
+	moderator := addTestUser(t, RoleModerator)
+	id, err := DB.AddMedia(&Media{Title: "Alien"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/media/%d", id)
+
+	w := serveAs(t, httptest.NewRequest("GET", path, nil), moderator)
+	field := fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, csrfFormField, testCSRFToken)
+	if !strings.Contains(w.Body.String(), field) {
+		t.Errorf("GET %s has no %s", path, field)
+	}
+
+	for _, token := range []string{"", "other token"} {
+		form := url.Values{csrfFormField: {token}}
+		req := httptest.NewRequest("POST", path+":delete", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if w := serveWithoutToken(t, req, moderator); w.Code != http.StatusForbidden {
+			t.Errorf("POST %s:delete with token %q = %d, want %d", path, token, w.Code, http.StatusForbidden)
+		}
+		if _, err := DB.GetMedia(id); err != nil {
+			t.Fatalf("media deleted with token %q: %v", token, err)
+		}
+	}
+
+	form := url.Values{csrfFormField: {testCSRFToken}}
+	req := httptest.NewRequest("POST", path+":delete", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w := serveWithoutToken(t, req, moderator); w.Code != http.StatusFound {
+		t.Fatalf("POST %s:delete with the token = %d %s, want a redirect", path, w.Code, w.Body.String())
+	}
+	if _, err := DB.GetMedia(id); err == nil {
+		t.Errorf("media not deleted with the token")
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// bechdelImporter is the author of the revisions importBechdel makes.
+const bechdelImporter = "Bechdel import"
+
+// bechdelRecord is one movie of a bechdeltest.com dump, as returned by its
+// getAllMovies and getMovieByImdbId API calls. The API quotes some numbers and
+// not others, so they are read as flexInt.
+type bechdelRecord struct {
+	ID      flexInt `json:"id"`
+	IMDBID  string  `json:"imdbid"`
+	Title   string  `json:"title"`
+	Year    flexInt `json:"year"`
+	Rating  flexInt `json:"rating"`
+	Dubious flexInt `json:"dubious"`
+}
+
+// flexInt is a JSON number that may be quoted.
+type flexInt int64
+
+func (n *flexInt) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		*n = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad number %s", b)
+	}
+	*n = flexInt(v)
+	return nil
+}
+
+// bechdel returns the result the record records.
+func (rec bechdelRecord) bechdel() Bechdel {
+	b := bechdelAtLevel(int(rec.Rating))
+	b.Disputed = rec.Dubious != 0
+	b.Source = bechdelSourceSite
+	if rec.ID != 0 {
+		b.SourceURL = fmt.Sprintf("https://bechdeltest.com/view/%d/", rec.ID)
+	}
+	return b
+}
+
+// readBechdelRecords parses a bechdeltest.com dump: a JSON array of movies.
+func readBechdelRecords(r io.Reader) ([]bechdelRecord, error) {
+	var records []bechdelRecord
+	if err := json.NewDecoder(r).Decode(&records); err != nil {
+		return nil, fmt.Errorf("bechdel: %v", err)
+	}
+	for i, rec := range records {
+		if rec.Rating < 0 || rec.Rating > 3 {
+			return nil, fmt.Errorf("bechdel: record %d (%q) has bad rating %d", i+1, rec.Title, rec.Rating)
+		}
+	}
+	return records, nil
+}
+
+// imdbID returns the number of the IMDb title the URL links to, or "".
+func imdbID(url string) string {
+	i := strings.Index(url, "/title/tt")
+	if i < 0 {
+		return ""
+	}
+	id := strings.TrimPrefix(url[i:], "/title/tt")
+	if j := strings.IndexAny(id, "/?"); j >= 0 {
+		id = id[:j]
+	}
+	return id
+}
+
+// bechdelMatch finds the record for m: by IMDb ID when m links to IMDb,
+// otherwise by title and, when both have one, release year.
+func bechdelMatch(m *Media, byIMDB map[string]bechdelRecord, byTitle map[string][]bechdelRecord) (bechdelRecord, bool) {
+	if id := imdbID(m.IMDBURL); id != "" {
+		if rec, ok := byIMDB[id]; ok {
+			return rec, true
+		}
+	}
+	for _, rec := range byTitle[listKey(m.Title)] {
+		if rec.Year == 0 || m.ReleaseDate == "" ||
+			strings.Contains(m.ReleaseDate, strconv.Itoa(int(rec.Year))) {
+			return rec, true
+		}
+	}
+	return bechdelRecord{}, false
+}
+
+// importBechdel sets the Bechdel results of the media in db from the
+// bechdeltest.com dump at path, printing a line to w for each change. Results
+// entered by contributors are left alone. With dryRun set nothing is saved.
+func importBechdel(db MediaDatabase, path string, w io.Writer, dryRun bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("bechdel: %v", err)
+	}
+	defer f.Close()
+
+	records, err := readBechdelRecords(f)
+	if err != nil {
+		return err
+	}
+	byIMDB := make(map[string]bechdelRecord, len(records))
+	byTitle := make(map[string][]bechdelRecord, len(records))
+	for _, rec := range records {
+		if rec.IMDBID != "" {
+			byIMDB[strings.TrimPrefix(rec.IMDBID, "tt")] = rec
+		}
+		key := listKey(rec.Title)
+		byTitle[key] = append(byTitle[key], rec)
+	}
+
+	stored, err := db.ListMedia()
+	if err != nil {
+		return fmt.Errorf("bechdel: could not list media: %v", err)
+	}
+	var changed, unmatched int
+	for _, m := range stored {
+		if m.Bechdel.Rated && m.Bechdel.Source != bechdelSourceSite {
+			continue
+		}
+		rec, ok := bechdelMatch(m, byIMDB, byTitle)
+		if !ok {
+			unmatched++
+			continue
+		}
+		b := rec.bechdel()
+		if b == m.Bechdel {
+			continue
+		}
+		fmt.Fprintf(w, "~ %d %s: %s -> %s\n", m.ID, m.Title, m.Bechdel.Summary(), b.Summary())
+		changed++
+		if dryRun {
+			continue
+		}
+		m.Bechdel = b
+		if err := db.UpdateMedia(m, newMediaEvent(EventMediaUpdated, m, 0, bechdelImporter)); err != nil {
+			return fmt.Errorf("bechdel: could not update %q: %v", m.Title, err)
+		}
+		rev := &Revision{Media: m, Author: bechdelImporter, Summary: "Bechdel test from " + path}
+		if err := recordRevision(db, rev); err != nil {
+			return fmt.Errorf("bechdel: %q: %v", m.Title, err)
+		}
+	}
+	fmt.Fprintf(w, "%d to change, %d not found in %s\n", changed, unmatched, path)
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestImportBechdel imports testdata/bechdel.json, which quotes some numbers
+// and not others, into media matched by IMDb link, by title and year, and
+// rated by a contributor.
+func TestImportBechdel(t *testing.T) {
+	db := newMemoryDB()
+	var ids []int64
+	for _, m := range []*Media{
+		{Title: "Alien", IMDBURL: "https://www.imdb.com/title/tt0078748/"},
+		{Title: "The Social Network", ReleaseDate: "2010"},
+		{Title: "Suspiria", ReleaseDate: "2018"},
+		{Title: "Titanic", Bechdel: Bechdel{Rated: true, Source: "Ann"}},
+		{Title: "Site Only"},
+	} {
+		id, err := db.AddMedia(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	var out bytes.Buffer
+	if err := importBechdel(db, "testdata/bechdel.json", &out, true); err != nil {
+		t.Fatalf("importBechdel: %v", err)
+	}
+	want := `~ 1 Alien: Not rated -> Passes
+~ 3 Suspiria: Not rated -> Fails: the women only talk about a man
+~ 2 The Social Network: Not rated -> Fails: the women do not talk to each other
+3 to change, 1 not found in testdata/bechdel.json
+`
+	if out.String() != want {
+		t.Errorf("dry run printed\n%s\nwant\n%s", out.String(), want)
+	}
+	if m, _ := db.GetMedia(ids[0]); m.Bechdel.Rated {
+		t.Fatalf("dry run rated Alien: %+v", m.Bechdel)
+	}
+
+	out.Reset()
+	if err := importBechdel(db, "testdata/bechdel.json", &out, false); err != nil {
+		t.Fatalf("importBechdel: %v", err)
+	}
+	alien, err := db.GetMedia(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !alien.Bechdel.Passes() || alien.Bechdel.Source != bechdelSourceSite || alien.Bechdel.SourceURL != "https://bechdeltest.com/view/1432/" {
+		t.Errorf("Alien's result = %+v, want a pass from bechdeltest.com", alien.Bechdel)
+	}
+	if revisions, _ := db.ListRevisions(ids[0]); len(revisions) != 1 || revisions[0].Author != bechdelImporter {
+		t.Errorf("Alien's revisions = %+v, want one by the importer", revisions)
+	}
+	titanic, err := db.GetMedia(ids[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if titanic.Bechdel.Source != "Ann" || titanic.Bechdel.Level() != 0 {
+		t.Errorf("Titanic's result = %+v, want Ann's left alone", titanic.Bechdel)
+	}
+
+	// Importing again changes nothing.
+	out.Reset()
+	if err := importBechdel(db, "testdata/bechdel.json", &out, false); err != nil {
+		t.Fatalf("importBechdel: %v", err)
+	}
+	if !strings.HasPrefix(out.String(), "0 to change") {
+		t.Errorf("importing again printed\n%s", out.String())
+	}
+}
+
+func TestReadBechdelRecordsBadRating(t *testing.T) {
+	_, err := readBechdelRecords(strings.NewReader(`[{"title": "Alien", "rating": "4"}]`))
+	if err == nil || !strings.Contains(err.Error(), "bad rating") {
+		t.Errorf("readBechdelRecords = %v, want a bad rating error", err)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+)
+
+// bechdelSourceSite is the Source of results imported from bechdeltest.com.
+const bechdelSourceSite = "bechdeltest.com"
+
+// Bechdel is the result of the Bechdel test (https://bechdeltest.com/) for
+// media. The criteria build on each other as they do on bechdeltest.com: the
+// women only count as talking if there are two of them, and so on.
+type Bechdel struct {
+	// Rated is false until someone has applied the test.
+	Rated bool
+
+	TwoWomen    bool // has at least two named women,
+	Talk        bool // who talk to each other,
+	AboutNotMan bool // about something besides a man.
+
+	// Disputed marks results that contributors disagree on.
+	Disputed bool
+
+	// Source is where the result came from, such as bechdelSourceSite or
+	// the name of the contributor. SourceURL links to it.
+	Source    string
+	SourceURL string
+}
+
+// Level returns how many of the criteria, in order, the media meets, from 0
+// to 3, as rated on bechdeltest.com.
+func (b Bechdel) Level() int {
+	switch {
+	case !b.TwoWomen:
+		return 0
+	case !b.Talk:
+		return 1
+	case !b.AboutNotMan:
+		return 2
+	}
+	return 3
+}
+
+// Passes reports whether the media has been rated and meets all criteria.
+func (b Bechdel) Passes() bool {
+	return b.Rated && b.Level() == 3
+}
+
+// Summary describes the result for display.
+func (b Bechdel) Summary() string {
+	if !b.Rated {
+		return "Not rated"
+	}
+	s := [...]string{
+		"Fails: fewer than two named women",
+		"Fails: the women do not talk to each other",
+		"Fails: the women only talk about a man",
+		"Passes",
+	}[b.Level()]
+	if b.Disputed {
+		s += " (disputed)"
+	}
+	return s
+}
+
+// bechdelAtLevel returns a rated result meeting the first level criteria.
+func bechdelAtLevel(level int) Bechdel {
+	return Bechdel{
+		Rated:       true,
+		TwoWomen:    level >= 1,
+		Talk:        level >= 2,
+		AboutNotMan: level >= 3,
+	}
+}
+
+// sqlLevel and bechdelFromSQL store the criteria in the bechdel column as the
+// Level, NULL when unrated.
+func (b Bechdel) sqlLevel() sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(b.Level()), Valid: b.Rated}
+}
+
+func bechdelFromSQL(level sql.NullInt64, disputed sql.NullBool, source, sourceURL sql.NullString) Bechdel {
+	b := Bechdel{}
+	if level.Valid {
+		b = bechdelAtLevel(int(level.Int64))
+	}
+	b.Disputed = disputed.Bool
+	b.Source = source.String
+	b.SourceURL = sourceURL.String
+	return b
+}
+
+// normalized returns b marked as rated if any criterion is met, and with the
+// criteria after the first unmet one cleared, as the SQL backends store it.
+func (b Bechdel) normalized() Bechdel {
+	if b.TwoWomen || b.Talk || b.AboutNotMan {
+		b.Rated = true
+	}
+	if b.Rated {
+		l := bechdelAtLevel(b.Level())
+		b.TwoWomen, b.Talk, b.AboutNotMan = l.TwoWomen, l.Talk, l.AboutNotMan
+	}
+	return b
+}
+
+// bechdelFromForm reads the bechdel* fields of the edit form (see
+// templates/edit.html).
+func bechdelFromForm(r *http.Request) Bechdel {
+	checked := func(name string) bool {
+		v, _ := strconv.ParseBool(r.FormValue(name))
+		return v
+	}
+	return Bechdel{
+		Rated:       checked("bechdelRated"),
+		TwoWomen:    checked("bechdelTwoWomen"),
+		Talk:        checked("bechdelTalk"),
+		AboutNotMan: checked("bechdelAboutNotMan"),
+		Disputed:    checked("bechdelDisputed"),
+		Source:      r.FormValue("bechdelSource"),
+		SourceURL:   r.FormValue("bechdelSourceURL"),
+	}.normalized()
+}
+
+// bechdelFilters are the values of the bechdel filter on /media/list.
+var bechdelFilters = map[string]func(Bechdel) bool{
+	"":        func(Bechdel) bool { return true },
+	"pass":    func(b Bechdel) bool { return b.Passes() },
+	"fail":    func(b Bechdel) bool { return b.Rated && !b.Passes() },
+	"unrated": func(b Bechdel) bool { return !b.Rated },
+}
@@ -0,0 +1,231 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+/*---------------------------  Criteria  ---------------------------*/
+
+// Criterion is one of the README's "What to include" criteria, evaluated per
+// character.
+type Criterion struct {
+	Key   string
+	Label string
+}
+
+// characterCriteria are the README criteria, in the README's order. Keys are
+// stored with evaluations, so never change an existing key.
+var characterCriteria = []Criterion{
+	{"protagonist", "Protagonist"},
+	{"breaks-stereotypes", "Breaks stereotypes"},
+	{"agency", "Agency | power"},
+	{"goals", "Goals (beyond finding or supporting a man)"},
+	{"journey", "On a journey"},
+	{"independent-ideas", "Independent ideas"},
+	{"more-than-one-woman", "More than one woman"},
+	{"assertive", "Assertive, intelligent, self-reliant characteristics"},
+	{"survivor", "Survivor"},
+	{"positive-impact", "Positive impact"},
+	{"helps-others", "Helping herself or others that is not a man"},
+	{"robust", "Robust character"},
+}
+
+// criterionByKey returns the character or rubric criterion with the given
+// key.
+func criterionByKey(key string) (Criterion, bool) {
+	lists := [][]Criterion{characterCriteria}
+	for _, rb := range rubrics {
+		lists = append(lists, rb.Include, rb.Exclude)
+	}
+	for _, criteria := range lists {
+		for _, c := range criteria {
+			if c.Key == key {
+				return c, true
+			}
+		}
+	}
+	return Criterion{}, false
+}
+
+// Verdicts a criterion can be evaluated to.
+const (
+	verdictUnknown = "unknown"
+	verdictMet     = "met"
+	verdictNotMet  = "not-met"
+)
+
+// Evaluation records whether a character or media meets a criterion, and why.
+type Evaluation struct {
+	Criterion     string
+	Verdict       string
+	Justification string `datastore:",noindex"`
+}
+
+// Label returns the human readable name of the evaluated criterion.
+func (e Evaluation) Label() string {
+	c, _ := criterionByKey(e.Criterion)
+	return c.Label
+}
+
+// CriteriaEvaluations returns one evaluation per character criterion, in
+// order. Criteria that have not been evaluated are unknown.
+func (c *Character) CriteriaEvaluations() []Evaluation {
+	return evaluationsFor(characterCriteria, c.Evaluations)
+}
+
+// CriteriaMet returns how many criteria the character meets.
+func (c *Character) CriteriaMet() int {
+	n := 0
+	for _, e := range c.Evaluations {
+		if e.Verdict == verdictMet {
+			n++
+		}
+	}
+	return n
+}
+
+// marshalEvaluations and unmarshalEvaluations store evaluations in a single
+// SQL column as JSON.
+func marshalEvaluations(evals []Evaluation) (string, error) {
+	if len(evals) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(evals)
+	return string(b), err
+}
+
+func unmarshalEvaluations(s string) ([]Evaluation, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var evals []Evaluation
+	err := json.Unmarshal([]byte(s), &evals)
+	return evals, err
+}
+
+/*---------------------------  Handlers  ---------------------------*/
+
+// characterPage is what character.html and the JSON view show.
+type characterPage struct {
+	*Character
+	Media        *Media
+	Actors       []*Person
+	PageSubTitle string `json:"-"`
+
+	// CanEdit is whether the user viewing the page may edit the character.
+	CanEdit bool `json:"-"`
+}
+
+// characterFromRequest retrieves a character, with its media and the actors
+// playing it, given a character ID in the URL's path.
+func characterFromRequest(r *http.Request) (*characterPage, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad character id: %v", err)
+	}
+	c, err := DB.GetCharacter(id)
+	if err != nil {
+		return nil, fmt.Errorf("could not find character: %w", err)
+	}
+	m, err := DB.GetMedia(c.MediaID)
+	if err != nil {
+		return nil, fmt.Errorf("could not find character media: %w", err)
+	}
+	if err := loadCredits(DB, m); err != nil {
+		return nil, err
+	}
+
+	page := &characterPage{Character: c, Media: m}
+	for _, credit := range m.Credits {
+		if credit.CharacterID == c.ID && credit.Person != nil {
+			page.Actors = append(page.Actors, credit.Person)
+		}
+	}
+	return page, nil
+}
+
+// characterHandler displays a character and its criteria evaluations.
+func characterHandler(w http.ResponseWriter, r *http.Request) error {
+	page, err := characterFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not show character: %v", err)
+	}
+	user, err := userFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+	page.PageSubTitle = "Character"
+	page.CanEdit = user.CanEditMedia(page.Media)
+	return characterTmpl.Execute(w, r, page)
+}
+
+// characterJSONHandler writes a character and its criteria evaluations as
+// JSON.
+func characterJSONHandler(w http.ResponseWriter, r *http.Request) error {
+	page, err := characterFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not show character: %v", err)
+	}
+	page.Evaluations = page.CriteriaEvaluations()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		return appErrorf(err, "could not write character: %v", err)
+	}
+	return nil
+}
+
+// editCharacterFormHandler displays a form for a character's details and
+// criteria evaluations.
+func editCharacterFormHandler(w http.ResponseWriter, r *http.Request) error {
+	page, err := characterFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	page.PageSubTitle = "Edit Character"
+	return characterEditTmpl.Execute(w, r, page)
+}
+
+// updateCharacterHandler saves a character's details and criteria
+// evaluations (see templates/character-edit.html).
+func updateCharacterHandler(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return appErrorf(err, "bad character id: %v", err)
+	}
+	c, err := DB.GetCharacter(id)
+	if err != nil {
+		return appErrorf(err, "could not find character: %v", err)
+	}
+
+	c.Name = r.FormValue("name")
+	c.Bio = r.FormValue("bio")
+	if c.Evaluations, err = evaluationsFromForm(r, characterCriteria); err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "could not parse evaluations: %v", err)
+	}
+
+	if err := DB.UpdateCharacter(c); err != nil {
+		return appErrorf(err, "could not save character: %v", err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/characters/%d", c.ID), http.StatusFound)
+	return nil
+}
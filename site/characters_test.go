@@ -0,0 +1,143 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestUpdateCharacter evaluates a character with the edit form, and reads
+// the evaluations back as JSON.
+func TestUpdateCharacter(t *testing.T) {
+	useDB(t, newMemoryDB())
+	moderator := addTestUser(t, RoleModerator)
+	m := &Media{Title: "Alien", Credits: parseCredits("", "Sigourney Weaver as Ripley")}
+	id, err := DB.AddMedia(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ID = id
+	if err := saveCredits(DB, m); err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/characters/%d", m.Credits[0].CharacterID)
+
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serveAs(t, req, moderator)
+	}
+	if w := post(url.Values{"name": {"Ripley"}, "verdict-survivor": {"maybe"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("POST with a bad verdict = %d, want 400", w.Code)
+	}
+	w := post(url.Values{
+		"name":                       {"Ellen Ripley"},
+		"verdict-survivor":           {verdictMet},
+		"justification-survivor":     {"Last one standing"},
+		"verdict-protagonist":        {verdictMet},
+		"verdict-goals":              {verdictNotMet},
+		"justification-journey":      {"Hard to say"},
+		"verdict-breaks-stereotypes": {""},
+	})
+	if w.Code != http.StatusFound {
+		t.Fatalf("POST %s = %d %s, want a redirect", path, w.Code, w.Body.String())
+	}
+
+	w = serveAs(t, httptest.NewRequest("GET", path+".json", nil), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s.json = %d", path, w.Code)
+	}
+	var page struct {
+		Name        string
+		Evaluations []Evaluation
+		Actors      []*Person
+	}
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Name != "Ellen Ripley" || len(page.Actors) != 1 || page.Actors[0].Name != "Sigourney Weaver" {
+		t.Errorf("character = %q played by %v, want Ellen Ripley played by Sigourney Weaver", page.Name, page.Actors)
+	}
+	if len(page.Evaluations) != len(characterCriteria) {
+		t.Fatalf("got %d evaluations, want one per criterion", len(page.Evaluations))
+	}
+	verdicts := make(map[string]string)
+	for _, e := range page.Evaluations {
+		verdicts[e.Criterion] = e.Verdict
+	}
+	for key, want := range map[string]string{
+		"protagonist":        verdictMet,
+		"survivor":           verdictMet,
+		"goals":              verdictNotMet,
+		"journey":            verdictUnknown,
+		"breaks-stereotypes": verdictUnknown,
+	} {
+		if verdicts[key] != want {
+			t.Errorf("verdict of %s = %q, want %q", key, verdicts[key], want)
+		}
+	}
+
+	c, err := DB.GetCharacter(m.Credits[0].CharacterID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only what was evaluated, or justified, is stored.
+	if len(c.Evaluations) != 4 || c.CriteriaMet() != 2 {
+		t.Errorf("stored evaluations = %+v, want 4 of which 2 met", c.Evaluations)
+	}
+}
+
+// TestCharacterNotFound checks that unknown characters, and those of media in
+// the trash, are not found.
+func TestCharacterNotFound(t *testing.T) {
+	useDB(t, newMemoryDB())
+	moderator := addTestUser(t, RoleModerator)
+	m := &Media{Title: "Alien", Credits: parseCredits("", "Sigourney Weaver as Ripley")}
+	id, err := DB.AddMedia(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ID = id
+	if err := saveCredits(DB, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.DeleteMedia(id, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	trashed := fmt.Sprintf("/characters/%d", m.Credits[0].CharacterID)
+
+	for _, tt := range []struct {
+		method, path string
+	}{
+		{"GET", "/characters/999"},
+		{"GET", "/characters/999.json"},
+		{"GET", "/characters/999/edit"},
+		{"POST", "/characters/999"},
+		{"GET", trashed},
+		{"GET", trashed + ".json"},
+	} {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(url.Values{"name": {"Nobody"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if w := serveAs(t, req, moderator); w.Code != http.StatusNotFound {
+			t.Errorf("%s %s = %d, want 404", tt.method, tt.path, w.Code)
+		}
+	}
+}
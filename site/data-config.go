@@ -17,7 +17,12 @@ package main
 import (
 	"cloud.google.com/go/pubsub"
 	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
 	"os"
+	"strconv"
 
 	"cloud.google.com/go/datastore"
 
@@ -30,19 +35,34 @@ var (
 	StorageBucket		*storage.BucketHandle
 	StorageBucketName	string
 
+	// Images keeps uploaded posters, see images.go. It is nil when uploads
+	// are not configured.
+	Images BlobStore
+
 	SessionStore		sessions.Store
-	PubsubClient 	*pubsub.Client
+
+	// Events carries the changes saved to DB to what reacts to them, see
+	// events.go.
+	Events EventBus
+
+	// See auth.go. AuthProvider is nil when logging in is not configured;
+	// LocalOIDC is set when the site serves its own stand-in provider.
+	AuthProvider IdentityProvider
+	LocalOIDC    *localOIDC
 
 
 )
 
-const PubsubTopicID = "fill-media-details"
+// EventsTopicID is the Pub/Sub topic events are published to.
+const EventsTopicID = "media-events"
 
 /*func init() {
 	var err error
 */
-// To use the in-memory test database, uncomment the next line.
-/*DB = newMemoryDB()*/
+// To use the in-memory test database, set DBBACKEND=memory (see configureDB).
+
+// To keep everything in a single SQLite file, set DBBACKEND=sqlite and
+// optionally SQLITE_PATH (defaults to media.db, created on first run).
 
 // [START cloudsql]
 // To use Cloud SQL, uncomment the following lines, and update the username,
@@ -67,12 +87,11 @@ const PubsubTopicID = "fill-media-details"
 	}*/
 
 // [START datastore]
-// To use Cloud Datastore, uncomment the following lines and update the
-// project ID.
+// To use Cloud Datastore, set DBBACKEND=datastore and DATASTORE_PROJECT_ID to
+// your project ID. Set DATASTORE_EMULATOR_HOST as well to use the local
+// Datastore emulator.
 // More options can be set, see the google package docs for details:
 // http://godoc.org/golang.org/x/oauth2/google
-//
-// DB, err = configureDatastoreDB("<your-project-id>")
 // [END datastore]
 
 /*	if err != nil {
@@ -81,11 +100,8 @@ const PubsubTopicID = "fill-media-details"
 */
 
 // [START storage]
-// To configure Cloud Storage, uncomment the following lines and update the
-// bucket name.
-//
-// StorageBucketName = "<your-storage-bucket>"
-// StorageBucket, err = configureStorage(StorageBucketName)
+// To keep uploaded images in Cloud Storage, set IMAGE_STORE=gcs and
+// STORAGE_BUCKET to the bucket name (see configureImages).
 // [END storage]
 
 /*	if err != nil {
@@ -93,9 +109,10 @@ const PubsubTopicID = "fill-media-details"
 	}
 */
 // [START pubsub]
-// To configure Pub/Sub, uncomment the following lines and update the project ID.
-//
-// PubsubClient, err = configurePubsub("<your-project-id>")
+// To publish media changes on Pub/Sub, for workers such as the one that fills
+// in media details, set PUBSUB_PROJECT_ID to your project ID (see
+// configureEvents). Set PUBSUB_EMULATOR_HOST as well to use the local Pub/Sub
+// emulator. Without it, events are handled in the site's own process.
 // [END pubsub]
 
 /*	if err != nil {
@@ -104,6 +121,26 @@ const PubsubTopicID = "fill-media-details"
 /*}
 */
 
+// configureDB returns the MediaDatabase selected by backend, the value of the
+// DBBACKEND environment variable. An empty backend defaults to Cloud SQL.
+func configureDB(backend string) (MediaDatabase, error) {
+	switch backend {
+	case "memory":
+		return newMemoryDB(), nil
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "media.db"
+		}
+		return newSQLiteDB(path)
+	case "datastore":
+		return configureDatastoreDB(os.Getenv("DATASTORE_PROJECT_ID"))
+	case "", "cloudsql":
+		return configureCloudSQL(cloudSQLConfigFromEnv())
+	}
+	return nil, fmt.Errorf("unknown database backend %q", backend)
+}
+
 func configureDatastoreDB(projectID string) (MediaDatabase, error) {
 	ctx := context.Background()
 	client, err := datastore.NewClient(ctx, projectID)
@@ -113,6 +150,115 @@ func configureDatastoreDB(projectID string) (MediaDatabase, error) {
 	return newDatastoreDB(client)
 }
 
+// configureSessions returns the cookie store for sessions. SESSION_KEY signs
+// the cookies; without it a random key is used, which logs everyone out when
+// the site restarts.
+func configureSessions() (sessions.Store, error) {
+	key := []byte(os.Getenv("SESSION_KEY"))
+	if len(key) == 0 {
+		log.Print("SESSION_KEY is not set, sessions will not survive a restart")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	store := sessions.NewCookieStore(key)
+	store.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   30 * 24 * 60 * 60,
+		HttpOnly: true,
+		Secure:   os.Getenv("GAE_INSTANCE") != "",
+		SameSite: http.SameSiteLaxMode,
+	}
+	return store, nil
+}
+
+// configureAuth returns the identity provider selected by the AUTH_PROVIDER
+// environment variable:
+//
+//	oidc   an OpenID Connect provider, set up with OIDC_ISSUER,
+//	       OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and OIDC_REDIRECT_URL
+//	local  the stand-in provider in auth-local.go, served by this site at
+//	       SITE_URL (defaults to http://localhost:8080)
+//
+// Logging in is disabled when AUTH_PROVIDER is empty. The local provider lets
+// anyone log in as anyone, so it is refused on App Engine.
+func configureAuth(provider string) (IdentityProvider, error) {
+	switch provider {
+	case "":
+		return nil, nil
+	case "oidc":
+		issuer := os.Getenv("OIDC_ISSUER")
+		if issuer == "" {
+			return nil, fmt.Errorf("AUTH_PROVIDER=oidc needs OIDC_ISSUER")
+		}
+		return newOIDCProvider(issuer, os.Getenv("OIDC_CLIENT_ID"),
+			os.Getenv("OIDC_CLIENT_SECRET"), os.Getenv("OIDC_REDIRECT_URL")), nil
+	case "local":
+		if os.Getenv("GAE_INSTANCE") != "" {
+			return nil, fmt.Errorf("AUTH_PROVIDER=local is for development and cannot be used on App Engine")
+		}
+		site := os.Getenv("SITE_URL")
+		if site == "" {
+			site = "http://localhost:8080"
+		}
+		LocalOIDC = newLocalOIDC(site + "/local-oidc")
+		return newOIDCProvider(LocalOIDC.issuer, "flipthescript", "", site+"/auth/callback"), nil
+	}
+	return nil, fmt.Errorf("unknown identity provider %q", provider)
+}
+
+// configureImages returns the BlobStore for uploaded images selected by the
+// IMAGE_STORE environment variable:
+//
+//	gcs    the Cloud Storage bucket STORAGE_BUCKET
+//	local  the directory IMAGE_DIR (defaults to uploads), served by this site
+//
+// Uploads are refused when it is not set.
+func configureImages(store string) (BlobStore, error) {
+	switch store {
+	case "":
+		return nil, nil
+	case "gcs":
+		StorageBucketName = os.Getenv("STORAGE_BUCKET")
+		if StorageBucketName == "" {
+			return nil, fmt.Errorf("IMAGE_STORE=gcs needs STORAGE_BUCKET")
+		}
+		var err error
+		if StorageBucket, err = configureStorage(StorageBucketName); err != nil {
+			return nil, err
+		}
+		return &gcsBlobStore{bucket: StorageBucket, bucketName: StorageBucketName}, nil
+	case "local":
+		dir := os.Getenv("IMAGE_DIR")
+		if dir == "" {
+			dir = "uploads"
+		}
+		return newLocalBlobStore(dir)
+	}
+	return nil, fmt.Errorf("unknown image store %q", store)
+}
+
+// configureEvents returns the event bus on Pub/Sub in the project, or the
+// in-process one if projectID is empty. The Pub/Sub client talks to the
+// emulator when PUBSUB_EMULATOR_HOST is set.
+func configureEvents(projectID string) (EventBus, error) {
+	if projectID == "" {
+		return newChannelBus(), nil
+	}
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: %v", err)
+	}
+	bus, err := newPubsubBus(ctx, client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return bus, nil
+}
+
 func configureStorage(bucketID string) (*storage.BucketHandle, error) {
 	ctx := context.Background()
 	client, err := storage.NewClient(ctx)
@@ -126,25 +272,69 @@ func configureStorage(bucketID string) (*storage.BucketHandle, error) {
 type cloudSQLConfig struct {
 	Username, Password, Instance, IP string
 	PgPort                       int
+
+	// SSLMode and the certificate paths, see PgSQLConfig.
+	SSLMode, SSLRootCert, SSLCert, SSLKey string
+
+	// Migrate applies pending schema migrations on startup.
+	Migrate bool
+}
+
+// cloudSQLConfigFromEnv reads the Cloud SQL settings from the environment.
+// PgSQL_IP and PgSQL_PORT are where to connect when not on App Engine,
+// localhost and the default port if unset.
+func cloudSQLConfigFromEnv() cloudSQLConfig {
+	port, _ := strconv.Atoi(os.Getenv("PgSQL_PORT"))
+	return cloudSQLConfig{
+		Username:    os.Getenv("PgSQL_USERNAME"),
+		Password:    os.Getenv("PgSQL_PWD"),
+		Instance:    os.Getenv("PgSQL_INSTANCE"),
+		IP:          os.Getenv("PgSQL_IP"),
+		PgPort:      port,
+		SSLMode:     os.Getenv("PgSQL_SSLMODE"),
+		SSLRootCert: os.Getenv("PgSQL_SSLROOTCERT"),
+		SSLCert:     os.Getenv("PgSQL_SSLCERT"),
+		SSLKey:      os.Getenv("PgSQL_SSLKEY"),
+		Migrate:     os.Getenv("PgSQL_MIGRATE") == "true",
+	}
 }
 
 func configureCloudSQL(config cloudSQLConfig) (MediaDatabase, error) {
+	return newPgSQLDB(config.pgSQLConfig())
+}
+
+// pgSQLConfig returns the connection settings for where the site is running.
+func (config cloudSQLConfig) pgSQLConfig() PgSQLConfig {
 	if os.Getenv("GAE_INSTANCE") != "" {
 		// Running in production.
-		return newPgSQLDB(PgSQLConfig{
-			Username:   config.Username,
-			Password:   config.Password,
-			UnixSocket:   "/cloudsql/" + config.Instance,
-			Instance:   config.Instance,
-			IP: 		config.IP,
-		})
+		return PgSQLConfig{
+			Username:    config.Username,
+			Password:    config.Password,
+			UnixSocket:  "/cloudsql/" + config.Instance,
+			Instance:    config.Instance,
+			IP:          config.IP,
+			SSLMode:     config.SSLMode,
+			SSLRootCert: config.SSLRootCert,
+			SSLCert:     config.SSLCert,
+			SSLKey:      config.SSLKey,
+			Migrate:     config.Migrate,
+		}
 	}
 
 	// Running locally.
-	return newPgSQLDB(PgSQLConfig{
-		Username: config.Username,
-		Password: config.Password,
-		Host:     "localhost",
-		Port:     config.PgPort,
-	})
+	host := config.IP
+	if host == "" {
+		host = "localhost"
+	}
+	return PgSQLConfig{
+		Username:    config.Username,
+		Password:    config.Password,
+		Host:        host,
+		Port:        config.PgPort,
+		SSLMode:     config.SSLMode,
+		SSLRootCert: config.SSLRootCert,
+		SSLCert:     config.SSLCert,
+		SSLKey:      config.SSLKey,
+		Migrate:     config.Migrate,
+	}
 }
\ No newline at end of file
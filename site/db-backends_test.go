@@ -0,0 +1,484 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The tests in this file run against each backend that needs no server:
+// memory, and SQLite in a temporary directory. The Datastore and PostgreSQL
+// backends have tests of their own, against the emulator and a live server.
+
+// testBackends are the backends the tests in this file run against, by name.
+var testBackends = []struct {
+	name  string
+	newDB func(t *testing.T) MediaDatabase
+}{
+	{"memory", func(t *testing.T) MediaDatabase { return newMemoryDB() }},
+	{"sqlite", newTestSQLiteDB},
+}
+
+// newTestSQLiteDB returns an empty SQLite database in a temporary directory,
+// closed at the end of the test.
+func newTestSQLiteDB(t *testing.T) MediaDatabase {
+	t.Helper()
+	db, err := newSQLiteDB(filepath.Join(t.TempDir(), "media.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// forEachBackend runs test as a subtest against an empty database of each
+// of testBackends.
+func forEachBackend(t *testing.T, test func(t *testing.T, db MediaDatabase)) {
+	for _, b := range testBackends {
+		t.Run(b.name, func(t *testing.T) { test(t, b.newDB(t)) })
+	}
+}
+
+// addTitles adds media with the given titles to db, returning their IDs.
+func addTitles(t *testing.T, db MediaDatabase, titles ...string) []int64 {
+	t.Helper()
+	var ids []int64
+	for _, title := range titles {
+		id, err := db.AddMedia(&Media{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// mediaTitles returns the titles of media, in order.
+func mediaTitles(media []*Media) []string {
+	var titles []string
+	for _, m := range media {
+		titles = append(titles, m.Title)
+	}
+	return titles
+}
+
+func TestBackendMedia(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db MediaDatabase) {
+		m := &Media{Title: "Alien", ReleaseDate: "1979", Tags: []string{"space"}}
+		id, err := db.AddMedia(m)
+		if err != nil {
+			t.Fatalf("AddMedia: %v", err)
+		}
+		if id == 0 || m.ID != id {
+			t.Fatalf("AddMedia assigned ID %d, media has %d", id, m.ID)
+		}
+		got, err := db.GetMedia(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Title != "Alien" || got.ReleaseDate != "1979" || !reflect.DeepEqual(got.Tags, []string{"space"}) {
+			t.Errorf("GetMedia = %+v, want Alien as added", got)
+		}
+
+		for _, tt := range []struct {
+			name    string
+			change  func() error
+			wantErr error
+			want    string // Title of the stored media, "" if it is not found.
+		}{
+			{"update", func() error {
+				return db.UpdateMedia(&Media{ID: id, Title: "Aliens"})
+			}, nil, "Aliens"},
+			{"update unknown", func() error {
+				return db.UpdateMedia(&Media{ID: id + 100, Title: "Nope"})
+			}, errNotFound, "Aliens"},
+			{"delete", func() error { return db.DeleteMedia(id, 1, "Ann") }, nil, ""},
+			{"delete again", func() error { return db.DeleteMedia(id, 1, "Ann") }, errNotFound, ""},
+			{"update deleted", func() error {
+				return db.UpdateMedia(&Media{ID: id, Title: "Ghost"})
+			}, errNotFound, ""},
+			{"restore", func() error { return db.RestoreMedia(id) }, nil, "Aliens"},
+			{"restore again", func() error { return db.RestoreMedia(id) }, errNotFound, "Aliens"},
+			{"purge live", func() error { return db.PurgeMedia(id) }, errNotFound, "Aliens"},
+			{"purge deleted", func() error {
+				if err := db.DeleteMedia(id, 0, ""); err != nil {
+					return err
+				}
+				return db.PurgeMedia(id)
+			}, nil, ""},
+		} {
+			err := tt.change()
+			if tt.wantErr == nil && err != nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+			}
+			got, err := db.GetMedia(id)
+			switch {
+			case tt.want == "" && !errors.Is(err, errNotFound):
+				t.Errorf("%s: GetMedia = %v, %v, want not found", tt.name, got, err)
+			case tt.want != "" && (err != nil || got.Title != tt.want):
+				t.Errorf("%s: GetMedia = %v, %v, want %q", tt.name, got, err, tt.want)
+			}
+		}
+	})
+}
+
+func TestBackendPeople(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db MediaDatabase) {
+		id, err := db.AddPerson(&Person{Name: "Sigourney Weaver"})
+		if err != nil {
+			t.Fatalf("AddPerson: %v", err)
+		}
+
+		for _, tt := range []struct {
+			name    string
+			change  func() error
+			wantErr error
+			want    string // Name of the stored person, "" if it is not found.
+		}{
+			{"update", func() error {
+				return db.UpdatePerson(&Person{ID: id, Name: "Sigourney"})
+			}, nil, "Sigourney"},
+			{"update unknown", func() error {
+				return db.UpdatePerson(&Person{ID: id + 100, Name: "Nobody"})
+			}, errNotFound, "Sigourney"},
+			{"delete", func() error { return db.DeletePerson(id) }, nil, ""},
+			{"delete again", func() error { return db.DeletePerson(id) }, errNotFound, ""},
+			{"update deleted", func() error {
+				return db.UpdatePerson(&Person{ID: id, Name: "Ghost"})
+			}, errNotFound, ""},
+		} {
+			err := tt.change()
+			if tt.wantErr == nil && err != nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+			}
+			got, err := db.GetPerson(id)
+			switch {
+			case tt.want == "" && !errors.Is(err, errNotFound):
+				t.Errorf("%s: GetPerson = %v, %v, want not found", tt.name, got, err)
+			case tt.want != "" && (err != nil || got.Name != tt.want):
+				t.Errorf("%s: GetPerson = %v, %v, want %q", tt.name, got, err, tt.want)
+			}
+		}
+	})
+}
+
+// TestBackendMissingCharactersAndCredits changes characters and credits that
+// are not there.
+func TestBackendMissingCharactersAndCredits(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db MediaDatabase) {
+		mediaID := addTitles(t, db, "Alien")[0]
+		personID, err := db.AddPerson(&Person{Name: "Sigourney Weaver"})
+		if err != nil {
+			t.Fatalf("AddPerson: %v", err)
+		}
+		characterID, err := db.AddCharacter(&Character{MediaID: mediaID, Name: "Ripley"})
+		if err != nil {
+			t.Fatalf("AddCharacter: %v", err)
+		}
+		creditID, err := db.AddCredit(&Credit{MediaID: mediaID, PersonID: personID, Role: roleActor, CharacterID: characterID})
+		if err != nil {
+			t.Fatalf("AddCredit: %v", err)
+		}
+
+		for _, tt := range []struct {
+			name    string
+			change  func() error
+			wantErr error
+		}{
+			{"update unknown character", func() error {
+				return db.UpdateCharacter(&Character{ID: characterID + 100, MediaID: mediaID, Name: "Nobody"})
+			}, errNotFound},
+			{"delete unknown character", func() error { return db.DeleteCharacter(characterID + 100) }, errNotFound},
+			{"delete unknown credit", func() error { return db.DeleteCredit(creditID + 100) }, errNotFound},
+			{"delete character", func() error { return db.DeleteCharacter(characterID) }, nil},
+			{"delete character again", func() error { return db.DeleteCharacter(characterID) }, errNotFound},
+			{"update deleted character", func() error {
+				return db.UpdateCharacter(&Character{ID: characterID, MediaID: mediaID, Name: "Ghost"})
+			}, errNotFound},
+			{"delete credit", func() error { return db.DeleteCredit(creditID) }, nil},
+			{"delete credit again", func() error { return db.DeleteCredit(creditID) }, errNotFound},
+		} {
+			err := tt.change()
+			if tt.wantErr == nil && err != nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+			}
+		}
+		if _, err := db.GetCharacter(characterID); !errors.Is(err, errNotFound) {
+			t.Errorf("GetCharacter of a deleted character = %v, want not found", err)
+		}
+	})
+}
+
+func TestBackendQueryMedia(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db MediaDatabase) {
+		for _, m := range []*Media{
+			{Title: "Beta", MediaType: "Film"},
+			{Title: "Alpha", MediaType: "Film"},
+			{Title: "Gamma", MediaType: "TV"},
+		} {
+			if _, err := db.AddMedia(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		list, err := db.ListMedia()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := mediaTitles(list), []string{"Alpha", "Beta", "Gamma"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("ListMedia = %v, want %v", got, want)
+		}
+		films, err := db.QueryMedia(&MediaQuery{MediaType: "Film"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := mediaTitles(films), []string{"Alpha", "Beta"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("QueryMedia of films = %v, want %v", got, want)
+		}
+	})
+}
+
+// addFacetMedia adds media to db for counting facets, with one media in the
+// trash that is not counted.
+func addFacetMedia(t *testing.T, db MediaDatabase) {
+	t.Helper()
+	for _, m := range []*Media{
+		{Title: "Alien", MediaType: "Film", Industry: "Hollywood", ReleaseDate: "1979",
+			Bechdel: bechdelAtLevel(3), InclusionScore: 80, Tags: []string{"space", "horror"}},
+		{Title: "Aliens", MediaType: "Film", Industry: "Hollywood", ReleaseDate: "1986",
+			Bechdel: bechdelAtLevel(1), InclusionScore: 50, Tags: []string{"space"}},
+		{Title: "Arrival", MediaType: "Film", ReleaseDate: "2016", InclusionScore: 10, Tags: []string{"space"}},
+		{Title: "Fleabag", MediaType: "TV", Industry: "BBC", ReleaseDate: "21 July 2016",
+			Bechdel: bechdelAtLevel(3), InclusionScore: 100},
+	} {
+		if _, err := db.AddMedia(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ghost := &Media{Title: "Ghost", MediaType: "Film", ReleaseDate: "1979", InclusionScore: 100, Tags: []string{"space"}}
+	if _, err := db.AddMedia(ghost); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteMedia(ghost.ID, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// facetCountTests are the counts of the media of addFacetMedia.
+var facetCountTests = []struct {
+	q     MediaQuery
+	facet string
+	want  map[string]int
+}{
+	{MediaQuery{}, facetMediaType, map[string]int{"Film": 3, "TV": 1}},
+	{MediaQuery{}, facetIndustry, map[string]int{"Hollywood": 2, "BBC": 1}},
+	{MediaQuery{}, facetDecade, map[string]int{"1970": 1, "1980": 1, "2010": 2}},
+	{MediaQuery{}, facetBechdel, map[string]int{"pass": 2, "fail": 1, "unrated": 1}},
+	{MediaQuery{}, facetScore, map[string]int{"25": 3, "50": 3, "75": 2, "100": 1}},
+	{MediaQuery{}, facetTag, map[string]int{"space": 3, "horror": 1}},
+	{MediaQuery{MediaType: "Film"}, facetDecade, map[string]int{"1970": 1, "1980": 1, "2010": 1}},
+	{MediaQuery{Decade: 2010}, facetMediaType, map[string]int{"Film": 1, "TV": 1}},
+	{MediaQuery{Bechdel: "pass", MinScore: 75}, facetMediaType, map[string]int{"Film": 1, "TV": 1}},
+	{MediaQuery{Tags: []string{"space"}}, facetTag, map[string]int{"space": 3, "horror": 1}},
+	{MediaQuery{Tags: []string{"horror"}}, facetIndustry, map[string]int{"Hollywood": 1}},
+	{MediaQuery{MediaType: "Radio"}, facetTag, map[string]int{}},
+}
+
+func TestBackendCountMedia(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db MediaDatabase) {
+		addFacetMedia(t, db)
+		for _, tt := range facetCountTests {
+			got, err := db.CountMedia(context.Background(), &tt.q, tt.facet)
+			if err != nil {
+				t.Fatalf("CountMedia(%+v, %s): %v", tt.q, tt.facet, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CountMedia(%+v, %s) = %v, want %v", tt.q, tt.facet, got, tt.want)
+			}
+		}
+		if _, err := db.CountMedia(context.Background(), &MediaQuery{}, "color"); err == nil {
+			t.Error("CountMedia of an unknown facet succeeded")
+		}
+	})
+}
+
+func TestBackendTrash(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db MediaDatabase) {
+		ids := addTitles(t, db, "A", "B", "C")
+		if err := db.DeleteMedia(ids[0], 7, "Ann"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.DeleteMedia(ids[2], 7, "Ann"); err != nil {
+			t.Fatal(err)
+		}
+		deleted, err := db.ListDeletedMedia()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := mediaTitles(deleted), []string{"C", "A"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("ListDeletedMedia = %v, want %v", got, want)
+		}
+		if d := deleted[0]; d.DeletedAt.IsZero() || d.DeletedByID != 7 || d.DeletedBy != "Ann" {
+			t.Errorf("deleted media = %+v, want deleted by 7 Ann", d)
+		}
+		live, err := db.ListMedia()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := mediaTitles(live), []string{"B"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("ListMedia = %v, want %v", got, want)
+		}
+		// Media in the trash is not queried or paged.
+		if q, err := db.QueryMedia(&MediaQuery{}); err != nil || len(q) != 1 {
+			t.Errorf("QueryMedia = %v, %v, want only B", q, err)
+		}
+		if p, err := db.PageMedia(&MediaQuery{}, "", 10); err != nil || len(p.Media) != 1 {
+			t.Errorf("PageMedia = %v, %v, want only B", p, err)
+		}
+	})
+}
+
+func TestBackendPageMedia(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db MediaDatabase) {
+		for _, m := range []*Media{
+			{Title: "E", MediaType: "Film"},
+			{Title: "A", MediaType: "Film"},
+			{Title: "D", MediaType: "TV"},
+			{Title: "C", MediaType: "Film"},
+			{Title: "B", MediaType: "Film"},
+		} {
+			if _, err := db.AddMedia(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, tt := range []struct {
+			name  string
+			q     *MediaQuery
+			size  int
+			pages [][]string
+		}{
+			{"all", &MediaQuery{}, 2, [][]string{{"A", "B"}, {"C", "D"}, {"E"}}},
+			{"filtered", &MediaQuery{MediaType: "Film"}, 2, [][]string{{"A", "B"}, {"C", "E"}}},
+			{"one page", &MediaQuery{MediaType: "TV"}, 10, [][]string{{"D"}}},
+			{"none", &MediaQuery{MediaType: "Radio"}, 10, [][]string{nil}},
+		} {
+			cursor := ""
+			for i, want := range tt.pages {
+				page, err := db.PageMedia(tt.q, cursor, tt.size)
+				if err != nil {
+					t.Fatalf("%s: page %d: %v", tt.name, i, err)
+				}
+				if titles := mediaTitles(page.Media); !reflect.DeepEqual(titles, want) {
+					t.Errorf("%s: page %d = %v, want %v", tt.name, i, titles, want)
+				}
+				if last := i == len(tt.pages)-1; last != (page.Next == "") {
+					t.Errorf("%s: page %d has next cursor %q", tt.name, i, page.Next)
+				}
+				cursor = page.Next
+			}
+		}
+
+		if _, err := db.PageMedia(&MediaQuery{}, "garbage", 2); !errors.Is(err, errBadCursor) {
+			t.Errorf("PageMedia with a bad cursor: got %v, want errBadCursor", err)
+		}
+	})
+}
+
+func TestBackendOutbox(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db MediaDatabase) {
+		m := &Media{Title: "Alien"}
+		id, err := db.AddMedia(m, newMediaEvent(EventMediaCreated, m, 1, "Ann"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Title = "Aliens"
+		if err := db.UpdateMedia(m, newMediaEvent(EventMediaUpdated, m, 1, "Ann")); err != nil {
+			t.Fatal(err)
+		}
+		// A failed change adds no events.
+		ghost := &Media{ID: id + 100}
+		if err := db.UpdateMedia(ghost, newMediaEvent(EventMediaUpdated, ghost, 1, "Ann")); !errors.Is(err, errNotFound) {
+			t.Fatalf("UpdateMedia of unknown media: got %v, want errNotFound", err)
+		}
+
+		events, err := db.ListOutbox(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 2 || events[0].Type != EventMediaCreated || events[1].Type != EventMediaUpdated {
+			t.Fatalf("ListOutbox = %v, want created then updated", events)
+		}
+		if e := events[0]; e.MediaID != id || e.Media == nil || e.Media.Title != "Alien" {
+			t.Errorf("created event = %+v, want media %d Alien", e, id)
+		}
+		if err := db.DeleteOutbox(events[0].ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.DeleteOutbox(events[0].ID); err != nil {
+			t.Errorf("DeleteOutbox of a removed event: %v", err)
+		}
+		if events, err = db.ListOutbox(10); err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0].Type != EventMediaUpdated {
+			t.Errorf("ListOutbox after delete = %v, want only updated", events)
+		}
+	})
+}
+
+func TestBackendChangeMedia(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db MediaDatabase) {
+		ids := addTitles(t, db, "Alien", "Aliens")
+
+		err := db.ChangeMedia(ids[0], func(m *Media) (bool, []*Event) {
+			m.Description = "In space"
+			return true, []*Event{newMediaEvent(EventMediaUpdated, m, 0, detailsFiller)}
+		})
+		if err != nil {
+			t.Fatalf("ChangeMedia: %v", err)
+		}
+		if m, err := db.GetMedia(ids[0]); err != nil || m.Title != "Alien" || m.Description != "In space" {
+			t.Errorf("GetMedia after ChangeMedia = %+v, %v, want Alien in space", m, err)
+		}
+		// Nothing is saved when nothing changed.
+		err = db.ChangeMedia(ids[0], func(m *Media) (bool, []*Event) {
+			m.Description = "Lost"
+			return false, []*Event{newMediaEvent(EventMediaUpdated, m, 0, detailsFiller)}
+		})
+		if err != nil {
+			t.Fatalf("ChangeMedia without changes: %v", err)
+		}
+		if m, _ := db.GetMedia(ids[0]); m.Description != "In space" {
+			t.Errorf("description after no change = %q, want In space", m.Description)
+		}
+		if events, _ := db.ListOutbox(10); len(events) != 1 || events[0].Media.Description != "In space" {
+			t.Errorf("ListOutbox = %v, want the one change", events)
+		}
+
+		if err := db.DeleteMedia(ids[1], 0, "test"); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []int64{ids[1], ids[1] + 100} {
+			err := db.ChangeMedia(id, func(m *Media) (bool, []*Event) { return true, nil })
+			if !errors.Is(err, errNotFound) {
+				t.Errorf("ChangeMedia of media %d: got %v, want errNotFound", id, err)
+			}
+		}
+	})
+}
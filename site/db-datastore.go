@@ -0,0 +1,1474 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/datastore/apiv1/datastorepb"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The Datastore kinds that media, people, characters, credits, users,
+// submissions, revisions, the events in the outbox and the number of media
+// with each tag are stored under.
+const (
+	mediaKind      = "Media"
+	personKind     = "Person"
+	characterKind  = "Character"
+	creditKind     = "Credit"
+	userKind       = "User"
+	submissionKind = "Submission"
+	revisionKind   = "Revision"
+	outboxKind     = "OutboxEvent"
+	schemaKind     = "Schema"
+	tagCountKind   = "TagCount"
+)
+
+// datastoreDB persists media to Cloud Datastore.
+// https://cloud.google.com/datastore/docs/concepts/overview
+//
+// Every exported Media field is stored as an entity property of the same
+// name, along with properties derived from them for queries (see
+// Media.Save). Queries filtering on CreatedByID need the composite index
+// declared in index.yaml.
+type datastoreDB struct {
+	client *datastore.Client
+}
+
+// Ensure datastoreDB conforms to the MediaDatabase interface.
+var _ MediaDatabase = &datastoreDB{}
+
+// newDatastoreDB creates a new MediaDatabase backed by Cloud Datastore.
+// See the datastore and google packages for details on creating a suitable
+// Client. When DATASTORE_EMULATOR_HOST is set the client talks to the local
+// emulator instead: https://cloud.google.com/datastore/docs/tools/datastore-emulator
+func newDatastoreDB(client *datastore.Client) (MediaDatabase, error) {
+	ctx := context.Background()
+	// Verify that we can communicate and authenticate with the datastore service.
+	t, err := client.NewTransaction(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not connect: %v", err)
+	}
+	if err := t.Rollback(); err != nil {
+		return nil, fmt.Errorf("datastoredb: could not connect: %v", err)
+	}
+	db := &datastoreDB{
+		client: client,
+	}
+	if err := db.migrateMedia(ctx); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Close closes the database.
+func (db *datastoreDB) Close() {
+	db.client.Close()
+}
+
+func (db *datastoreDB) datastoreKey(id int64) *datastore.Key {
+	return datastore.IDKey(mediaKind, id, nil)
+}
+
+// GetMedia retrieves media by its ID.
+func (db *datastoreDB) GetMedia(id int64) (*Media, error) {
+	ctx := context.Background()
+	k := db.datastoreKey(id)
+	media := &Media{}
+	if err := ignoreFieldMismatch(db.client.Get(ctx, k, media)); err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastoredb: media with id %d %w", id, errNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not get media: %v", err)
+	}
+	if !media.DeletedAt.IsZero() {
+		return nil, fmt.Errorf("datastoredb: media with id %d %w", id, errNotFound)
+	}
+	media.ID = id
+	return media, nil
+}
+
+// AddMedia saves a given media, assigning it a new ID.
+func (db *datastoreDB) AddMedia(m *Media, events ...*Event) (id int64, err error) {
+	ctx := context.Background()
+	// The ID is allocated first, as the events need it.
+	keys, err := db.client.AllocateIDs(ctx, []*datastore.Key{datastore.IncompleteKey(mediaKind, nil)})
+	if err != nil {
+		return 0, fmt.Errorf("datastoredb: could not allocate media ID: %v", err)
+	}
+	k := keys[0]
+	m.ID = k.ID
+	setEventMediaID(events, k.ID)
+	err = db.withEvents(ctx, events, func(tx *datastore.Transaction) error {
+		if _, err := tx.Put(k, m); err != nil {
+			return fmt.Errorf("datastoredb: could not put media: %v", err)
+		}
+		return countTags(tx, nil, m.Tags)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return k.ID, nil
+}
+
+// DeleteMedia moves a given media to the trash.
+func (db *datastoreDB) DeleteMedia(id int64, byID int64, by string, events ...*Event) error {
+	if id == 0 {
+		return errors.New("datastoredb: media with unassigned ID passed into deleteMedia")
+	}
+	return db.setDeleted(id, true, events, func(m *Media) {
+		m.DeletedAt, m.DeletedByID, m.DeletedBy = time.Now(), byID, by
+	})
+}
+
+// RestoreMedia takes a given media out of the trash.
+func (db *datastoreDB) RestoreMedia(id int64, events ...*Event) error {
+	return db.setDeleted(id, false, events, func(m *Media) {
+		m.DeletedAt, m.DeletedByID, m.DeletedBy = time.Time{}, 0, ""
+	})
+}
+
+// setDeleted applies change to the media with the given ID in a transaction,
+// with the events, moving it into the trash if deleted is set and out of it
+// otherwise. Media already where it is moved to is not found.
+func (db *datastoreDB) setDeleted(id int64, deleted bool, events []*Event, change func(m *Media)) error {
+	ctx := context.Background()
+	k := db.datastoreKey(id)
+	return db.withEvents(ctx, events, func(tx *datastore.Transaction) error {
+		m := &Media{}
+		if err := ignoreFieldMismatch(tx.Get(k, m)); err == datastore.ErrNoSuchEntity {
+			return fmt.Errorf("datastoredb: media with id %d %w", id, errNotFound)
+		} else if err != nil {
+			return fmt.Errorf("datastoredb: could not get media: %v", err)
+		}
+		if m.DeletedAt.IsZero() == deleted {
+			change(m)
+			if _, err := tx.Put(k, m); err != nil {
+				return err
+			}
+			if deleted {
+				return countTags(tx, m.Tags, nil)
+			}
+			return countTags(tx, nil, m.Tags)
+		}
+		if deleted {
+			return fmt.Errorf("datastoredb: media with id %d %w", id, errNotFound)
+		}
+		return fmt.Errorf("datastoredb: media with id %d in the trash %w", id, errNotFound)
+	})
+}
+
+// ListDeletedMedia returns the media in the trash, most recently deleted
+// first. Media saved before there was a trash has no DeletedAt, so it is not
+// found by the query.
+func (db *datastoreDB) ListDeletedMedia() ([]*Media, error) {
+	q := datastore.NewQuery(mediaKind).FilterField("DeletedAt", ">", time.Time{})
+	media, err := db.listAllMedia(q)
+	if err != nil {
+		return nil, err
+	}
+	sortDeletedMedia(media)
+	return media, nil
+}
+
+// PurgeMedia permanently removes a given media in the trash.
+func (db *datastoreDB) PurgeMedia(id int64) error {
+	ctx := context.Background()
+	k := db.datastoreKey(id)
+	m := &Media{}
+	if err := ignoreFieldMismatch(db.client.Get(ctx, k, m)); err == datastore.ErrNoSuchEntity || err == nil && m.DeletedAt.IsZero() {
+		return fmt.Errorf("datastoredb: media with id %d in the trash %w", id, errNotFound)
+	} else if err != nil {
+		return fmt.Errorf("datastoredb: could not get media: %v", err)
+	}
+	if err := db.client.Delete(ctx, k); err != nil {
+		return fmt.Errorf("datastoredb: could not delete media: %v", err)
+	}
+	// Datastore has no foreign keys, so remove the media's characters and
+	// credits here.
+	for _, kind := range []string{characterKind, creditKind} {
+		q := datastore.NewQuery(kind).FilterField("MediaID", "=", id).KeysOnly()
+		if err := db.deleteAll(ctx, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateMedia updates the entry for a given media. The error wraps
+// errNotFound if it does not exist or is in the trash.
+func (db *datastoreDB) UpdateMedia(m *Media, events ...*Event) error {
+	if m.ID == 0 {
+		return errors.New("datastoredb: media with unassigned ID passed into updateMedia")
+	}
+	ctx := context.Background()
+	k := db.datastoreKey(m.ID)
+	return db.withEvents(ctx, events, func(tx *datastore.Transaction) error {
+		// A blind Put would add media that is not there, and take media out
+		// of the trash, as m is not deleted.
+		old := &Media{}
+		if err := ignoreFieldMismatch(tx.Get(k, old)); err == datastore.ErrNoSuchEntity || err == nil && !old.DeletedAt.IsZero() {
+			return fmt.Errorf("datastoredb: media with id %d %w", m.ID, errNotFound)
+		} else if err != nil {
+			return fmt.Errorf("datastoredb: could not get media: %v", err)
+		}
+		if _, err := tx.Put(k, m); err != nil {
+			return fmt.Errorf("datastoredb: could not update media: %v", err)
+		}
+		return countTags(tx, old.Tags, m.Tags)
+	})
+}
+
+// ChangeMedia reads a given media and saves the changes change makes to it.
+// The transaction is tried again if the media changes meanwhile, calling
+// change again.
+func (db *datastoreDB) ChangeMedia(id int64, change func(m *Media) (bool, []*Event)) error {
+	ctx := context.Background()
+	k := db.datastoreKey(id)
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		m := &Media{}
+		if err := ignoreFieldMismatch(tx.Get(k, m)); err == datastore.ErrNoSuchEntity || err == nil && !m.DeletedAt.IsZero() {
+			return fmt.Errorf("datastoredb: media with id %d %w", id, errNotFound)
+		} else if err != nil {
+			return fmt.Errorf("datastoredb: could not get media: %v", err)
+		}
+		m.ID = id
+		oldTags := append([]string(nil), m.Tags...)
+		changed, events := change(m)
+		if !changed {
+			return nil
+		}
+		if _, err := tx.Put(k, m); err != nil {
+			return fmt.Errorf("datastoredb: could not update media: %v", err)
+		}
+		if err := countTags(tx, oldTags, m.Tags); err != nil {
+			return err
+		}
+		return putOutbox(tx, events)
+	})
+	return err
+}
+
+// ListMedia returns a list of media, ordered by title.
+func (db *datastoreDB) ListMedia() ([]*Media, error) {
+	q := datastore.NewQuery(mediaKind).
+		Order("Title")
+	return db.listMedia(q)
+}
+
+// ListMediaCreatedBy returns a list of media, ordered by title, filtered by
+// the user who created the media entry.
+func (db *datastoreDB) ListMediaCreatedBy(userID int64) ([]*Media, error) {
+	if userID == 0 {
+		return db.ListMedia()
+	}
+
+	q := datastore.NewQuery(mediaKind).
+		FilterField("CreatedByID", "=", userID).
+		Order("Title")
+	return db.listMedia(q)
+}
+
+// QueryMedia returns the media matching q, in the order it asks for. The
+// filters run in Datastore (see filterQuery), and the media is sorted here,
+// as ordering it there too would need an index for each combination of
+// filters.
+func (db *datastoreDB) QueryMedia(q *MediaQuery) ([]*Media, error) {
+	media, err := db.listMedia(filterQuery(q))
+	if err != nil {
+		return nil, err
+	}
+	return filterMedia(media, q), nil
+}
+
+// CountMedia returns the number of media matching q with each value of
+// facet. Each value is counted by an aggregation query, so no media is read,
+// with at most countConcurrency of them running at once. The values of
+// facets that have no fixed set of them are found first, with a distinct
+// projection of their property. Tags are the exception: there is no end to
+// them, so only the maxTagFacetValues most used ones are counted, along with
+// those q asks for. Those are read from their stored totals when q does not
+// filter the media at all.
+func (db *datastoreDB) CountMedia(ctx context.Context, q *MediaQuery, facet string) (map[string]int, error) {
+	property, ok := facetProperties[facet]
+	if !ok {
+		return nil, fmt.Errorf("datastoredb: no facet %q", facet)
+	}
+	if facet == facetTag && isUnfiltered(q) {
+		return db.topTagCounts(ctx)
+	}
+	values, err := db.facetPropertyValues(ctx, q, facet, property)
+	if err != nil {
+		return nil, err
+	}
+
+	dq := filterQuery(q)
+	counts := make(map[string]int)
+	var mu sync.Mutex
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(countConcurrency)
+	for _, v := range values {
+		v := v
+		g.Go(func() error {
+			n, err := db.count(gctx, dq.FilterField(property, "=", v))
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				mu.Lock()
+				counts[fmt.Sprint(v)] = n
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// countConcurrency is the most aggregation queries CountMedia runs at once.
+const countConcurrency = 8
+
+// maxTagFacetValues is the number of most used tags CountMedia counts.
+const maxTagFacetValues = 30
+
+// isUnfiltered reports whether q matches all the media outside the trash.
+func isUnfiltered(q *MediaQuery) bool {
+	return q.MediaType == "" && q.Industry == "" && q.Decade == 0 && q.Bechdel == "" &&
+		q.MinScore == 0 && !q.HideFlagged && len(q.Tags) == 0
+}
+
+// facetPropertyValues returns the values of the property a facet is counted
+// by: the fixed values of the Bechdel test and score facets, the most used
+// tags and those q asks for, or those any media has for the others.
+func (db *datastoreDB) facetPropertyValues(ctx context.Context, q *MediaQuery, facet, property string) ([]interface{}, error) {
+	switch facet {
+	case facetBechdel:
+		return []interface{}{"pass", "fail", "unrated"}, nil
+	case facetTag:
+		top, err := db.topTagCounts(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var values []interface{}
+		for t := range top {
+			values = append(values, t)
+		}
+		for _, t := range q.Tags {
+			if _, ok := top[t]; !ok {
+				values = append(values, t)
+			}
+		}
+		return values, nil
+	case facetScore:
+		var values []interface{}
+		for _, t := range scoreThresholds {
+			n, _ := strconv.ParseInt(t, 10, 64)
+			values = append(values, n)
+		}
+		return values, nil
+	}
+	var entities []datastore.PropertyList
+	dq := datastore.NewQuery(mediaKind).Project(property).DistinctOn(property)
+	if _, err := db.client.GetAll(ctx, dq, &entities); err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list %s values: %v", facet, err)
+	}
+	var values []interface{}
+	for _, e := range entities {
+		for _, p := range e {
+			if p.Value != "" && p.Value != int64(0) {
+				values = append(values, p.Value)
+			}
+		}
+	}
+	return values, nil
+}
+
+// count returns the number of entities dq selects.
+func (db *datastoreDB) count(ctx context.Context, dq *datastore.Query) (int, error) {
+	res, err := db.client.RunAggregationQuery(ctx, dq.NewAggregationQuery().WithCount("count"))
+	if err != nil {
+		return 0, fmt.Errorf("datastoredb: could not count media: %v", err)
+	}
+	v, ok := res["count"].(*datastorepb.Value)
+	if !ok {
+		return 0, fmt.Errorf("datastoredb: could not count media: got %T", res["count"])
+	}
+	return int(v.GetIntegerValue()), nil
+}
+
+// tagCountEntity is the number of media outside the trash with a tag. It is
+// kept up to date in the transaction of every change to media, so the tag
+// facet need not find every tag there is.
+type tagCountEntity struct {
+	Tag   string
+	Count int
+}
+
+// tagCountKey returns the key of the count of a tag. Names like __x__ are
+// reserved, so the tag is prefixed.
+func tagCountKey(tag string) *datastore.Key {
+	return datastore.NameKey(tagCountKind, "tag:"+tag, nil)
+}
+
+// topTagCounts returns the counts of the maxTagFacetValues most used tags.
+func (db *datastoreDB) topTagCounts(ctx context.Context) (map[string]int, error) {
+	var entities []*tagCountEntity
+	dq := datastore.NewQuery(tagCountKind).FilterField("Count", ">", 0).Order("-Count").Limit(maxTagFacetValues)
+	if _, err := db.client.GetAll(ctx, dq, &entities); err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list tag counts: %v", err)
+	}
+	counts := make(map[string]int)
+	for _, e := range entities {
+		counts[e.Tag] = e.Count
+	}
+	return counts, nil
+}
+
+// countTags updates the tag counts in tx for media outside the trash that
+// had the tags old and now has the tags new. Either is nil for media added
+// to or taken out of those outside the trash.
+func countTags(tx *datastore.Transaction, old, new []string) error {
+	diff := make(map[string]int)
+	for _, t := range dedupTags(old) {
+		diff[t]--
+	}
+	for _, t := range dedupTags(new) {
+		diff[t]++
+	}
+	var keys []*datastore.Key
+	var tags []string
+	for t, d := range diff {
+		if d != 0 {
+			keys = append(keys, tagCountKey(t))
+			tags = append(tags, t)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	counts := make([]tagCountEntity, len(keys))
+	if err := tx.GetMulti(keys, counts); err != nil {
+		multi, ok := err.(datastore.MultiError)
+		if !ok {
+			return fmt.Errorf("datastoredb: could not get tag counts: %v", err)
+		}
+		for _, err := range multi {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return fmt.Errorf("datastoredb: could not get tag counts: %v", err)
+			}
+		}
+	}
+	for i, t := range tags {
+		counts[i].Tag = t
+		counts[i].Count += diff[t]
+	}
+	if _, err := tx.PutMulti(keys, counts); err != nil {
+		return fmt.Errorf("datastoredb: could not put tag counts: %v", err)
+	}
+	return nil
+}
+
+// dedupTags returns tags without repeats, as media with a tag twice is
+// still counted once for it.
+func dedupTags(tags []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, t := range tags {
+		if !seen[t] {
+			seen[t] = true
+			unique = append(unique, t)
+		}
+	}
+	return unique
+}
+
+// PageMedia returns the page of size media matching q that follows cursor.
+// Pages are read with Datastore cursors, which are what cursor holds (see
+// pageQuery).
+func (db *datastoreDB) PageMedia(q *MediaQuery, cursor string, size int) (*MediaPage, error) {
+	dq, checkScore := pageQuery(q)
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, fmt.Errorf("datastoredb: %w", errBadCursor)
+		}
+		dq = dq.Start(c)
+	}
+
+	ctx := context.Background()
+	it := db.client.Run(ctx, dq)
+	page := &MediaPage{}
+	var next datastore.Cursor
+	for {
+		m := &Media{}
+		k, err := it.Next(m)
+		if err == iterator.Done {
+			return page, nil
+		}
+		if err := ignoreFieldMismatch(err); err != nil {
+			if cursor != "" && status.Code(err) == codes.InvalidArgument {
+				// The cursor is for another query.
+				return nil, fmt.Errorf("datastoredb: %v: %w", err, errBadCursor)
+			}
+			return nil, fmt.Errorf("datastoredb: could not list media: %v", err)
+		}
+		if checkScore && m.InclusionScore < q.MinScore {
+			continue
+		}
+		if len(page.Media) == size {
+			// There is more, from after the last media of the page.
+			page.Next = next.String()
+			return page, nil
+		}
+		m.ID = k.ID
+		page.Media = append(page.Media, m)
+		if next, err = it.Cursor(); err != nil {
+			return nil, fmt.Errorf("datastoredb: could not get cursor: %v", err)
+		}
+	}
+}
+
+// pageQuery returns the Datastore query for the media matching q, in the
+// order it asks for, and whether PageMedia is left to skip media below q's
+// minimum score. That is when the minimum is not one of scoreThresholds,
+// as Datastore runs the inequality filter on the score only when ordering
+// by score first. The composite indexes are in index.yaml.
+func pageQuery(q *MediaQuery) (dq *datastore.Query, checkScore bool) {
+	if q.MinScore == 0 || q.Sort == sortScore || isScoreThreshold(q.MinScore) {
+		dq = filterQuery(q)
+	} else {
+		unscored := *q
+		unscored.MinScore = 0
+		dq, checkScore = filterQuery(&unscored), true
+	}
+
+	switch q.Sort {
+	case sortRelease:
+		dq = dq.Order("-" + releaseYearProperty).Order("Title")
+	case sortAdded:
+		dq = dq.Order("-" + createdDayProperty).Order("-__key__")
+	case sortScore:
+		dq = dq.Order("-InclusionScore").Order("Title")
+	default:
+		dq = dq.Order("Title")
+	}
+	// Media with the same values is otherwise ordered by key, which is by ID.
+	return dq, checkScore
+}
+
+// Properties stored with media, derived from its fields, for the filters and
+// orders Datastore cannot run on the fields themselves. Media.Save adds them,
+// and Media.Load leaves them out.
+const (
+	// decadeProperty is the first year of the decade of the release, 0 if
+	// the release date has no year.
+	decadeProperty = "Decade"
+	// bechdelProperty is the key of bechdelFilters the Bechdel test
+	// matches: pass, fail or unrated.
+	bechdelProperty = "BechdelResult"
+	// scoreProperty lists each of scoreThresholds the inclusion score
+	// meets, so the score facet filters on equality.
+	scoreProperty = "ScoreAtLeast"
+	// releaseYearProperty and createdDayProperty are the first sort keys of
+	// the release and date added orders (see mediaSortKeys).
+	releaseYearProperty = "ReleaseYear"
+	createdDayProperty  = "CreatedDay"
+)
+
+// facetProperties are the properties MediaDatabase.CountMedia counts each
+// facet by.
+var facetProperties = map[string]string{
+	facetMediaType: "MediaType",
+	facetIndustry:  "Industry",
+	facetDecade:    decadeProperty,
+	facetBechdel:   bechdelProperty,
+	facetScore:     scoreProperty,
+	facetTag:       "Tags",
+}
+
+// Save returns the properties media is stored with: its fields and the
+// properties derived from them.
+func (m *Media) Save() ([]datastore.Property, error) {
+	props, err := datastore.SaveStruct(m)
+	if err != nil {
+		return nil, err
+	}
+	var decade int64
+	if values := facetValues[facetDecade](m); values != nil {
+		decade, _ = strconv.ParseInt(values[0], 10, 64)
+	}
+	var bechdel string
+	if values := facetValues[facetBechdel](m); values != nil {
+		bechdel = values[0]
+	}
+	scores := []interface{}{}
+	for _, v := range facetValues[facetScore](m) {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		scores = append(scores, n)
+	}
+	return append(props,
+		datastore.Property{Name: decadeProperty, Value: decade},
+		datastore.Property{Name: bechdelProperty, Value: bechdel},
+		datastore.Property{Name: scoreProperty, Value: scores},
+		datastore.Property{Name: releaseYearProperty, Value: mediaSortKeys[sortRelease][0].value(m)},
+		datastore.Property{Name: createdDayProperty, Value: mediaSortKeys[sortAdded][0].value(m)},
+	), nil
+}
+
+// Load sets the fields of media from its stored properties, leaving out the
+// derived ones. As for structs, the error is an *ErrFieldMismatch if there
+// are properties media no longer has a field for.
+func (m *Media) Load(props []datastore.Property) error {
+	fields := make([]datastore.Property, 0, len(props))
+	for _, p := range props {
+		switch p.Name {
+		case decadeProperty, bechdelProperty, scoreProperty, releaseYearProperty, createdDayProperty:
+		default:
+			fields = append(fields, p)
+		}
+	}
+	return datastore.LoadStruct(m, fields)
+}
+
+// filterQuery returns the Datastore query for the media matching q, leaving
+// out media in the trash. The filters are on equality, which Datastore runs
+// together by merging indexes, except for a minimum score that is not one of
+// scoreThresholds. That is on inequality, which cannot be ordered by anything
+// but the score first (see pageQuery).
+func filterQuery(q *MediaQuery) *datastore.Query {
+	dq := datastore.NewQuery(mediaKind).FilterField("DeletedAt", "=", time.Time{})
+	if q.MediaType != "" {
+		dq = dq.FilterField("MediaType", "=", q.MediaType)
+	}
+	if q.Industry != "" {
+		dq = dq.FilterField("Industry", "=", q.Industry)
+	}
+	if q.Decade != 0 {
+		dq = dq.FilterField(decadeProperty, "=", q.Decade)
+	}
+	if q.Bechdel != "" {
+		dq = dq.FilterField(bechdelProperty, "=", q.Bechdel)
+	}
+	if q.MinScore != 0 {
+		if isScoreThreshold(q.MinScore) {
+			dq = dq.FilterField(scoreProperty, "=", q.MinScore)
+		} else {
+			dq = dq.FilterField("InclusionScore", ">=", q.MinScore)
+		}
+	}
+	if q.HideFlagged {
+		dq = dq.FilterField("Disqualified", "=", false)
+	}
+	for _, t := range q.Tags {
+		dq = dq.FilterField("Tags", "=", t)
+	}
+	return dq
+}
+
+// isScoreThreshold reports whether score is one of scoreThresholds.
+func isScoreThreshold(score int) bool {
+	for _, t := range scoreThresholds {
+		if t == strconv.Itoa(score) {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaSchemaVersion is the version of the properties derived from media and
+// of the tag counts kept with it. It is stored under schemaKind, and media
+// stored by an older version is saved, and its tags counted, again, once,
+// when the database is opened.
+const mediaSchemaVersion = 3
+
+// schemaEntity records the version of the properties stored with a kind.
+type schemaEntity struct {
+	Version int
+}
+
+// migrateMedia saves all the media again, with the derived properties of
+// mediaSchemaVersion, unless the stored version is already that. Media is
+// saved in batches, each in a transaction so it does not undo changes made
+// in the meantime. Media saved before there was a trash gets its zero
+// DeletedAt too, which filterQuery relies on. The tags are counted after.
+func (db *datastoreDB) migrateMedia(ctx context.Context) error {
+	k := datastore.NameKey(schemaKind, mediaKind, nil)
+	var schema schemaEntity
+	if err := db.client.Get(ctx, k, &schema); err != nil && err != datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastoredb: could not get media schema version: %v", err)
+	}
+	if schema.Version >= mediaSchemaVersion {
+		return nil
+	}
+
+	keys, err := db.client.GetAll(ctx, datastore.NewQuery(mediaKind).KeysOnly(), nil)
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not list media: %v", err)
+	}
+	const batchSize = 100
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		keys = keys[len(batch):]
+		if _, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			return resaveMedia(tx, batch)
+		}); err != nil {
+			return fmt.Errorf("datastoredb: could not migrate media: %v", err)
+		}
+	}
+	if err := db.recountTags(ctx); err != nil {
+		return err
+	}
+
+	if _, err := db.client.Put(ctx, k, &schemaEntity{Version: mediaSchemaVersion}); err != nil {
+		return fmt.Errorf("datastoredb: could not put media schema version: %v", err)
+	}
+	return nil
+}
+
+// resaveMedia saves the media with the given keys again in tx, skipping any
+// deleted since they were listed.
+func resaveMedia(tx *datastore.Transaction, keys []*datastore.Key) error {
+	media := make([]*Media, len(keys))
+	for i := range media {
+		media[i] = &Media{}
+	}
+	errs := make(datastore.MultiError, len(keys))
+	if err := tx.GetMulti(keys, media); err != nil {
+		multi, ok := err.(datastore.MultiError)
+		if !ok {
+			return err
+		}
+		errs = multi
+	}
+	var found []*datastore.Key
+	var foundMedia []*Media
+	for i, err := range errs {
+		if err == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if err := ignoreFieldMismatch(err); err != nil {
+			return err
+		}
+		found = append(found, keys[i])
+		foundMedia = append(foundMedia, media[i])
+	}
+	_, err := tx.PutMulti(found, foundMedia)
+	return err
+}
+
+// recountTags replaces the tag counts with those of the media outside the
+// trash, read in full.
+func (db *datastoreDB) recountTags(ctx context.Context) error {
+	counts := make(map[string]int)
+	it := db.client.Run(ctx, datastore.NewQuery(mediaKind).FilterField("DeletedAt", "=", time.Time{}))
+	for {
+		var m Media
+		_, err := it.Next(&m)
+		if err == iterator.Done {
+			break
+		}
+		if err := ignoreFieldMismatch(err); err != nil {
+			return fmt.Errorf("datastoredb: could not list media: %v", err)
+		}
+		for _, t := range dedupTags(m.Tags) {
+			counts[t]++
+		}
+	}
+
+	// Datastore takes at most 500 entities in a call.
+	const batchSize = 500
+	stale, err := db.client.GetAll(ctx, datastore.NewQuery(tagCountKind).KeysOnly(), nil)
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not list tag counts: %v", err)
+	}
+	for len(stale) > 0 {
+		batch := stale
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		stale = stale[len(batch):]
+		if err := db.client.DeleteMulti(ctx, batch); err != nil {
+			return fmt.Errorf("datastoredb: could not delete tag counts: %v", err)
+		}
+	}
+	var keys []*datastore.Key
+	var entities []*tagCountEntity
+	for t, n := range counts {
+		keys = append(keys, tagCountKey(t))
+		entities = append(entities, &tagCountEntity{Tag: t, Count: n})
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > batchSize {
+			n = batchSize
+		}
+		if _, err := db.client.PutMulti(ctx, keys[:n], entities[:n]); err != nil {
+			return fmt.Errorf("datastoredb: could not put tag counts: %v", err)
+		}
+		keys, entities = keys[n:], entities[n:]
+	}
+	return nil
+}
+
+// listMedia runs q and fills in the ID of each media from its key. Media in
+// the trash is left out here, so that queries need not filter on DeletedAt.
+func (db *datastoreDB) listMedia(q *datastore.Query) ([]*Media, error) {
+	all, err := db.listAllMedia(q)
+	if err != nil {
+		return nil, err
+	}
+	mediaList := make([]*Media, 0, len(all))
+	for _, m := range all {
+		if m.DeletedAt.IsZero() {
+			mediaList = append(mediaList, m)
+		}
+	}
+	return mediaList, nil
+}
+
+// listAllMedia runs q, trash and all, and fills in the ID of each media from
+// its key.
+func (db *datastoreDB) listAllMedia(q *datastore.Query) ([]*Media, error) {
+	ctx := context.Background()
+	mediaList := make([]*Media, 0)
+	keys, err := db.client.GetAll(ctx, q, &mediaList)
+	if err := ignoreFieldMismatch(err); err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list media: %v", err)
+	}
+
+	for i, k := range keys {
+		mediaList[i].ID = k.ID
+	}
+
+	return mediaList, nil
+}
+
+// ignoreFieldMismatch drops the error returned when an entity has properties
+// the struct no longer has, such as the ActorID, CharacterID and DirectorID
+// of media saved before credits existed. The other fields are still loaded.
+func ignoreFieldMismatch(err error) error {
+	if _, ok := err.(*datastore.ErrFieldMismatch); ok {
+		return nil
+	}
+	return err
+}
+
+// deleteAll deletes every entity matched by the keys-only query q.
+func (db *datastoreDB) deleteAll(ctx context.Context, q *datastore.Query) error {
+	keys, err := db.client.GetAll(ctx, q, nil)
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not list keys: %v", err)
+	}
+	if err := db.client.DeleteMulti(ctx, keys); err != nil {
+		return fmt.Errorf("datastoredb: could not delete: %v", err)
+	}
+	return nil
+}
+
+/*---------------------------  People  ---------------------------*/
+
+// ListPeople returns a list of people, ordered by name.
+func (db *datastoreDB) ListPeople() ([]*Person, error) {
+	ctx := context.Background()
+	people := make([]*Person, 0)
+	keys, err := db.client.GetAll(ctx, datastore.NewQuery(personKind).Order("Name"), &people)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list people: %v", err)
+	}
+	for i, k := range keys {
+		people[i].ID = k.ID
+	}
+	return people, nil
+}
+
+// GetPerson retrieves a person by its ID.
+func (db *datastoreDB) GetPerson(id int64) (*Person, error) {
+	ctx := context.Background()
+	p := &Person{}
+	if err := db.client.Get(ctx, datastore.IDKey(personKind, id, nil), p); err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastoredb: person with id %d %w", id, errNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not get person: %v", err)
+	}
+	p.ID = id
+	return p, nil
+}
+
+// AddPerson saves a given person, assigning it a new ID.
+func (db *datastoreDB) AddPerson(p *Person) (id int64, err error) {
+	ctx := context.Background()
+	k, err := db.client.Put(ctx, datastore.IncompleteKey(personKind, nil), p)
+	if err != nil {
+		return 0, fmt.Errorf("datastoredb: could not put person: %v", err)
+	}
+	p.ID = k.ID
+	return k.ID, nil
+}
+
+// UpdatePerson updates the entry for a given person.
+func (db *datastoreDB) UpdatePerson(p *Person) error {
+	if p.ID == 0 {
+		return errors.New("datastoredb: person with unassigned ID passed into updatePerson")
+	}
+	ctx := context.Background()
+	k := datastore.IDKey(personKind, p.ID, nil)
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		// A blind Put would add a person that is not there.
+		if err := tx.Get(k, &Person{}); err == datastore.ErrNoSuchEntity {
+			return fmt.Errorf("datastoredb: person with id %d %w", p.ID, errNotFound)
+		} else if err != nil {
+			return fmt.Errorf("datastoredb: could not get person: %v", err)
+		}
+		if _, err := tx.Put(k, p); err != nil {
+			return fmt.Errorf("datastoredb: could not update person: %v", err)
+		}
+		return nil
+	})
+	return err
+}
+
+// DeletePerson removes a given person, and their credits, by ID.
+func (db *datastoreDB) DeletePerson(id int64) error {
+	ctx := context.Background()
+	k := datastore.IDKey(personKind, id, nil)
+	if err := db.client.Get(ctx, k, &Person{}); err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastoredb: person with id %d %w", id, errNotFound)
+	} else if err != nil {
+		return fmt.Errorf("datastoredb: could not get person: %v", err)
+	}
+	if err := db.client.Delete(ctx, k); err != nil {
+		return fmt.Errorf("datastoredb: could not delete person: %v", err)
+	}
+	return db.deleteAll(ctx, datastore.NewQuery(creditKind).FilterField("PersonID", "=", id).KeysOnly())
+}
+
+/*---------------------------  Characters  ---------------------------*/
+
+// ListCharacters returns the characters of the given media, ordered by name.
+func (db *datastoreDB) ListCharacters(mediaID int64) ([]*Character, error) {
+	ctx := context.Background()
+	chars := make([]*Character, 0)
+	q := datastore.NewQuery(characterKind).FilterField("MediaID", "=", mediaID)
+	keys, err := db.client.GetAll(ctx, q, &chars)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list characters: %v", err)
+	}
+	for i, k := range keys {
+		chars[i].ID = k.ID
+	}
+	// Sorted here rather than in the query, which would need another index.
+	sort.Slice(chars, func(i, j int) bool {
+		if chars[i].Name != chars[j].Name {
+			return chars[i].Name < chars[j].Name
+		}
+		return chars[i].ID < chars[j].ID
+	})
+	return chars, nil
+}
+
+// GetCharacter retrieves a character by its ID.
+func (db *datastoreDB) GetCharacter(id int64) (*Character, error) {
+	ctx := context.Background()
+	c := &Character{}
+	if err := db.client.Get(ctx, datastore.IDKey(characterKind, id, nil), c); err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastoredb: character with id %d %w", id, errNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not get character: %v", err)
+	}
+	c.ID = id
+	return c, nil
+}
+
+// AddCharacter saves a given character, assigning it a new ID.
+func (db *datastoreDB) AddCharacter(c *Character) (id int64, err error) {
+	ctx := context.Background()
+	k, err := db.client.Put(ctx, datastore.IncompleteKey(characterKind, nil), c)
+	if err != nil {
+		return 0, fmt.Errorf("datastoredb: could not put character: %v", err)
+	}
+	c.ID = k.ID
+	return k.ID, nil
+}
+
+// UpdateCharacter updates the entry for a given character.
+func (db *datastoreDB) UpdateCharacter(c *Character) error {
+	if c.ID == 0 {
+		return errors.New("datastoredb: character with unassigned ID passed into updateCharacter")
+	}
+	ctx := context.Background()
+	k := datastore.IDKey(characterKind, c.ID, nil)
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		// A blind Put would add a character that is not there.
+		if err := tx.Get(k, &Character{}); err == datastore.ErrNoSuchEntity {
+			return fmt.Errorf("datastoredb: character with id %d %w", c.ID, errNotFound)
+		} else if err != nil {
+			return fmt.Errorf("datastoredb: could not get character: %v", err)
+		}
+		if _, err := tx.Put(k, c); err != nil {
+			return fmt.Errorf("datastoredb: could not update character: %v", err)
+		}
+		return nil
+	})
+	return err
+}
+
+// DeleteCharacter removes a given character by its ID, unlinking it from the
+// credits that reference it.
+func (db *datastoreDB) DeleteCharacter(id int64) error {
+	ctx := context.Background()
+	k := datastore.IDKey(characterKind, id, nil)
+	if err := db.client.Get(ctx, k, &Character{}); err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastoredb: character with id %d %w", id, errNotFound)
+	} else if err != nil {
+		return fmt.Errorf("datastoredb: could not get character: %v", err)
+	}
+	if err := db.client.Delete(ctx, k); err != nil {
+		return fmt.Errorf("datastoredb: could not delete character: %v", err)
+	}
+
+	var credits []*Credit
+	keys, err := db.client.GetAll(ctx, datastore.NewQuery(creditKind).FilterField("CharacterID", "=", id), &credits)
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not list credits: %v", err)
+	}
+	for _, c := range credits {
+		c.CharacterID = 0
+	}
+	if _, err := db.client.PutMulti(ctx, keys, credits); err != nil {
+		return fmt.Errorf("datastoredb: could not update credits: %v", err)
+	}
+	return nil
+}
+
+/*---------------------------  Credits  ---------------------------*/
+
+// ListCredits returns the credits of the given media, or of all media when
+// mediaID is 0, ordered by ID.
+func (db *datastoreDB) ListCredits(mediaID int64) ([]*Credit, error) {
+	q := datastore.NewQuery(creditKind)
+	if mediaID != 0 {
+		q = q.FilterField("MediaID", "=", mediaID)
+	}
+	return db.listCredits(q)
+}
+
+// ListPersonCredits returns the credits of the given person, ordered by ID.
+func (db *datastoreDB) ListPersonCredits(personID int64) ([]*Credit, error) {
+	return db.listCredits(datastore.NewQuery(creditKind).FilterField("PersonID", "=", personID))
+}
+
+func (db *datastoreDB) listCredits(q *datastore.Query) ([]*Credit, error) {
+	ctx := context.Background()
+	credits := make([]*Credit, 0)
+	keys, err := db.client.GetAll(ctx, q, &credits)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list credits: %v", err)
+	}
+	for i, k := range keys {
+		credits[i].ID = k.ID
+	}
+	sort.Slice(credits, func(i, j int) bool { return credits[i].ID < credits[j].ID })
+	return credits, nil
+}
+
+// AddCredit saves a given credit, assigning it a new ID.
+func (db *datastoreDB) AddCredit(c *Credit) (id int64, err error) {
+	ctx := context.Background()
+	k, err := db.client.Put(ctx, datastore.IncompleteKey(creditKind, nil), c)
+	if err != nil {
+		return 0, fmt.Errorf("datastoredb: could not put credit: %v", err)
+	}
+	c.ID = k.ID
+	return k.ID, nil
+}
+
+// DeleteCredit removes a given credit by its ID.
+func (db *datastoreDB) DeleteCredit(id int64) error {
+	ctx := context.Background()
+	k := datastore.IDKey(creditKind, id, nil)
+	if err := db.client.Get(ctx, k, &Credit{}); err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastoredb: credit with id %d %w", id, errNotFound)
+	} else if err != nil {
+		return fmt.Errorf("datastoredb: could not get credit: %v", err)
+	}
+	if err := db.client.Delete(ctx, k); err != nil {
+		return fmt.Errorf("datastoredb: could not delete credit: %v", err)
+	}
+	return nil
+}
+
+/*---------------------------  Users  ---------------------------*/
+
+// GetUser retrieves a user by its ID.
+func (db *datastoreDB) GetUser(id int64) (*User, error) {
+	ctx := context.Background()
+	u := &User{}
+	if err := db.client.Get(ctx, datastore.IDKey(userKind, id, nil), u); err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastoredb: user with id %d %w", id, errNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not get user: %v", err)
+	}
+	u.ID = id
+	return u, nil
+}
+
+// GetUserByIdentity retrieves the user with the given identity.
+func (db *datastoreDB) GetUserByIdentity(issuer, subject string) (*User, error) {
+	ctx := context.Background()
+	q := datastore.NewQuery(userKind).
+		FilterField("Issuer", "=", issuer).
+		FilterField("Subject", "=", subject).
+		Limit(1)
+	var users []*User
+	keys, err := db.client.GetAll(ctx, q, &users)
+	if err := ignoreFieldMismatch(err); err != nil {
+		return nil, fmt.Errorf("datastoredb: could not get user: %v", err)
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("datastoredb: user %s at %s %w", subject, issuer, errNotFound)
+	}
+	users[0].ID = keys[0].ID
+	return users[0], nil
+}
+
+// AddUser saves a given user, assigning it a new ID.
+func (db *datastoreDB) AddUser(u *User) (id int64, err error) {
+	ctx := context.Background()
+	k, err := db.client.Put(ctx, datastore.IncompleteKey(userKind, nil), u)
+	if err != nil {
+		return 0, fmt.Errorf("datastoredb: could not put user: %v", err)
+	}
+	u.ID = k.ID
+	return k.ID, nil
+}
+
+// UpdateUser updates the entry for a given user.
+func (db *datastoreDB) UpdateUser(u *User) error {
+	if u.ID == 0 {
+		return errors.New("datastoredb: user with unassigned ID passed into updateUser")
+	}
+	ctx := context.Background()
+	if _, err := db.client.Put(ctx, datastore.IDKey(userKind, u.ID, nil), u); err != nil {
+		return fmt.Errorf("datastoredb: could not update user: %v", err)
+	}
+	return nil
+}
+
+// ListUsers returns all the users, ordered by ID.
+func (db *datastoreDB) ListUsers() ([]*User, error) {
+	ctx := context.Background()
+	var users []*User
+	keys, err := db.client.GetAll(ctx, datastore.NewQuery(userKind).Order("__key__"), &users)
+	if err := ignoreFieldMismatch(err); err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list users: %v", err)
+	}
+	for i, k := range keys {
+		users[i].ID = k.ID
+	}
+	return users, nil
+}
+
+/*---------------------------  Submissions  ---------------------------*/
+
+// submissionEntity is how submissions are stored: the submitted media is kept
+// as JSON, as Datastore cannot store its lists of credits.
+type submissionEntity struct {
+	Submission
+	MediaJSON string `datastore:",noindex"`
+}
+
+// newSubmissionEntity returns the entity to store s as.
+func newSubmissionEntity(s *Submission) (*submissionEntity, error) {
+	media, err := marshalMedia(s.Media)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not store submission media: %v", err)
+	}
+	return &submissionEntity{Submission: *s, MediaJSON: media}, nil
+}
+
+// submission returns the submission stored as e under the key k.
+func (e *submissionEntity) submission(k *datastore.Key) (*Submission, error) {
+	s := e.Submission
+	s.ID = k.ID
+	var err error
+	if s.Media, err = unmarshalMedia(e.MediaJSON); err != nil {
+		return nil, fmt.Errorf("datastoredb: could not read submission media: %v", err)
+	}
+	return &s, nil
+}
+
+// GetSubmission retrieves a submission by its ID.
+func (db *datastoreDB) GetSubmission(id int64) (*Submission, error) {
+	ctx := context.Background()
+	k := datastore.IDKey(submissionKind, id, nil)
+	e := &submissionEntity{}
+	if err := ignoreFieldMismatch(db.client.Get(ctx, k, e)); err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastoredb: submission with id %d %w", id, errNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not get submission: %v", err)
+	}
+	return e.submission(k)
+}
+
+// ListSubmissions returns the submissions with the given status, oldest
+// first.
+func (db *datastoreDB) ListSubmissions(status SubmissionStatus) ([]*Submission, error) {
+	q := datastore.NewQuery(submissionKind).FilterField("Status", "=", string(status))
+	return db.listSubmissions(q, false)
+}
+
+// ListSubmissionsBy returns the submissions of the given user, newest first.
+func (db *datastoreDB) ListSubmissionsBy(userID int64) ([]*Submission, error) {
+	q := datastore.NewQuery(submissionKind).FilterField("SubmittedByID", "=", userID)
+	return db.listSubmissions(q, true)
+}
+
+// listSubmissions returns the submissions q finds, oldest or newest first.
+// Datastore IDs are not in order, so they are sorted here.
+func (db *datastoreDB) listSubmissions(q *datastore.Query, newestFirst bool) ([]*Submission, error) {
+	ctx := context.Background()
+	var entities []*submissionEntity
+	keys, err := db.client.GetAll(ctx, q, &entities)
+	if err := ignoreFieldMismatch(err); err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list submissions: %v", err)
+	}
+	list := make([]*Submission, len(entities))
+	for i, e := range entities {
+		if list[i], err = e.submission(keys[i]); err != nil {
+			return nil, err
+		}
+	}
+	sortSubmissions(list, newestFirst)
+	return list, nil
+}
+
+// AddSubmission saves a given submission, assigning it a new ID.
+func (db *datastoreDB) AddSubmission(s *Submission) (id int64, err error) {
+	e, err := newSubmissionEntity(s)
+	if err != nil {
+		return 0, err
+	}
+	ctx := context.Background()
+	k, err := db.client.Put(ctx, datastore.IncompleteKey(submissionKind, nil), e)
+	if err != nil {
+		return 0, fmt.Errorf("datastoredb: could not put submission: %v", err)
+	}
+	s.ID = k.ID
+	return k.ID, nil
+}
+
+// UpdateSubmission updates the entry for a given submission.
+func (db *datastoreDB) UpdateSubmission(s *Submission, events ...*Event) error {
+	if s.ID == 0 {
+		return errors.New("datastoredb: submission with unassigned ID passed into updateSubmission")
+	}
+	e, err := newSubmissionEntity(s)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	return db.withEvents(ctx, events, func(tx *datastore.Transaction) error {
+		if _, err := tx.Put(datastore.IDKey(submissionKind, s.ID, nil), e); err != nil {
+			return fmt.Errorf("datastoredb: could not update submission: %v", err)
+		}
+		return nil
+	})
+}
+
+// AddSubmittedMedia saves the media of a submission of new media, and the
+// submission with its ID, in one transaction.
+func (db *datastoreDB) AddSubmittedMedia(s *Submission, m *Media, events ...*Event) (id int64, err error) {
+	if s.ID == 0 {
+		return 0, errors.New("datastoredb: submission with unassigned ID passed into addSubmittedMedia")
+	}
+	ctx := context.Background()
+	keys, err := db.client.AllocateIDs(ctx, []*datastore.Key{datastore.IncompleteKey(mediaKind, nil)})
+	if err != nil {
+		return 0, fmt.Errorf("datastoredb: could not allocate media ID: %v", err)
+	}
+	k := keys[0]
+	linked := *s
+	linked.MediaID = k.ID
+	e, err := newSubmissionEntity(&linked)
+	if err != nil {
+		return 0, err
+	}
+	m.ID = k.ID
+	setEventMediaID(events, k.ID)
+	err = db.withEvents(ctx, events, func(tx *datastore.Transaction) error {
+		if _, err := tx.Put(k, m); err != nil {
+			return fmt.Errorf("datastoredb: could not put media: %v", err)
+		}
+		if _, err := tx.Put(datastore.IDKey(submissionKind, s.ID, nil), e); err != nil {
+			return fmt.Errorf("datastoredb: could not update submission: %v", err)
+		}
+		return countTags(tx, nil, m.Tags)
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.MediaID = k.ID
+	return k.ID, nil
+}
+
+/*---------------------------  Revisions  ---------------------------*/
+
+// revisionEntity is how revisions are stored: the media is kept as JSON, like
+// a submission's.
+type revisionEntity struct {
+	Revision
+	MediaJSON string `datastore:",noindex"`
+}
+
+// revision returns the revision stored as e under the key k.
+func (e *revisionEntity) revision(k *datastore.Key) (*Revision, error) {
+	r := e.Revision
+	r.ID = k.ID
+	var err error
+	if r.Media, err = unmarshalMedia(e.MediaJSON); err != nil {
+		return nil, fmt.Errorf("datastoredb: could not read revision media: %v", err)
+	}
+	return &r, nil
+}
+
+// GetRevision retrieves a revision by its ID.
+func (db *datastoreDB) GetRevision(id int64) (*Revision, error) {
+	ctx := context.Background()
+	k := datastore.IDKey(revisionKind, id, nil)
+	e := &revisionEntity{}
+	if err := ignoreFieldMismatch(db.client.Get(ctx, k, e)); err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastoredb: revision with id %d %w", id, errNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not get revision: %v", err)
+	}
+	return e.revision(k)
+}
+
+// ListRevisions returns the revisions of the given media, oldest first.
+// Datastore IDs are not in order, so they are sorted here.
+func (db *datastoreDB) ListRevisions(mediaID int64) ([]*Revision, error) {
+	ctx := context.Background()
+	q := datastore.NewQuery(revisionKind).FilterField("MediaID", "=", mediaID)
+	var entities []*revisionEntity
+	keys, err := db.client.GetAll(ctx, q, &entities)
+	if err := ignoreFieldMismatch(err); err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list revisions: %v", err)
+	}
+	list := make([]*Revision, len(entities))
+	for i, e := range entities {
+		if list[i], err = e.revision(keys[i]); err != nil {
+			return nil, err
+		}
+	}
+	sortRevisions(list)
+	return list, nil
+}
+
+// AddRevision saves a given revision, assigning it a new ID.
+func (db *datastoreDB) AddRevision(r *Revision) (id int64, err error) {
+	media, err := marshalMedia(r.Media)
+	if err != nil {
+		return 0, fmt.Errorf("datastoredb: could not store revision media: %v", err)
+	}
+	e := &revisionEntity{Revision: *r, MediaJSON: media}
+	ctx := context.Background()
+	k, err := db.client.Put(ctx, datastore.IncompleteKey(revisionKind, nil), e)
+	if err != nil {
+		return 0, fmt.Errorf("datastoredb: could not put revision: %v", err)
+	}
+	r.ID = k.ID
+	return k.ID, nil
+}
+
+/*---------------------------  Outbox  ---------------------------*/
+
+// outboxEntity is how events wait in the outbox: as JSON, as they are
+// published, with the time they are ordered by. Datastore IDs are not
+// assigned in order.
+type outboxEntity struct {
+	Type string
+	Time time.Time
+	Data string `datastore:",noindex"`
+}
+
+// withEvents runs change in a transaction, adding the events to the outbox
+// in it too.
+func (db *datastoreDB) withEvents(ctx context.Context, events []*Event, change func(tx *datastore.Transaction) error) error {
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := change(tx); err != nil {
+			return err
+		}
+		return putOutbox(tx, events)
+	})
+	return err
+}
+
+// putOutbox adds the events to the outbox in tx.
+func putOutbox(tx *datastore.Transaction, events []*Event) error {
+	for _, e := range events {
+		data, err := marshalEvent(e)
+		if err != nil {
+			return fmt.Errorf("datastoredb: could not store event: %v", err)
+		}
+		entity := &outboxEntity{Type: string(e.Type), Time: e.Time, Data: data}
+		if _, err := tx.Put(datastore.IncompleteKey(outboxKind, nil), entity); err != nil {
+			return fmt.Errorf("datastoredb: could not add event to outbox: %v", err)
+		}
+	}
+	return nil
+}
+
+// ListOutbox returns up to n events waiting to be published, oldest first.
+func (db *datastoreDB) ListOutbox(n int) ([]*Event, error) {
+	ctx := context.Background()
+	var entities []*outboxEntity
+	keys, err := db.client.GetAll(ctx, datastore.NewQuery(outboxKind).Order("Time").Limit(n), &entities)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list outbox: %v", err)
+	}
+	list := make([]*Event, len(entities))
+	for i, entity := range entities {
+		if list[i], err = unmarshalEvent(entity.Data); err != nil {
+			return nil, fmt.Errorf("datastoredb: could not read event %d: %v", keys[i].ID, err)
+		}
+		list[i].ID = keys[i].ID
+	}
+	return list, nil
+}
+
+// DeleteOutbox removes a published event from the outbox.
+func (db *datastoreDB) DeleteOutbox(id int64) error {
+	ctx := context.Background()
+	if err := db.client.Delete(ctx, datastore.IDKey(outboxKind, id, nil)); err != nil {
+		return fmt.Errorf("datastoredb: could not delete event: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// newEmulatorDB returns a datastoreDB talking to the Datastore emulator, in a
+// project of its own so tests do not see each other's entities. The test is
+// skipped when DATASTORE_EMULATOR_HOST is not set; start the emulator with
+//
+//	gcloud beta emulators datastore start --consistency=1.0
+//	$(gcloud beta emulators datastore env-init)
+func newEmulatorDB(t *testing.T) *datastoreDB {
+	t.Helper()
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST is not set")
+	}
+	client, err := datastore.NewClient(context.Background(), fmt.Sprintf("fts-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := newDatastoreDB(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db.(*datastoreDB)
+}
+
+func TestDatastoreDBMedia(t *testing.T) {
+	db := newEmulatorDB(t)
+	id, err := db.AddMedia(&Media{Title: "Alien", ReleaseDate: "1979"})
+	if err != nil {
+		t.Fatalf("AddMedia: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		change  func() error
+		wantErr error
+		want    string // Title of the stored media, "" if it is not found.
+	}{
+		{"update", func() error {
+			return db.UpdateMedia(&Media{ID: id, Title: "Aliens"})
+		}, nil, "Aliens"},
+		{"update unknown", func() error {
+			return db.UpdateMedia(&Media{ID: id + 100, Title: "Nope"})
+		}, errNotFound, "Aliens"},
+		{"delete", func() error { return db.DeleteMedia(id, 1, "Ann") }, nil, ""},
+		{"delete again", func() error { return db.DeleteMedia(id, 1, "Ann") }, errNotFound, ""},
+		{"update deleted", func() error {
+			return db.UpdateMedia(&Media{ID: id, Title: "Ghost"})
+		}, errNotFound, ""},
+		{"restore", func() error { return db.RestoreMedia(id) }, nil, "Aliens"},
+		{"restore again", func() error { return db.RestoreMedia(id) }, errNotFound, "Aliens"},
+		{"purge live", func() error { return db.PurgeMedia(id) }, errNotFound, "Aliens"},
+		{"purge deleted", func() error {
+			if err := db.DeleteMedia(id, 0, ""); err != nil {
+				return err
+			}
+			return db.PurgeMedia(id)
+		}, nil, ""},
+	} {
+		err := tt.change()
+		if tt.wantErr == nil && err != nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+		}
+		got, err := db.GetMedia(id)
+		switch {
+		case tt.want == "" && !errors.Is(err, errNotFound):
+			t.Errorf("%s: GetMedia = %v, %v, want not found", tt.name, got, err)
+		case tt.want != "" && (err != nil || got.Title != tt.want):
+			t.Errorf("%s: GetMedia = %v, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestDatastoreDBTrash(t *testing.T) {
+	db := newEmulatorDB(t)
+	var ids []int64
+	for _, title := range []string{"A", "B", "C"} {
+		id, err := db.AddMedia(&Media{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range []int64{ids[0], ids[2]} {
+		if err := db.DeleteMedia(id, 7, "Ann"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted, err := db.ListDeletedMedia()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 || deleted[0].ID != ids[2] || deleted[1].ID != ids[0] {
+		t.Fatalf("ListDeletedMedia = %v, want C then A", deleted)
+	}
+	if d := deleted[0]; d.DeletedByID != 7 || d.DeletedBy != "Ann" {
+		t.Errorf("deleted media = %+v, want deleted by 7 Ann", d)
+	}
+	live, err := db.ListMedia()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 1 || live[0].Title != "B" {
+		t.Errorf("ListMedia = %v, want only B", live)
+	}
+}
+
+func TestDatastoreDBOutbox(t *testing.T) {
+	db := newEmulatorDB(t)
+	m := &Media{Title: "Alien"}
+	id, err := db.AddMedia(m, newMediaEvent(EventMediaCreated, m, 1, "Ann"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Title = "Aliens"
+	if err := db.UpdateMedia(m, newMediaEvent(EventMediaUpdated, m, 1, "Ann")); err != nil {
+		t.Fatal(err)
+	}
+	// A failed change adds no events.
+	ghost := &Media{ID: id + 100}
+	if err := db.UpdateMedia(ghost, newMediaEvent(EventMediaUpdated, ghost, 1, "Ann")); !errors.Is(err, errNotFound) {
+		t.Fatalf("UpdateMedia of unknown media: got %v, want errNotFound", err)
+	}
+
+	events, err := db.ListOutbox(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Type != EventMediaCreated || events[1].Type != EventMediaUpdated {
+		t.Fatalf("ListOutbox = %v, want created then updated", events)
+	}
+	if e := events[0]; e.MediaID != id || e.Media == nil || e.Media.Title != "Alien" {
+		t.Errorf("created event = %+v, want media %d Alien", e, id)
+	}
+	if err := db.DeleteOutbox(events[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if events, err = db.ListOutbox(10); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != EventMediaUpdated {
+		t.Errorf("ListOutbox after delete = %v, want only updated", events)
+	}
+}
+
+func TestDatastoreDBPageMedia(t *testing.T) {
+	db := newEmulatorDB(t)
+	for _, m := range []*Media{
+		{Title: "E", MediaType: "Film", InclusionScore: 2, ReleaseDate: "1979",
+			CreatedDate: "05-01-2020", Bechdel: bechdelAtLevel(2)},
+		{Title: "A", MediaType: "Film", InclusionScore: 5, ReleaseDate: "1979", CreatedDate: "01-01-2020"},
+		{Title: "D", MediaType: "TV", InclusionScore: 5, ReleaseDate: "2016", CreatedDate: "04-01-2020"},
+		{Title: "C", MediaType: "Film", InclusionScore: 1, ReleaseDate: "1995", CreatedDate: "03-01-2020"},
+		{Title: "B", MediaType: "Film", InclusionScore: 3, ReleaseDate: "1986",
+			CreatedDate: "02-01-2020", Bechdel: bechdelAtLevel(1)},
+		{Title: "BB", MediaType: "Film", ReleaseDate: "1979", CreatedDate: "06-01-2020"},
+	} {
+		if _, err := db.AddMedia(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Pages skip media in the trash.
+	trashed, err := db.QueryMedia(&MediaQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range trashed {
+		if m.Title == "BB" {
+			if err := db.DeleteMedia(m.ID, 0, ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Every filter and order /media/list links to can be paged.
+	for _, tt := range []struct {
+		name  string
+		q     *MediaQuery
+		size  int
+		pages [][]string
+	}{
+		{"all", &MediaQuery{}, 2, [][]string{{"A", "B"}, {"C", "D"}, {"E"}}},
+		{"filtered", &MediaQuery{MediaType: "Film"}, 2, [][]string{{"A", "B"}, {"C", "E"}}},
+		{"by score", &MediaQuery{Sort: sortScore, MinScore: 2}, 3, [][]string{{"A", "D", "B"}, {"E"}}},
+		{"min score by title", &MediaQuery{MinScore: 2}, 3, [][]string{{"A", "B", "D"}, {"E"}}},
+		{"decade", &MediaQuery{Decade: 1970}, 1, [][]string{{"A"}, {"E"}}},
+		{"failing bechdel", &MediaQuery{Bechdel: "fail"}, 2, [][]string{{"B", "E"}}},
+		{"by release", &MediaQuery{Sort: sortRelease}, 2, [][]string{{"D", "C"}, {"B", "A"}, {"E"}}},
+		{"by date added", &MediaQuery{Sort: sortAdded}, 2, [][]string{{"E", "D"}, {"C", "B"}, {"A"}}},
+		{"none", &MediaQuery{MediaType: "Radio"}, 10, [][]string{nil}},
+	} {
+		cursor := ""
+		for i, want := range tt.pages {
+			page, err := db.PageMedia(tt.q, cursor, tt.size)
+			if err != nil {
+				t.Fatalf("%s: page %d: %v", tt.name, i, err)
+			}
+			var titles []string
+			for _, m := range page.Media {
+				titles = append(titles, m.Title)
+			}
+			if !reflect.DeepEqual(titles, want) {
+				t.Errorf("%s: page %d = %v, want %v", tt.name, i, titles, want)
+			}
+			if last := i == len(tt.pages)-1; last != (page.Next == "") {
+				t.Errorf("%s: page %d has next cursor %q", tt.name, i, page.Next)
+			}
+			cursor = page.Next
+		}
+	}
+
+	if _, err := db.PageMedia(&MediaQuery{}, "garbage", 2); !errors.Is(err, errBadCursor) {
+		t.Errorf("PageMedia with a garbage cursor = %v, want errBadCursor", err)
+	}
+}
+
+func TestDatastoreDBCountMedia(t *testing.T) {
+	db := newEmulatorDB(t)
+	addFacetMedia(t, db)
+	for _, tt := range facetCountTests {
+		got, err := db.CountMedia(context.Background(), &tt.q, tt.facet)
+		if err != nil {
+			t.Fatalf("CountMedia(%+v, %s): %v", tt.q, tt.facet, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("CountMedia(%+v, %s) = %v, want %v", tt.q, tt.facet, got, tt.want)
+		}
+	}
+
+	// Media saved before the derived properties is counted once the
+	// database is opened again.
+	ctx := context.Background()
+	props, err := datastore.SaveStruct(&Media{Title: "Heat", MediaType: "Film", ReleaseDate: "1995"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := datastore.PropertyList(props)
+	if _, err := db.client.Put(ctx, datastore.IncompleteKey(mediaKind, nil), &old); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.client.Delete(ctx, datastore.NameKey(schemaKind, mediaKind, nil)); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := newDatastoreDB(db.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := reopened.CountMedia(context.Background(), &MediaQuery{MediaType: "Film"}, facetDecade)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"1970": 1, "1980": 1, "1990": 1, "2010": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CountMedia of film decades after migrating = %v, want %v", got, want)
+	}
+	// The tags are counted again too, leaving out the media in the trash.
+	got, err = reopened.CountMedia(context.Background(), &MediaQuery{}, facetTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"space": 3, "horror": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CountMedia of tags after migrating = %v, want %v", got, want)
+	}
+}
+
+func TestDatastoreDBTagCounts(t *testing.T) {
+	db := newEmulatorDB(t)
+	m := &Media{Title: "Alien", Tags: []string{"space", "horror"}}
+	if _, err := db.AddMedia(m); err != nil {
+		t.Fatal(err)
+	}
+	m.Tags = []string{"space", "space", "classic"}
+	if err := db.UpdateMedia(m); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.CountMedia(context.Background(), &MediaQuery{}, facetTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"space": 1, "classic": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tag counts after update = %v, want %v", got, want)
+	}
+
+	if err := db.DeleteMedia(m.ID, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = db.CountMedia(context.Background(), &MediaQuery{}, facetTag); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("tag counts after delete = %v, want none", got)
+	}
+	if err := db.RestoreMedia(m.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = db.CountMedia(context.Background(), &MediaQuery{}, facetTag); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"space": 1, "classic": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tag counts after restore = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,935 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Ensure memoryDB conforms to the MediaDatabase interface.
+var _ MediaDatabase = &memoryDB{}
+
+// memoryDB is a simple in-memory persistence layer for media. It is used for
+// local development and for running the handlers without a database.
+type memoryDB struct {
+	mu     sync.Mutex
+	nextID int64            // next ID to assign to media.
+	media  map[int64]*Media // maps from Media ID to Media.
+
+	// People, characters and credits share one ID sequence.
+	nextPeopleID int64
+	people       map[int64]*Person
+	characters   map[int64]*Character
+	credits      map[int64]*Credit
+
+	nextUserID int64
+	users      map[int64]*User
+
+	// Submissions keep their media as JSON, like the other backends, so
+	// they do not share it with the callers.
+	nextSubmissionID int64
+	submissions      map[int64]*Submission
+	submissionMedia  map[int64]string
+
+	// Revisions keep their media as JSON too.
+	nextRevisionID int64
+	revisions      map[int64]*Revision
+	revisionMedia  map[int64]string
+
+	// Events wait in the outbox as JSON, see events.go.
+	nextEventID int64
+	outbox      map[int64]string
+}
+
+// newMemoryDB creates a new MediaDatabase backed by memory.
+func newMemoryDB() *memoryDB {
+	return &memoryDB{
+		media:  make(map[int64]*Media),
+		nextID: 1,
+
+		nextPeopleID: 1,
+		people:       make(map[int64]*Person),
+		characters:   make(map[int64]*Character),
+		credits:      make(map[int64]*Credit),
+
+		nextUserID: 1,
+		users:      make(map[int64]*User),
+
+		nextSubmissionID: 1,
+		submissions:      make(map[int64]*Submission),
+		submissionMedia:  make(map[int64]string),
+
+		nextRevisionID: 1,
+		revisions:      make(map[int64]*Revision),
+		revisionMedia:  make(map[int64]string),
+
+		nextEventID: 1,
+		outbox:      make(map[int64]string),
+	}
+}
+
+// Close closes the database.
+func (db *memoryDB) Close() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.media = nil
+	db.people = nil
+	db.characters = nil
+	db.credits = nil
+	db.users = nil
+	db.submissions = nil
+	db.submissionMedia = nil
+	db.revisions = nil
+	db.revisionMedia = nil
+	db.outbox = nil
+}
+
+// GetMedia retrieves media by its ID.
+func (db *memoryDB) GetMedia(id int64) (*Media, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	media, ok := db.media[id]
+	if !ok || !media.DeletedAt.IsZero() {
+		return nil, fmt.Errorf("memorydb: media with ID %d %w", id, errNotFound)
+	}
+	return copyMedia(media), nil
+}
+
+// copyMedia returns a copy of m that shares none of its slices, so media is
+// not changed through the copies the store hands out or keeps. Credits are
+// kept separately and left out.
+func copyMedia(m *Media) *Media {
+	c := *m
+	c.Assessments = append([]Evaluation(nil), m.Assessments...)
+	c.Tags = append([]string(nil), m.Tags...)
+	c.Credits = nil
+	return &c
+}
+
+// AddMedia saves a given media, assigning it a new ID.
+func (db *memoryDB) AddMedia(m *Media, events ...*Event) (id int64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	m.ID = db.nextID
+	setEventMediaID(events, m.ID)
+	outbox, err := marshalOutbox(events)
+	if err != nil {
+		return 0, err
+	}
+	db.addOutboxLocked(outbox)
+	db.media[m.ID] = copyMedia(m)
+
+	db.nextID++
+
+	return m.ID, nil
+}
+
+// DeleteMedia moves a given media to the trash.
+func (db *memoryDB) DeleteMedia(id int64, byID int64, by string, events ...*Event) error {
+	if id == 0 {
+		return errors.New("memorydb: media with unassigned ID passed into deleteMedia")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	m, ok := db.media[id]
+	if !ok || !m.DeletedAt.IsZero() {
+		return fmt.Errorf("memorydb: could not delete media with ID %d: %w", id, errNotFound)
+	}
+	outbox, err := marshalOutbox(events)
+	if err != nil {
+		return err
+	}
+	db.addOutboxLocked(outbox)
+	m.DeletedAt, m.DeletedByID, m.DeletedBy = time.Now(), byID, by
+	return nil
+}
+
+// ListDeletedMedia returns the media in the trash, most recently deleted
+// first.
+func (db *memoryDB) ListDeletedMedia() ([]*Media, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var mediaList []*Media
+	for _, media := range db.media {
+		if media.DeletedAt.IsZero() {
+			continue
+		}
+		mediaList = append(mediaList, copyMedia(media))
+	}
+	sortDeletedMedia(mediaList)
+	return mediaList, nil
+}
+
+// RestoreMedia takes a given media out of the trash.
+func (db *memoryDB) RestoreMedia(id int64, events ...*Event) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	m, ok := db.media[id]
+	if !ok || m.DeletedAt.IsZero() {
+		return fmt.Errorf("memorydb: media with ID %d in the trash %w", id, errNotFound)
+	}
+	outbox, err := marshalOutbox(events)
+	if err != nil {
+		return err
+	}
+	db.addOutboxLocked(outbox)
+	m.DeletedAt, m.DeletedByID, m.DeletedBy = time.Time{}, 0, ""
+	return nil
+}
+
+// PurgeMedia permanently removes a given media in the trash.
+func (db *memoryDB) PurgeMedia(id int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if m, ok := db.media[id]; !ok || m.DeletedAt.IsZero() {
+		return fmt.Errorf("memorydb: media with ID %d in the trash %w", id, errNotFound)
+	}
+	delete(db.media, id)
+	for cid, c := range db.characters {
+		if c.MediaID == id {
+			db.deleteCharacterLocked(cid)
+		}
+	}
+	for cid, c := range db.credits {
+		if c.MediaID == id {
+			delete(db.credits, cid)
+		}
+	}
+	return nil
+}
+
+// UpdateMedia updates the entry for a given media.
+func (db *memoryDB) UpdateMedia(m *Media, events ...*Event) error {
+	if m.ID == 0 {
+		return errors.New("memorydb: media with unassigned ID passed into updateMedia")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if old, ok := db.media[m.ID]; !ok || !old.DeletedAt.IsZero() {
+		return fmt.Errorf("memorydb: could not update media with ID %d: %w", m.ID, errNotFound)
+	}
+	outbox, err := marshalOutbox(events)
+	if err != nil {
+		return err
+	}
+	db.addOutboxLocked(outbox)
+	db.media[m.ID] = copyMedia(m)
+	return nil
+}
+
+// ChangeMedia reads a given media and saves the changes change makes to it.
+func (db *memoryDB) ChangeMedia(id int64, change func(m *Media) (bool, []*Event)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	old, ok := db.media[id]
+	if !ok || !old.DeletedAt.IsZero() {
+		return fmt.Errorf("memorydb: could not change media with ID %d: %w", id, errNotFound)
+	}
+	m := copyMedia(old)
+	changed, events := change(m)
+	if !changed {
+		return nil
+	}
+	outbox, err := marshalOutbox(events)
+	if err != nil {
+		return err
+	}
+	db.addOutboxLocked(outbox)
+	m.ID = id
+	db.media[id] = copyMedia(m)
+	return nil
+}
+
+// mediaByTitle implements sort.Interface, ordering media by Title.
+// Media with the same title are ordered by ID so the listing is stable.
+// https://golang.org/pkg/sort/#example__sortWrapper
+type mediaByTitle []*Media
+
+func (s mediaByTitle) Len() int      { return len(s) }
+func (s mediaByTitle) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s mediaByTitle) Less(i, j int) bool {
+	if s[i].Title != s[j].Title {
+		return s[i].Title < s[j].Title
+	}
+	return s[i].ID < s[j].ID
+}
+
+// ListMedia returns a list of media, ordered by title.
+func (db *memoryDB) ListMedia() ([]*Media, error) {
+	return db.listMedia(func(*Media) bool { return true })
+}
+
+// ListMediaCreatedBy returns a list of media, ordered by title, filtered by
+// the user who created the media entry.
+func (db *memoryDB) ListMediaCreatedBy(userID int64) ([]*Media, error) {
+	if userID == 0 {
+		return db.ListMedia()
+	}
+	return db.listMedia(func(m *Media) bool { return m.CreatedByID == userID })
+}
+
+// QueryMedia returns the media matching q, in the order it asks for.
+func (db *memoryDB) QueryMedia(q *MediaQuery) ([]*Media, error) {
+	media, err := db.listMedia(q.matches)
+	if err != nil {
+		return nil, err
+	}
+	return filterMedia(media, q), nil
+}
+
+// CountMedia returns the number of media matching q with each value of
+// facet, counting the stored media without copying it.
+func (db *memoryDB) CountMedia(ctx context.Context, q *MediaQuery, facet string) (map[string]int, error) {
+	values, ok := facetValues[facet]
+	if !ok {
+		return nil, fmt.Errorf("memorydb: no facet %q", facet)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	counts := make(map[string]int)
+	for _, m := range db.media {
+		if !m.DeletedAt.IsZero() || !q.matches(m) {
+			continue
+		}
+		for _, v := range values(m) {
+			counts[v]++
+		}
+	}
+	return counts, nil
+}
+
+// PageMedia returns the page of size media matching q that follows cursor.
+// Only the media of the page is copied.
+func (db *memoryDB) PageMedia(q *MediaQuery, cursor string, size int) (*MediaPage, error) {
+	after, err := decodeCursor(cursor, q.Sort)
+	if err != nil {
+		return nil, fmt.Errorf("memorydb: %w", err)
+	}
+	keys := mediaSortKeys[q.Sort]
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var media []*Media
+	for _, m := range db.media {
+		if m.DeletedAt.IsZero() && q.matches(m) && (after == nil || compareMedia(keys, m, after) > 0) {
+			media = append(media, m)
+		}
+	}
+	sort.Slice(media, func(i, j int) bool {
+		return compareMedia(keys, media[i], sortValues(keys, media[j])) < 0
+	})
+	// One more than the page tells whether there is a following page.
+	if len(media) > size+1 {
+		media = media[:size+1]
+	}
+	for i, m := range media {
+		media[i] = copyMedia(m)
+	}
+	return trimPage(media, q, size), nil
+}
+
+// listMedia returns copies of the stored media accepted by keep, ordered by
+// title.
+func (db *memoryDB) listMedia(keep func(*Media) bool) ([]*Media, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var mediaList []*Media
+	for _, media := range db.media {
+		if !media.DeletedAt.IsZero() || !keep(media) {
+			continue
+		}
+		mediaList = append(mediaList, copyMedia(media))
+	}
+
+	sort.Sort(mediaByTitle(mediaList))
+	return mediaList, nil
+}
+
+/*---------------------------  People  ---------------------------*/
+
+// ListPeople returns a list of people, ordered by name.
+func (db *memoryDB) ListPeople() ([]*Person, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var people []*Person
+	for _, person := range db.people {
+		p := *person
+		people = append(people, &p)
+	}
+	sort.Slice(people, func(i, j int) bool {
+		if people[i].Name != people[j].Name {
+			return people[i].Name < people[j].Name
+		}
+		return people[i].ID < people[j].ID
+	})
+	return people, nil
+}
+
+// GetPerson retrieves a person by its ID.
+func (db *memoryDB) GetPerson(id int64) (*Person, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	person, ok := db.people[id]
+	if !ok {
+		return nil, fmt.Errorf("memorydb: person with ID %d %w", id, errNotFound)
+	}
+	p := *person
+	return &p, nil
+}
+
+// AddPerson saves a given person, assigning it a new ID.
+func (db *memoryDB) AddPerson(p *Person) (id int64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	p.ID = db.nextPeopleID
+	db.nextPeopleID++
+	stored := *p
+	db.people[p.ID] = &stored
+	return p.ID, nil
+}
+
+// UpdatePerson updates the entry for a given person.
+func (db *memoryDB) UpdatePerson(p *Person) error {
+	if p.ID == 0 {
+		return errors.New("memorydb: person with unassigned ID passed into updatePerson")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.people[p.ID]; !ok {
+		return fmt.Errorf("memorydb: could not update person with ID %d: %w", p.ID, errNotFound)
+	}
+	stored := *p
+	db.people[p.ID] = &stored
+	return nil
+}
+
+// DeletePerson removes a given person, and their credits, by ID.
+func (db *memoryDB) DeletePerson(id int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.people[id]; !ok {
+		return fmt.Errorf("memorydb: could not delete person with ID %d: %w", id, errNotFound)
+	}
+	delete(db.people, id)
+	for cid, c := range db.credits {
+		if c.PersonID == id {
+			delete(db.credits, cid)
+		}
+	}
+	return nil
+}
+
+/*---------------------------  Characters  ---------------------------*/
+
+// ListCharacters returns the characters of the given media, ordered by name.
+func (db *memoryDB) ListCharacters(mediaID int64) ([]*Character, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var chars []*Character
+	for _, character := range db.characters {
+		if character.MediaID != mediaID {
+			continue
+		}
+		c := *character
+		c.Evaluations = append([]Evaluation(nil), character.Evaluations...)
+		chars = append(chars, &c)
+	}
+	sort.Slice(chars, func(i, j int) bool {
+		if chars[i].Name != chars[j].Name {
+			return chars[i].Name < chars[j].Name
+		}
+		return chars[i].ID < chars[j].ID
+	})
+	return chars, nil
+}
+
+// GetCharacter retrieves a character by its ID.
+func (db *memoryDB) GetCharacter(id int64) (*Character, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	character, ok := db.characters[id]
+	if !ok {
+		return nil, fmt.Errorf("memorydb: character with ID %d %w", id, errNotFound)
+	}
+	c := *character
+	c.Evaluations = append([]Evaluation(nil), character.Evaluations...)
+	return &c, nil
+}
+
+// AddCharacter saves a given character, assigning it a new ID.
+func (db *memoryDB) AddCharacter(c *Character) (id int64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c.ID = db.nextPeopleID
+	db.nextPeopleID++
+	stored := *c
+	stored.Evaluations = append([]Evaluation(nil), c.Evaluations...)
+	db.characters[c.ID] = &stored
+	return c.ID, nil
+}
+
+// UpdateCharacter updates the entry for a given character.
+func (db *memoryDB) UpdateCharacter(c *Character) error {
+	if c.ID == 0 {
+		return errors.New("memorydb: character with unassigned ID passed into updateCharacter")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.characters[c.ID]; !ok {
+		return fmt.Errorf("memorydb: could not update character with ID %d: %w", c.ID, errNotFound)
+	}
+	stored := *c
+	stored.Evaluations = append([]Evaluation(nil), c.Evaluations...)
+	db.characters[c.ID] = &stored
+	return nil
+}
+
+// DeleteCharacter removes a given character by its ID.
+func (db *memoryDB) DeleteCharacter(id int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.characters[id]; !ok {
+		return fmt.Errorf("memorydb: could not delete character with ID %d: %w", id, errNotFound)
+	}
+	db.deleteCharacterLocked(id)
+	return nil
+}
+
+// deleteCharacterLocked removes a character and unlinks it from its credits.
+// db.mu must be held.
+func (db *memoryDB) deleteCharacterLocked(id int64) {
+	delete(db.characters, id)
+	for _, c := range db.credits {
+		if c.CharacterID == id {
+			c.CharacterID = 0
+		}
+	}
+}
+
+/*---------------------------  Credits  ---------------------------*/
+
+// ListCredits returns the credits of the given media, or of all media when
+// mediaID is 0, ordered by ID.
+func (db *memoryDB) ListCredits(mediaID int64) ([]*Credit, error) {
+	return db.listCredits(func(c *Credit) bool { return mediaID == 0 || c.MediaID == mediaID })
+}
+
+// ListPersonCredits returns the credits of the given person, ordered by ID.
+func (db *memoryDB) ListPersonCredits(personID int64) ([]*Credit, error) {
+	return db.listCredits(func(c *Credit) bool { return c.PersonID == personID })
+}
+
+func (db *memoryDB) listCredits(keep func(*Credit) bool) ([]*Credit, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var credits []*Credit
+	for _, credit := range db.credits {
+		if !keep(credit) {
+			continue
+		}
+		c := *credit
+		credits = append(credits, &c)
+	}
+	sort.Slice(credits, func(i, j int) bool { return credits[i].ID < credits[j].ID })
+	return credits, nil
+}
+
+// AddCredit saves a given credit, assigning it a new ID.
+func (db *memoryDB) AddCredit(c *Credit) (id int64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.media[c.MediaID]; !ok {
+		return 0, fmt.Errorf("memorydb: could not add credit, media with ID %d does not exist", c.MediaID)
+	}
+	if _, ok := db.people[c.PersonID]; !ok {
+		return 0, fmt.Errorf("memorydb: could not add credit, person with ID %d does not exist", c.PersonID)
+	}
+
+	c.ID = db.nextPeopleID
+	db.nextPeopleID++
+	stored := *c
+	stored.Person, stored.Character = nil, nil
+	db.credits[c.ID] = &stored
+	return c.ID, nil
+}
+
+// DeleteCredit removes a given credit by its ID.
+func (db *memoryDB) DeleteCredit(id int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.credits[id]; !ok {
+		return fmt.Errorf("memorydb: could not delete credit with ID %d: %w", id, errNotFound)
+	}
+	delete(db.credits, id)
+	return nil
+}
+
+/*---------------------------  Users  ---------------------------*/
+
+// GetUser retrieves a user by its ID.
+func (db *memoryDB) GetUser(id int64) (*User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	user, ok := db.users[id]
+	if !ok {
+		return nil, fmt.Errorf("memorydb: user with ID %d %w", id, errNotFound)
+	}
+	u := *user
+	return &u, nil
+}
+
+// GetUserByIdentity retrieves the user with the given identity.
+func (db *memoryDB) GetUserByIdentity(issuer, subject string) (*User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, user := range db.users {
+		if user.Issuer == issuer && user.Subject == subject {
+			u := *user
+			return &u, nil
+		}
+	}
+	return nil, fmt.Errorf("memorydb: user %s at %s %w", subject, issuer, errNotFound)
+}
+
+// AddUser saves a given user, assigning it a new ID.
+func (db *memoryDB) AddUser(u *User) (id int64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, user := range db.users {
+		if user.Issuer == u.Issuer && user.Subject == u.Subject {
+			return 0, fmt.Errorf("memorydb: user %s at %s already exists", u.Subject, u.Issuer)
+		}
+	}
+	u.ID = db.nextUserID
+	db.nextUserID++
+	stored := *u
+	db.users[u.ID] = &stored
+	return u.ID, nil
+}
+
+// UpdateUser updates the entry for a given user.
+func (db *memoryDB) UpdateUser(u *User) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.users[u.ID]; !ok {
+		return fmt.Errorf("memorydb: could not update user with ID %d, does not exist", u.ID)
+	}
+	stored := *u
+	db.users[u.ID] = &stored
+	return nil
+}
+
+// ListUsers returns all the users, ordered by ID.
+func (db *memoryDB) ListUsers() ([]*User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var users []*User
+	for _, user := range db.users {
+		u := *user
+		users = append(users, &u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+/*---------------------------  Submissions  ---------------------------*/
+
+// GetSubmission retrieves a submission by its ID.
+func (db *memoryDB) GetSubmission(id int64) (*Submission, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.submissions[id]; !ok {
+		return nil, fmt.Errorf("memorydb: submission with ID %d %w", id, errNotFound)
+	}
+	return db.submission(id)
+}
+
+// submission returns a copy of the stored submission with the given ID. The
+// caller must hold db.mu.
+func (db *memoryDB) submission(id int64) (*Submission, error) {
+	s := *db.submissions[id]
+	var err error
+	if s.Media, err = unmarshalMedia(db.submissionMedia[id]); err != nil {
+		return nil, fmt.Errorf("memorydb: could not read submission media: %v", err)
+	}
+	return &s, nil
+}
+
+// ListSubmissions returns the submissions with the given status, oldest
+// first.
+func (db *memoryDB) ListSubmissions(status SubmissionStatus) ([]*Submission, error) {
+	return db.listSubmissions(func(s *Submission) bool { return s.Status == status }, false)
+}
+
+// ListSubmissionsBy returns the submissions of the given user, newest first.
+func (db *memoryDB) ListSubmissionsBy(userID int64) ([]*Submission, error) {
+	return db.listSubmissions(func(s *Submission) bool { return s.SubmittedByID == userID }, true)
+}
+
+// listSubmissions returns the submissions matching keep, oldest or newest
+// first.
+func (db *memoryDB) listSubmissions(keep func(*Submission) bool, newestFirst bool) ([]*Submission, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var list []*Submission
+	for id, s := range db.submissions {
+		if !keep(s) {
+			continue
+		}
+		c, err := db.submission(id)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	sortSubmissions(list, newestFirst)
+	return list, nil
+}
+
+// AddSubmission saves a given submission, assigning it a new ID.
+func (db *memoryDB) AddSubmission(s *Submission) (id int64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	media, err := marshalMedia(s.Media)
+	if err != nil {
+		return 0, fmt.Errorf("memorydb: could not store submission media: %v", err)
+	}
+	s.ID = db.nextSubmissionID
+	db.nextSubmissionID++
+	stored := *s
+	stored.Media = nil
+	db.submissions[s.ID] = &stored
+	db.submissionMedia[s.ID] = media
+	return s.ID, nil
+}
+
+// UpdateSubmission updates the entry for a given submission.
+func (db *memoryDB) UpdateSubmission(s *Submission, events ...*Event) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.submissions[s.ID]; !ok {
+		return fmt.Errorf("memorydb: could not update submission with ID %d, does not exist", s.ID)
+	}
+	media, err := marshalMedia(s.Media)
+	if err != nil {
+		return fmt.Errorf("memorydb: could not store submission media: %v", err)
+	}
+	outbox, err := marshalOutbox(events)
+	if err != nil {
+		return err
+	}
+	db.addOutboxLocked(outbox)
+	stored := *s
+	stored.Media = nil
+	db.submissions[s.ID] = &stored
+	db.submissionMedia[s.ID] = media
+	return nil
+}
+
+// AddSubmittedMedia saves the media of a submission of new media, and the
+// submission with its ID, together.
+func (db *memoryDB) AddSubmittedMedia(s *Submission, m *Media, events ...*Event) (id int64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.submissions[s.ID]; !ok {
+		return 0, fmt.Errorf("memorydb: could not update submission with ID %d, does not exist", s.ID)
+	}
+	media, err := marshalMedia(s.Media)
+	if err != nil {
+		return 0, fmt.Errorf("memorydb: could not store submission media: %v", err)
+	}
+	m.ID = db.nextID
+	setEventMediaID(events, m.ID)
+	outbox, err := marshalOutbox(events)
+	if err != nil {
+		return 0, err
+	}
+	db.addOutboxLocked(outbox)
+	db.media[m.ID] = copyMedia(m)
+	db.nextID++
+
+	s.MediaID = m.ID
+	stored := *s
+	stored.Media = nil
+	db.submissions[s.ID] = &stored
+	db.submissionMedia[s.ID] = media
+	return m.ID, nil
+}
+
+/*---------------------------  Revisions  ---------------------------*/
+
+// GetRevision retrieves a revision by its ID.
+func (db *memoryDB) GetRevision(id int64) (*Revision, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.revisions[id]; !ok {
+		return nil, fmt.Errorf("memorydb: revision with ID %d %w", id, errNotFound)
+	}
+	return db.revision(id)
+}
+
+// revision returns a copy of the stored revision with the given ID. The
+// caller must hold db.mu.
+func (db *memoryDB) revision(id int64) (*Revision, error) {
+	r := *db.revisions[id]
+	var err error
+	if r.Media, err = unmarshalMedia(db.revisionMedia[id]); err != nil {
+		return nil, fmt.Errorf("memorydb: could not read revision media: %v", err)
+	}
+	return &r, nil
+}
+
+// ListRevisions returns the revisions of the given media, oldest first.
+func (db *memoryDB) ListRevisions(mediaID int64) ([]*Revision, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var list []*Revision
+	for id, r := range db.revisions {
+		if r.MediaID != mediaID {
+			continue
+		}
+		c, err := db.revision(id)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+// AddRevision saves a given revision, assigning it a new ID.
+func (db *memoryDB) AddRevision(r *Revision) (id int64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	media, err := marshalMedia(r.Media)
+	if err != nil {
+		return 0, fmt.Errorf("memorydb: could not store revision media: %v", err)
+	}
+	r.ID = db.nextRevisionID
+	db.nextRevisionID++
+	stored := *r
+	stored.Media = nil
+	db.revisions[r.ID] = &stored
+	db.revisionMedia[r.ID] = media
+	return r.ID, nil
+}
+
+/*---------------------------  Outbox  ---------------------------*/
+
+// marshalOutbox returns events as they are kept in the outbox, before
+// anything is changed, so the change fails as a whole if one cannot be.
+func marshalOutbox(events []*Event) ([]string, error) {
+	var outbox []string
+	for _, e := range events {
+		data, err := marshalEvent(e)
+		if err != nil {
+			return nil, fmt.Errorf("memorydb: could not store event: %v", err)
+		}
+		outbox = append(outbox, data)
+	}
+	return outbox, nil
+}
+
+// addOutboxLocked adds the events returned by marshalOutbox to the outbox.
+// db.mu must be held.
+func (db *memoryDB) addOutboxLocked(outbox []string) {
+	for _, data := range outbox {
+		db.outbox[db.nextEventID] = data
+		db.nextEventID++
+	}
+}
+
+// ListOutbox returns up to n events waiting to be published, oldest first.
+func (db *memoryDB) ListOutbox(n int) ([]*Event, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var ids []int64
+	for id := range db.outbox {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	var list []*Event
+	for _, id := range ids {
+		e, err := unmarshalEvent(db.outbox[id])
+		if err != nil {
+			return nil, fmt.Errorf("memorydb: could not read event %d: %v", id, err)
+		}
+		e.ID = id
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+// DeleteOutbox removes a published event from the outbox.
+func (db *memoryDB) DeleteOutbox(id int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(db.outbox, id)
+	return nil
+}
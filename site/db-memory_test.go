@@ -0,0 +1,50 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMemoryDBCopies(t *testing.T) {
+	db := newMemoryDB()
+	m := &Media{Title: "Alien", Tags: []string{"space"}, Assessments: []Evaluation{{Criterion: "a", Verdict: "yes"}}}
+	id, err := db.AddMedia(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Changing the caller's media after saving it changes nothing stored.
+	m.Tags[0] = "changed"
+	m.Assessments[0].Verdict = "changed"
+
+	got, err := db.GetMedia(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Tags, []string{"space"}) || got.Assessments[0].Verdict != "yes" {
+		t.Fatalf("stored media changed through the caller: %+v", got)
+	}
+	// Nor does changing what was read.
+	got.Tags[0] = "read"
+	got.Assessments[0].Verdict = "read"
+	list, err := db.ListMedia()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list[0].Tags[0] != "space" || list[0].Assessments[0].Verdict != "yes" {
+		t.Fatalf("stored media changed through a read copy: %+v", list[0])
+	}
+}
@@ -0,0 +1,502 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+/*---------------------------  Migrations  ---------------------------*/
+
+// migration is one numbered step of the PostgreSQL schema. Migrations are
+// applied in version order, each in its own transaction, and recorded in the
+// schema_version table. Never edit a migration that has shipped; add a new one.
+type migration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+// pgMigrations is the full history of the PostgreSQL schema.
+//
+// When adding a migration, update pgSchema below to match.
+var pgMigrations = []migration{
+	{1, "create media", []string{
+		// Adopts the hand-created table, so IF NOT EXISTS.
+		`CREATE TABLE IF NOT EXISTS media (
+			id INT PRIMARY KEY,
+			title VARCHAR(255) NULL,
+			description TEXT NULL,
+			mediaType VARCHAR(255) NULL,
+			industry VARCHAR(255) NULL,
+			releaseDate VARCHAR(255) NULL,
+			actorId INT NULL,
+			characterId INT NULL,
+			directorId INT NULL,
+			imageURL VARCHAR(255) NULL,
+			bechdel VARCHAR(255) NULL,
+			wikiURL VARCHAR(255) NULL,
+			imdbURL VARCHAR(255) NULL,
+			rottentomURL VARCHAR(255) NULL,
+			createdById INT NULL,
+			createdBy VARCHAR(255) NULL,
+			createdDate VARCHAR(255) NULL
+		)`,
+	}},
+	{2, "media id identity", []string{
+		// AddMedia relies on the database assigning IDs with RETURNING id.
+		`ALTER TABLE media ALTER COLUMN id TYPE BIGINT`,
+		`ALTER TABLE media ALTER COLUMN id ADD GENERATED BY DEFAULT AS IDENTITY`,
+		// Start after any rows created by hand before IDs were generated.
+		`SELECT setval(pg_get_serial_sequence('media', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM media`,
+	}},
+	{3, "people, characters and credits", []string{
+		`CREATE TABLE people (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			bio TEXT NULL
+		)`,
+		`CREATE INDEX people_name ON people (lower(name))`,
+		`CREATE TABLE characters (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			mediaId BIGINT NOT NULL REFERENCES media (id) ON DELETE CASCADE,
+			name VARCHAR(255) NOT NULL,
+			bio TEXT NULL
+		)`,
+		`CREATE INDEX characters_mediaId ON characters (mediaId)`,
+		`CREATE TABLE credits (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			mediaId BIGINT NOT NULL REFERENCES media (id) ON DELETE CASCADE,
+			personId BIGINT NOT NULL REFERENCES people (id) ON DELETE CASCADE,
+			role VARCHAR(64) NOT NULL,
+			characterId BIGINT NULL REFERENCES characters (id) ON DELETE SET NULL
+		)`,
+		`CREATE INDEX credits_mediaId ON credits (mediaId)`,
+		`CREATE INDEX credits_personId ON credits (personId)`,
+		// The old columns held placeholder numbers, not references.
+		`ALTER TABLE media DROP COLUMN actorId, DROP COLUMN characterId, DROP COLUMN directorId`,
+	}},
+	{4, "character evaluations", []string{
+		// JSON list of criteria evaluations, see characters.go.
+		`ALTER TABLE characters ADD COLUMN evaluations TEXT NULL`,
+	}},
+	{5, "media rubric assessments", []string{
+		// JSON list of assessments against the rubric, see rubric.go.
+		`ALTER TABLE media
+			ADD COLUMN rubricVersion INT NULL,
+			ADD COLUMN assessments TEXT NULL,
+			ADD COLUMN inclusionScore INT NOT NULL DEFAULT 0,
+			ADD COLUMN disqualified BOOLEAN NOT NULL DEFAULT FALSE`,
+		`CREATE INDEX media_inclusionScore ON media (inclusionScore)`,
+	}},
+	{6, "bechdel results", []string{
+		// bechdel was a VARCHAR holding a boolean the site always set to
+		// false, so only true is kept. It now holds the Bechdel level, see
+		// bechdel.go, NULL when unrated.
+		`ALTER TABLE media ALTER COLUMN bechdel TYPE SMALLINT
+			USING CASE WHEN lower(bechdel) IN ('true', 't', '1') THEN 3 END`,
+		`ALTER TABLE media
+			ADD COLUMN bechdelDisputed BOOLEAN NOT NULL DEFAULT FALSE,
+			ADD COLUMN bechdelSource VARCHAR(255) NULL,
+			ADD COLUMN bechdelSourceURL VARCHAR(255) NULL`,
+		`CREATE INDEX media_bechdel ON media (bechdel)`,
+	}},
+	{7, "media tags and release year", []string{
+		// tags is a JSON list, see media-query.go. releaseYear is the year
+		// of releaseDate, for the decade filter.
+		`ALTER TABLE media
+			ADD COLUMN tags TEXT NULL,
+			ADD COLUMN releaseYear INT NULL`,
+		`UPDATE media SET releaseYear =
+			CAST(substring(releaseDate FROM '(?:^|\D)((?:18|19|20)\d\d)(?:\D|$)') AS INT)`,
+		`CREATE INDEX media_releaseYear ON media (releaseYear)`,
+	}},
+	{8, "users", []string{
+		// Users are identified by the identity provider that logged them
+		// in, see auth.go.
+		`CREATE TABLE users (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			issuer VARCHAR(255) NOT NULL,
+			subject VARCHAR(255) NOT NULL,
+			name VARCHAR(255) NULL,
+			email VARCHAR(255) NULL,
+			createdDate VARCHAR(255) NULL,
+			UNIQUE (issuer, subject)
+		)`,
+	}},
+	{9, "user roles", []string{
+		// What users may do, see roles.go.
+		`ALTER TABLE users ADD COLUMN role VARCHAR(32) NOT NULL DEFAULT 'contributor'`,
+	}},
+	{10, "submissions", []string{
+		// Changes to media waiting for moderation, see submissions.go.
+		// media is the submitted media as JSON.
+		`CREATE TABLE submissions (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			mediaId BIGINT NULL,
+			media TEXT NOT NULL,
+			justification TEXT NULL,
+			status VARCHAR(32) NOT NULL,
+			submittedById BIGINT NULL,
+			submittedBy VARCHAR(255) NULL,
+			submittedDate VARCHAR(255) NULL,
+			reviewedById BIGINT NULL,
+			reviewedBy VARCHAR(255) NULL,
+			reviewedDate VARCHAR(255) NULL,
+			reason TEXT NULL
+		)`,
+		`CREATE INDEX submissions_status ON submissions (status, id)`,
+		`CREATE INDEX submissions_submittedById ON submissions (submittedById, id)`,
+	}},
+	{11, "revisions", []string{
+		// The history of each media item, see revisions.go. media is the
+		// media as the change left it, as JSON.
+		`CREATE TABLE revisions (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			mediaId BIGINT NOT NULL,
+			media TEXT NOT NULL,
+			deleted BOOLEAN NOT NULL DEFAULT false,
+			authorId BIGINT NULL,
+			author VARCHAR(255) NULL,
+			date TIMESTAMPTZ NOT NULL,
+			summary TEXT NULL
+		)`,
+		`CREATE INDEX revisions_mediaId ON revisions (mediaId, id)`,
+	}},
+	{12, "media trash", []string{
+		// Deleted media stays in the trash until it is purged, see trash.go.
+		`ALTER TABLE media ADD COLUMN deletedAt TIMESTAMPTZ NULL`,
+		`ALTER TABLE media ADD COLUMN deletedById BIGINT NULL`,
+		`ALTER TABLE media ADD COLUMN deletedBy VARCHAR(255) NULL`,
+		`CREATE INDEX media_deletedAt ON media (deletedAt) WHERE deletedAt IS NOT NULL`,
+	}},
+	{13, "outbox", []string{
+		// Events saved with the changes they are about, until they are
+		// published, see events.go.
+		`CREATE TABLE outbox (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			type VARCHAR(64) NOT NULL,
+			data TEXT NOT NULL,
+			created TIMESTAMPTZ NOT NULL
+		)`,
+	}},
+	{14, "revision submissions", []string{
+		// The submission that made each change, so approving one again
+		// does not record it twice, see applySubmission.
+		`ALTER TABLE revisions ADD COLUMN submissionId BIGINT NULL`,
+	}},
+}
+
+// pgSchema is the set of columns, per table, that the migrations above
+// produce. It is what checkSchemaDrift compares the live database against.
+// Postgres folds unquoted identifiers to lower case.
+var pgSchema = map[string][]string{
+	"media": {
+		"id", "title", "description", "mediatype", "industry", "releasedate",
+		"imageurl", "bechdel", "wikiurl", "imdburl", "rottentomurl",
+		"createdbyid", "createdby", "createddate",
+		"rubricversion", "assessments", "inclusionscore", "disqualified",
+		"bechdeldisputed", "bechdelsource", "bechdelsourceurl",
+		"tags", "releaseyear", "deletedat", "deletedbyid", "deletedby",
+	},
+	"people":     {"id", "name", "bio"},
+	"characters": {"id", "mediaid", "name", "bio", "evaluations"},
+	"credits":    {"id", "mediaid", "personid", "role", "characterid"},
+	"users":      {"id", "issuer", "subject", "name", "email", "createddate", "role"},
+	"submissions": {
+		"id", "mediaid", "media", "justification", "status",
+		"submittedbyid", "submittedby", "submitteddate",
+		"reviewedbyid", "reviewedby", "revieweddate", "reason",
+	},
+	"revisions": {
+		"id", "mediaid", "media", "deleted", "authorid", "author", "date", "summary",
+		"submissionid",
+	},
+	"outbox":         {"id", "type", "data", "created"},
+	"schema_version": {"version", "name", "applied_at"},
+}
+
+const createSchemaVersionStatement = `
+  CREATE TABLE IF NOT EXISTS schema_version (
+		version INT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`
+
+// hasSchemaVersionStatement tells whether schema_version exists, without
+// creating it, so checking the schema changes nothing.
+const hasSchemaVersionStatement = `
+  SELECT EXISTS (SELECT 1 FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_name = 'schema_version')`
+
+// migrationLock is the key of the PostgreSQL advisory lock migrate takes, so
+// that instances starting together with PgSQL_MIGRATE=true apply each
+// migration once. The value is arbitrary.
+const migrationLock = 0x66747301
+
+/*---------------------------  Core Functions  ---------------------------*/
+
+// latestVersion returns the version the migrations bring the schema to.
+func latestVersion(migrations []migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// appliedVersions returns the migration versions recorded in schema_version.
+// A database without schema_version has none.
+func appliedVersions(conn *sql.DB) (map[int]bool, error) {
+	var exists bool
+	if err := conn.QueryRow(hasSchemaVersionStatement).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("postgreSQL: could not look for schema_version: %v", err)
+	}
+	applied := make(map[int]bool)
+	if !exists {
+		return applied, nil
+	}
+
+	rows, err := conn.Query(`SELECT version FROM schema_version`)
+	if err != nil {
+		return nil, fmt.Errorf("postgreSQL: could not read schema_version: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			return nil, fmt.Errorf("postgreSQL: could not read schema_version: %v", err)
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
+
+// unapplied returns the migrations whose versions are not in applied.
+func unapplied(applied map[int]bool, migrations []migration) []migration {
+	var pending []migration
+	for _, m := range migrations {
+		if !applied[m.version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// pendingMigrations returns the migrations not yet applied to conn.
+func pendingMigrations(conn *sql.DB, migrations []migration) ([]migration, error) {
+	applied, err := appliedVersions(conn)
+	if err != nil {
+		return nil, err
+	}
+	return unapplied(applied, migrations), nil
+}
+
+// lockMigrations begins a transaction holding the migration lock, waiting
+// for any other process migrating the database to commit first.
+func lockMigrations(conn *sql.DB) (*sql.Tx, error) {
+	tx, err := conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLock); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("could not lock: %v", err)
+	}
+	return tx, nil
+}
+
+// migrate applies every pending migration in order. Each migration runs
+// under the migration lock and is skipped if another process applied it
+// while this one waited for the lock.
+func migrate(conn *sql.DB, migrations []migration) error {
+	tx, err := lockMigrations(conn)
+	if err != nil {
+		return fmt.Errorf("postgreSQL: could not create schema_version: %v", err)
+	}
+	if _, err := tx.Exec(createSchemaVersionStatement); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("postgreSQL: could not create schema_version: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("postgreSQL: could not create schema_version: %v", err)
+	}
+
+	pending, err := pendingMigrations(conn, migrations)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		applied, err := applyMigration(conn, m)
+		if err != nil {
+			return err
+		}
+		if applied {
+			log.Printf("Applied migration %d: %s", m.version, m.name)
+		}
+	}
+	return nil
+}
+
+// applyMigration applies m in a transaction holding the migration lock. It
+// returns false if m had already been applied.
+func applyMigration(conn *sql.DB, m migration) (bool, error) {
+	tx, err := lockMigrations(conn)
+	if err != nil {
+		return false, fmt.Errorf("postgreSQL: migration %d: %v", m.version, err)
+	}
+	var done bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_version WHERE version = $1)`,
+		m.version).Scan(&done); err != nil || done {
+		tx.Rollback()
+		if err != nil {
+			return false, fmt.Errorf("postgreSQL: migration %d: could not read schema_version: %v", m.version, err)
+		}
+		return false, nil
+	}
+	for _, stmt := range m.statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return false, fmt.Errorf("postgreSQL: migration %d (%s): %v", m.version, m.name, err)
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version (version, name) VALUES ($1, $2)`,
+		m.version, m.name); err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("postgreSQL: migration %d: could not record version: %v", m.version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("postgreSQL: migration %d: %v", m.version, err)
+	}
+	return true, nil
+}
+
+// ensureSchemaCurrent returns an error if conn is missing any migrations.
+func ensureSchemaCurrent(conn *sql.DB, migrations []migration) error {
+	pending, err := pendingMigrations(conn, migrations)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("postgreSQL: %d pending migrations (next is %d: %s); set PgSQL_MIGRATE=true or run with -migrate",
+			len(pending), pending[0].version, pending[0].name)
+	}
+	return nil
+}
+
+// checkSchemaDrift reports, to w, any difference between the live schema and
+// the one the migrations describe. It returns false if the schema drifted.
+// It only reads the database.
+func checkSchemaDrift(conn *sql.DB, w io.Writer) (bool, error) {
+	ok := true
+
+	applied, err := appliedVersions(conn)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range unapplied(applied, pgMigrations) {
+		fmt.Fprintf(w, "pending migration %d: %s\n", m.version, m.name)
+		ok = false
+	}
+	for v := range applied {
+		if v > latestVersion(pgMigrations) {
+			fmt.Fprintf(w, "database has migration %d, which this binary does not know about\n", v)
+			ok = false
+		}
+	}
+
+	rows, err := conn.Query(`SELECT table_name, column_name FROM information_schema.columns
+		WHERE table_schema = current_schema()`)
+	if err != nil {
+		return false, fmt.Errorf("postgreSQL: could not read columns: %v", err)
+	}
+	defer rows.Close()
+
+	live := make(map[string]map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return false, fmt.Errorf("postgreSQL: could not read columns: %v", err)
+		}
+		if live[table] == nil {
+			live[table] = make(map[string]bool)
+		}
+		live[table][column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("postgreSQL: could not read columns: %v", err)
+	}
+
+	var tables []string
+	for table := range pgSchema {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		want := make(map[string]bool)
+		for _, column := range pgSchema[table] {
+			want[column] = true
+			if !live[table][column] {
+				fmt.Fprintf(w, "%s: missing column %s\n", table, column)
+				ok = false
+			}
+		}
+		var extra []string
+		for column := range live[table] {
+			if !want[column] {
+				extra = append(extra, column)
+			}
+		}
+		sort.Strings(extra)
+		for _, column := range extra {
+			fmt.Fprintf(w, "%s: unexpected column %s\n", table, column)
+			ok = false
+		}
+	}
+
+	if ok {
+		fmt.Fprintf(w, "schema is at version %d, no drift\n", latestVersion(pgMigrations))
+	}
+	return ok, nil
+}
+
+// runSchemaCommand backs the -migrate and -check-schema flags. It connects
+// with the Cloud SQL settings from the environment and either applies the
+// pending migrations or reports drift.
+func runSchemaCommand(apply bool) error {
+	conn, err := cloudSQLConfigFromEnv().pgSQLConfig().open()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if apply {
+		return migrate(conn, pgMigrations)
+	}
+	ok, err := checkSchemaDrift(conn, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("postgreSQL: schema drift detected")
+	}
+	return nil
+}
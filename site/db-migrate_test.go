@@ -0,0 +1,140 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestPgConn returns a connection to an empty schema of its own in the
+// PostgreSQL server at PgSQL_TEST_DSN, a key=value connection string such as
+//
+//	host=localhost port=5432 user=postgres password=fts sslmode=disable
+//
+// for a server started with
+//
+//	docker run --rm -e POSTGRES_PASSWORD=fts -p 5432:5432 postgres
+//
+// The test is skipped when PgSQL_TEST_DSN is not set.
+func newTestPgConn(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("PgSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("PgSQL_TEST_DSN is not set")
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := fmt.Sprintf("fts_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+	conn, err := sql.Open("postgres", dsn+" search_path="+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestUnapplied(t *testing.T) {
+	migrations := []migration{{1, "a", nil}, {2, "b", nil}, {3, "c", nil}}
+	for _, tt := range []struct {
+		applied map[int]bool
+		want    []int
+	}{
+		{nil, []int{1, 2, 3}},
+		{map[int]bool{1: true}, []int{2, 3}},
+		{map[int]bool{2: true}, []int{1, 3}},
+		{map[int]bool{1: true, 2: true, 3: true, 4: true}, nil},
+	} {
+		var got []int
+		for _, m := range unapplied(tt.applied, migrations) {
+			got = append(got, m.version)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("unapplied(%v) = %v, want %v", tt.applied, got, tt.want)
+		}
+	}
+}
+
+func TestCheckSchemaDriftReadOnly(t *testing.T) {
+	conn := newTestPgConn(t)
+
+	var out bytes.Buffer
+	ok, err := checkSchemaDrift(conn, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || !strings.Contains(out.String(), "pending migration 1: create media") {
+		t.Errorf("checkSchemaDrift on an empty schema = %v:\n%s", ok, out.String())
+	}
+	var exists bool
+	if err := conn.QueryRow(hasSchemaVersionStatement).Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("checkSchemaDrift created schema_version")
+	}
+}
+
+// TestMigrateConcurrently starts several instances migrating at once, as
+// instances deployed with PgSQL_MIGRATE=true do.
+func TestMigrateConcurrently(t *testing.T) {
+	conn := newTestPgConn(t)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = migrate(conn, pgMigrations)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("migrate %d: %v", i, err)
+		}
+	}
+
+	var n int
+	if err := conn.QueryRow(`SELECT count(*) FROM schema_version`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(pgMigrations) {
+		t.Errorf("schema_version has %d rows, want %d", n, len(pgMigrations))
+	}
+	var out bytes.Buffer
+	if ok, err := checkSchemaDrift(conn, &out); err != nil || !ok {
+		t.Errorf("checkSchemaDrift after migrating = %v, %v:\n%s", ok, err, out.String())
+	}
+	if err := ensureSchemaCurrent(conn, pgMigrations); err != nil {
+		t.Error(err)
+	}
+}
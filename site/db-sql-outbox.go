@@ -0,0 +1,133 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+/*---------------------------  Statements  ---------------------------*/
+
+// The table is created by migration 13 in db-migrate.go. data is the event as
+// it is published, as JSON; type is kept beside it for people looking at the
+// table.
+
+const listOutboxStatement = `SELECT id, data FROM outbox ORDER BY id LIMIT $1`
+
+const insertOutboxStatement = `
+  INSERT INTO outbox (type, data, created) VALUES ($1, $2, $3)`
+
+const deleteOutboxStatement = `DELETE FROM outbox WHERE id = $1`
+
+// prepareOutbox prepares the outbox statements.
+func (db *pgsqlDB) prepareOutbox() error {
+	for _, s := range []struct {
+		stmt  **sql.Stmt
+		query string
+		name  string
+	}{
+		{&db.listOutbox, listOutboxStatement, "listOutbox"},
+		{&db.insertOutbox, insertOutboxStatement, "insertOutbox"},
+		{&db.deleteOutbox, deleteOutboxStatement, "deleteOutbox"},
+	} {
+		var err error
+		if *s.stmt, err = db.conn.Prepare(s.query); err != nil {
+			return fmt.Errorf("postgreSQL: prepare %s: %v", s.name, err)
+		}
+	}
+	return nil
+}
+
+// withEvents runs change in a transaction on conn, then adds the events to
+// the outbox with insertOutbox in the same transaction, committing only if
+// both succeed. change runs its statements through tx.Stmt. prefix names the
+// backend in errors.
+func withEvents(prefix string, conn *sql.DB, insertOutbox *sql.Stmt, events []*Event, change func(tx *sql.Tx) error) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: could not begin transaction: %v", prefix, err)
+	}
+	if err := change(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := addEvents(prefix, tx, insertOutbox, events); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: could not commit: %v", prefix, err)
+	}
+	return nil
+}
+
+// addEvents adds the events to the outbox with insertOutbox, in tx.
+func addEvents(prefix string, tx *sql.Tx, insertOutbox *sql.Stmt, events []*Event) error {
+	insert := tx.Stmt(insertOutbox)
+	for _, e := range events {
+		data, err := marshalEvent(e)
+		if err != nil {
+			return fmt.Errorf("%s: could not store event: %v", prefix, err)
+		}
+		if _, err := insert.Exec(string(e.Type), data, e.Time); err != nil {
+			return fmt.Errorf("%s: could not add event to outbox: %v", prefix, err)
+		}
+	}
+	return nil
+}
+
+// scanOutboxRows reads every event of rows and closes it. prefix names the
+// backend in errors.
+func scanOutboxRows(prefix string, rows *sql.Rows) ([]*Event, error) {
+	defer rows.Close()
+
+	var list []*Event
+	for rows.Next() {
+		var (
+			id   int64
+			data string
+		)
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, fmt.Errorf("%s: could not read row: %v", prefix, err)
+		}
+		e, err := unmarshalEvent(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: could not read event %d: %v", prefix, id, err)
+		}
+		e.ID = id
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+/*---------------------------  Outbox  ---------------------------*/
+
+// ListOutbox returns up to n events waiting to be published, oldest first.
+func (db *pgsqlDB) ListOutbox(n int) ([]*Event, error) {
+	rows, err := db.listOutbox.Query(n)
+	if err != nil {
+		return nil, fmt.Errorf("postgreSQL: could not list outbox: %v", err)
+	}
+	return scanOutboxRows("postgreSQL", rows)
+}
+
+// DeleteOutbox removes a published event from the outbox.
+func (db *pgsqlDB) DeleteOutbox(id int64) error {
+	if _, err := db.deleteOutbox.Exec(id); err != nil {
+		return fmt.Errorf("postgreSQL: could not delete event: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+/*---------------------------  Statements  ---------------------------*/
+
+// The tables are created by migrations 3 and 4 in db-migrate.go.
+
+const listPeopleStatement = `SELECT id, name, bio FROM people ORDER BY name, id`
+
+const getPersonStatement = `SELECT id, name, bio FROM people WHERE id = $1`
+
+const insertPersonStatement = `INSERT INTO people (name, bio) VALUES ($1, $2) RETURNING id`
+
+const updatePersonStatement = `UPDATE people SET name=$1, bio=$2 WHERE id = $3`
+
+const deletePersonStatement = `DELETE FROM people WHERE id = $1`
+
+const listCharactersStatement = `
+  SELECT id, mediaId, name, bio, evaluations FROM characters WHERE mediaId = $1 ORDER BY name, id`
+
+const getCharacterStatement = `
+  SELECT id, mediaId, name, bio, evaluations FROM characters WHERE id = $1`
+
+const insertCharacterStatement = `
+  INSERT INTO characters (mediaId, name, bio, evaluations) VALUES ($1, $2, $3, $4) RETURNING id`
+
+const updateCharacterStatement = `
+  UPDATE characters SET mediaId=$1, name=$2, bio=$3, evaluations=$4 WHERE id = $5`
+
+const deleteCharacterStatement = `DELETE FROM characters WHERE id = $1`
+
+const listCreditsStatement = `
+  SELECT id, mediaId, personId, role, characterId FROM credits WHERE mediaId = $1 ORDER BY id`
+
+const listAllCreditsStatement = `
+  SELECT id, mediaId, personId, role, characterId FROM credits ORDER BY id`
+
+const listPersonCreditsStatement = `
+  SELECT id, mediaId, personId, role, characterId FROM credits WHERE personId = $1 ORDER BY id`
+
+const insertCreditStatement = `
+  INSERT INTO credits (mediaId, personId, role, characterId) VALUES ($1, $2, $3, $4) RETURNING id`
+
+const deleteCreditStatement = `DELETE FROM credits WHERE id = $1`
+
+// preparePeople prepares the people, character and credit statements.
+func (db *pgsqlDB) preparePeople() error {
+	for _, s := range []struct {
+		stmt  **sql.Stmt
+		query string
+		name  string
+	}{
+		{&db.listPeople, listPeopleStatement, "listPeople"},
+		{&db.getPerson, getPersonStatement, "getPerson"},
+		{&db.insertPerson, insertPersonStatement, "insertPerson"},
+		{&db.updatePerson, updatePersonStatement, "updatePerson"},
+		{&db.deletePerson, deletePersonStatement, "deletePerson"},
+		{&db.listCharacters, listCharactersStatement, "listCharacters"},
+		{&db.getCharacter, getCharacterStatement, "getCharacter"},
+		{&db.insertCharacter, insertCharacterStatement, "insertCharacter"},
+		{&db.updateCharacter, updateCharacterStatement, "updateCharacter"},
+		{&db.deleteCharacter, deleteCharacterStatement, "deleteCharacter"},
+		{&db.listCredits, listCreditsStatement, "listCredits"},
+		{&db.listAllCredits, listAllCreditsStatement, "listAllCredits"},
+		{&db.listPersonCredits, listPersonCreditsStatement, "listPersonCredits"},
+		{&db.insertCredit, insertCreditStatement, "insertCredit"},
+		{&db.deleteCredit, deleteCreditStatement, "deleteCredit"},
+	} {
+		var err error
+		if *s.stmt, err = db.conn.Prepare(s.query); err != nil {
+			return fmt.Errorf("postgreSQL: prepare %s: %v", s.name, err)
+		}
+	}
+	return nil
+}
+
+/*---------------------------  Scanning  ---------------------------*/
+
+// scanPerson reads a person from a sql.Row or sql.Rows.
+func scanPerson(s rowScanner) (*Person, error) {
+	var (
+		id   int64
+		name sql.NullString
+		bio  sql.NullString
+	)
+	if err := s.Scan(&id, &name, &bio); err != nil {
+		return nil, err
+	}
+	return &Person{ID: id, Name: name.String, Bio: bio.String}, nil
+}
+
+// scanCharacter reads a character from a sql.Row or sql.Rows.
+func scanCharacter(s rowScanner) (*Character, error) {
+	var (
+		id          int64
+		mediaID     int64
+		name        sql.NullString
+		bio         sql.NullString
+		evaluations sql.NullString
+	)
+	if err := s.Scan(&id, &mediaID, &name, &bio, &evaluations); err != nil {
+		return nil, err
+	}
+	evals, err := unmarshalEvaluations(evaluations.String)
+	if err != nil {
+		return nil, fmt.Errorf("bad evaluations for character %d: %v", id, err)
+	}
+	return &Character{ID: id, MediaID: mediaID, Name: name.String, Bio: bio.String, Evaluations: evals}, nil
+}
+
+// scanCredit reads a credit from a sql.Row or sql.Rows.
+func scanCredit(s rowScanner) (*Credit, error) {
+	var (
+		id          int64
+		mediaID     int64
+		personID    int64
+		role        sql.NullString
+		characterID sql.NullInt64
+	)
+	if err := s.Scan(&id, &mediaID, &personID, &role, &characterID); err != nil {
+		return nil, err
+	}
+	return &Credit{
+		ID:          id,
+		MediaID:     mediaID,
+		PersonID:    personID,
+		Role:        role.String,
+		CharacterID: characterID.Int64,
+	}, nil
+}
+
+// nullID stores a zero ID as NULL, for optional foreign keys.
+func nullID(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
+
+// scanPeopleRows, scanCharacterRows and scanCreditRows read every row of rows
+// and close it. prefix names the backend in errors.
+func scanPeopleRows(prefix string, rows *sql.Rows) ([]*Person, error) {
+	defer rows.Close()
+
+	var people []*Person
+	for rows.Next() {
+		p, err := scanPerson(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%s: could not read row: %v", prefix, err)
+		}
+		people = append(people, p)
+	}
+	return people, rows.Err()
+}
+
+func scanCharacterRows(prefix string, rows *sql.Rows) ([]*Character, error) {
+	defer rows.Close()
+
+	var chars []*Character
+	for rows.Next() {
+		c, err := scanCharacter(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%s: could not read row: %v", prefix, err)
+		}
+		chars = append(chars, c)
+	}
+	return chars, rows.Err()
+}
+
+func scanCreditRows(prefix string, rows *sql.Rows) ([]*Credit, error) {
+	defer rows.Close()
+
+	var credits []*Credit
+	for rows.Next() {
+		c, err := scanCredit(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%s: could not read row: %v", prefix, err)
+		}
+		credits = append(credits, c)
+	}
+	return credits, rows.Err()
+}
+
+/*---------------------------  People  ---------------------------*/
+
+// ListPeople returns a list of people, ordered by name.
+func (db *pgsqlDB) ListPeople() ([]*Person, error) {
+	rows, err := db.listPeople.Query()
+	if err != nil {
+		return nil, err
+	}
+	return scanPeopleRows("postgreSQL", rows)
+}
+
+// GetPerson retrieves a person by its ID.
+func (db *pgsqlDB) GetPerson(id int64) (*Person, error) {
+	p, err := scanPerson(db.getPerson.QueryRow(id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("postgreSQL: person with id %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("postgreSQL: could not get person: %v", err)
+	}
+	return p, nil
+}
+
+// AddPerson saves a given person, assigning it a new ID.
+func (db *pgsqlDB) AddPerson(p *Person) (id int64, err error) {
+	if err := db.insertPerson.QueryRow(p.Name, p.Bio).Scan(&id); err != nil {
+		return 0, fmt.Errorf("postgreSQL: could not insert person: %v", err)
+	}
+	p.ID = id
+	return id, nil
+}
+
+// UpdatePerson updates the entry for a given person.
+func (db *pgsqlDB) UpdatePerson(p *Person) error {
+	if p.ID == 0 {
+		return errors.New("postgreSQL: person with unassigned ID passed into updatePerson")
+	}
+	return execOnRow("postgreSQL", "person", db.updatePerson, p.ID, p.Name, p.Bio, p.ID)
+}
+
+// DeletePerson removes a given person, and their credits, by ID.
+func (db *pgsqlDB) DeletePerson(id int64) error {
+	return execOnRow("postgreSQL", "person", db.deletePerson, id, id)
+}
+
+/*---------------------------  Characters  ---------------------------*/
+
+// ListCharacters returns the characters of the given media, ordered by name.
+func (db *pgsqlDB) ListCharacters(mediaID int64) ([]*Character, error) {
+	rows, err := db.listCharacters.Query(mediaID)
+	if err != nil {
+		return nil, err
+	}
+	return scanCharacterRows("postgreSQL", rows)
+}
+
+// GetCharacter retrieves a character by its ID.
+func (db *pgsqlDB) GetCharacter(id int64) (*Character, error) {
+	c, err := scanCharacter(db.getCharacter.QueryRow(id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("postgreSQL: character with id %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("postgreSQL: could not get character: %v", err)
+	}
+	return c, nil
+}
+
+// AddCharacter saves a given character, assigning it a new ID.
+func (db *pgsqlDB) AddCharacter(c *Character) (id int64, err error) {
+	evals, err := marshalEvaluations(c.Evaluations)
+	if err != nil {
+		return 0, fmt.Errorf("postgreSQL: could not encode evaluations: %v", err)
+	}
+	if err := db.insertCharacter.QueryRow(c.MediaID, c.Name, c.Bio, evals).Scan(&id); err != nil {
+		return 0, fmt.Errorf("postgreSQL: could not insert character: %v", err)
+	}
+	c.ID = id
+	return id, nil
+}
+
+// UpdateCharacter updates the entry for a given character.
+func (db *pgsqlDB) UpdateCharacter(c *Character) error {
+	if c.ID == 0 {
+		return errors.New("postgreSQL: character with unassigned ID passed into updateCharacter")
+	}
+	evals, err := marshalEvaluations(c.Evaluations)
+	if err != nil {
+		return fmt.Errorf("postgreSQL: could not encode evaluations: %v", err)
+	}
+	return execOnRow("postgreSQL", "character", db.updateCharacter, c.ID, c.MediaID, c.Name, c.Bio, evals, c.ID)
+}
+
+// DeleteCharacter removes a given character by its ID.
+func (db *pgsqlDB) DeleteCharacter(id int64) error {
+	return execOnRow("postgreSQL", "character", db.deleteCharacter, id, id)
+}
+
+/*---------------------------  Credits  ---------------------------*/
+
+// ListCredits returns the credits of the given media, or of all media when
+// mediaID is 0, ordered by ID.
+func (db *pgsqlDB) ListCredits(mediaID int64) ([]*Credit, error) {
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if mediaID == 0 {
+		rows, err = db.listAllCredits.Query()
+	} else {
+		rows, err = db.listCredits.Query(mediaID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanCreditRows("postgreSQL", rows)
+}
+
+// ListPersonCredits returns the credits of the given person, ordered by ID.
+func (db *pgsqlDB) ListPersonCredits(personID int64) ([]*Credit, error) {
+	rows, err := db.listPersonCredits.Query(personID)
+	if err != nil {
+		return nil, err
+	}
+	return scanCreditRows("postgreSQL", rows)
+}
+
+// AddCredit saves a given credit, assigning it a new ID.
+func (db *pgsqlDB) AddCredit(c *Credit) (id int64, err error) {
+	err = db.insertCredit.QueryRow(c.MediaID, c.PersonID, c.Role, nullID(c.CharacterID)).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("postgreSQL: could not insert credit: %v", err)
+	}
+	c.ID = id
+	return id, nil
+}
+
+// DeleteCredit removes a given credit by its ID.
+func (db *pgsqlDB) DeleteCredit(id int64) error {
+	return execOnRow("postgreSQL", "credit", db.deleteCredit, id, id)
+}
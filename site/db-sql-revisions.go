@@ -0,0 +1,154 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+/*---------------------------  Statements  ---------------------------*/
+
+// The table is created by migrations 11 and 14 in db-migrate.go. It has no
+// foreign key to media, as revisions outlive the media they are of.
+
+const revisionColumns = `id, mediaId, media, deleted, authorId, author, date, summary, submissionId`
+
+const getRevisionStatement = `SELECT ` + revisionColumns + ` FROM revisions WHERE id = $1`
+
+const listRevisionsStatement = `
+  SELECT ` + revisionColumns + ` FROM revisions WHERE mediaId = $1 ORDER BY id`
+
+const insertRevisionStatement = `
+  INSERT INTO revisions (mediaId, media, deleted, authorId, author, date, summary, submissionId)
+  VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+
+// prepareRevisions prepares the revision statements.
+func (db *pgsqlDB) prepareRevisions() error {
+	for _, s := range []struct {
+		stmt  **sql.Stmt
+		query string
+		name  string
+	}{
+		{&db.getRevision, getRevisionStatement, "getRevision"},
+		{&db.listRevisions, listRevisionsStatement, "listRevisions"},
+		{&db.insertRevision, insertRevisionStatement, "insertRevision"},
+	} {
+		var err error
+		if *s.stmt, err = db.conn.Prepare(s.query); err != nil {
+			return fmt.Errorf("postgreSQL: prepare %s: %v", s.name, err)
+		}
+	}
+	return nil
+}
+
+// scanRevision reads a revision from a sql.Row or sql.Rows.
+func scanRevision(s rowScanner) (*Revision, error) {
+	var (
+		id           int64
+		mediaID      int64
+		media        string
+		deleted      bool
+		authorID     sql.NullInt64
+		author       sql.NullString
+		date         time.Time
+		summary      sql.NullString
+		submissionID sql.NullInt64
+	)
+	if err := s.Scan(&id, &mediaID, &media, &deleted, &authorID, &author, &date, &summary, &submissionID); err != nil {
+		return nil, err
+	}
+	m, err := unmarshalMedia(media)
+	if err != nil {
+		return nil, fmt.Errorf("bad media: %v", err)
+	}
+	return &Revision{
+		ID:           id,
+		MediaID:      mediaID,
+		Media:        m,
+		Deleted:      deleted,
+		AuthorID:     authorID.Int64,
+		Author:       author.String,
+		Date:         date,
+		Summary:      summary.String,
+		SubmissionID: submissionID.Int64,
+	}, nil
+}
+
+// revisionValues returns the values of the insert statement's revision
+// columns, in order.
+func revisionValues(r *Revision) ([]interface{}, error) {
+	media, err := marshalMedia(r.Media)
+	if err != nil {
+		return nil, fmt.Errorf("could not store media: %v", err)
+	}
+	return []interface{}{
+		r.MediaID, media, r.Deleted, nullID(r.AuthorID), r.Author, r.Date, r.Summary,
+		nullID(r.SubmissionID),
+	}, nil
+}
+
+// scanRevisionRows reads every row of rows and closes it. prefix names the
+// backend in errors.
+func scanRevisionRows(prefix string, rows *sql.Rows) ([]*Revision, error) {
+	defer rows.Close()
+
+	var list []*Revision
+	for rows.Next() {
+		r, err := scanRevision(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%s: could not read row: %v", prefix, err)
+		}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+/*---------------------------  Revisions  ---------------------------*/
+
+// GetRevision retrieves a revision by its ID.
+func (db *pgsqlDB) GetRevision(id int64) (*Revision, error) {
+	r, err := scanRevision(db.getRevision.QueryRow(id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("postgreSQL: revision with id %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("postgreSQL: could not get revision: %v", err)
+	}
+	return r, nil
+}
+
+// ListRevisions returns the revisions of the given media, oldest first.
+func (db *pgsqlDB) ListRevisions(mediaID int64) ([]*Revision, error) {
+	rows, err := db.listRevisions.Query(mediaID)
+	if err != nil {
+		return nil, err
+	}
+	return scanRevisionRows("postgreSQL", rows)
+}
+
+// AddRevision saves a given revision, assigning it a new ID.
+func (db *pgsqlDB) AddRevision(r *Revision) (id int64, err error) {
+	values, err := revisionValues(r)
+	if err != nil {
+		return 0, fmt.Errorf("postgreSQL: %v", err)
+	}
+	if err := db.insertRevision.QueryRow(values...).Scan(&id); err != nil {
+		return 0, fmt.Errorf("postgreSQL: could not insert revision: %v", err)
+	}
+	r.ID = id
+	return id, nil
+}
@@ -0,0 +1,234 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+/*---------------------------  Statements  ---------------------------*/
+
+// The table is created by migration 10 in db-migrate.go.
+
+const submissionColumns = `id, mediaId, media, justification, status,
+  submittedById, submittedBy, submittedDate, reviewedById, reviewedBy, reviewedDate, reason`
+
+const getSubmissionStatement = `SELECT ` + submissionColumns + ` FROM submissions WHERE id = $1`
+
+const listSubmissionsStatement = `
+  SELECT ` + submissionColumns + ` FROM submissions WHERE status = $1 ORDER BY id`
+
+const listSubmissionsByStatement = `
+  SELECT ` + submissionColumns + ` FROM submissions WHERE submittedById = $1 ORDER BY id DESC`
+
+const insertSubmissionStatement = `
+  INSERT INTO submissions (mediaId, media, justification, status,
+    submittedById, submittedBy, submittedDate, reviewedById, reviewedBy, reviewedDate, reason)
+  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`
+
+const updateSubmissionStatement = `
+  UPDATE submissions SET mediaId=$1, media=$2, justification=$3, status=$4,
+    submittedById=$5, submittedBy=$6, submittedDate=$7, reviewedById=$8, reviewedBy=$9,
+    reviewedDate=$10, reason=$11
+  WHERE id = $12`
+
+// prepareSubmissions prepares the submission statements.
+func (db *pgsqlDB) prepareSubmissions() error {
+	for _, s := range []struct {
+		stmt  **sql.Stmt
+		query string
+		name  string
+	}{
+		{&db.getSubmission, getSubmissionStatement, "getSubmission"},
+		{&db.listSubmissions, listSubmissionsStatement, "listSubmissions"},
+		{&db.listSubmissionsBy, listSubmissionsByStatement, "listSubmissionsBy"},
+		{&db.insertSubmission, insertSubmissionStatement, "insertSubmission"},
+		{&db.updateSubmission, updateSubmissionStatement, "updateSubmission"},
+	} {
+		var err error
+		if *s.stmt, err = db.conn.Prepare(s.query); err != nil {
+			return fmt.Errorf("postgreSQL: prepare %s: %v", s.name, err)
+		}
+	}
+	return nil
+}
+
+// scanSubmission reads a submission from a sql.Row or sql.Rows.
+func scanSubmission(s rowScanner) (*Submission, error) {
+	var (
+		id            int64
+		mediaID       sql.NullInt64
+		media         string
+		justification sql.NullString
+		status        string
+		submittedByID sql.NullInt64
+		submittedBy   sql.NullString
+		submittedDate sql.NullString
+		reviewedByID  sql.NullInt64
+		reviewedBy    sql.NullString
+		reviewedDate  sql.NullString
+		reason        sql.NullString
+	)
+	if err := s.Scan(&id, &mediaID, &media, &justification, &status,
+		&submittedByID, &submittedBy, &submittedDate,
+		&reviewedByID, &reviewedBy, &reviewedDate, &reason); err != nil {
+		return nil, err
+	}
+	m, err := unmarshalMedia(media)
+	if err != nil {
+		return nil, fmt.Errorf("bad media: %v", err)
+	}
+	return &Submission{
+		ID:            id,
+		MediaID:       mediaID.Int64,
+		Media:         m,
+		Justification: justification.String,
+		Status:        SubmissionStatus(status),
+		SubmittedByID: submittedByID.Int64,
+		SubmittedBy:   submittedBy.String,
+		SubmittedDate: submittedDate.String,
+		ReviewedByID:  reviewedByID.Int64,
+		ReviewedBy:    reviewedBy.String,
+		ReviewedDate:  reviewedDate.String,
+		Reason:        reason.String,
+	}, nil
+}
+
+// submissionValues returns the values of the insert and update statements'
+// submission columns, in order.
+func submissionValues(s *Submission) ([]interface{}, error) {
+	media, err := marshalMedia(s.Media)
+	if err != nil {
+		return nil, fmt.Errorf("could not store media: %v", err)
+	}
+	return []interface{}{
+		nullID(s.MediaID), media, s.Justification, string(s.Status),
+		nullID(s.SubmittedByID), s.SubmittedBy, s.SubmittedDate,
+		nullID(s.ReviewedByID), s.ReviewedBy, s.ReviewedDate, s.Reason,
+	}, nil
+}
+
+// scanSubmissionRows reads every row of rows and closes it. prefix names the
+// backend in errors.
+func scanSubmissionRows(prefix string, rows *sql.Rows) ([]*Submission, error) {
+	defer rows.Close()
+
+	var list []*Submission
+	for rows.Next() {
+		s, err := scanSubmission(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%s: could not read row: %v", prefix, err)
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+/*---------------------------  Submissions  ---------------------------*/
+
+// GetSubmission retrieves a submission by its ID.
+func (db *pgsqlDB) GetSubmission(id int64) (*Submission, error) {
+	s, err := scanSubmission(db.getSubmission.QueryRow(id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("postgreSQL: submission with id %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("postgreSQL: could not get submission: %v", err)
+	}
+	return s, nil
+}
+
+// ListSubmissions returns the submissions with the given status, oldest
+// first.
+func (db *pgsqlDB) ListSubmissions(status SubmissionStatus) ([]*Submission, error) {
+	rows, err := db.listSubmissions.Query(string(status))
+	if err != nil {
+		return nil, err
+	}
+	return scanSubmissionRows("postgreSQL", rows)
+}
+
+// ListSubmissionsBy returns the submissions of the given user, newest first.
+func (db *pgsqlDB) ListSubmissionsBy(userID int64) ([]*Submission, error) {
+	rows, err := db.listSubmissionsBy.Query(userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanSubmissionRows("postgreSQL", rows)
+}
+
+// AddSubmission saves a given submission, assigning it a new ID.
+func (db *pgsqlDB) AddSubmission(s *Submission) (id int64, err error) {
+	values, err := submissionValues(s)
+	if err != nil {
+		return 0, fmt.Errorf("postgreSQL: %v", err)
+	}
+	if err := db.insertSubmission.QueryRow(values...).Scan(&id); err != nil {
+		return 0, fmt.Errorf("postgreSQL: could not insert submission: %v", err)
+	}
+	s.ID = id
+	return id, nil
+}
+
+// UpdateSubmission updates the entry for a given submission.
+func (db *pgsqlDB) UpdateSubmission(s *Submission, events ...*Event) error {
+	if s.ID == 0 {
+		return errors.New("postgreSQL: submission with unassigned ID passed into updateSubmission")
+	}
+	values, err := submissionValues(s)
+	if err != nil {
+		return fmt.Errorf("postgreSQL: %v", err)
+	}
+	return withEvents("postgreSQL", db.conn, db.insertOutbox, events, func(tx *sql.Tx) error {
+		_, err := execAffectingOneRow(tx.Stmt(db.updateSubmission), append(values, s.ID)...)
+		return err
+	})
+}
+
+// AddSubmittedMedia saves the media of a submission of new media, and the
+// submission with its ID, in one transaction.
+func (db *pgsqlDB) AddSubmittedMedia(s *Submission, m *Media, events ...*Event) (id int64, err error) {
+	if s.ID == 0 {
+		return 0, errors.New("postgreSQL: submission with unassigned ID passed into addSubmittedMedia")
+	}
+	values, err := mediaValues(m)
+	if err != nil {
+		return 0, fmt.Errorf("postgreSQL: %v", err)
+	}
+	err = withEvents("postgreSQL", db.conn, db.insertOutbox, events, func(tx *sql.Tx) error {
+		if err := tx.Stmt(db.insert).QueryRow(values...).Scan(&id); err != nil {
+			return fmt.Errorf("postgreSQL: could not insert media: %v", err)
+		}
+		linked := *s
+		linked.MediaID = id
+		submission, err := submissionValues(&linked)
+		if err != nil {
+			return fmt.Errorf("postgreSQL: %v", err)
+		}
+		if _, err := execAffectingOneRow(tx.Stmt(db.updateSubmission), append(submission, s.ID)...); err != nil {
+			return err
+		}
+		m.ID = id
+		setEventMediaID(events, id)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.MediaID = id
+	return id, nil
+}
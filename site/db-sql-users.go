@@ -0,0 +1,167 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+/*---------------------------  Statements  ---------------------------*/
+
+// The table is created by migrations 8 and 9 in db-migrate.go.
+
+const userColumns = `id, issuer, subject, name, email, createdDate, role`
+
+const getUserStatement = `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+
+const getUserByIdentityStatement = `
+  SELECT ` + userColumns + ` FROM users WHERE issuer = $1 AND subject = $2`
+
+const listUsersStatement = `SELECT ` + userColumns + ` FROM users ORDER BY id`
+
+const insertUserStatement = `
+  INSERT INTO users (issuer, subject, name, email, createdDate, role)
+  VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+
+const updateUserStatement = `
+  UPDATE users SET issuer=$1, subject=$2, name=$3, email=$4, createdDate=$5, role=$6
+  WHERE id = $7`
+
+// prepareUsers prepares the user statements.
+func (db *pgsqlDB) prepareUsers() error {
+	for _, s := range []struct {
+		stmt  **sql.Stmt
+		query string
+		name  string
+	}{
+		{&db.getUser, getUserStatement, "getUser"},
+		{&db.getUserByIdentity, getUserByIdentityStatement, "getUserByIdentity"},
+		{&db.insertUser, insertUserStatement, "insertUser"},
+		{&db.updateUser, updateUserStatement, "updateUser"},
+		{&db.listUsers, listUsersStatement, "listUsers"},
+	} {
+		var err error
+		if *s.stmt, err = db.conn.Prepare(s.query); err != nil {
+			return fmt.Errorf("postgreSQL: prepare %s: %v", s.name, err)
+		}
+	}
+	return nil
+}
+
+// scanUser reads a user from a sql.Row or sql.Rows.
+func scanUser(s rowScanner) (*User, error) {
+	var (
+		id          int64
+		issuer      sql.NullString
+		subject     sql.NullString
+		name        sql.NullString
+		email       sql.NullString
+		createdDate sql.NullString
+		role        sql.NullString
+	)
+	if err := s.Scan(&id, &issuer, &subject, &name, &email, &createdDate, &role); err != nil {
+		return nil, err
+	}
+	return &User{
+		ID:          id,
+		Issuer:      issuer.String,
+		Subject:     subject.String,
+		Name:        name.String,
+		Email:       email.String,
+		CreatedDate: createdDate.String,
+		Role:        Role(role.String),
+	}, nil
+}
+
+// userValues returns the values of the insert and update statements' user
+// columns, in order.
+func userValues(u *User) []interface{} {
+	role := u.Role
+	if role == "" {
+		role = defaultRole
+	}
+	return []interface{}{u.Issuer, u.Subject, u.Name, u.Email, u.CreatedDate, string(role)}
+}
+
+// scanUserRows reads every row of rows and closes it. prefix names the
+// backend in errors.
+func scanUserRows(prefix string, rows *sql.Rows) ([]*User, error) {
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%s: could not read row: %v", prefix, err)
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+/*---------------------------  Users  ---------------------------*/
+
+// GetUser retrieves a user by its ID.
+func (db *pgsqlDB) GetUser(id int64) (*User, error) {
+	u, err := scanUser(db.getUser.QueryRow(id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("postgreSQL: user with id %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("postgreSQL: could not get user: %v", err)
+	}
+	return u, nil
+}
+
+// GetUserByIdentity retrieves the user with the given identity.
+func (db *pgsqlDB) GetUserByIdentity(issuer, subject string) (*User, error) {
+	u, err := scanUser(db.getUserByIdentity.QueryRow(issuer, subject))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("postgreSQL: user %s at %s %w", subject, issuer, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("postgreSQL: could not get user: %v", err)
+	}
+	return u, nil
+}
+
+// AddUser saves a given user, assigning it a new ID.
+func (db *pgsqlDB) AddUser(u *User) (id int64, err error) {
+	if err := db.insertUser.QueryRow(userValues(u)...).Scan(&id); err != nil {
+		return 0, fmt.Errorf("postgreSQL: could not insert user: %v", err)
+	}
+	u.ID = id
+	return id, nil
+}
+
+// UpdateUser updates the entry for a given user.
+func (db *pgsqlDB) UpdateUser(u *User) error {
+	if u.ID == 0 {
+		return errors.New("postgreSQL: user with unassigned ID passed into updateUser")
+	}
+	_, err := execAffectingOneRow(db.updateUser, append(userValues(u), u.ID)...)
+	return err
+}
+
+// ListUsers returns all the users, ordered by ID.
+func (db *pgsqlDB) ListUsers() ([]*User, error) {
+	rows, err := db.listUsers.Query()
+	if err != nil {
+		return nil, err
+	}
+	return scanUserRows("postgreSQL", rows)
+}
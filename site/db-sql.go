@@ -15,14 +15,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	_ "github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/dialers/postgres"
-	"math/rand"
 	"time"
 
-	"log"
 )
 
 
@@ -38,6 +40,30 @@ type pgsqlDB struct {
 	get    *sql.Stmt
 	update *sql.Stmt
 	delete *sql.Stmt
+
+	// getForUpdate locks the media it gets until the transaction ends, see
+	// ChangeMedia.
+	getForUpdate *sql.Stmt
+
+	// The trash, see trash.go.
+	trash, restore, listDeleted *sql.Stmt
+
+	// See db-sql-people.go.
+	listPeople, getPerson, insertPerson, updatePerson, deletePerson                 *sql.Stmt
+	listCharacters, getCharacter, insertCharacter, updateCharacter, deleteCharacter *sql.Stmt
+	listCredits, listAllCredits, listPersonCredits, insertCredit, deleteCredit      *sql.Stmt
+
+	// See db-sql-users.go.
+	getUser, getUserByIdentity, insertUser, updateUser, listUsers *sql.Stmt
+
+	// See db-sql-submissions.go.
+	getSubmission, listSubmissions, listSubmissionsBy, insertSubmission, updateSubmission *sql.Stmt
+
+	// See db-sql-revisions.go.
+	getRevision, listRevisions, insertRevision *sql.Stmt
+
+	// See db-sql-outbox.go.
+	listOutbox, insertOutbox, deleteOutbox *sql.Stmt
 }
 
 type PgSQLConfig struct {
@@ -61,104 +87,144 @@ type PgSQLConfig struct {
 	//
 	// If set, Host and Port should be unset.
 	UnixSocket string
+
+	// SSLMode is the lib/pq sslmode, such as "disable" or "verify-ca", and
+	// SSLRootCert, SSLCert and SSLKey are the paths of the certificates it
+	// checks. Unset, lib/pq's defaults apply, except that unix sockets,
+	// which the Cloud SQL proxy already encrypts, do not use SSL.
+	SSLMode, SSLRootCert, SSLCert, SSLKey string
+
+	// Migrate applies pending schema migrations (see db-migrate.go) when the
+	// database is opened. Otherwise a schema that is behind is an error.
+	Migrate bool
 }
 
 // Ensure pgsqlDB conforms to the MediaDatabase interface.
 var _ MediaDatabase = &pgsqlDB{}
 
-var mySQLUsed = false
-
-// dataStoreName returns a connection string suitable for sql.Open.
+// dataStoreName returns a lib/pq connection string suitable for sql.Open.
+// See https://godoc.org/github.com/lib/pq for the parameters.
 func (c PgSQLConfig) dataStoreName() string {
-	var cred string
-	// [username[:password]@]
-	if c.Username != "" {
-		cred = c.Username
-		if c.Password != "" {
-			cred = cred + ":" + c.Password
+	host, sslMode := c.Host, c.SSLMode
+	if c.UnixSocket != "" {
+		// lib/pq takes the directory holding the socket as the host.
+		host = c.UnixSocket
+		if sslMode == "" {
+			sslMode = "disable"
 		}
-		cred = cred + "@"
 	}
-
-	if c.UnixSocket != "" {
-		return fmt.Sprintf("%sunix(%s)/%s", cred, c.UnixSocket, DBName)
+	var port string
+	if c.Port != 0 {
+		port = strconv.Itoa(c.Port)
 	}
-	if mySQLUsed {
-		return fmt.Sprintf("%stcp([%s]:%d)/%s", cred, c.Host, c.Port, DBName) }
 
+	var params []string
+	for _, p := range []struct{ key, value string }{
+		{"host", host},
+		{"port", port},
+		{"dbname", DBName},
+		{"user", c.Username},
+		{"password", c.Password},
+		{"sslmode", sslMode},
+		{"sslrootcert", c.SSLRootCert},
+		{"sslcert", c.SSLCert},
+		{"sslkey", c.SSLKey},
+	} {
+		if p.value != "" {
+			params = append(params, p.key+"="+quoteConnValue(p.value))
+		}
+	}
+	return strings.Join(params, " ")
+}
 
-	return fmt.Sprintf("host=%s dbname=%s user=%s password=%s",
-		c.Instance, DBName, c.Username, c.Password)
+// quoteConnValue quotes a connection string value, so that values such as
+// passwords may hold spaces and quotes.
+func quoteConnValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	return "'" + strings.ReplaceAll(v, "'", `\'`) + "'"
 }
 
 /*---------------------------  Statements  ---------------------------*/
 
-var createTableStatements = []string{
-	`CREATE DATABASE IF NOT EXISTS media DEFAULT CHARACTER SET = 'utf8' DEFAULT COLLATE 'utf8_general_ci';`,
-	`USE media;`,
-	`CREATE TABLE IF NOT EXISTS media (
-		id INT PRIMARY KEY,
-		title VARCHAR(255) NULL,
-		description TEXT NULL,
-		mediaType VARCHAR(255) NULL,
-		releaseDate VARCHAR(255) NULL,
-		industry VARCHAR(255) NULL,
-		actorId INT NULL,
-		characterId INT NULL,
-		directorId INT NULL,
-		imageURL VARCHAR(255) NULL,
-		bechdel VARCHAR(255) NULL,
-		wikiURL VARCHAR(255) NULL,
-		imdbURL VARCHAR(255) NULL,
-		rottentomURL VARCHAR(255) NULL,
-		createdById INT NULL,
-		createdBy VARCHAR(255) NULL,
-		createdDate VARCHAR(255) NULL
-	)`,
-}
-
-const getStatement = `SELECT * FROM media WHERE id = $1`
-
-const listStatement = `SELECT * FROM media ORDER BY title`
-
-const listByStatement = `SELECT * FROM media WHERE createdbyid = $1 ORDER BY title`
+// mediaColumns are the media columns in the order scanMedia reads them.
+const mediaColumns = `id, title, description, mediaType, industry, releaseDate,
+		imageURL, bechdel, wikiURL, imdbURL, rottentomURL,
+		createdById, createdBy, createdDate,
+		rubricVersion, assessments, inclusionScore, disqualified,
+		bechdelDisputed, bechdelSource, bechdelSourceURL, tags,
+		deletedAt, deletedById, deletedBy`
+
+// Media in the trash has a deletedAt, and is left out of everything but
+// listDeletedStatement.
+
+const getStatement = `SELECT ` + mediaColumns + ` FROM media WHERE id = $1 AND deletedAt IS NULL`
+
+const getForUpdateStatement = getStatement + ` FOR UPDATE`
+
+const listStatement = `SELECT ` + mediaColumns + ` FROM media WHERE deletedAt IS NULL ORDER BY title`
+
+const listByStatement = `
+  SELECT ` + mediaColumns + ` FROM media WHERE createdbyid = $1 AND deletedAt IS NULL ORDER BY title`
+
+const listDeletedStatement = `
+  SELECT ` + mediaColumns + ` FROM media WHERE deletedAt IS NOT NULL ORDER BY deletedAt DESC, id DESC`
 
 const insertStatement = `
   INSERT INTO media (title, description, mediaType,
-		industry, releaseDate, actorID, characterID,
-		directorID, imageURL, bechdel, wikiURL, imdbURL,
-		rottentomURL, createdByID, createdBy, createdDate
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`
+		industry, releaseDate, imageURL, bechdel, wikiURL, imdbURL,
+		rottentomURL, createdByID, createdBy, createdDate,
+		rubricVersion, assessments, inclusionScore, disqualified,
+		bechdelDisputed, bechdelSource, bechdelSourceURL, tags, releaseYear
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13,
+		$14, $15, $16, $17, $18, $19, $20, $21, $22)
+  RETURNING id`
+
+const trashStatement = `
+  UPDATE media SET deletedAt=$1, deletedById=$2, deletedBy=$3 WHERE id = $4 AND deletedAt IS NULL`
 
-const deleteStatement = `DELETE FROM media WHERE id = $1`
+const restoreStatement = `
+  UPDATE media SET deletedAt=NULL, deletedById=NULL, deletedBy=NULL
+  WHERE id = $1 AND deletedAt IS NOT NULL`
+
+const deleteStatement = `DELETE FROM media WHERE id = $1 AND deletedAt IS NOT NULL`
 
 const updateStatement = `
   UPDATE media
   SET title=$1, description=$2, mediaType=$3, industry=$4, 
-  		releaseDate=$5, actorID=$6, characterID=$7, directorID=$8, 
-  		imageURL=$9, bechdel=$10, wikiURL=$11, imdbURL=$12, 
-  		rottentomURL=$13, createdById=$14, createdBy=$15, createdDate=$16
-  WHERE id = $17`
+  		releaseDate=$5, imageURL=$6, bechdel=$7, wikiURL=$8, imdbURL=$9, 
+  		rottentomURL=$10, createdById=$11, createdBy=$12, createdDate=$13,
+  		rubricVersion=$14, assessments=$15, inclusionScore=$16, disqualified=$17,
+  		bechdelDisputed=$18, bechdelSource=$19, bechdelSourceURL=$20,
+  		tags=$21, releaseYear=$22
+  WHERE id = $23 AND deletedAt IS NULL`
 
 /*---------------------------  Core Functions  ---------------------------*/
 
 // newPgSQLDB creates a new MediaDatabase backed by a given PgSQL server.
 func newPgSQLDB(config PgSQLConfig) (MediaDatabase, error) {
-
-	/*conn, err := sql.Open("postgres", config.dataStoreName())*/
-
-	/*TODO verify which to use and pass back to datastore name*/
-	conn, err := sql.Open("postgres", fmt.Sprintf(`sslmode=require sslrootcert=/Users/warrick/homebrew/etc/openssl/certs/server-ca.pem sslcert=/Users/warrick/homebrew/etc/openssl/certs/client-cert.pem sslkey=/Users/warrick/homebrew/etc/openssl/certs/client-key.pem host=%s user=%s dbname=%s password=%s`, config.IP, config.Username, DBName, config.Password))
-
-
-/*	conn, err := sql.Open("cloudsqlpostgres", fmt.Sprintf(`host=%s dbname=%s user=%s password=%s sslmode=verify-ca sslrootcert=/Users/warrick/homebrew/etc/openssl/certs/server-ca.pem sslcert=/Users/warrick/homebrew/etc/openssl/certs/client-cert.pem sslkey=/Users/warrick/homebrew/etc/openssl/certs/client-key.pem"`, config.Instance, DBName, config.Username, config.Password))
-*/
+	conn, err := config.open()
 	if err != nil {
-		return nil, fmt.Errorf("postgreSQL: could not get a connection: %v", err)
+		return nil, err
 	}
+	db, err := newPgSQLDBFromConn(conn, config.Migrate)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
 
-	// Check database and table exists. If not, create it.
-	if err := config.ensureTableExists(conn); err != nil {
+// newPgSQLDBFromConn creates a pgsqlDB using conn, applying pending
+// migrations first if applyMigrations is set.
+func newPgSQLDBFromConn(conn *sql.DB, applyMigrations bool) (*pgsqlDB, error) {
+	// Bring the schema up to date, or check that it already is.
+	var err error
+	if applyMigrations {
+		err = migrate(conn, pgMigrations)
+	} else {
+		err = ensureSchemaCurrent(conn, pgMigrations)
+	}
+	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
@@ -171,6 +237,9 @@ func newPgSQLDB(config PgSQLConfig) (MediaDatabase, error) {
 	if db.get, err = conn.Prepare(getStatement); err != nil {
 		return nil, fmt.Errorf("postgreSQL: prepare get: %v", err)
 	}
+	if db.getForUpdate, err = conn.Prepare(getForUpdateStatement); err != nil {
+		return nil, fmt.Errorf("postgreSQL: prepare getForUpdate: %v", err)
+	}
 	if db.list, err = conn.Prepare(listStatement); err != nil {
 		return nil, fmt.Errorf("postgreSQL: prepare list: %v", err)
 	}
@@ -186,32 +255,48 @@ func newPgSQLDB(config PgSQLConfig) (MediaDatabase, error) {
 	if db.delete, err = conn.Prepare(deleteStatement); err != nil {
 		return nil, fmt.Errorf("postgreSQL: prepare delete: %v", err)
 	}
+	if db.trash, err = conn.Prepare(trashStatement); err != nil {
+		return nil, fmt.Errorf("postgreSQL: prepare trash: %v", err)
+	}
+	if db.restore, err = conn.Prepare(restoreStatement); err != nil {
+		return nil, fmt.Errorf("postgreSQL: prepare restore: %v", err)
+	}
+	if db.listDeleted, err = conn.Prepare(listDeletedStatement); err != nil {
+		return nil, fmt.Errorf("postgreSQL: prepare listDeleted: %v", err)
+	}
+	if err := db.preparePeople(); err != nil {
+		return nil, err
+	}
+	if err := db.prepareUsers(); err != nil {
+		return nil, err
+	}
+	if err := db.prepareSubmissions(); err != nil {
+		return nil, err
+	}
+	if err := db.prepareRevisions(); err != nil {
+		return nil, err
+	}
+	if err := db.prepareOutbox(); err != nil {
+		return nil, err
+	}
 
 	return db, nil
 }
 
-/*TODO Make sure this is checking if table exists - changed dataStoreName to pass name*/
+// open connects to the PgSQL server and checks the connection.
+func (config PgSQLConfig) open() (*sql.DB, error) {
 
-func (config PgSQLConfig) ensureTableExists(conn *sql.DB) error {
+	conn, err := sql.Open("postgres", config.dataStoreName())
+	if err != nil {
+		return nil, fmt.Errorf("postgreSQL: could not get a connection: %v", err)
+	}
 
 	// Check the connection.
 	if err := conn.Ping(); err != nil {
 		conn.Close()
-		return fmt.Errorf("postgreSQL: could not establish a good connection: %v", err)
+		return nil, fmt.Errorf("postgreSQL: could not establish a good connection: %v", err)
 	}
-
-	/*TODO generalize media name to pass in*/
-
-	if _, err := conn.Exec(`SELECT EXISTS (SELECT * FROM media)`); err != nil {
-			// MySQL error 1146, PgSQL error 42P01 is "table does not exist"
-			log.Printf("TABLE NOT EXIST: %v", err)
-			// Unknown error.
-			return fmt.Errorf("postgreSQL: could not connect to the database: %v", err)
-		}
-
-	log.Printf("TABLE EXISTs")
-
-	return nil
+	return conn, nil
 }
 
 // Close closes the database, freeing up any resources.
@@ -234,12 +319,8 @@ func scanMedia(s rowScanner) (*Media, error) {
 		industry	  sql.NullString
 		releaseDate  sql.NullString
 
-		actorID       sql.NullInt64
-		characterID   sql.NullInt64
-		directorID    sql.NullInt64
-
 		imageURL      sql.NullString
-		bechdel		  sql.NullBool
+		bechdel		  sql.NullInt64
 		wikiURL		  sql.NullString
 		imdbURL		  sql.NullString
 		rottentomURL  sql.NullString
@@ -247,14 +328,40 @@ func scanMedia(s rowScanner) (*Media, error) {
 		createdByID   sql.NullInt64
 		createdBy     sql.NullString
 		createdDate   sql.NullString
+
+		rubricVersion  sql.NullInt64
+		assessments    sql.NullString
+		inclusionScore sql.NullInt64
+		disqualified   sql.NullBool
+
+		bechdelDisputed  sql.NullBool
+		bechdelSource    sql.NullString
+		bechdelSourceURL sql.NullString
+		tags             sql.NullString
+
+		deletedAt   sql.NullTime
+		deletedByID sql.NullInt64
+		deletedBy   sql.NullString
 	)
 
 	if err := s.Scan(&id, &title, &description, &mediaType,
-		&industry, &releaseDate, &actorID, &characterID,
-		&directorID, &imageURL, &bechdel, &wikiURL, &imdbURL,
-		&rottentomURL, &createdByID, &createdBy, &createdDate); err != nil {
+		&industry, &releaseDate, &imageURL, &bechdel, &wikiURL, &imdbURL,
+		&rottentomURL, &createdByID, &createdBy, &createdDate,
+		&rubricVersion, &assessments, &inclusionScore, &disqualified,
+		&bechdelDisputed, &bechdelSource, &bechdelSourceURL, &tags,
+		&deletedAt, &deletedByID, &deletedBy); err != nil {
 		return nil, err
 	}
+	evals, err := unmarshalEvaluations(assessments.String)
+	if err != nil {
+		return nil, fmt.Errorf("bad assessments for media %d: %v", id, err)
+	}
+	var tagList []string
+	if tags.Valid {
+		if err := json.Unmarshal([]byte(tags.String), &tagList); err != nil {
+			return nil, fmt.Errorf("bad tags for media %d: %v", id, err)
+		}
+	}
 
 	media := &Media{
 		ID:            id,
@@ -264,12 +371,8 @@ func scanMedia(s rowScanner) (*Media, error) {
 		Industry:      industry.String,
 		ReleaseDate:   releaseDate.String,
 
-		ActorID:	   actorID.Int64,
-		CharacterID:   characterID.Int64,
-		DirectorID:    directorID.Int64,
-
 		ImageURL:      imageURL.String,
-		Bechdel:	   bechdel.Bool,
+		Bechdel:	   bechdelFromSQL(bechdel, bechdelDisputed, bechdelSource, bechdelSourceURL),
 		WikiURL:	   wikiURL.String,
 		IMDBURL:	   imdbURL.String,
 		RottenTomURL:  rottentomURL.String,
@@ -278,10 +381,216 @@ func scanMedia(s rowScanner) (*Media, error) {
 		CreatedBy:     createdBy.String,
 		CreatedDate:   createdDate.String,
 
+		RubricVersion:  int(rubricVersion.Int64),
+		Assessments:    evals,
+		InclusionScore: int(inclusionScore.Int64),
+		Disqualified:   disqualified.Bool,
+
+		Tags: tagList,
+
+		DeletedAt:   deletedAt.Time,
+		DeletedByID: deletedByID.Int64,
+		DeletedBy:   deletedBy.String,
 	}
 	return media, nil
 }
 
+// mediaValues returns the values of the insert and update statements' media
+// columns, in order. Tags are a JSON list, NULL when there are none, and
+// releaseYear is kept for QueryMedia.
+func mediaValues(m *Media) ([]interface{}, error) {
+	assessments, err := marshalEvaluations(m.Assessments)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode assessments: %v", err)
+	}
+	var tags sql.NullString
+	if len(m.Tags) > 0 {
+		b, err := json.Marshal(m.Tags)
+		if err != nil {
+			return nil, fmt.Errorf("could not encode tags: %v", err)
+		}
+		tags = sql.NullString{String: string(b), Valid: true}
+	}
+	releaseYear := sql.NullInt64{Int64: int64(m.ReleaseYear()), Valid: m.ReleaseYear() != 0}
+	return []interface{}{m.Title, m.Description,
+		m.MediaType, m.Industry, m.ReleaseDate, m.ImageURL, m.Bechdel.sqlLevel(),
+		m.WikiURL, m.IMDBURL, m.RottenTomURL, m.CreatedByID,
+		m.CreatedBy, m.CreatedDate,
+		m.RubricVersion, assessments, m.InclusionScore, m.Disqualified,
+		m.Bechdel.Disputed, m.Bechdel.Source, m.Bechdel.SourceURL,
+		tags, releaseYear}, nil
+}
+
+// mediaQuerySQL returns the WHERE, ORDER BY and LIMIT clauses selecting the
+// media q asks for, and their arguments. With after set, only media sorting
+// after those sort key values are selected (see mediaSortKeys); with limit
+// set, at most that many. param returns the placeholder of the nth argument,
+// and hasTag is the condition that media has the tag in the placeholder %s.
+func mediaQuerySQL(q *MediaQuery, after []interface{}, limit int, param func(n int) string, hasTag string) (string, []interface{}) {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return param(len(args))
+	}
+	where := mediaFilterSQL(q, arg, hasTag)
+
+	// Media after the cursor: (k1 > v1) OR (k1 = v1 AND k2 > v2) OR ...
+	keys := mediaSortKeys[q.Sort]
+	if after != nil {
+		var or []string
+		for i, k := range keys {
+			var and []string
+			for j := 0; j < i; j++ {
+				and = append(and, keys[j].sql+" = "+arg(after[j]))
+			}
+			op := " > "
+			if k.desc {
+				op = " < "
+			}
+			and = append(and, k.sql+op+arg(after[i]))
+			or = append(or, "("+strings.Join(and, " AND ")+")")
+		}
+		where = append(where, "("+strings.Join(or, " OR ")+")")
+	}
+
+	var clauses string
+	if len(where) > 0 {
+		clauses = " WHERE " + strings.Join(where, " AND ")
+	}
+	var order []string
+	for _, k := range keys {
+		if k.desc {
+			order = append(order, k.sql+" DESC")
+		} else {
+			order = append(order, k.sql)
+		}
+	}
+	clauses += " ORDER BY " + strings.Join(order, ", ")
+	if limit > 0 {
+		clauses += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	return clauses, args
+}
+
+// mediaFilterSQL returns the conditions selecting the media q asks for,
+// leaving out media in the trash. arg adds an argument and returns its
+// placeholder; hasTag is as for mediaQuerySQL.
+func mediaFilterSQL(q *MediaQuery, arg func(v interface{}) string, hasTag string) []string {
+	where := []string{"deletedAt IS NULL"}
+	add := func(cond string, v interface{}) {
+		where = append(where, fmt.Sprintf(cond, arg(v)))
+	}
+	if q.MediaType != "" {
+		add("mediaType = %s", q.MediaType)
+	}
+	if q.Industry != "" {
+		add("industry = %s", q.Industry)
+	}
+	if q.Decade != 0 {
+		add("releaseYear >= %s", q.Decade)
+		add("releaseYear < %s", q.Decade+10)
+	}
+	// bechdel is the level, see Bechdel.sqlLevel.
+	switch q.Bechdel {
+	case "pass":
+		where = append(where, "bechdel = 3")
+	case "fail":
+		where = append(where, "bechdel < 3")
+	case "unrated":
+		where = append(where, "bechdel IS NULL")
+	}
+	if q.MinScore != 0 {
+		add("inclusionScore >= %s", q.MinScore)
+	}
+	if q.HideFlagged {
+		where = append(where, "NOT disqualified")
+	}
+	for _, t := range q.Tags {
+		add(hasTag, t)
+	}
+	return where
+}
+
+// facetSQL is how mediaCountSQL counts a facet: by the value of key, over the
+// matching media m joined with the tables in from, where cond holds.
+type facetSQL struct {
+	key, from, cond string
+}
+
+// facetsSQL are the facets mediaCountSQL counts. Tags, whose table depends on
+// the database, are counted over its eachTag.
+var facetsSQL = map[string]facetSQL{
+	facetMediaType: {key: "m.mediaType"},
+	facetIndustry:  {key: "m.industry"},
+	facetDecade:    {key: "m.releaseYear / 10 * 10"},
+	facetBechdel: {key: `CASE WHEN m.bechdel IS NULL THEN 'unrated'
+		WHEN m.bechdel = 3 THEN 'pass' ELSE 'fail' END`},
+	facetScore: {
+		key:  "t.threshold",
+		from: ", (" + scoreThresholdsSQL() + ") AS t",
+		cond: " WHERE m.inclusionScore >= t.threshold",
+	},
+	facetTag: {key: "tag.value"},
+}
+
+// scoreThresholdsSQL returns a query of the scoreThresholds, as threshold.
+func scoreThresholdsSQL() string {
+	var selects []string
+	for _, t := range scoreThresholds {
+		selects = append(selects, "SELECT "+t+" AS threshold")
+	}
+	return strings.Join(selects, " UNION ALL ")
+}
+
+// mediaCountSQL returns the statement counting the media q asks for by the
+// values of facet, and its arguments. param and hasTag are as for
+// mediaQuerySQL, and eachTag is the table of the tags of the media m, with
+// the tag in its column value.
+func mediaCountSQL(q *MediaQuery, facet string, param func(n int) string, hasTag, eachTag string) (string, []interface{}, error) {
+	f, ok := facetsSQL[facet]
+	if !ok {
+		return "", nil, fmt.Errorf("no facet %q", facet)
+	}
+	if facet == facetTag {
+		f.from = ", " + eachTag
+	}
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return param(len(args))
+	}
+	where := mediaFilterSQL(q, arg, hasTag)
+	return `SELECT ` + f.key + `, COUNT(*)
+		FROM (SELECT * FROM media WHERE ` + strings.Join(where, " AND ") + `) AS m` + f.from + f.cond + `
+		GROUP BY 1`, args, nil
+}
+
+// countMedia runs the statement of mediaCountSQL, leaving out media without a
+// value. prefix names the backend in errors.
+func countMedia(ctx context.Context, prefix string, conn *sql.DB, query string, args []interface{}) (map[string]int, error) {
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: could not count media: %v", prefix, err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var value sql.NullString
+		var n int
+		if err := rows.Scan(&value, &n); err != nil {
+			return nil, fmt.Errorf("%s: could not read row: %v", prefix, err)
+		}
+		if value.String != "" {
+			counts[value.String] = n
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: could not read rows: %v", prefix, err)
+	}
+	return counts, nil
+}
+
 // execAffectingOneRow executes a given statement, expecting one row to be affected.
 func execAffectingOneRow(stmt *sql.Stmt, args ...interface{}) (sql.Result, error) {
 	r, err := stmt.Exec(args...)
@@ -303,11 +612,8 @@ func execAffectingOneRow(stmt *sql.Stmt, args ...interface{}) (sql.Result, error
 // GetMedia retrieves media by its ID.
 func (db *pgsqlDB) GetMedia(id int64) (*Media, error) {
 	media, err := scanMedia(db.get.QueryRow(id))
-
-	log.Printf("GET MEDIA | %v", media)
-
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("postgreSQL: could not find media with id %d", id)
+		return nil, fmt.Errorf("postgreSQL: media with id %d %w", id, errNotFound)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("postgreSQL: could not get media: %v", err)
@@ -317,14 +623,6 @@ func (db *pgsqlDB) GetMedia(id int64) (*Media, error) {
 
 // ListMedia returns a list of media, ordered by title.
 func (db *pgsqlDB) ListMedia() ([]*Media, error) {
-	rand.Seed(time.Now().Unix())
-	tempPhotoList := []string{
-		"http://media.tmz.com/2013/12/13/1213-grumpy-1.jpg",
-		"https://blog.hubspot.com/hubfs/cats-hollywood.jpg",
-		"https://www.fuzzyfuzzlet.com/MTV/Dollface-Persian-Kitten_Directors-Chair.jpg",
-		"https://placekitten.com/g/200/300",
-	}
-
 	rows, err := db.list.Query()
 	if err != nil {
 		return nil, err
@@ -332,22 +630,80 @@ func (db *pgsqlDB) ListMedia() ([]*Media, error) {
 	defer rows.Close()
 
 	var mediaList []*Media
-	n:=0
 	for rows.Next() {
 		media, err := scanMedia(rows)
 		if err != nil {
 			return nil, fmt.Errorf("postgreSQL: could not read row: %v", err)
 		}
-		if media.ImageURL == "" {
-			n = rand.Int() % len(tempPhotoList)
-		}
-		media.ImageURL = (tempPhotoList[n])
 		mediaList = append(mediaList, media)
 	}
 
 	return mediaList, nil
 }
 
+// QueryMedia returns the media matching q, in the order it asks for.
+func (db *pgsqlDB) QueryMedia(q *MediaQuery) ([]*Media, error) {
+	clauses, args := mediaQuerySQL(q, nil, 0, pgParam, pgHasTag)
+	return db.queryMedia(clauses, args)
+}
+
+// CountMedia returns the number of media matching q with each value of
+// facet, counted by the database.
+func (db *pgsqlDB) CountMedia(ctx context.Context, q *MediaQuery, facet string) (map[string]int, error) {
+	query, args, err := mediaCountSQL(q, facet, pgParam, pgHasTag, pgEachTag)
+	if err != nil {
+		return nil, fmt.Errorf("postgreSQL: %v", err)
+	}
+	return countMedia(ctx, "postgreSQL", db.conn, query, args)
+}
+
+// PageMedia returns the page of size media matching q that follows cursor.
+func (db *pgsqlDB) PageMedia(q *MediaQuery, cursor string, size int) (*MediaPage, error) {
+	after, err := decodeCursor(cursor, q.Sort)
+	if err != nil {
+		return nil, fmt.Errorf("postgreSQL: %w", err)
+	}
+	// One more row than the page tells whether there is a next page.
+	clauses, args := mediaQuerySQL(q, after, size+1, pgParam, pgHasTag)
+	media, err := db.queryMedia(clauses, args)
+	if err != nil {
+		return nil, err
+	}
+	return trimPage(media, q, size), nil
+}
+
+// pgParam is the mediaQuerySQL and mediaCountSQL argument for Postgres.
+func pgParam(n int) string { return fmt.Sprintf("$%d", n) }
+
+// pgHasTag and pgEachTag are the mediaQuerySQL and mediaCountSQL
+// arguments for Postgres.
+const (
+	pgHasTag  = "tags::jsonb @> jsonb_build_array(%s::text)"
+	pgEachTag = "jsonb_array_elements_text(m.tags::jsonb) AS tag(value)"
+)
+
+// queryMedia selects the media with the given clauses.
+func (db *pgsqlDB) queryMedia(clauses string, args []interface{}) ([]*Media, error) {
+	rows, err := db.conn.Query(`SELECT `+mediaColumns+` FROM media`+clauses, args...)
+	if err != nil {
+		return nil, fmt.Errorf("postgreSQL: could not query media: %v", err)
+	}
+	defer rows.Close()
+
+	var mediaList []*Media
+	for rows.Next() {
+		media, err := scanMedia(rows)
+		if err != nil {
+			return nil, fmt.Errorf("postgreSQL: could not read row: %v", err)
+		}
+		mediaList = append(mediaList, media)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgreSQL: could not read rows: %v", err)
+	}
+	return mediaList, nil
+}
+
 // ListBooksCreatedBy returns a list of books, ordered by title, filtered by
 // the user who created the book entry.
 func (db *pgsqlDB) ListMediaCreatedBy(userID int64) ([]*Media, error) {
@@ -376,61 +732,159 @@ func (db *pgsqlDB) ListMediaCreatedBy(userID int64) ([]*Media, error) {
 
 /*---------------------------  Create/Add  ---------------------------*/
 
-// CreateTable creates the table, and if necessary, the database.
-func createTable(conn *sql.DB) error {
-	for _, stmt := range createTableStatements {
-		_, err := conn.Exec(stmt)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 // Save media, assigning it a new ID.
-func (db *pgsqlDB) AddMedia(m *Media) (id int64, err error) {
-	r, err := execAffectingOneRow(db.insert, m.Title, m.Description,
-		m.MediaType, m.Industry, m.ReleaseDate, m.ActorID,
-		m.CharacterID, m.DirectorID, m.ImageURL, m.Bechdel,
-		m.WikiURL, m.IMDBURL, m.RottenTomURL, m.CreatedByID,
-		m.CreatedBy, m.CreatedDate)
+//
+// The Postgres driver does not support LastInsertId, so the ID generated by
+// the identity column comes back through INSERT ... RETURNING id.
+func (db *pgsqlDB) AddMedia(m *Media, events ...*Event) (id int64, err error) {
+	values, err := mediaValues(m)
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("postgreSQL: %v", err)
 	}
-
-	lastInsertID, err := r.LastInsertId()
+	err = withEvents("postgreSQL", db.conn, db.insertOutbox, events, func(tx *sql.Tx) error {
+		if err := tx.Stmt(db.insert).QueryRow(values...).Scan(&id); err != nil {
+			return fmt.Errorf("postgreSQL: could not insert media: %v", err)
+		}
+		m.ID = id
+		setEventMediaID(events, id)
+		return nil
+	})
 	if err != nil {
-		return 0, fmt.Errorf("postgreSQL: could not get last insert ID: %v", err)
+		return 0, err
 	}
-	return lastInsertID, nil
+	return id, nil
 }
 
 
 /*---------------------------  Update  ---------------------------*/
 
-// Updatemedia updates the entry for a given media.
-func (db *pgsqlDB) UpdateMedia(m *Media) error {
+// Updatemedia updates the entry for a given media. The error wraps
+// errNotFound if it does not exist or is in the trash.
+func (db *pgsqlDB) UpdateMedia(m *Media, events ...*Event) error {
 	if m.ID == 0 {
 		return errors.New("postgreSQL: media with unassigned ID passed into update")
 	}
 
-	_, err := execAffectingOneRow(db.update, m.Title, m.Description,
-		m.MediaType, m.Industry, m.ReleaseDate, m.ActorID,
-		m.CharacterID, m.DirectorID, m.ImageURL, m.Bechdel,
-		m.WikiURL, m.IMDBURL, m.RottenTomURL, m.CreatedByID,
-		m.CreatedBy, m.CreatedDate, m.ID)
-	return err
+	values, err := mediaValues(m)
+	if err != nil {
+		return fmt.Errorf("postgreSQL: %v", err)
+	}
+	return withEvents("postgreSQL", db.conn, db.insertOutbox, events, func(tx *sql.Tx) error {
+		return execOnMedia("postgreSQL", tx.Stmt(db.update), m.ID, append(values, m.ID)...)
+	})
+}
+
+// ChangeMedia reads a given media and saves the changes change makes to it.
+// The row is locked from when it is read.
+func (db *pgsqlDB) ChangeMedia(id int64, change func(m *Media) (bool, []*Event)) error {
+	return changeMedia("postgreSQL", db.conn, db.getForUpdate, db.update, db.insertOutbox, id, change)
+}
+
+// changeMedia reads the media with the given ID with get, and saves the
+// changes change makes to it with update, in one transaction with the events
+// of the change. prefix names the backend in errors.
+func changeMedia(prefix string, conn *sql.DB, get, update, insertOutbox *sql.Stmt, id int64, change func(*Media) (bool, []*Event)) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: could not begin transaction: %v", prefix, err)
+	}
+	defer tx.Rollback()
+
+	m, err := scanMedia(tx.Stmt(get).QueryRow(id))
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%s: media with id %d %w", prefix, id, errNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: could not get media: %v", prefix, err)
+	}
+	changed, events := change(m)
+	if !changed {
+		return nil
+	}
+	values, err := mediaValues(m)
+	if err != nil {
+		return fmt.Errorf("%s: %v", prefix, err)
+	}
+	if err := execOnMedia(prefix, tx.Stmt(update), id, append(values, id)...); err != nil {
+		return err
+	}
+	if err := addEvents(prefix, tx, insertOutbox, events); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: could not commit: %v", prefix, err)
+	}
+	return nil
 }
 
 
 /*---------------------------  Delete  ---------------------------*/
 
 
-// DeleteMedia removes a given book by its ID.
-func (db *pgsqlDB) DeleteMedia(id int64) error {
+// DeleteMedia moves a given media to the trash.
+func (db *pgsqlDB) DeleteMedia(id int64, byID int64, by string, events ...*Event) error {
 	if id == 0 {
 		return errors.New("postgreSQL: media with unassigned ID passed into deleteMedia")
 	}
-	_, err := execAffectingOneRow(db.delete, id)
-	return err
-}
\ No newline at end of file
+	return withEvents("postgreSQL", db.conn, db.insertOutbox, events, func(tx *sql.Tx) error {
+		return execOnMedia("postgreSQL", tx.Stmt(db.trash), id, time.Now(), nullID(byID), by, id)
+	})
+}
+
+// ListDeletedMedia returns the media in the trash, most recently deleted
+// first.
+func (db *pgsqlDB) ListDeletedMedia() ([]*Media, error) {
+	rows, err := db.listDeleted.Query()
+	if err != nil {
+		return nil, fmt.Errorf("postgreSQL: could not list deleted media: %v", err)
+	}
+	defer rows.Close()
+
+	var mediaList []*Media
+	for rows.Next() {
+		media, err := scanMedia(rows)
+		if err != nil {
+			return nil, fmt.Errorf("postgreSQL: could not read row: %v", err)
+		}
+		mediaList = append(mediaList, media)
+	}
+	return mediaList, rows.Err()
+}
+
+// RestoreMedia takes a given media out of the trash.
+func (db *pgsqlDB) RestoreMedia(id int64, events ...*Event) error {
+	return withEvents("postgreSQL", db.conn, db.insertOutbox, events, func(tx *sql.Tx) error {
+		return execOnMedia("postgreSQL", tx.Stmt(db.restore), id, id)
+	})
+}
+
+// PurgeMedia permanently removes a given media in the trash. Its characters
+// and credits go with it, see migration 3 in db-migrate.go.
+func (db *pgsqlDB) PurgeMedia(id int64) error {
+	return execOnMedia("postgreSQL", db.delete, id, id)
+}
+
+// execOnMedia runs stmt, which changes the media with the given ID if it is
+// in or out of the trash as the statement expects. The error wraps
+// errNotFound if it changed nothing. prefix names the backend in errors.
+func execOnMedia(prefix string, stmt *sql.Stmt, id int64, args ...interface{}) error {
+	return execOnRow(prefix, "media", stmt, id, args...)
+}
+
+// execOnRow runs stmt, which changes the row of the given kind, such as
+// "person", with the given ID. The error wraps errNotFound if it changed
+// nothing. prefix names the backend in errors.
+func execOnRow(prefix, kind string, stmt *sql.Stmt, id int64, args ...interface{}) error {
+	r, err := stmt.Exec(args...)
+	if err != nil {
+		return fmt.Errorf("%s: could not execute statement: %v", prefix, err)
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: could not get rows affected: %v", prefix, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %s with id %d %w", prefix, kind, id, errNotFound)
+	}
+	return nil
+}
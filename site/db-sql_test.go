@@ -0,0 +1,126 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPgSQLConfigDataStoreName(t *testing.T) {
+	old := DBName
+	DBName = "fts"
+	defer func() { DBName = old }()
+
+	for _, tt := range []struct {
+		name   string
+		config PgSQLConfig
+		want   string
+	}{
+		{"tcp", PgSQLConfig{Username: "site", Password: "pw", Host: "10.0.0.3", Port: 6432},
+			`host='10.0.0.3' port='6432' dbname='fts' user='site' password='pw'`},
+		{"default port", PgSQLConfig{Username: "site", Host: "localhost"},
+			`host='localhost' dbname='fts' user='site'`},
+		{"certificates", PgSQLConfig{Host: "10.0.0.3", SSLMode: "verify-ca",
+			SSLRootCert: "/certs/server-ca.pem", SSLCert: "/certs/client.pem", SSLKey: "/certs/client.key"},
+			`host='10.0.0.3' dbname='fts' sslmode='verify-ca' sslrootcert='/certs/server-ca.pem' sslcert='/certs/client.pem' sslkey='/certs/client.key'`},
+		{"unix socket", PgSQLConfig{Username: "site", UnixSocket: "/cloudsql/p:r:i"},
+			`host='/cloudsql/p:r:i' dbname='fts' user='site' sslmode='disable'`},
+		{"unix socket with SSL", PgSQLConfig{UnixSocket: "/cloudsql/p:r:i", SSLMode: "require"},
+			`host='/cloudsql/p:r:i' dbname='fts' sslmode='require'`},
+		{"quoting", PgSQLConfig{Host: "db", Password: `it's a \secret`},
+			`host='db' dbname='fts' password='it\'s a \\secret'`},
+	} {
+		if got := tt.config.dataStoreName(); got != tt.want {
+			t.Errorf("%s: dataStoreName() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// newTestPgSQLDB returns a pgsqlDB on an empty, migrated schema; see
+// newTestPgConn.
+func newTestPgSQLDB(t *testing.T) *pgsqlDB {
+	t.Helper()
+	db, err := newPgSQLDBFromConn(newTestPgConn(t), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestPgSQLAddMedia(t *testing.T) {
+	db := newTestPgSQLDB(t)
+
+	// The IDs come from AddMedia's RETURNING id.
+	ids := make(map[int64]bool)
+	for _, title := range []string{"Alien", "Aliens"} {
+		m := &Media{Title: title, ReleaseDate: "1979"}
+		id, err := db.AddMedia(m, newMediaEvent(EventMediaCreated, m, 0, "test"))
+		if err != nil {
+			t.Fatalf("AddMedia: %v", err)
+		}
+		if id == 0 || ids[id] || m.ID != id {
+			t.Fatalf("AddMedia returned ID %d, media has %d, seen %v", id, m.ID, ids)
+		}
+		ids[id] = true
+
+		got, err := db.GetMedia(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Title != title || got.ReleaseYear() != 1979 {
+			t.Errorf("GetMedia(%d) = %+v, want %s from 1979", id, got, title)
+		}
+	}
+	events, err := db.ListOutbox(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || !ids[events[0].MediaID] || !ids[events[1].MediaID] {
+		t.Errorf("ListOutbox = %v, want an event for each of %v", events, ids)
+	}
+}
+
+func TestPgSQLCreateRedirect(t *testing.T) {
+	useDB(t, newTestPgSQLDB(t))
+	moderator := addTestUser(t, RoleModerator)
+
+	form := url.Values{"title": {"Alien"}, "directors": {"Ridley Scott"}}
+	req := httptest.NewRequest("POST", "/media", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := serveAs(t, req, moderator)
+	if w.Code != http.StatusFound {
+		t.Fatalf("POST /media = %d %s, want a redirect", w.Code, w.Body.String())
+	}
+
+	list, err := DB.ListMedia()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("ListMedia = %v, want the new media", list)
+	}
+	loc := w.Header().Get("Location")
+	if want := fmt.Sprintf("/media/%d", list[0].ID); loc != want {
+		t.Errorf("POST /media redirected to %s, want %s", loc, want)
+	}
+	if w := serveAs(t, httptest.NewRequest("GET", loc, nil), nil); w.Code != http.StatusOK {
+		t.Errorf("GET %s = %d", loc, w.Code)
+	}
+}
@@ -0,0 +1,1035 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	// Pure Go SQLite driver, so the site still builds as a single binary.
+	_ "modernc.org/sqlite"
+)
+
+/*---------------------------  Core Structures  ---------------------------*/
+
+// sqliteDB persists media to an embedded SQLite database file.
+type sqliteDB struct {
+	conn *sql.DB
+
+	list   *sql.Stmt
+	listBy *sql.Stmt
+	insert *sql.Stmt
+	get    *sql.Stmt
+	update *sql.Stmt
+	delete *sql.Stmt
+
+	trash, restore, listDeleted *sql.Stmt
+
+	listPeople, getPerson, insertPerson, updatePerson, deletePerson                 *sql.Stmt
+	listCharacters, getCharacter, insertCharacter, updateCharacter, deleteCharacter *sql.Stmt
+	listCredits, listAllCredits, listPersonCredits, insertCredit, deleteCredit      *sql.Stmt
+
+	getUser, getUserByIdentity, insertUser, updateUser, listUsers *sql.Stmt
+
+	getSubmission, listSubmissions, listSubmissionsBy, insertSubmission, updateSubmission *sql.Stmt
+
+	getRevision, listRevisions, insertRevision *sql.Stmt
+
+	listOutbox, insertOutbox, deleteOutbox *sql.Stmt
+}
+
+// Ensure sqliteDB conforms to the MediaDatabase interface.
+var _ MediaDatabase = &sqliteDB{}
+
+/*---------------------------  Statements  ---------------------------*/
+
+// Statements select mediaColumns rather than *, so files created before a
+// column was dropped keep working.
+var sqliteCreateTableStatements = []string{
+	`CREATE TABLE IF NOT EXISTS media (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		title TEXT NULL,
+		description TEXT NULL,
+		mediaType TEXT NULL,
+		industry TEXT NULL,
+		releaseDate TEXT NULL,
+		imageURL TEXT NULL,
+		bechdel INTEGER NULL,
+		wikiURL TEXT NULL,
+		imdbURL TEXT NULL,
+		rottentomURL TEXT NULL,
+		createdById INTEGER NULL,
+		createdBy TEXT NULL,
+		createdDate TEXT NULL,
+		rubricVersion INTEGER NULL,
+		assessments TEXT NULL,
+		inclusionScore INTEGER NOT NULL DEFAULT 0,
+		disqualified BOOLEAN NOT NULL DEFAULT FALSE,
+		bechdelDisputed BOOLEAN NOT NULL DEFAULT FALSE,
+		bechdelSource TEXT NULL,
+		bechdelSourceURL TEXT NULL,
+		tags TEXT NULL,
+		releaseYear INTEGER NULL,
+		deletedAt DATETIME NULL,
+		deletedById INTEGER NULL,
+		deletedBy TEXT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS media_title ON media (title)`,
+	`CREATE INDEX IF NOT EXISTS media_createdById ON media (createdById, title)`,
+	`CREATE TABLE IF NOT EXISTS people (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		bio TEXT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS characters (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		mediaId INTEGER NOT NULL REFERENCES media (id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		bio TEXT NULL,
+		evaluations TEXT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS characters_mediaId ON characters (mediaId)`,
+	`CREATE TABLE IF NOT EXISTS credits (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		mediaId INTEGER NOT NULL REFERENCES media (id) ON DELETE CASCADE,
+		personId INTEGER NOT NULL REFERENCES people (id) ON DELETE CASCADE,
+		role TEXT NOT NULL,
+		characterId INTEGER NULL REFERENCES characters (id) ON DELETE SET NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS credits_mediaId ON credits (mediaId)`,
+	`CREATE INDEX IF NOT EXISTS credits_personId ON credits (personId)`,
+	`CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		name TEXT NULL,
+		email TEXT NULL,
+		createdDate TEXT NULL,
+		role TEXT NOT NULL DEFAULT 'contributor',
+		UNIQUE (issuer, subject)
+	)`,
+	`CREATE TABLE IF NOT EXISTS submissions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		mediaId INTEGER NULL,
+		media TEXT NOT NULL,
+		justification TEXT NULL,
+		status TEXT NOT NULL,
+		submittedById INTEGER NULL,
+		submittedBy TEXT NULL,
+		submittedDate TEXT NULL,
+		reviewedById INTEGER NULL,
+		reviewedBy TEXT NULL,
+		reviewedDate TEXT NULL,
+		reason TEXT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS submissions_status ON submissions (status, id)`,
+	`CREATE INDEX IF NOT EXISTS submissions_submittedById ON submissions (submittedById, id)`,
+	`CREATE TABLE IF NOT EXISTS revisions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		mediaId INTEGER NOT NULL,
+		media TEXT NOT NULL,
+		deleted BOOLEAN NOT NULL DEFAULT 0,
+		authorId INTEGER NULL,
+		author TEXT NULL,
+		date DATETIME NOT NULL,
+		summary TEXT NULL,
+		submissionId INTEGER NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS revisions_mediaId ON revisions (mediaId, id)`,
+	`CREATE TABLE IF NOT EXISTS outbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type TEXT NOT NULL,
+		data TEXT NOT NULL,
+		created DATETIME NOT NULL
+	)`,
+}
+
+// sqliteAddedColumns are columns added to tables after they were first
+// released. CREATE TABLE IF NOT EXISTS leaves existing files alone, so
+// sqliteAddColumns adds any that are missing, then runs their backfill.
+var sqliteAddedColumns = []struct {
+	table, column, decl string
+	backfill            string
+}{
+	{"characters", "evaluations", "TEXT NULL", ""},
+	{"media", "rubricVersion", "INTEGER NULL", ""},
+	{"media", "assessments", "TEXT NULL", ""},
+	{"media", "inclusionScore", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"media", "disqualified", "BOOLEAN NOT NULL DEFAULT FALSE", ""},
+	// bechdel was a boolean the site always set to false; it now holds the
+	// Bechdel level, NULL when unrated. See migration 6 in db-migrate.go.
+	{"media", "bechdelDisputed", "BOOLEAN NOT NULL DEFAULT FALSE",
+		`UPDATE media SET bechdel = CASE WHEN bechdel THEN 3 ELSE NULL END`},
+	{"media", "bechdelSource", "TEXT NULL", ""},
+	{"media", "bechdelSourceURL", "TEXT NULL", ""},
+	{"media", "tags", "TEXT NULL", ""},
+	// SQLite has no regular expressions, so only years at the start or end
+	// of releaseDate are backfilled, with releaseYearPattern's 18, 19 and 20
+	// prefixes. Saving media sets the rest.
+	{"media", "releaseYear", "INTEGER NULL",
+		`UPDATE media SET releaseYear = CASE
+			WHEN substr(releaseDate, 1, 2) IN ('18', '19', '20') AND (releaseDate GLOB '[0-9][0-9][0-9][0-9]'
+				OR releaseDate GLOB '[0-9][0-9][0-9][0-9][^0-9]*') THEN CAST(substr(releaseDate, 1, 4) AS INTEGER)
+			WHEN substr(releaseDate, -4, 2) IN ('18', '19', '20') AND releaseDate GLOB '*[^0-9][0-9][0-9][0-9][0-9]'
+				THEN CAST(substr(releaseDate, -4) AS INTEGER)
+		END`},
+	{"users", "role", "TEXT NOT NULL DEFAULT 'contributor'", ""},
+	{"media", "deletedAt", "DATETIME NULL", ""},
+	{"media", "deletedById", "INTEGER NULL", ""},
+	{"media", "deletedBy", "TEXT NULL", ""},
+	{"revisions", "submissionId", "INTEGER NULL", ""},
+}
+
+const sqliteGetStatement = `SELECT ` + mediaColumns + ` FROM media WHERE id = ? AND deletedAt IS NULL`
+
+const sqliteListStatement = `
+  SELECT ` + mediaColumns + ` FROM media WHERE deletedAt IS NULL ORDER BY title, id`
+
+const sqliteListByStatement = `
+  SELECT ` + mediaColumns + ` FROM media WHERE createdById = ? AND deletedAt IS NULL ORDER BY title, id`
+
+const sqliteListDeletedStatement = `
+  SELECT ` + mediaColumns + ` FROM media WHERE deletedAt IS NOT NULL ORDER BY deletedAt DESC, id DESC`
+
+const sqliteInsertStatement = `
+  INSERT INTO media (title, description, mediaType,
+		industry, releaseDate, imageURL, bechdel, wikiURL, imdbURL,
+		rottentomURL, createdById, createdBy, createdDate,
+		rubricVersion, assessments, inclusionScore, disqualified,
+		bechdelDisputed, bechdelSource, bechdelSourceURL, tags, releaseYear
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+const sqliteTrashStatement = `
+  UPDATE media SET deletedAt=?, deletedById=?, deletedBy=? WHERE id = ? AND deletedAt IS NULL`
+
+const sqliteRestoreStatement = `
+  UPDATE media SET deletedAt=NULL, deletedById=NULL, deletedBy=NULL
+  WHERE id = ? AND deletedAt IS NOT NULL`
+
+const sqliteDeleteStatement = `DELETE FROM media WHERE id = ? AND deletedAt IS NOT NULL`
+
+const sqliteUpdateStatement = `
+  UPDATE media
+  SET title=?, description=?, mediaType=?, industry=?,
+		releaseDate=?, imageURL=?, bechdel=?, wikiURL=?, imdbURL=?,
+		rottentomURL=?, createdById=?, createdBy=?, createdDate=?,
+		rubricVersion=?, assessments=?, inclusionScore=?, disqualified=?,
+		bechdelDisputed=?, bechdelSource=?, bechdelSourceURL=?,
+		tags=?, releaseYear=?
+  WHERE id = ? AND deletedAt IS NULL`
+
+// The people statements mirror those in db-sql-people.go.
+
+const sqliteListPeopleStatement = `SELECT id, name, bio FROM people ORDER BY name, id`
+
+const sqliteGetPersonStatement = `SELECT id, name, bio FROM people WHERE id = ?`
+
+const sqliteInsertPersonStatement = `INSERT INTO people (name, bio) VALUES (?, ?)`
+
+const sqliteUpdatePersonStatement = `UPDATE people SET name=?, bio=? WHERE id = ?`
+
+const sqliteDeletePersonStatement = `DELETE FROM people WHERE id = ?`
+
+const sqliteListCharactersStatement = `
+  SELECT id, mediaId, name, bio, evaluations FROM characters WHERE mediaId = ? ORDER BY name, id`
+
+const sqliteGetCharacterStatement = `
+  SELECT id, mediaId, name, bio, evaluations FROM characters WHERE id = ?`
+
+const sqliteInsertCharacterStatement = `
+  INSERT INTO characters (mediaId, name, bio, evaluations) VALUES (?, ?, ?, ?)`
+
+const sqliteUpdateCharacterStatement = `
+  UPDATE characters SET mediaId=?, name=?, bio=?, evaluations=? WHERE id = ?`
+
+const sqliteDeleteCharacterStatement = `DELETE FROM characters WHERE id = ?`
+
+const sqliteListCreditsStatement = `
+  SELECT id, mediaId, personId, role, characterId FROM credits WHERE mediaId = ? ORDER BY id`
+
+const sqliteListAllCreditsStatement = `
+  SELECT id, mediaId, personId, role, characterId FROM credits ORDER BY id`
+
+const sqliteListPersonCreditsStatement = `
+  SELECT id, mediaId, personId, role, characterId FROM credits WHERE personId = ? ORDER BY id`
+
+const sqliteInsertCreditStatement = `
+  INSERT INTO credits (mediaId, personId, role, characterId) VALUES (?, ?, ?, ?)`
+
+const sqliteDeleteCreditStatement = `DELETE FROM credits WHERE id = ?`
+
+// The user statements mirror those in db-sql-users.go.
+
+const sqliteGetUserStatement = `SELECT ` + userColumns + ` FROM users WHERE id = ?`
+
+const sqliteGetUserByIdentityStatement = `
+  SELECT ` + userColumns + ` FROM users WHERE issuer = ? AND subject = ?`
+
+const sqliteListUsersStatement = `SELECT ` + userColumns + ` FROM users ORDER BY id`
+
+const sqliteInsertUserStatement = `
+  INSERT INTO users (issuer, subject, name, email, createdDate, role) VALUES (?, ?, ?, ?, ?, ?)`
+
+const sqliteUpdateUserStatement = `
+  UPDATE users SET issuer=?, subject=?, name=?, email=?, createdDate=?, role=? WHERE id = ?`
+
+// The submission statements mirror those in db-sql-submissions.go.
+
+const sqliteGetSubmissionStatement = `SELECT ` + submissionColumns + ` FROM submissions WHERE id = ?`
+
+const sqliteListSubmissionsStatement = `
+  SELECT ` + submissionColumns + ` FROM submissions WHERE status = ? ORDER BY id`
+
+const sqliteListSubmissionsByStatement = `
+  SELECT ` + submissionColumns + ` FROM submissions WHERE submittedById = ? ORDER BY id DESC`
+
+const sqliteInsertSubmissionStatement = `
+  INSERT INTO submissions (mediaId, media, justification, status,
+    submittedById, submittedBy, submittedDate, reviewedById, reviewedBy, reviewedDate, reason)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+const sqliteUpdateSubmissionStatement = `
+  UPDATE submissions SET mediaId=?, media=?, justification=?, status=?,
+    submittedById=?, submittedBy=?, submittedDate=?, reviewedById=?, reviewedBy=?,
+    reviewedDate=?, reason=?
+  WHERE id = ?`
+
+// The revision statements mirror those in db-sql-revisions.go.
+
+const sqliteGetRevisionStatement = `SELECT ` + revisionColumns + ` FROM revisions WHERE id = ?`
+
+const sqliteListRevisionsStatement = `
+  SELECT ` + revisionColumns + ` FROM revisions WHERE mediaId = ? ORDER BY id`
+
+const sqliteInsertRevisionStatement = `
+  INSERT INTO revisions (mediaId, media, deleted, authorId, author, date, summary, submissionId)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+const sqliteListOutboxStatement = `SELECT id, data FROM outbox ORDER BY id LIMIT ?`
+
+const sqliteInsertOutboxStatement = `
+  INSERT INTO outbox (type, data, created) VALUES (?, ?, ?)`
+
+const sqliteDeleteOutboxStatement = `DELETE FROM outbox WHERE id = ?`
+
+/*---------------------------  Core Functions  ---------------------------*/
+
+// newSQLiteDB creates a new MediaDatabase backed by the SQLite file at path,
+// creating the file and its schema on first run.
+func newSQLiteDB(path string) (MediaDatabase, error) {
+	// Foreign keys are off by default in SQLite; credits rely on them to
+	// cascade deletes.
+	conn, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not open %s: %v", path, err)
+	}
+	// SQLite allows a single writer; serialise access through one connection.
+	conn.SetMaxOpenConns(1)
+
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sqlite: could not establish a good connection: %v", err)
+	}
+	for _, stmt := range sqliteCreateTableStatements {
+		if _, err := conn.Exec(stmt); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("sqlite: could not create schema: %v", err)
+		}
+	}
+	if err := sqliteAddColumns(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	db := &sqliteDB{
+		conn: conn,
+	}
+
+	// Prepared statements. The actual SQL queries are in the Statements
+	// section above.
+	if db.get, err = conn.Prepare(sqliteGetStatement); err != nil {
+		return nil, fmt.Errorf("sqlite: prepare get: %v", err)
+	}
+	if db.list, err = conn.Prepare(sqliteListStatement); err != nil {
+		return nil, fmt.Errorf("sqlite: prepare list: %v", err)
+	}
+	if db.listBy, err = conn.Prepare(sqliteListByStatement); err != nil {
+		return nil, fmt.Errorf("sqlite: prepare listBy: %v", err)
+	}
+	if db.insert, err = conn.Prepare(sqliteInsertStatement); err != nil {
+		return nil, fmt.Errorf("sqlite: prepare insert: %v", err)
+	}
+	if db.update, err = conn.Prepare(sqliteUpdateStatement); err != nil {
+		return nil, fmt.Errorf("sqlite: prepare update: %v", err)
+	}
+	if db.delete, err = conn.Prepare(sqliteDeleteStatement); err != nil {
+		return nil, fmt.Errorf("sqlite: prepare delete: %v", err)
+	}
+	for _, s := range []struct {
+		stmt  **sql.Stmt
+		query string
+		name  string
+	}{
+		{&db.trash, sqliteTrashStatement, "trash"},
+		{&db.restore, sqliteRestoreStatement, "restore"},
+		{&db.listDeleted, sqliteListDeletedStatement, "listDeleted"},
+		{&db.listPeople, sqliteListPeopleStatement, "listPeople"},
+		{&db.getPerson, sqliteGetPersonStatement, "getPerson"},
+		{&db.insertPerson, sqliteInsertPersonStatement, "insertPerson"},
+		{&db.updatePerson, sqliteUpdatePersonStatement, "updatePerson"},
+		{&db.deletePerson, sqliteDeletePersonStatement, "deletePerson"},
+		{&db.listCharacters, sqliteListCharactersStatement, "listCharacters"},
+		{&db.getCharacter, sqliteGetCharacterStatement, "getCharacter"},
+		{&db.insertCharacter, sqliteInsertCharacterStatement, "insertCharacter"},
+		{&db.updateCharacter, sqliteUpdateCharacterStatement, "updateCharacter"},
+		{&db.deleteCharacter, sqliteDeleteCharacterStatement, "deleteCharacter"},
+		{&db.listCredits, sqliteListCreditsStatement, "listCredits"},
+		{&db.listAllCredits, sqliteListAllCreditsStatement, "listAllCredits"},
+		{&db.listPersonCredits, sqliteListPersonCreditsStatement, "listPersonCredits"},
+		{&db.insertCredit, sqliteInsertCreditStatement, "insertCredit"},
+		{&db.deleteCredit, sqliteDeleteCreditStatement, "deleteCredit"},
+		{&db.getUser, sqliteGetUserStatement, "getUser"},
+		{&db.getUserByIdentity, sqliteGetUserByIdentityStatement, "getUserByIdentity"},
+		{&db.insertUser, sqliteInsertUserStatement, "insertUser"},
+		{&db.updateUser, sqliteUpdateUserStatement, "updateUser"},
+		{&db.listUsers, sqliteListUsersStatement, "listUsers"},
+		{&db.getSubmission, sqliteGetSubmissionStatement, "getSubmission"},
+		{&db.listSubmissions, sqliteListSubmissionsStatement, "listSubmissions"},
+		{&db.listSubmissionsBy, sqliteListSubmissionsByStatement, "listSubmissionsBy"},
+		{&db.insertSubmission, sqliteInsertSubmissionStatement, "insertSubmission"},
+		{&db.updateSubmission, sqliteUpdateSubmissionStatement, "updateSubmission"},
+		{&db.getRevision, sqliteGetRevisionStatement, "getRevision"},
+		{&db.listRevisions, sqliteListRevisionsStatement, "listRevisions"},
+		{&db.insertRevision, sqliteInsertRevisionStatement, "insertRevision"},
+		{&db.listOutbox, sqliteListOutboxStatement, "listOutbox"},
+		{&db.insertOutbox, sqliteInsertOutboxStatement, "insertOutbox"},
+		{&db.deleteOutbox, sqliteDeleteOutboxStatement, "deleteOutbox"},
+	} {
+		if *s.stmt, err = conn.Prepare(s.query); err != nil {
+			return nil, fmt.Errorf("sqlite: prepare %s: %v", s.name, err)
+		}
+	}
+
+	return db, nil
+}
+
+// Close closes the database, freeing up any resources.
+func (db *sqliteDB) Close() {
+	db.conn.Close()
+}
+
+// sqliteAddColumns adds the sqliteAddedColumns missing from conn.
+func sqliteAddColumns(conn *sql.DB) error {
+	for _, c := range sqliteAddedColumns {
+		var n int
+		err := conn.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`,
+			c.table, c.column).Scan(&n)
+		if err != nil {
+			return fmt.Errorf("sqlite: could not read %s columns: %v", c.table, err)
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := conn.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, c.table, c.column, c.decl)); err != nil {
+			return fmt.Errorf("sqlite: could not add %s.%s: %v", c.table, c.column, err)
+		}
+		if c.backfill == "" {
+			continue
+		}
+		if _, err := conn.Exec(c.backfill); err != nil {
+			return fmt.Errorf("sqlite: could not backfill %s.%s: %v", c.table, c.column, err)
+		}
+	}
+	return nil
+}
+
+// sqliteExecAffectingOneRow executes a given statement, expecting one row to
+// be affected.
+func sqliteExecAffectingOneRow(stmt *sql.Stmt, args ...interface{}) (sql.Result, error) {
+	r, err := stmt.Exec(args...)
+	if err != nil {
+		return r, fmt.Errorf("sqlite: could not execute statement: %v", err)
+	}
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return r, fmt.Errorf("sqlite: could not get rows affected: %v", err)
+	} else if rowsAffected != 1 {
+		return r, fmt.Errorf("sqlite: expected 1 row affected, got %d", rowsAffected)
+	}
+	return r, nil
+}
+
+/*---------------------------  Get/List  ---------------------------*/
+
+// GetMedia retrieves media by its ID.
+func (db *sqliteDB) GetMedia(id int64) (*Media, error) {
+	media, err := scanMedia(db.get.QueryRow(id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("sqlite: media with id %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not get media: %v", err)
+	}
+	return media, nil
+}
+
+// ListMedia returns a list of media, ordered by title.
+func (db *sqliteDB) ListMedia() ([]*Media, error) {
+	rows, err := db.list.Query()
+	if err != nil {
+		return nil, err
+	}
+	return sqliteScanMediaRows(rows)
+}
+
+// ListMediaCreatedBy returns a list of media, ordered by title, filtered by
+// the user who created the media entry.
+func (db *sqliteDB) ListMediaCreatedBy(userID int64) ([]*Media, error) {
+	if userID == 0 {
+		return db.ListMedia()
+	}
+
+	rows, err := db.listBy.Query(userID)
+	if err != nil {
+		return nil, err
+	}
+	return sqliteScanMediaRows(rows)
+}
+
+// QueryMedia returns the media matching q, in the order it asks for.
+func (db *sqliteDB) QueryMedia(q *MediaQuery) ([]*Media, error) {
+	clauses, args := mediaQuerySQL(q, nil, 0, sqliteParam, sqliteHasTag)
+	return db.queryMedia(clauses, args)
+}
+
+// CountMedia returns the number of media matching q with each value of
+// facet, counted by the database.
+func (db *sqliteDB) CountMedia(ctx context.Context, q *MediaQuery, facet string) (map[string]int, error) {
+	query, args, err := mediaCountSQL(q, facet, sqliteParam, sqliteHasTag, sqliteEachTag)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: %v", err)
+	}
+	return countMedia(ctx, "sqlite", db.conn, query, args)
+}
+
+// PageMedia returns the page of size media matching q that follows cursor.
+func (db *sqliteDB) PageMedia(q *MediaQuery, cursor string, size int) (*MediaPage, error) {
+	after, err := decodeCursor(cursor, q.Sort)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: %w", err)
+	}
+	// One more row than the page tells whether there is a next page.
+	clauses, args := mediaQuerySQL(q, after, size+1, sqliteParam, sqliteHasTag)
+	media, err := db.queryMedia(clauses, args)
+	if err != nil {
+		return nil, err
+	}
+	return trimPage(media, q, size), nil
+}
+
+// sqliteParam, sqliteHasTag and sqliteEachTag are the mediaQuerySQL and
+// mediaCountSQL arguments for SQLite.
+func sqliteParam(int) string { return "?" }
+
+const (
+	sqliteHasTag  = "EXISTS (SELECT 1 FROM json_each(media.tags) WHERE value = %s)"
+	sqliteEachTag = "json_each(m.tags) AS tag"
+)
+
+// queryMedia selects the media with the given clauses.
+func (db *sqliteDB) queryMedia(clauses string, args []interface{}) ([]*Media, error) {
+	rows, err := db.conn.Query(`SELECT `+mediaColumns+` FROM media`+clauses, args...)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not query media: %v", err)
+	}
+	return sqliteScanMediaRows(rows)
+}
+
+// sqliteScanMediaRows reads every row of rows and closes it.
+func sqliteScanMediaRows(rows *sql.Rows) ([]*Media, error) {
+	defer rows.Close()
+
+	var mediaList []*Media
+	for rows.Next() {
+		media, err := scanMedia(rows)
+		if err != nil {
+			return nil, fmt.Errorf("sqlite: could not read row: %v", err)
+		}
+		mediaList = append(mediaList, media)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqlite: could not read rows: %v", err)
+	}
+	return mediaList, nil
+}
+
+/*---------------------------  Create/Add  ---------------------------*/
+
+// AddMedia saves a given media, assigning it a new ID.
+func (db *sqliteDB) AddMedia(m *Media, events ...*Event) (id int64, err error) {
+	values, err := mediaValues(m)
+	if err != nil {
+		return 0, fmt.Errorf("sqlite: %v", err)
+	}
+	err = withEvents("sqlite", db.conn, db.insertOutbox, events, func(tx *sql.Tx) error {
+		r, err := sqliteExecAffectingOneRow(tx.Stmt(db.insert), values...)
+		if err != nil {
+			return err
+		}
+		if id, err = r.LastInsertId(); err != nil {
+			return fmt.Errorf("sqlite: could not get last insert ID: %v", err)
+		}
+		m.ID = id
+		setEventMediaID(events, id)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// sqliteInsert executes an insert statement and returns the new row's ID.
+func sqliteInsert(stmt *sql.Stmt, args ...interface{}) (int64, error) {
+	r, err := sqliteExecAffectingOneRow(stmt, args...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("sqlite: could not get last insert ID: %v", err)
+	}
+	return id, nil
+}
+
+/*---------------------------  Update  ---------------------------*/
+
+// UpdateMedia updates the entry for a given media. The error wraps
+// errNotFound if it does not exist or is in the trash.
+func (db *sqliteDB) UpdateMedia(m *Media, events ...*Event) error {
+	if m.ID == 0 {
+		return errors.New("sqlite: media with unassigned ID passed into update")
+	}
+
+	values, err := mediaValues(m)
+	if err != nil {
+		return fmt.Errorf("sqlite: %v", err)
+	}
+	return withEvents("sqlite", db.conn, db.insertOutbox, events, func(tx *sql.Tx) error {
+		return execOnMedia("sqlite", tx.Stmt(db.update), m.ID, append(values, m.ID)...)
+	})
+}
+
+// ChangeMedia reads a given media and saves the changes change makes to it.
+// The single connection keeps other writes out until it is done.
+func (db *sqliteDB) ChangeMedia(id int64, change func(m *Media) (bool, []*Event)) error {
+	return changeMedia("sqlite", db.conn, db.get, db.update, db.insertOutbox, id, change)
+}
+
+/*---------------------------  Delete  ---------------------------*/
+
+// DeleteMedia moves a given media to the trash.
+func (db *sqliteDB) DeleteMedia(id int64, byID int64, by string, events ...*Event) error {
+	if id == 0 {
+		return errors.New("sqlite: media with unassigned ID passed into deleteMedia")
+	}
+	return withEvents("sqlite", db.conn, db.insertOutbox, events, func(tx *sql.Tx) error {
+		return execOnMedia("sqlite", tx.Stmt(db.trash), id, time.Now(), nullID(byID), by, id)
+	})
+}
+
+// ListDeletedMedia returns the media in the trash, most recently deleted
+// first.
+func (db *sqliteDB) ListDeletedMedia() ([]*Media, error) {
+	rows, err := db.listDeleted.Query()
+	if err != nil {
+		return nil, err
+	}
+	return sqliteScanMediaRows(rows)
+}
+
+// RestoreMedia takes a given media out of the trash.
+func (db *sqliteDB) RestoreMedia(id int64, events ...*Event) error {
+	return withEvents("sqlite", db.conn, db.insertOutbox, events, func(tx *sql.Tx) error {
+		return execOnMedia("sqlite", tx.Stmt(db.restore), id, id)
+	})
+}
+
+// PurgeMedia permanently removes a given media in the trash, with its
+// characters and credits.
+func (db *sqliteDB) PurgeMedia(id int64) error {
+	return execOnMedia("sqlite", db.delete, id, id)
+}
+
+/*---------------------------  People  ---------------------------*/
+
+// ListPeople returns a list of people, ordered by name.
+func (db *sqliteDB) ListPeople() ([]*Person, error) {
+	rows, err := db.listPeople.Query()
+	if err != nil {
+		return nil, err
+	}
+	return scanPeopleRows("sqlite", rows)
+}
+
+// GetPerson retrieves a person by its ID.
+func (db *sqliteDB) GetPerson(id int64) (*Person, error) {
+	p, err := scanPerson(db.getPerson.QueryRow(id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("sqlite: person with id %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not get person: %v", err)
+	}
+	return p, nil
+}
+
+// AddPerson saves a given person, assigning it a new ID.
+func (db *sqliteDB) AddPerson(p *Person) (id int64, err error) {
+	if p.ID, err = sqliteInsert(db.insertPerson, p.Name, p.Bio); err != nil {
+		return 0, err
+	}
+	return p.ID, nil
+}
+
+// UpdatePerson updates the entry for a given person.
+func (db *sqliteDB) UpdatePerson(p *Person) error {
+	if p.ID == 0 {
+		return errors.New("sqlite: person with unassigned ID passed into updatePerson")
+	}
+	return execOnRow("sqlite", "person", db.updatePerson, p.ID, p.Name, p.Bio, p.ID)
+}
+
+// DeletePerson removes a given person, and their credits, by ID.
+func (db *sqliteDB) DeletePerson(id int64) error {
+	return execOnRow("sqlite", "person", db.deletePerson, id, id)
+}
+
+/*---------------------------  Characters  ---------------------------*/
+
+// ListCharacters returns the characters of the given media, ordered by name.
+func (db *sqliteDB) ListCharacters(mediaID int64) ([]*Character, error) {
+	rows, err := db.listCharacters.Query(mediaID)
+	if err != nil {
+		return nil, err
+	}
+	return scanCharacterRows("sqlite", rows)
+}
+
+// GetCharacter retrieves a character by its ID.
+func (db *sqliteDB) GetCharacter(id int64) (*Character, error) {
+	c, err := scanCharacter(db.getCharacter.QueryRow(id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("sqlite: character with id %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not get character: %v", err)
+	}
+	return c, nil
+}
+
+// AddCharacter saves a given character, assigning it a new ID.
+func (db *sqliteDB) AddCharacter(c *Character) (id int64, err error) {
+	evals, err := marshalEvaluations(c.Evaluations)
+	if err != nil {
+		return 0, fmt.Errorf("sqlite: could not encode evaluations: %v", err)
+	}
+	if c.ID, err = sqliteInsert(db.insertCharacter, c.MediaID, c.Name, c.Bio, evals); err != nil {
+		return 0, err
+	}
+	return c.ID, nil
+}
+
+// UpdateCharacter updates the entry for a given character.
+func (db *sqliteDB) UpdateCharacter(c *Character) error {
+	if c.ID == 0 {
+		return errors.New("sqlite: character with unassigned ID passed into updateCharacter")
+	}
+	evals, err := marshalEvaluations(c.Evaluations)
+	if err != nil {
+		return fmt.Errorf("sqlite: could not encode evaluations: %v", err)
+	}
+	return execOnRow("sqlite", "character", db.updateCharacter, c.ID, c.MediaID, c.Name, c.Bio, evals, c.ID)
+}
+
+// DeleteCharacter removes a given character by its ID.
+func (db *sqliteDB) DeleteCharacter(id int64) error {
+	return execOnRow("sqlite", "character", db.deleteCharacter, id, id)
+}
+
+/*---------------------------  Credits  ---------------------------*/
+
+// ListCredits returns the credits of the given media, or of all media when
+// mediaID is 0, ordered by ID.
+func (db *sqliteDB) ListCredits(mediaID int64) ([]*Credit, error) {
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if mediaID == 0 {
+		rows, err = db.listAllCredits.Query()
+	} else {
+		rows, err = db.listCredits.Query(mediaID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanCreditRows("sqlite", rows)
+}
+
+// ListPersonCredits returns the credits of the given person, ordered by ID.
+func (db *sqliteDB) ListPersonCredits(personID int64) ([]*Credit, error) {
+	rows, err := db.listPersonCredits.Query(personID)
+	if err != nil {
+		return nil, err
+	}
+	return scanCreditRows("sqlite", rows)
+}
+
+// AddCredit saves a given credit, assigning it a new ID.
+func (db *sqliteDB) AddCredit(c *Credit) (id int64, err error) {
+	c.ID, err = sqliteInsert(db.insertCredit, c.MediaID, c.PersonID, c.Role, nullID(c.CharacterID))
+	if err != nil {
+		return 0, err
+	}
+	return c.ID, nil
+}
+
+// DeleteCredit removes a given credit by its ID.
+func (db *sqliteDB) DeleteCredit(id int64) error {
+	return execOnRow("sqlite", "credit", db.deleteCredit, id, id)
+}
+
+/*---------------------------  Users  ---------------------------*/
+
+// GetUser retrieves a user by its ID.
+func (db *sqliteDB) GetUser(id int64) (*User, error) {
+	u, err := scanUser(db.getUser.QueryRow(id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("sqlite: user with id %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not get user: %v", err)
+	}
+	return u, nil
+}
+
+// GetUserByIdentity retrieves the user with the given identity.
+func (db *sqliteDB) GetUserByIdentity(issuer, subject string) (*User, error) {
+	u, err := scanUser(db.getUserByIdentity.QueryRow(issuer, subject))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("sqlite: user %s at %s %w", subject, issuer, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not get user: %v", err)
+	}
+	return u, nil
+}
+
+// AddUser saves a given user, assigning it a new ID.
+func (db *sqliteDB) AddUser(u *User) (id int64, err error) {
+	r, err := sqliteExecAffectingOneRow(db.insertUser, userValues(u)...)
+	if err != nil {
+		return 0, err
+	}
+	if id, err = r.LastInsertId(); err != nil {
+		return 0, fmt.Errorf("sqlite: could not get last insert ID: %v", err)
+	}
+	u.ID = id
+	return id, nil
+}
+
+// UpdateUser updates the entry for a given user.
+func (db *sqliteDB) UpdateUser(u *User) error {
+	if u.ID == 0 {
+		return errors.New("sqlite: user with unassigned ID passed into updateUser")
+	}
+	_, err := sqliteExecAffectingOneRow(db.updateUser, append(userValues(u), u.ID)...)
+	return err
+}
+
+// ListUsers returns all the users, ordered by ID.
+func (db *sqliteDB) ListUsers() ([]*User, error) {
+	rows, err := db.listUsers.Query()
+	if err != nil {
+		return nil, err
+	}
+	return scanUserRows("sqlite", rows)
+}
+
+/*---------------------------  Submissions  ---------------------------*/
+
+// GetSubmission retrieves a submission by its ID.
+func (db *sqliteDB) GetSubmission(id int64) (*Submission, error) {
+	s, err := scanSubmission(db.getSubmission.QueryRow(id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("sqlite: submission with id %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not get submission: %v", err)
+	}
+	return s, nil
+}
+
+// ListSubmissions returns the submissions with the given status, oldest
+// first.
+func (db *sqliteDB) ListSubmissions(status SubmissionStatus) ([]*Submission, error) {
+	rows, err := db.listSubmissions.Query(string(status))
+	if err != nil {
+		return nil, err
+	}
+	return scanSubmissionRows("sqlite", rows)
+}
+
+// ListSubmissionsBy returns the submissions of the given user, newest first.
+func (db *sqliteDB) ListSubmissionsBy(userID int64) ([]*Submission, error) {
+	rows, err := db.listSubmissionsBy.Query(userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanSubmissionRows("sqlite", rows)
+}
+
+// AddSubmission saves a given submission, assigning it a new ID.
+func (db *sqliteDB) AddSubmission(s *Submission) (id int64, err error) {
+	values, err := submissionValues(s)
+	if err != nil {
+		return 0, fmt.Errorf("sqlite: %v", err)
+	}
+	r, err := sqliteExecAffectingOneRow(db.insertSubmission, values...)
+	if err != nil {
+		return 0, err
+	}
+	if id, err = r.LastInsertId(); err != nil {
+		return 0, fmt.Errorf("sqlite: could not get last insert ID: %v", err)
+	}
+	s.ID = id
+	return id, nil
+}
+
+// UpdateSubmission updates the entry for a given submission.
+func (db *sqliteDB) UpdateSubmission(s *Submission, events ...*Event) error {
+	if s.ID == 0 {
+		return errors.New("sqlite: submission with unassigned ID passed into updateSubmission")
+	}
+	values, err := submissionValues(s)
+	if err != nil {
+		return fmt.Errorf("sqlite: %v", err)
+	}
+	return withEvents("sqlite", db.conn, db.insertOutbox, events, func(tx *sql.Tx) error {
+		_, err := sqliteExecAffectingOneRow(tx.Stmt(db.updateSubmission), append(values, s.ID)...)
+		return err
+	})
+}
+
+// AddSubmittedMedia saves the media of a submission of new media, and the
+// submission with its ID, in one transaction.
+func (db *sqliteDB) AddSubmittedMedia(s *Submission, m *Media, events ...*Event) (id int64, err error) {
+	if s.ID == 0 {
+		return 0, errors.New("sqlite: submission with unassigned ID passed into addSubmittedMedia")
+	}
+	values, err := mediaValues(m)
+	if err != nil {
+		return 0, fmt.Errorf("sqlite: %v", err)
+	}
+	err = withEvents("sqlite", db.conn, db.insertOutbox, events, func(tx *sql.Tx) error {
+		r, err := sqliteExecAffectingOneRow(tx.Stmt(db.insert), values...)
+		if err != nil {
+			return err
+		}
+		if id, err = r.LastInsertId(); err != nil {
+			return fmt.Errorf("sqlite: could not get last insert ID: %v", err)
+		}
+		linked := *s
+		linked.MediaID = id
+		submission, err := submissionValues(&linked)
+		if err != nil {
+			return fmt.Errorf("sqlite: %v", err)
+		}
+		if _, err := sqliteExecAffectingOneRow(tx.Stmt(db.updateSubmission), append(submission, s.ID)...); err != nil {
+			return err
+		}
+		m.ID = id
+		setEventMediaID(events, id)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.MediaID = id
+	return id, nil
+}
+
+/*---------------------------  Revisions  ---------------------------*/
+
+// GetRevision retrieves a revision by its ID.
+func (db *sqliteDB) GetRevision(id int64) (*Revision, error) {
+	r, err := scanRevision(db.getRevision.QueryRow(id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("sqlite: revision with id %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not get revision: %v", err)
+	}
+	return r, nil
+}
+
+// ListRevisions returns the revisions of the given media, oldest first.
+func (db *sqliteDB) ListRevisions(mediaID int64) ([]*Revision, error) {
+	rows, err := db.listRevisions.Query(mediaID)
+	if err != nil {
+		return nil, err
+	}
+	return scanRevisionRows("sqlite", rows)
+}
+
+// AddRevision saves a given revision, assigning it a new ID.
+func (db *sqliteDB) AddRevision(r *Revision) (id int64, err error) {
+	values, err := revisionValues(r)
+	if err != nil {
+		return 0, fmt.Errorf("sqlite: %v", err)
+	}
+	res, err := sqliteExecAffectingOneRow(db.insertRevision, values...)
+	if err != nil {
+		return 0, err
+	}
+	if id, err = res.LastInsertId(); err != nil {
+		return 0, fmt.Errorf("sqlite: could not get last insert ID: %v", err)
+	}
+	r.ID = id
+	return id, nil
+}
+
+/*---------------------------  Outbox  ---------------------------*/
+
+// ListOutbox returns up to n events waiting to be published, oldest first.
+func (db *sqliteDB) ListOutbox(n int) ([]*Event, error) {
+	rows, err := db.listOutbox.Query(n)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not list outbox: %v", err)
+	}
+	return scanOutboxRows("sqlite", rows)
+}
+
+// DeleteOutbox removes a published event from the outbox.
+func (db *sqliteDB) DeleteOutbox(id int64) error {
+	if _, err := db.deleteOutbox.Exec(id); err != nil {
+		return fmt.Errorf("sqlite: could not delete event: %v", err)
+	}
+	return nil
+}
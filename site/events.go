@@ -0,0 +1,578 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Changes to media are announced as events on the EventBus, for the parts of
+// the site that react to them, such as the worker filling in media details
+// (see fill-details.go).
+//
+// Events are not published by the code making the change. They are handed to
+// the database with it, which saves them to its outbox in the same
+// transaction, and relayOutbox publishes them from there. An event is so
+// saved if and only if its change is, and stays in the outbox until it is
+// published. It may be published more than once, if the relay stops between
+// publishing it and removing it, so handlers must cope with seeing an event
+// twice; Event.ID tells them apart.
+
+// EventType is the kind of change an event is about.
+type EventType string
+
+const (
+	// EventMediaCreated is published when media is added. Media is the
+	// media as added.
+	EventMediaCreated EventType = "media.created"
+
+	// EventMediaUpdated is published when media is changed, or restored
+	// from the trash. Media is the media as changed.
+	EventMediaUpdated EventType = "media.updated"
+
+	// EventMediaDeleted is published when media is moved to the trash.
+	// Media is the media as it was.
+	EventMediaDeleted EventType = "media.deleted"
+
+	// EventSubmissionApproved is published when a moderator approves a
+	// submission. Submission is the submission as approved, with the ID of
+	// the media it was applied to.
+	EventSubmissionApproved EventType = "submission.approved"
+)
+
+// Event is a change to the site, made by the user ActorID, named Actor.
+// ActorID is 0 for the import tools and workers.
+type Event struct {
+	// ID is assigned by the outbox.
+	ID      int64
+	Type    EventType
+	Time    time.Time
+	ActorID int64
+	Actor   string
+
+	MediaID    int64
+	Media      *Media      `json:",omitempty"`
+	Submission *Submission `json:",omitempty"`
+}
+
+// newMediaEvent returns an event of type t about m, made now by the given
+// actor. The event shares m, which the database stores it with, so media
+// being added gets its new ID.
+func newMediaEvent(t EventType, m *Media, actorID int64, actor string) *Event {
+	return &Event{
+		Type:    t,
+		Time:    time.Now(),
+		ActorID: actorID,
+		Actor:   actor,
+		MediaID: m.ID,
+		Media:   m,
+	}
+}
+
+// newSubmissionEvent returns an event of type t about s, made now by the
+// user u.
+func newSubmissionEvent(t EventType, s *Submission, u *User) *Event {
+	return &Event{
+		Type:       t,
+		Time:       time.Now(),
+		ActorID:    u.ID,
+		Actor:      u.DisplayName(),
+		MediaID:    s.MediaID,
+		Submission: s,
+	}
+}
+
+// setEventMediaID gives the events about media being added the ID it was
+// given.
+func setEventMediaID(events []*Event, id int64) {
+	for _, e := range events {
+		if e.MediaID == 0 {
+			e.MediaID = id
+		}
+	}
+}
+
+// marshalEvent and unmarshalEvent store events in the outbox as JSON, as
+// they are published.
+func marshalEvent(e *Event) (string, error) {
+	b, err := json.Marshal(e)
+	return string(b), err
+}
+
+func unmarshalEvent(s string) (*Event, error) {
+	e := &Event{}
+	err := json.Unmarshal([]byte(s), e)
+	return e, err
+}
+
+// OutboxDatabase keeps the events saved with changes until they are
+// published. Events are added by the methods of MediaDatabase that take
+// them.
+type OutboxDatabase interface {
+	// ListOutbox returns up to n events waiting to be published, oldest
+	// first.
+	ListOutbox(n int) ([]*Event, error)
+
+	// DeleteOutbox removes a published event from the outbox. Events
+	// already removed are ignored.
+	DeleteOutbox(id int64) error
+}
+
+/*---------------------------  Bus  ---------------------------*/
+
+// EventBus carries events to their subscribers.
+type EventBus interface {
+	// Publish sends e to the subscriptions of its type.
+	Publish(ctx context.Context, e *Event) error
+
+	// Subscribe calls handle, in the background until ctx is done or the
+	// bus is closed, with the events of the given types. Subscriptions are
+	// named, and only made once: every event is handled by one of the
+	// subscribers of the same name. Events whose handler fails are handled
+	// again, and given up on after eventMaxAttempts attempts.
+	Subscribe(ctx context.Context, name string, types []EventType, handle EventHandler) error
+
+	// Close stops the subscribers, and waits for their handlers to return.
+	Close()
+}
+
+// EventHandler handles an event. Errors are worth trying again.
+type EventHandler func(ctx context.Context, e *Event) error
+
+// eventMaxAttempts is how many times an event is handled before it is given
+// up on. Pub/Sub dead letter policies allow 5 to 100.
+const eventMaxAttempts = 5
+
+// hasType reports whether t is one of types.
+func hasType(types []EventType, t EventType) bool {
+	for _, want := range types {
+		if want == t {
+			return true
+		}
+	}
+	return false
+}
+
+/*---------------------------  In-process  ---------------------------*/
+
+// channelBus is an EventBus for a single process, running the site locally.
+// Events are queued on a channel per subscription; the ones not handled when
+// the process stops are lost.
+type channelBus struct {
+	mu     sync.Mutex
+	subs   map[string]*channelSubscription
+	wg     sync.WaitGroup
+	done   chan struct{}
+	closed bool
+}
+
+// channelSubscription is a subscription to a channelBus.
+type channelSubscription struct {
+	types  []EventType
+	events chan *Event
+}
+
+// channelQueueSize is how many events a subscription of a channelBus
+// queues before publishing waits for it.
+const channelQueueSize = 256
+
+// channelRetryDelay is how long a channelBus waits after the first failed
+// attempt to handle an event, doubling after each attempt after that.
+var channelRetryDelay = time.Second
+
+// Ensure channelBus conforms to the EventBus interface.
+var _ EventBus = &channelBus{}
+
+// newChannelBus returns an empty in-process bus.
+func newChannelBus() *channelBus {
+	return &channelBus{subs: make(map[string]*channelSubscription), done: make(chan struct{})}
+}
+
+// Publish queues e on the subscriptions of its type.
+func (b *channelBus) Publish(ctx context.Context, e *Event) error {
+	b.mu.Lock()
+	if b.closed {
+		// Checked here too, as select picks at random when a queue has
+		// room as well.
+		b.mu.Unlock()
+		return errors.New("events: bus closed")
+	}
+	var queues []chan *Event
+	for _, sub := range b.subs {
+		if hasType(sub.types, e.Type) {
+			queues = append(queues, sub.events)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, q := range queues {
+		// Each subscription gets its own copy, as handlers may change it.
+		data, err := marshalEvent(e)
+		if err != nil {
+			return fmt.Errorf("events: could not encode event: %v", err)
+		}
+		c, err := unmarshalEvent(data)
+		if err != nil {
+			return fmt.Errorf("events: could not decode event: %v", err)
+		}
+		select {
+		case q <- c:
+		case <-b.done:
+			return errors.New("events: bus closed")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Subscribe starts handling the events of the given types queued on the
+// named subscription. A name can only be subscribed once.
+func (b *channelBus) Subscribe(ctx context.Context, name string, types []EventType, handle EventHandler) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errors.New("events: bus closed")
+	}
+	if _, ok := b.subs[name]; ok {
+		return fmt.Errorf("events: %s is already subscribed", name)
+	}
+	sub := &channelSubscription{types: types, events: make(chan *Event, channelQueueSize)}
+	b.subs[name] = sub
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			select {
+			case e := <-sub.events:
+				b.handle(ctx, name, e, handle)
+			case <-ctx.Done():
+				return
+			case <-b.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// handle calls handle with e until it succeeds, eventMaxAttempts times at
+// most, logging the event if it never does.
+func (b *channelBus) handle(ctx context.Context, name string, e *Event, handle EventHandler) {
+	delay := channelRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := handle(ctx, e)
+		if err == nil {
+			return
+		}
+		if attempt >= eventMaxAttempts {
+			log.Printf("events: %s: giving up on %s event %d after %d attempts: %v", name, e.Type, e.ID, attempt, err)
+			return
+		}
+		log.Printf("events: %s: %s event %d, attempt %d: %v", name, e.Type, e.ID, attempt, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		case <-b.done:
+			return
+		}
+		delay *= 2
+	}
+}
+
+// Close stops the subscribers.
+func (b *channelBus) Close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+}
+
+/*---------------------------  Pub/Sub  ---------------------------*/
+
+// pubsubBus is an EventBus on Cloud Pub/Sub, for the site and its workers
+// running as separate processes. Events are published to the EventsTopicID
+// topic, with their type in the "type" attribute. Subscriptions are Pub/Sub
+// subscriptions of the same name, filtered by type. The events a subscriber
+// gives up on are moved to the subscription's dead letter topic, its name
+// followed by "-dead-letter", to be looked at by people.
+//
+// Pub/Sub counts the deliveries of each message, across every instance of
+// the subscribers, and moves it to the dead letter topic itself after
+// eventMaxAttempts, as the subscription's dead letter policy says. For that,
+// the Pub/Sub service account must be allowed to publish to the dead letter
+// topic and to subscribe to the subscription.
+type pubsubBus struct {
+	client *pubsub.Client
+	topic  *pubsub.Topic
+
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	cancels []context.CancelFunc
+}
+
+// Ensure pubsubBus conforms to the EventBus interface.
+var _ EventBus = &pubsubBus{}
+
+// newPubsubBus returns a bus on the topics of client, creating the events
+// topic if it does not exist. The bus closes client when it is closed.
+func newPubsubBus(ctx context.Context, client *pubsub.Client) (*pubsubBus, error) {
+	topic, err := ensureTopic(ctx, client, EventsTopicID)
+	if err != nil {
+		return nil, err
+	}
+	return &pubsubBus{client: client, topic: topic}, nil
+}
+
+// Publish publishes e to the events topic, and waits for Pub/Sub to have it.
+func (b *pubsubBus) Publish(ctx context.Context, e *Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("pubsub: could not encode event: %v", err)
+	}
+	_, err = b.topic.Publish(ctx, &pubsub.Message{
+		Data: data,
+		Attributes: map[string]string{
+			"type":    string(e.Type),
+			"eventID": strconv.FormatInt(e.ID, 10),
+			"mediaID": strconv.FormatInt(e.MediaID, 10),
+		},
+	}).Get(ctx)
+	if err != nil {
+		return fmt.Errorf("pubsub: could not publish %s event %d: %v", e.Type, e.ID, err)
+	}
+	return nil
+}
+
+// Subscribe creates the named subscription and its dead letter topic, if they
+// do not exist, and starts receiving its messages. The filter of a
+// subscription cannot be changed once it is made; events of other types it
+// receives are acknowledged without being handled. Subscriptions made
+// without a dead letter policy are given one.
+func (b *pubsubBus) Subscribe(ctx context.Context, name string, types []EventType, handle EventHandler) error {
+	deadLetter, err := ensureTopic(ctx, b.client, name+"-dead-letter")
+	if err != nil {
+		return err
+	}
+	policy := &pubsub.DeadLetterPolicy{
+		DeadLetterTopic:     deadLetter.String(),
+		MaxDeliveryAttempts: eventMaxAttempts,
+	}
+	sub := b.client.Subscription(name)
+	ok, err := sub.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("pubsub: %v", err)
+	}
+	if ok {
+		config, err := sub.Config(ctx)
+		if err != nil {
+			return fmt.Errorf("pubsub: could not get subscription %s: %v", name, err)
+		}
+		if p := config.DeadLetterPolicy; p == nil || *p != *policy {
+			_, err := sub.Update(ctx, pubsub.SubscriptionConfigToUpdate{DeadLetterPolicy: policy})
+			if err != nil {
+				return fmt.Errorf("pubsub: could not set the dead letter policy of %s: %v", name, err)
+			}
+		}
+	} else {
+		var filter []string
+		for _, t := range types {
+			filter = append(filter, fmt.Sprintf("attributes.type = %q", t))
+		}
+		sub, err = b.client.CreateSubscription(ctx, name, pubsub.SubscriptionConfig{
+			Topic:            b.topic,
+			Filter:           strings.Join(filter, " OR "),
+			AckDeadline:      time.Minute,
+			RetryPolicy:      &pubsub.RetryPolicy{MinimumBackoff: 10 * time.Second, MaximumBackoff: 10 * time.Minute},
+			DeadLetterPolicy: policy,
+		})
+		if err != nil {
+			return fmt.Errorf("pubsub: could not create subscription %s: %v", name, err)
+		}
+	}
+	// Handlers may call other sites, which should not be hammered.
+	sub.ReceiveSettings.MaxOutstandingMessages = 4
+
+	ctx, cancel := context.WithCancel(ctx)
+	b.mu.Lock()
+	b.cancels = append(b.cancels, cancel)
+	b.mu.Unlock()
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		log.Printf("events: handling %s", name)
+		err := sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+			b.handle(ctx, msg, types, handle, deadLetter)
+		})
+		if err != nil {
+			log.Printf("events: %s: %v", name, err)
+		}
+	}()
+	return nil
+}
+
+// deliveryAttempt returns how many times msg has been delivered, this time
+// included, as Pub/Sub counts for subscriptions with a dead letter policy.
+// It is 0 if it is not counted.
+func deliveryAttempt(msg *pubsub.Message) int {
+	if msg.DeliveryAttempt == nil {
+		return 0
+	}
+	return *msg.DeliveryAttempt
+}
+
+// handle calls handle with the event in msg, if it is of one of the given
+// types. Messages are acknowledged when it succeeds, and left to be
+// delivered again otherwise. On the last attempt they are moved to
+// deadLetter with the error, rather than left for Pub/Sub to move without.
+func (b *pubsubBus) handle(ctx context.Context, msg *pubsub.Message, types []EventType, handle EventHandler, deadLetter *pubsub.Topic) {
+	attempt := deliveryAttempt(msg)
+	e := &Event{}
+	if err := json.Unmarshal(msg.Data, e); err != nil || e.Type == "" {
+		// Trying again will not help.
+		b.moveToDeadLetter(ctx, msg, fmt.Errorf("bad message %q", msg.Data), attempt, deadLetter)
+		return
+	}
+	if !hasType(types, e.Type) {
+		msg.Ack()
+		return
+	}
+	err := handle(ctx, e)
+	switch {
+	case err == nil:
+		msg.Ack()
+	case attempt >= eventMaxAttempts:
+		b.moveToDeadLetter(ctx, msg, err, attempt, deadLetter)
+	default:
+		log.Printf("events: %s event %d, attempt %d: %v", e.Type, e.ID, attempt, err)
+		msg.Nack()
+	}
+}
+
+// moveToDeadLetter publishes msg to deadLetter, with why it failed, and
+// acknowledges it.
+func (b *pubsubBus) moveToDeadLetter(ctx context.Context, msg *pubsub.Message, reason error, attempt int, deadLetter *pubsub.Topic) {
+	log.Printf("events: giving up on message %s after %d attempts: %v", msg.ID, attempt, reason)
+	attrs := map[string]string{
+		"error":     reason.Error(),
+		"attempts":  strconv.Itoa(attempt),
+		"messageID": msg.ID,
+	}
+	for k, v := range msg.Attributes {
+		attrs[k] = v
+	}
+	if _, err := deadLetter.Publish(ctx, &pubsub.Message{Data: msg.Data, Attributes: attrs}).Get(ctx); err != nil {
+		log.Printf("events: could not move message %s to %s: %v", msg.ID, deadLetter.ID(), err)
+		msg.Nack()
+		return
+	}
+	msg.Ack()
+}
+
+// Close stops the subscribers and closes the client.
+func (b *pubsubBus) Close() {
+	b.mu.Lock()
+	for _, cancel := range b.cancels {
+		cancel()
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+	b.topic.Stop()
+	b.client.Close()
+}
+
+// ensureTopic returns the topic with the given ID, creating it if needed.
+func ensureTopic(ctx context.Context, client *pubsub.Client, id string) (*pubsub.Topic, error) {
+	topic := client.Topic(id)
+	ok, err := topic.Exists(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: %v", err)
+	}
+	if ok {
+		return topic, nil
+	}
+	if topic, err = client.CreateTopic(ctx, id); err != nil {
+		return nil, fmt.Errorf("pubsub: could not create topic %s: %v", id, err)
+	}
+	return topic, nil
+}
+
+/*---------------------------  Outbox  ---------------------------*/
+
+// outboxBatchSize is how many events relayOnce reads from the outbox at a
+// time.
+const outboxBatchSize = 100
+
+// outboxInterval is how often relayOutbox looks for events to publish.
+const outboxInterval = time.Second
+
+// relayOnce publishes the events in the outbox of db to bus, oldest first,
+// removing each once it is published. It stops at the first event that
+// cannot be published, to try it again first next time, and returns how
+// many were.
+func relayOnce(ctx context.Context, db OutboxDatabase, bus EventBus) (int, error) {
+	n := 0
+	for {
+		events, err := db.ListOutbox(outboxBatchSize)
+		if err != nil {
+			return n, fmt.Errorf("could not list outbox: %v", err)
+		}
+		for _, e := range events {
+			if err := bus.Publish(ctx, e); err != nil {
+				return n, err
+			}
+			if err := db.DeleteOutbox(e.ID); err != nil {
+				return n, fmt.Errorf("could not remove event %d from outbox: %v", e.ID, err)
+			}
+			n++
+		}
+		if len(events) < outboxBatchSize {
+			return n, nil
+		}
+	}
+}
+
+// relayOutbox runs relayOnce every interval until ctx is done. When several
+// processes relay the same outbox, events may be published more than once.
+func relayOutbox(ctx context.Context, db OutboxDatabase, bus EventBus, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if _, err := relayOnce(ctx, db, bus); err != nil {
+			log.Printf("events: %v", err)
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,440 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// eventWait is how long the tests wait for events to be handled.
+const eventWait = time.Minute
+
+// countingHandler is an EventHandler that counts the attempts at each event,
+// failing the first fails[ID] of them.
+type countingHandler struct {
+	mu      sync.Mutex
+	fails   map[int64]int
+	calls   map[int64]int
+	handled chan *Event
+}
+
+func newCountingHandler() *countingHandler {
+	return &countingHandler{fails: make(map[int64]int), calls: make(map[int64]int), handled: make(chan *Event, 10)}
+}
+
+func (h *countingHandler) handle(ctx context.Context, e *Event) error {
+	h.mu.Lock()
+	h.calls[e.ID]++
+	n, fails := h.calls[e.ID], h.fails[e.ID]
+	h.mu.Unlock()
+	if n <= fails {
+		return fmt.Errorf("attempt %d fails", n)
+	}
+	h.handled <- e
+	return nil
+}
+
+// callsTo returns how many times the event with the given ID was handled.
+func (h *countingHandler) callsTo(id int64) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls[id]
+}
+
+// waitHandled returns the next event h handles successfully.
+func (h *countingHandler) waitHandled(t *testing.T) *Event {
+	t.Helper()
+	select {
+	case e := <-h.handled:
+		return e
+	case <-time.After(eventWait):
+		t.Fatal("timed out waiting for an event to be handled")
+		return nil
+	}
+}
+
+// fastRetries makes channelBus retry without waiting for the rest of the
+// test.
+func fastRetries(t *testing.T) {
+	old := channelRetryDelay
+	channelRetryDelay = time.Millisecond
+	t.Cleanup(func() { channelRetryDelay = old })
+}
+
+func TestChannelBus(t *testing.T) {
+	ctx := context.Background()
+	bus := newChannelBus()
+	defer bus.Close()
+	media := newCountingHandler()
+	if err := bus.Subscribe(ctx, "media", []EventType{EventMediaCreated}, media.handle); err != nil {
+		t.Fatal(err)
+	}
+	all := newCountingHandler()
+	if err := bus.Subscribe(ctx, "all", []EventType{EventMediaCreated, EventSubmissionApproved}, all.handle); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Subscribe(ctx, "media", []EventType{EventMediaUpdated}, media.handle); err == nil {
+		t.Error("subscribing to media twice succeeded")
+	}
+
+	m := &Media{ID: 3, Title: "Alien"}
+	created := newMediaEvent(EventMediaCreated, m, 1, "Ann")
+	created.ID = 1
+	approved := &Event{ID: 2, Type: EventSubmissionApproved, MediaID: 3}
+	for _, e := range []*Event{created, approved} {
+		if err := bus.Publish(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := media.waitHandled(t)
+	if got.ID != 1 || got.Media == nil || got.Media.Title != "Alien" {
+		t.Errorf("media got %+v, want event 1 about Alien", got)
+	}
+	if got.Media == m {
+		t.Error("media got the published event, not a copy")
+	}
+	if a, b := all.waitHandled(t), all.waitHandled(t); a.ID != 1 || b.ID != 2 {
+		t.Errorf("all got events %d and %d, want 1 and 2", a.ID, b.ID)
+	}
+
+	if n := media.callsTo(2); n != 0 {
+		t.Errorf("media handled the approval %d times, want none", n)
+	}
+}
+
+// TestChannelBusClosed publishes to a closed bus many times, as Publish once
+// only failed when select happened to pick the closed bus over the queue.
+func TestChannelBusClosed(t *testing.T) {
+	ctx := context.Background()
+	bus := newChannelBus()
+	h := newCountingHandler()
+	if err := bus.Subscribe(ctx, "media", []EventType{EventMediaCreated}, h.handle); err != nil {
+		t.Fatal(err)
+	}
+	bus.Close()
+	for i := 0; i < 100; i++ {
+		if err := bus.Publish(ctx, &Event{ID: 1, Type: EventMediaCreated}); err == nil {
+			t.Fatal("publishing to a closed bus succeeded")
+		}
+	}
+	if err := bus.Subscribe(ctx, "other", []EventType{EventMediaCreated}, h.handle); err == nil {
+		t.Error("subscribing to a closed bus succeeded")
+	}
+}
+
+func TestChannelBusRetries(t *testing.T) {
+	fastRetries(t)
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name      string
+		fails     int
+		wantCalls int
+	}{
+		{"succeeds", 0, 1},
+		{"succeeds again", 2, 3},
+		{"gives up", eventMaxAttempts, eventMaxAttempts},
+	} {
+		bus := newChannelBus()
+		h := newCountingHandler()
+		h.fails[1] = tt.fails
+		if err := bus.Subscribe(ctx, "media", []EventType{EventMediaCreated}, h.handle); err != nil {
+			t.Fatal(err)
+		}
+		// Events are handled in order, so the second is handled once the
+		// first has been handled or given up on.
+		for id := int64(1); id <= 2; id++ {
+			if err := bus.Publish(ctx, &Event{ID: id, Type: EventMediaCreated}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tt.fails < eventMaxAttempts {
+			h.waitHandled(t)
+		}
+		h.waitHandled(t)
+		if n := h.callsTo(1); n != tt.wantCalls {
+			t.Errorf("%s: handled %d times, want %d", tt.name, n, tt.wantCalls)
+		}
+		bus.Close()
+	}
+}
+
+// recordingBus is an EventBus that keeps what is published to it, and
+// fails to publish the event failID.
+type recordingBus struct {
+	EventBus
+	failID    int64
+	published []*Event
+}
+
+func (b *recordingBus) Publish(ctx context.Context, e *Event) error {
+	if e.ID == b.failID {
+		return errors.New("bus is down")
+	}
+	b.published = append(b.published, e)
+	return nil
+}
+
+func TestRelayOnce(t *testing.T) {
+	ctx := context.Background()
+	db := newMemoryDB()
+	for _, title := range []string{"A", "B", "C"} {
+		m := &Media{Title: title}
+		if _, err := db.AddMedia(m, newMediaEvent(EventMediaCreated, m, 1, "Ann")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := db.ListOutbox(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("ListOutbox = %v, want 3 events", events)
+	}
+
+	bus := &recordingBus{failID: events[1].ID}
+	n, err := relayOnce(ctx, db, bus)
+	if err == nil || n != 1 || len(bus.published) != 1 || bus.published[0].Media.Title != "A" {
+		t.Fatalf("relayOnce with B failing = %d, %v, published %v, want only A", n, err, bus.published)
+	}
+	if left, _ := db.ListOutbox(10); len(left) != 2 || left[0].ID != events[1].ID {
+		t.Fatalf("outbox after the failure = %v, want B and C", left)
+	}
+
+	bus.failID = 0
+	if n, err = relayOnce(ctx, db, bus); err != nil || n != 2 {
+		t.Fatalf("relayOnce = %d, %v, want 2", n, err)
+	}
+	if len(bus.published) != 3 || bus.published[1].Media.Title != "B" || bus.published[2].Media.Title != "C" {
+		t.Errorf("published %v, want A, B then C", bus.published)
+	}
+	if left, _ := db.ListOutbox(10); len(left) != 0 {
+		t.Errorf("outbox after relaying = %v, want none", left)
+	}
+	if n, err = relayOnce(ctx, db, bus); err != nil || n != 0 {
+		t.Errorf("relayOnce of an empty outbox = %d, %v", n, err)
+	}
+}
+
+// fakeFillers makes the details fillers describe all media, without
+// asking other sites.
+func fakeFillers(t *testing.T) {
+	old := detailFillers
+	detailFillers = []func(ctx context.Context, m *Media, d *mediaDetails) error{
+		func(ctx context.Context, m *Media, d *mediaDetails) error {
+			d.Description = "Described " + m.Title
+			return nil
+		},
+	}
+	t.Cleanup(func() { detailFillers = old })
+}
+
+// TestFillKeepsChanges changes media while its details are looked for,
+// which filling them in must not undo.
+func TestFillKeepsChanges(t *testing.T) {
+	db := newMemoryDB()
+	id, err := db.AddMedia(&Media{Title: "Alien"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := detailFillers
+	detailFillers = []func(ctx context.Context, m *Media, d *mediaDetails) error{
+		func(ctx context.Context, m *Media, d *mediaDetails) error {
+			edited := *m
+			edited.Title, edited.Tags = "Alien (1979)", []string{"space"}
+			if err := db.UpdateMedia(&edited); err != nil {
+				return err
+			}
+			d.Description = "Described " + m.Title
+			return nil
+		},
+	}
+	t.Cleanup(func() { detailFillers = old })
+
+	if err := fillMediaDetails(context.Background(), db, id); err != nil {
+		t.Fatal(err)
+	}
+	m, err := db.GetMedia(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Title != "Alien (1979)" || len(m.Tags) != 1 || m.Description != "Described Alien" {
+		t.Errorf("filled media = %q, tags %v, %q; want the edit kept and the description filled in",
+			m.Title, m.Tags, m.Description)
+	}
+}
+
+/*---------------------------  Pub/Sub  ---------------------------*/
+
+// newEmulatorBus returns a pubsubBus and its client talking to the Pub/Sub
+// emulator, in a project of its own so tests do not see each other's
+// messages. The test is skipped when PUBSUB_EMULATOR_HOST is not set; start
+// the emulator with
+//
+//	gcloud beta emulators pubsub start
+//	$(gcloud beta emulators pubsub env-init)
+func newEmulatorBus(t *testing.T) (*pubsubBus, *pubsub.Client) {
+	t.Helper()
+	if os.Getenv("PUBSUB_EMULATOR_HOST") == "" {
+		t.Skip("PUBSUB_EMULATOR_HOST is not set")
+	}
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, fmt.Sprintf("fts-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus, err := newPubsubBus(ctx, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(bus.Close)
+	return bus, client
+}
+
+func TestPubsubBusRetries(t *testing.T) {
+	bus, _ := newEmulatorBus(t)
+	ctx := context.Background()
+	h := newCountingHandler()
+	h.fails[1] = 2
+	if err := bus.Subscribe(ctx, "media", []EventType{EventMediaCreated}, h.handle); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Publish(ctx, &Event{ID: 1, Type: EventMediaCreated, MediaID: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if e := h.waitHandled(t); e.ID != 1 || e.MediaID != 3 {
+		t.Errorf("handled %+v, want event 1 about media 3", e)
+	}
+	if n := h.callsTo(1); n != 3 {
+		t.Errorf("handled %d times, want 3", n)
+	}
+}
+
+func TestPubsubBusDeadLetter(t *testing.T) {
+	bus, client := newEmulatorBus(t)
+	ctx, cancel := context.WithTimeout(context.Background(), eventWait)
+	defer cancel()
+	h := newCountingHandler()
+	h.fails[1] = eventMaxAttempts
+	if err := bus.Subscribe(ctx, "media", []EventType{EventMediaCreated}, h.handle); err != nil {
+		t.Fatal(err)
+	}
+	config, err := client.Subscription("media").Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := config.DeadLetterPolicy; p == nil || p.MaxDeliveryAttempts != eventMaxAttempts ||
+		p.DeadLetterTopic != client.Topic("media-dead-letter").String() {
+		t.Errorf("dead letter policy = %+v, want media-dead-letter after %d attempts", p, eventMaxAttempts)
+	}
+	// Messages published before a subscription is made do not reach it.
+	dead, err := client.CreateSubscription(ctx, "media-dead-letter-test", pubsub.SubscriptionConfig{
+		Topic: client.Topic("media-dead-letter"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Publish(ctx, &Event{ID: 1, Type: EventMediaCreated, MediaID: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got *pubsub.Message
+	rctx, stop := context.WithCancel(ctx)
+	err = dead.Receive(rctx, func(ctx context.Context, msg *pubsub.Message) {
+		msg.Ack()
+		got = msg
+		stop()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil {
+		t.Fatal("timed out waiting for the dead letter")
+	}
+	want := map[string]string{"type": string(EventMediaCreated), "eventID": "1", "attempts": fmt.Sprint(eventMaxAttempts)}
+	for k, v := range want {
+		if got.Attributes[k] != v {
+			t.Errorf("dead letter attribute %s = %q, want %q", k, got.Attributes[k], v)
+		}
+	}
+	if n := h.callsTo(1); n != eventMaxAttempts {
+		t.Errorf("handled %d times, want %d", n, eventMaxAttempts)
+	}
+}
+
+// TestPubsubFillDetailsAgain publishes the same event twice, as the outbox
+// relay may, and checks the details are filled in once.
+func TestPubsubFillDetailsAgain(t *testing.T) {
+	bus, _ := newEmulatorBus(t)
+	fakeFillers(t)
+	ctx := context.Background()
+	db := newMemoryDB()
+	m := &Media{Title: "Alien"}
+	id, err := db.AddMedia(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan error, 2)
+	fill := fillDetailsHandler(db)
+	types := []EventType{EventMediaCreated}
+	err = bus.Subscribe(ctx, fillSubscription, types, func(ctx context.Context, e *Event) error {
+		err := fill(ctx, e)
+		handled <- err
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ID = id
+	e := newMediaEvent(EventMediaCreated, m, 1, "Ann")
+	e.ID = 1
+	for i := 0; i < 2; i++ {
+		if err := bus.Publish(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-handled:
+			if err != nil {
+				t.Fatalf("handling %d: %v", i, err)
+			}
+		case <-time.After(eventWait):
+			t.Fatalf("timed out waiting for handling %d", i)
+		}
+	}
+
+	got, err := db.GetMedia(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Description != "Described Alien" {
+		t.Errorf("description = %q, want it filled in", got.Description)
+	}
+	revisions, err := db.ListRevisions(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 {
+		t.Errorf("revisions = %+v, want one", revisions)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// When media is added or changed, the fillSubscription subscription to the
+// events (see events.go) fills in the details the media is missing from the
+// sites it links to: the description and poster from Wikipedia, and the
+// Bechdel test result from bechdeltest.com. It runs in the site with the
+// in-process bus, and in the worker (see -worker in main.go) with Pub/Sub.
+//
+// Only empty details are filled in, so handling an event twice changes
+// nothing the second time.
+
+// fillSubscription is the subscription the details are filled in from.
+const fillSubscription = "fill-media-details"
+
+// detailsFiller is the author of the revisions, and the actor of the events,
+// of the changes the filler makes.
+const detailsFiller = "Details worker"
+
+/*---------------------------  Details  ---------------------------*/
+
+// mediaDetails are the details found for media by the fillers.
+type mediaDetails struct {
+	Description string
+	ImageURL    string
+	Bechdel     *Bechdel
+}
+
+// apply fills in the details m is missing, reporting whether it changed.
+func (d *mediaDetails) apply(m *Media) bool {
+	changed := false
+	if m.Description == "" && d.Description != "" {
+		m.Description, changed = d.Description, true
+	}
+	if m.ImageURL == "" && d.ImageURL != "" {
+		m.ImageURL, changed = d.ImageURL, true
+	}
+	if !m.Bechdel.Rated && d.Bechdel != nil {
+		m.Bechdel, changed = *d.Bechdel, true
+	}
+	return changed
+}
+
+// detailsClient fetches details from other sites.
+var detailsClient = &http.Client{Timeout: 30 * time.Second}
+
+// errNoDetails is returned by getDetailsJSON when the site has nothing for
+// the media.
+var errNoDetails = errors.New("no details")
+
+// getDetailsJSON fetches the JSON at u into v. Errors other than
+// errNoDetails are worth trying again.
+func getDetailsJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	// Wikipedia asks clients to say who they are.
+	req.Header.Set("User-Agent", "FlipTheScript/1.0 (media details worker)")
+	resp, err := detailsClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errNoDetails
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: %v", u, err)
+	}
+	return nil
+}
+
+// wikipediaAPI is the address of the Wikipedia REST API, with the host of the
+// article the media links to in place of {host}.
+var wikipediaAPI = "https://{host}/api/rest_v1"
+
+// wikipediaDetails finds the description and poster of m in the summary of
+// the Wikipedia article it links to. The poster is copied into Images, and
+// only looked for when there is one.
+func wikipediaDetails(ctx context.Context, m *Media, d *mediaDetails) error {
+	u, err := url.Parse(m.WikiURL)
+	if err != nil || !strings.HasSuffix(u.Host, ".wikipedia.org") || !strings.HasPrefix(u.Path, "/wiki/") {
+		return nil
+	}
+	var summary struct {
+		Type          string `json:"type"`
+		Extract       string `json:"extract"`
+		OriginalImage struct {
+			Source string `json:"source"`
+		} `json:"originalimage"`
+	}
+	api := strings.Replace(wikipediaAPI, "{host}", u.Host, 1)
+	title := url.PathEscape(strings.TrimPrefix(u.Path, "/wiki/"))
+	err = getDetailsJSON(ctx, api+"/page/summary/"+title, &summary)
+	if err == errNoDetails || summary.Type == "disambiguation" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("wikipedia: %v", err)
+	}
+	d.Description = summary.Extract
+	if Images != nil && m.ImageURL == "" && summary.OriginalImage.Source != "" {
+		imageURL, err := fetchImage(ctx, Images, summary.OriginalImage.Source)
+		if errors.Is(err, errBadImage) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("wikipedia: could not copy poster: %v", err)
+		}
+		d.ImageURL = imageURL
+	}
+	return nil
+}
+
+// bechdelAPI is the address of the bechdeltest.com API.
+var bechdelAPI = "https://bechdeltest.com/api/v1"
+
+// bechdelDetails finds the Bechdel test result of m on bechdeltest.com by
+// the IMDb title it links to.
+func bechdelDetails(ctx context.Context, m *Media, d *mediaDetails) error {
+	id := imdbID(m.IMDBURL)
+	if id == "" || m.Bechdel.Rated {
+		return nil
+	}
+	var rec bechdelRecord
+	err := getDetailsJSON(ctx, bechdelAPI+"/getMovieByImdbId?imdbid="+url.QueryEscape(id), &rec)
+	if err == errNoDetails {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("bechdel: %v", err)
+	}
+	// Titles the site does not know come back without an ID.
+	if rec.ID == 0 || rec.Rating < 0 || rec.Rating > 3 {
+		return nil
+	}
+	b := rec.bechdel()
+	d.Bechdel = &b
+	return nil
+}
+
+// detailFillers find the details of media, each adding what it finds to d.
+var detailFillers = []func(ctx context.Context, m *Media, d *mediaDetails) error{
+	wikipediaDetails,
+	bechdelDetails,
+}
+
+// fillMediaDetails fills in the details the media with the given ID is
+// missing, recording the change in its history. The error wraps errNotFound
+// if the media is gone.
+func fillMediaDetails(ctx context.Context, db MediaDatabase, id int64) error {
+	m, err := db.GetMedia(id)
+	if err != nil {
+		return fmt.Errorf("could not find media: %w", err)
+	}
+	d := &mediaDetails{}
+	for _, fill := range detailFillers {
+		if err := fill(ctx, m, d); err != nil {
+			return err
+		}
+	}
+
+	// The media may have changed while the details were looked for; fill in
+	// what is still missing in what it is now, leaving the rest as it is.
+	var filled *Media
+	err = db.ChangeMedia(id, func(m *Media) (bool, []*Event) {
+		if !d.apply(m) {
+			filled = nil
+			return false, nil
+		}
+		filled = m
+		return true, []*Event{newMediaEvent(EventMediaUpdated, m, 0, detailsFiller)}
+	})
+	if err != nil {
+		return fmt.Errorf("could not update media: %w", err)
+	}
+	if filled == nil {
+		return nil
+	}
+	rev := &Revision{Media: filled, Author: detailsFiller, Summary: "Filled in details"}
+	return recordRevision(db, rev)
+}
+
+/*---------------------------  Subscription  ---------------------------*/
+
+// fillDetailsHandler returns the handler of the events of the fill
+// subscription, filling in the details of the media they are about in db.
+// The changes made by the filler itself are skipped, as is media that is
+// gone.
+func fillDetailsHandler(db MediaDatabase) EventHandler {
+	return func(ctx context.Context, e *Event) error {
+		if e.ActorID == 0 && e.Actor == detailsFiller {
+			return nil
+		}
+		err := fillMediaDetails(ctx, db, e.MediaID)
+		if errors.Is(err, errNotFound) {
+			log.Printf("fill: media %d is gone", e.MediaID)
+			return nil
+		}
+		return err
+	}
+}
+
+// subscribeFiller fills in the details of the media added or changed in db,
+// as bus announces them, until ctx is done.
+func subscribeFiller(ctx context.Context, bus EventBus, db MediaDatabase) error {
+	types := []EventType{EventMediaCreated, EventMediaUpdated}
+	return bus.Subscribe(ctx, fillSubscription, types, fillDetailsHandler(db))
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// imageImporter is the author of the revisions importImages makes.
+const imageImporter = "Image import"
+
+// imageClient fetches the images importImages copies.
+var imageClient = &http.Client{Timeout: time.Minute}
+
+// fetchImage copies the image at url into store, returning its new URL.
+func fetchImage(ctx context.Context, store BlobStore, url string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := imageClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s", resp.Status)
+	}
+	return storeImage(ctx, store, resp.Body)
+}
+
+// importImages copies the posters of the media in db that are linked from
+// other sites into store, so pages are served variants of them rather than
+// the images as they are (see thumbnails.go), and makes the variants missing
+// from posters stored before they were made. It prints a line to w for each
+// media; images that cannot be fetched are left linked. With dryRun set
+// nothing is fetched or saved.
+func importImages(db MediaDatabase, store BlobStore, w io.Writer, dryRun bool) error {
+	stored, err := db.ListMedia()
+	if err != nil {
+		return fmt.Errorf("images: could not list media: %v", err)
+	}
+	ctx := context.Background()
+	var copied, resized, failed int
+	for _, m := range stored {
+		if hash, ok := m.storedPoster(); ok {
+			made, err := makeMissingVariants(ctx, store, hash, dryRun)
+			if err != nil {
+				fmt.Fprintf(w, "! %d %s: variants of %s: %v\n", m.ID, m.Title, m.ImageURL, err)
+				failed++
+			} else if made {
+				fmt.Fprintf(w, "~ %d %s: variants of %s\n", m.ID, m.Title, m.ImageURL)
+				resized++
+			}
+			continue
+		}
+		if !strings.HasPrefix(m.ImageURL, "http://") && !strings.HasPrefix(m.ImageURL, "https://") ||
+			strings.HasPrefix(m.ImageURL, store.URL("images/")) {
+			// Not linked, or stored already.
+			continue
+		}
+		if dryRun {
+			fmt.Fprintf(w, "~ %d %s: %s\n", m.ID, m.Title, m.ImageURL)
+			copied++
+			continue
+		}
+		url, err := fetchImage(ctx, store, m.ImageURL)
+		if err != nil {
+			fmt.Fprintf(w, "! %d %s: %s: %v\n", m.ID, m.Title, m.ImageURL, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "~ %d %s: %s -> %s\n", m.ID, m.Title, m.ImageURL, url)
+		copied++
+		m.ImageURL = url
+		if err := db.UpdateMedia(m, newMediaEvent(EventMediaUpdated, m, 0, imageImporter)); err != nil {
+			return fmt.Errorf("images: could not update %q: %v", m.Title, err)
+		}
+		rev := &Revision{Media: m, Author: imageImporter, Summary: "Poster copied from its site"}
+		if err := recordRevision(db, rev); err != nil {
+			return fmt.Errorf("images: %q: %v", m.Title, err)
+		}
+	}
+	fmt.Fprintf(w, "%d to copy, %d to make variants of, %d failed\n", copied, resized, failed)
+	return nil
+}
@@ -0,0 +1,436 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+	_ "golang.org/x/image/webp"
+)
+
+// Posters uploaded with media are kept in a BlobStore under a name derived
+// from their content, so uploading the same image twice stores it once and a
+// stored image never changes. The metadata of uploads, such as where and with
+// what camera a photo was taken, is dropped before they are stored, as they
+// are public.
+
+// BlobStore keeps uploaded files.
+type BlobStore interface {
+	// Put stores the data read from r under the given name, unless there
+	// already is a blob of that name.
+	Put(ctx context.Context, name, contentType string, r io.Reader) error
+
+	// Get opens the blob of the given name. The error wraps errNotFound if
+	// there is none.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// URL returns where browsers can fetch the blob of the given name.
+	URL(name string) string
+}
+
+/*---------------------------  Cloud Storage  ---------------------------*/
+
+// gcsBlobStore keeps blobs in a Cloud Storage bucket, which must be readable
+// by allUsers for the URLs to work.
+type gcsBlobStore struct {
+	bucket     *storage.BucketHandle
+	bucketName string
+}
+
+// Ensure gcsBlobStore conforms to the BlobStore interface.
+var _ BlobStore = &gcsBlobStore{}
+
+func (s *gcsBlobStore) Put(ctx context.Context, name, contentType string, r io.Reader) error {
+	obj := s.bucket.Object(name)
+	if _, err := obj.Attrs(ctx); err == nil {
+		return nil
+	} else if err != storage.ErrObjectNotExist {
+		return fmt.Errorf("gcs: %v", err)
+	}
+	w := obj.NewWriter(ctx)
+	w.ContentType = contentType
+	// Blobs never change, be aggressive about caching.
+	w.CacheControl = "public, max-age=31536000, immutable"
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return fmt.Errorf("gcs: could not write %s: %v", name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("gcs: could not write %s: %v", name, err)
+	}
+	return nil
+}
+
+func (s *gcsBlobStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := s.bucket.Object(name).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, fmt.Errorf("gcs: %s: %w", name, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gcs: %v", err)
+	}
+	return rc, nil
+}
+
+func (s *gcsBlobStore) URL(name string) string {
+	return fmt.Sprintf("https://storage.googleapis.com/%s/%s", s.bucketName, name)
+}
+
+/*---------------------------  Local directory  ---------------------------*/
+
+// localImagePath is where the site serves the blobs of a localBlobStore.
+const localImagePath = "/uploads/"
+
+// localBlobStore keeps blobs as files in a directory, for running the site
+// without Cloud Storage. The site serves them itself, see ServeHTTP.
+type localBlobStore struct {
+	dir string
+}
+
+// Ensure localBlobStore conforms to the BlobStore interface.
+var _ BlobStore = &localBlobStore{}
+
+// newLocalBlobStore returns a BlobStore keeping blobs in dir, which is
+// created if needed.
+func newLocalBlobStore(dir string) (*localBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("local blobs: %v", err)
+	}
+	return &localBlobStore{dir: dir}, nil
+}
+
+// file returns the path of the blob of the given name.
+func (s *localBlobStore) file(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (s *localBlobStore) Put(ctx context.Context, name, contentType string, r io.Reader) error {
+	file := s.file(name)
+	if _, err := os.Stat(file); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return fmt.Errorf("local blobs: %v", err)
+	}
+	// Write to a temporary file first so a failed upload leaves nothing
+	// under the name.
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".upload-")
+	if err != nil {
+		return fmt.Errorf("local blobs: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("local blobs: could not write %s: %v", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("local blobs: could not write %s: %v", name, err)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("local blobs: could not write %s: %v", name, err)
+	}
+	return nil
+}
+
+func (s *localBlobStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	f, err := os.Open(s.file(name))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("local blobs: %s: %w", name, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("local blobs: %v", err)
+	}
+	return f, nil
+}
+
+func (s *localBlobStore) URL(name string) string {
+	return localImagePath + name
+}
+
+// ServeHTTP serves the blobs under localImagePath.
+func (s *localBlobStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.StripPrefix(localImagePath, http.FileServer(http.Dir(s.dir))).ServeHTTP(w, r)
+}
+
+/*---------------------------  Uploads  ---------------------------*/
+
+// maxImageSize is the largest image that can be uploaded, in bytes, and
+// maxImagePixels the most pixels it may have once decoded.
+const (
+	maxImageSize   = 10 << 20
+	maxImagePixels = 40 << 20
+)
+
+// imageExtensions are the types of image that can be uploaded, by content
+// type, and the extension they are stored with.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// errBadImage is wrapped by the errors for uploads that are not images that
+// can be kept.
+var errBadImage = errors.New("bad image")
+
+// checkImage returns the content type of the image data, sniffed from the
+// data rather than trusted from the browser. The error wraps errBadImage if
+// it is not an image type that can be uploaded.
+func checkImage(data []byte) (contentType string, err error) {
+	contentType = http.DetectContentType(data)
+	if _, ok := imageExtensions[contentType]; !ok {
+		return "", fmt.Errorf("%w: %s is not a JPEG, PNG, GIF or WebP image", errBadImage, contentType)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errBadImage, err)
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return "", fmt.Errorf("%w: %dx%d is too many pixels", errBadImage, config.Width, config.Height)
+	}
+	return contentType, nil
+}
+
+// imageHash returns the hash of image data that names it.
+func imageHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// imageName returns the content-addressed name an image is stored under.
+func imageName(hash, contentType string) string {
+	return "images/" + hash + imageExtensions[contentType]
+}
+
+// storeImage validates the image read from r and keeps it in store, with its
+// variants, returning its URL.
+func storeImage(ctx context.Context, store BlobStore, r io.Reader) (url string, err error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxImageSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxImageSize {
+		return "", fmt.Errorf("%w: larger than %d MB", errBadImage, maxImageSize>>20)
+	}
+	contentType, err := checkImage(data)
+	if err != nil {
+		return "", err
+	}
+	if data, err = stripMetadata(data, contentType); err != nil {
+		return "", err
+	}
+	hash := imageHash(data)
+	// See thumbnails.go.
+	if err := makeVariants(ctx, store, hash, data); err != nil {
+		return "", err
+	}
+	name := imageName(hash, contentType)
+	if err := store.Put(ctx, name, contentType, bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+	return store.URL(name), nil
+}
+
+/*---------------------------  Metadata  ---------------------------*/
+
+// stripMetadata returns the image data of the given content type without its
+// metadata. Only the pixels are kept, and what is needed to show them as
+// they are meant to be: the EXIF orientation of JPEG images, and color
+// profiles.
+func stripMetadata(data []byte, contentType string) ([]byte, error) {
+	var stripped []byte
+	var err error
+	switch contentType {
+	case "image/jpeg":
+		stripped, err = stripJPEGMetadata(data)
+	case "image/png":
+		stripped, err = stripPNGMetadata(data)
+	case "image/gif":
+		stripped, err = stripGIFMetadata(data)
+	case "image/webp":
+		stripped, err = stripWebPMetadata(data)
+	default:
+		return nil, fmt.Errorf("%w: %s has no metadata to strip", errBadImage, contentType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadImage, err)
+	}
+	return stripped, nil
+}
+
+// stripJPEGMetadata drops the EXIF and XMP (APP1), IPTC (APP13) and comment
+// segments of JPEG data, adding back an EXIF segment with only the
+// orientation if there was one.
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("not a JPEG image")
+	}
+	out := []byte{0xFF, 0xD8}
+	orientation := jpegOrientation(data)
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xFF {
+		marker := data[i+1]
+		if marker == 0xDA {
+			// The image data starts, there is no more metadata.
+			break
+		}
+		if orientation > 1 && marker != 0xE0 {
+			// After the JFIF segment, which must come first.
+			out = append(out, orientationSegment(orientation)...)
+			orientation = 0
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		switch marker {
+		case 0xE1, 0xED, 0xFE:
+		default:
+			out = append(out, data[i:i+2+size]...)
+		}
+		i += 2 + size
+	}
+	return append(out, data[i:]...), nil
+}
+
+// orientationSegment returns a JPEG APP1 segment of EXIF data holding only
+// the orientation given.
+func orientationSegment(orientation int) []byte {
+	segment := []byte("\xFF\xE1\x00\x22Exif\x00\x00")
+	// A big-endian TIFF header, then the first IFD: one SHORT entry and no
+	// next IFD.
+	segment = append(segment, "MM\x00\x2A\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01"...)
+	segment = append(segment, 0, byte(orientation), 0, 0, 0, 0, 0, 0)
+	return segment
+}
+
+// pngMetadataChunks are the types of PNG chunks that hold metadata.
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"tIME": true,
+}
+
+// stripPNGMetadata drops the text, EXIF and time chunks of PNG data.
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, errors.New("not a PNG image")
+	}
+	out := []byte(signature)
+	for i := len(signature); i < len(data); {
+		if i+12 > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		size := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + size
+		if end > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		if !pngMetadataChunks[string(data[i+4:i+8])] {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+// stripGIFMetadata re-encodes GIF data, which keeps its frames and looping
+// but drops its comment and application extensions, such as XMP.
+func stripGIFMetadata(data []byte) ([]byte, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// stripWebPMetadata drops the EXIF and XMP chunks of WebP data, and their
+// flags in its VP8X header.
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP image")
+	}
+	out := append([]byte(nil), data[:12]...)
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2
+		if end > len(data) {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		switch string(data[i : i+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), data[i:end]...)
+			if len(chunk) > 8 {
+				// The EXIF and XMP flags.
+				chunk[8] &^= 0x08 | 0x04
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+// uploadFileFromForm stores the image in the "image" form field, if there is
+// one, returning its URL.
+func uploadFileFromForm(r *http.Request) (url string, err error) {
+	f, _, err := r.FormFile("image")
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if Images == nil {
+		return "", fmt.Errorf("%w: image uploads are not set up, see IMAGE_STORE", errBadImage)
+	}
+	return storeImage(r.Context(), Images, f)
+}
@@ -0,0 +1,299 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultListPath is where list/fts.json lives relative to the site directory.
+const defaultListPath = "../list/fts.json"
+
+// listImporter is the author of the revisions syncList makes, and the
+// creator of the media it adds. Only that media is pruned.
+const listImporter = "List import"
+
+// listRecord is one line of list/fts.json. The keys come straight from the
+// spreadsheet export, hence the odd names. Unset columns are null. Year tells
+// apart media that share a title, such as remakes.
+type listRecord struct {
+	ID       *int64  `json:"ID"`
+	Title    string  `json:"Titles"`
+	Year     *int    `json:"Year"`
+	Type     *string `json:"Type"`
+	Director *string `json:"Director"`
+	Industry *string `json:"Industry (Holly...)"`
+}
+
+// readListRecords parses newline-delimited list records from r.
+func readListRecords(r io.Reader) ([]listRecord, error) {
+	dec := json.NewDecoder(r)
+
+	var records []listRecord
+	for line := 1; ; line++ {
+		var rec listRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("list: record %d: %v", line, err)
+		}
+		if strings.TrimSpace(rec.Title) == "" {
+			return nil, fmt.Errorf("list: record %d has no title", line)
+		}
+		records = append(records, rec)
+	}
+}
+
+// apply copies the columns set in the record onto m. Null columns leave the
+// existing value alone so data added through the site is not wiped out.
+// A Director column replaces the director credits, keeping the cast.
+func (rec listRecord) apply(m *Media) {
+	m.Title = strings.TrimSpace(rec.Title)
+	if rec.Year != nil && m.ReleaseYear() == 0 {
+		m.ReleaseDate = strconv.Itoa(*rec.Year)
+	}
+	if rec.Type != nil {
+		m.MediaType = *rec.Type
+	}
+	if rec.Industry != nil {
+		m.Industry = *rec.Industry
+	}
+	if rec.Director != nil {
+		credits := parseCredits(*rec.Director, "")
+		for _, c := range m.Credits {
+			if c.Role != roleDirector {
+				credits = append(credits, c)
+			}
+		}
+		m.Credits = credits
+	}
+}
+
+// listKey is the title list records and stored media are matched on. The
+// list has no IDs yet, so titles are compared case-insensitively.
+func listKey(title string) string {
+	return strings.ToLower(strings.TrimSpace(title))
+}
+
+// year returns the release year of the record, or 0 if it has none.
+func (rec listRecord) year() int {
+	if rec.Year == nil {
+		return 0
+	}
+	return *rec.Year
+}
+
+// match returns the stored media with the record's title and release year,
+// or nil if there is none. Media without a year matches a record with one,
+// and a record without a year matches the only media of its title.
+// ambiguous is set if the record has no year and several media have its
+// title.
+func (rec listRecord) match(sameTitle []*Media) (m *Media, ambiguous bool) {
+	year := rec.year()
+	for _, s := range sameTitle {
+		if year != 0 && s.ReleaseYear() == year {
+			return s, false
+		}
+	}
+	if len(sameTitle) != 1 {
+		return nil, year == 0 && len(sameTitle) > 1
+	}
+	if s := sameTitle[0]; year == 0 || s.ReleaseYear() == 0 {
+		return s, false
+	}
+	return nil, false
+}
+
+// mediaChange is an update of stored media to match the list.
+type mediaChange struct {
+	Old, New *Media
+}
+
+// listDiff describes what syncing the list into a database would do.
+// Removed only holds media the list added, and Ambiguous the records left
+// alone as they need a year to tell which stored media they are.
+type listDiff struct {
+	Added     []*Media
+	Changed   []mediaChange
+	Removed   []*Media
+	Ambiguous []listRecord
+}
+
+// diffList compares the list records against the stored media.
+func diffList(records []listRecord, stored []*Media) listDiff {
+	byTitle := make(map[string][]*Media, len(stored))
+	for _, m := range stored {
+		key := listKey(m.Title)
+		byTitle[key] = append(byTitle[key], m)
+	}
+
+	var d listDiff
+	type recordKey struct {
+		title string
+		year  int
+	}
+	seen := make(map[recordKey]bool, len(records))
+	matched := make(map[*Media]bool, len(stored))
+	for _, rec := range records {
+		key := listKey(rec.Title)
+		if seen[recordKey{key, rec.year()}] {
+			// Duplicate records in the list; the first one wins.
+			continue
+		}
+		seen[recordKey{key, rec.year()}] = true
+
+		old, ambiguous := rec.match(byTitle[key])
+		if ambiguous {
+			d.Ambiguous = append(d.Ambiguous, rec)
+			for _, m := range byTitle[key] {
+				matched[m] = true
+			}
+			continue
+		}
+		if old == nil {
+			m := &Media{}
+			rec.apply(m)
+			m.CreatedBy = listImporter
+			d.Added = append(d.Added, m)
+			continue
+		}
+		matched[old] = true
+		m := *old
+		rec.apply(&m)
+		if m.Title != old.Title || m.ReleaseDate != old.ReleaseDate || m.MediaType != old.MediaType ||
+			m.Industry != old.Industry || m.DirectorNames() != old.DirectorNames() {
+			d.Changed = append(d.Changed, mediaChange{Old: old, New: &m})
+		}
+	}
+	for _, m := range stored {
+		if !matched[m] && m.CreatedBy == listImporter {
+			d.Removed = append(d.Removed, m)
+		}
+	}
+	return d
+}
+
+// listName returns the title of m with its release year, if it has one, as
+// titles alone do not tell remakes apart.
+func listName(m *Media) string {
+	if year := m.ReleaseYear(); year != 0 {
+		return fmt.Sprintf("%s (%d)", m.Title, year)
+	}
+	return m.Title
+}
+
+// Print writes a human readable summary of the diff to w. Removals are only
+// listed when prune is set, as they are not applied otherwise.
+func (d listDiff) Print(w io.Writer, prune bool) {
+	for _, m := range d.Added {
+		fmt.Fprintf(w, "+ %s [%s]\n", listName(m), m.MediaType)
+	}
+	for _, c := range d.Changed {
+		fmt.Fprintf(w, "~ %d %s\n", c.Old.ID, listName(c.Old))
+		if c.Old.Title != c.New.Title {
+			fmt.Fprintf(w, "    Title: %q -> %q\n", c.Old.Title, c.New.Title)
+		}
+		if c.Old.ReleaseDate != c.New.ReleaseDate {
+			fmt.Fprintf(w, "    ReleaseDate: %q -> %q\n", c.Old.ReleaseDate, c.New.ReleaseDate)
+		}
+		if c.Old.MediaType != c.New.MediaType {
+			fmt.Fprintf(w, "    MediaType: %q -> %q\n", c.Old.MediaType, c.New.MediaType)
+		}
+		if c.Old.Industry != c.New.Industry {
+			fmt.Fprintf(w, "    Industry: %q -> %q\n", c.Old.Industry, c.New.Industry)
+		}
+		if c.Old.DirectorNames() != c.New.DirectorNames() {
+			fmt.Fprintf(w, "    Directors: %q -> %q\n", c.Old.DirectorNames(), c.New.DirectorNames())
+		}
+	}
+	if prune {
+		for _, m := range d.Removed {
+			fmt.Fprintf(w, "- %d %s\n", m.ID, listName(m))
+		}
+	}
+	for _, rec := range d.Ambiguous {
+		fmt.Fprintf(w, "? %s: several media have this title, give it a Year\n", strings.TrimSpace(rec.Title))
+	}
+	fmt.Fprintf(w, "%d to add, %d to change, %d not in list, %d ambiguous\n",
+		len(d.Added), len(d.Changed), len(d.Removed), len(d.Ambiguous))
+}
+
+// syncList upserts the list at path into db. With dryRun set the diff is only
+// printed to w. With prune set, media the list added that is no longer in it
+// is deleted; media added through the site is never pruned.
+func syncList(db MediaDatabase, path string, w io.Writer, dryRun, prune bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("list: %v", err)
+	}
+	defer f.Close()
+
+	records, err := readListRecords(f)
+	if err != nil {
+		return err
+	}
+	stored, err := db.ListMedia()
+	if err != nil {
+		return fmt.Errorf("list: could not list media: %v", err)
+	}
+	if err := loadCredits(db, stored...); err != nil {
+		return fmt.Errorf("list: %v", err)
+	}
+
+	d := diffList(records, stored)
+	d.Print(w, prune)
+	if dryRun {
+		return nil
+	}
+
+	for _, m := range d.Added {
+		if m.ID, err = db.AddMedia(m, newMediaEvent(EventMediaCreated, m, 0, listImporter)); err != nil {
+			return fmt.Errorf("list: could not add %q: %v", m.Title, err)
+		}
+		if err := saveCredits(db, m); err != nil {
+			return fmt.Errorf("list: could not credit %q: %v", m.Title, err)
+		}
+		if err := recordRevision(db, &Revision{Media: m, Author: listImporter, Summary: "Added from " + path}); err != nil {
+			return fmt.Errorf("list: %q: %v", m.Title, err)
+		}
+	}
+	for _, c := range d.Changed {
+		if err := db.UpdateMedia(c.New, newMediaEvent(EventMediaUpdated, c.New, 0, listImporter)); err != nil {
+			return fmt.Errorf("list: could not update %q: %v", c.New.Title, err)
+		}
+		if err := saveCredits(db, c.New); err != nil {
+			return fmt.Errorf("list: could not credit %q: %v", c.New.Title, err)
+		}
+		if err := recordRevision(db, &Revision{Media: c.New, Author: listImporter, Summary: "Updated from " + path}); err != nil {
+			return fmt.Errorf("list: %q: %v", c.New.Title, err)
+		}
+	}
+	if prune {
+		for _, m := range d.Removed {
+			rev := &Revision{MediaID: m.ID, Author: listImporter, Summary: "Not in " + path}
+			if err := deleteMedia(db, rev); err != nil {
+				return fmt.Errorf("list: could not delete %q: %v", m.Title, err)
+			}
+		}
+	}
+	return nil
+}
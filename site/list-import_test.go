@@ -0,0 +1,73 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// TestSyncListDryRun diffs testdata/fts.json, which has the spreadsheet's
+// odd keys, a column the site does not read, padded and duplicate titles, a
+// remake told apart by its year and one that is not.
+func TestSyncListDryRun(t *testing.T) {
+	db := newMemoryDB()
+	for _, m := range []*Media{
+		{Title: "Alien", ReleaseDate: "1979", MediaType: "movie", CreatedBy: "Ann"},
+		{Title: "Suspiria", ReleaseDate: "1977", MediaType: "movie", CreatedBy: listImporter},
+		{Title: "Suspiria", ReleaseDate: "2018", MediaType: "movie", CreatedBy: listImporter},
+		{Title: "Little Women", ReleaseDate: "1994", MediaType: "movie", CreatedBy: listImporter},
+		{Title: "Little Women", ReleaseDate: "2019", MediaType: "movie", CreatedBy: listImporter},
+		{Title: "Agent Carter", MediaType: "TV", CreatedBy: "Ann"},
+		{Title: "Old Import", MediaType: "movie", CreatedBy: listImporter},
+		{Title: "Site Only", MediaType: "movie", CreatedBy: "Ann"},
+	} {
+		if _, err := db.AddMedia(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := db.ListMedia()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := syncList(db, "testdata/fts.json", &out, true, true); err != nil {
+		t.Fatalf("syncList: %v", err)
+	}
+	// Suspiria (1977) is not in the list but is pruned: the list added it.
+	want := `+ 3 Women [movie]
+~ 3 Suspiria (2018)
+    Directors: "" -> "Luca Guadagnino"
+~ 6 Agent Carter
+    ReleaseDate: "" -> "2015"
+- 7 Old Import
+- 2 Suspiria (1977)
+? Little Women: several media have this title, give it a Year
+1 to add, 2 to change, 2 not in list, 1 ambiguous
+`
+	if got := out.String(); got != want {
+		t.Errorf("syncList printed\n%s\nwant\n%s", got, want)
+	}
+
+	after, err := db.ListMedia()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("dry run changed the media:\n%v\nwant\n%v", after, before)
+	}
+}
@@ -15,16 +15,16 @@
 package main
 
 import (
-	"cloud.google.com/go/pubsub"
 	"context"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
-	"time"
+	"syscall"
 
 	"cloud.google.com/go/bigquery"
 
@@ -33,7 +33,7 @@ import (
 )
 
 var (
-	// See data-scratch.go
+	// See data-config.go
 	DB				MediaDatabase
 	DBName = os.Getenv("DBNAME")
 	TABLENAME = os.Getenv("TABLENAME")
@@ -44,6 +44,14 @@ var (
 	editTmpl   = parseTemplate("edit.html")
 	detailTmpl = parseTemplate("detail.html")
 	detailBQTmpl = parseTemplate("detailBQ.html")
+	characterTmpl     = parseTemplate("character.html")
+	characterEditTmpl = parseTemplate("character-edit.html")
+	searchTmpl        = parseTemplate("search.html")
+	usersTmpl         = parseTemplate("users.html")
+	submissionsTmpl   = parseTemplate("submissions.html")
+	submissionTmpl    = parseTemplate("submission.html")
+	historyTmpl       = parseTemplate("history.html")
+	trashTmpl         = parseTemplate("trash.html")
 
 	debugProject = true
 	bigQueryClient *bigquery.Client
@@ -54,7 +62,6 @@ var (
 TODO break down the index file into components - add list section and pass in data - remove hardcode of page in TemplatesTODO var for all the things esp images and db names
 TODO all form input - get it
 TODO add tests
-TODO add actors, characters, directors and expand on media
 TODO add in memory, datastore and pubsub to store data loaded
 TODO put flipthescript domain in place and upload on AE
 */
@@ -67,27 +74,122 @@ func init() {
 	if datasetID == "" || projectID == ""{
 		log.Print("SETUP ENVIRONMENT VARIABLES")
 	}
-	bigQueryClient, err = bigquery.NewClient(context.Background(), projectID);
+	if projectID != "" {
+		bigQueryClient, err = bigquery.NewClient(context.Background(), projectID);
+		if err != nil {
+			log.Fatalf("Cannot initialize BigQuery client: %v, ", err)
+		}
+	}
+}
+
+func main() {
+	importList := flag.String("import-list", "", "sync media from a list file such as "+defaultListPath+" into the database and exit")
+	importBechdelPath := flag.String("import-bechdel", "", "set Bechdel test results from a bechdeltest.com JSON dump and exit")
+	importImagesFlag := flag.Bool("import-images", false, "copy posters linked from other sites into the IMAGE_STORE, make the missing poster variants, and exit")
+	dryRun := flag.Bool("dry-run", false, "with -import-list, -import-bechdel or -import-images, only print what would be added, changed or removed")
+	prune := flag.Bool("prune", false, "with -import-list, delete media the list added that is no longer in it")
+	migrateOnly := flag.Bool("migrate", false, "apply pending PostgreSQL schema migrations and exit")
+	checkSchema := flag.Bool("check-schema", false, "report PostgreSQL schema drift and exit")
+	worker := flag.Bool("worker", false, "fill in media details from the "+EventsTopicID+" Pub/Sub topic instead of serving the site")
+	flag.Parse()
+
+	if *migrateOnly || *checkSchema {
+		if err := runSchemaCommand(*migrateOnly); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// DBBACKEND=memory runs the site without a database.
+	var err error
+	DB, err = configureDB(os.Getenv("DBBACKEND"))
 	if err != nil {
-		log.Fatalf("Cannot initialize BigQuery client: %v, ", err)
-	}
-	DB, err = configureCloudSQL(cloudSQLConfig{
-		Username: os.Getenv("PgSQL_USERNAME"),
-		Password: os.Getenv("PgSQL_PWD"),
-		Instance: os.Getenv("PgSQL_INSTANCE"),
-		IP: os.Getenv("PgSQL_IP"),
-	})
-	// 	// The connection name of the Cloud SQL v2 instance, i.e.,
-	// 	// "project:region:instance-id"
-	// 	// Cloud SQL v1 instances are not supported.
-	// 	Instance: "",
-	// })
+		log.Fatal(err)
+	}
+
+	if *importList != "" {
+		if err := syncList(DB, *importList, os.Stdout, *dryRun, *prune); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *importBechdelPath != "" {
+		if err := importBechdel(DB, *importBechdelPath, os.Stdout, *dryRun); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Uploaded images, see images.go.
+	if Images, err = configureImages(os.Getenv("IMAGE_STORE")); err != nil {
+		log.Fatal(err)
+	}
+	if *importImagesFlag {
+		if Images == nil {
+			log.Fatal("-import-images needs IMAGE_STORE")
+		}
+		if err := importImages(DB, Images, os.Stdout, *dryRun); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Media changes are announced as events, see events.go.
+	projectID := os.Getenv("PUBSUB_PROJECT_ID")
+	if Events, err = configureEvents(projectID); err != nil {
+		log.Fatal(err)
+	}
+	if *worker {
+		if projectID == "" {
+			log.Fatal("-worker needs PUBSUB_PROJECT_ID")
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := subscribeFiller(ctx, Events, DB); err != nil {
+			log.Fatal(err)
+		}
+		<-ctx.Done()
+		Events.Close()
+		return
+	}
+
+	// Searches use an in-process index, kept in sync with the changes made
+	// through DB.
+	idb := newIndexedDB(DB)
+	if err := idb.index.rebuild(); err != nil {
+		log.Fatal(err)
+	}
+	DB = idb
+
+	// Deleted media is purged from the trash after a while, see trash.go.
+	retention, err := trashRetention()
 	if err != nil {
 		log.Fatal(err)
 	}
-}
+	go purgeTrashEvery(DB, retention, trashPurgeInterval)
+
+	// Events saved with changes are published from the outbox. Without
+	// Pub/Sub there is no worker, so the site fills in media details itself.
+	ctx := context.Background()
+	if projectID == "" {
+		if err := subscribeFiller(ctx, Events, DB); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// Workers change media too; the search index hears of it through events.
+	if err := idb.index.subscribe(ctx, Events); err != nil {
+		log.Fatal(err)
+	}
+	go relayOutbox(ctx, DB, Events, outboxInterval)
+
+	// Logging in, see auth.go.
+	if SessionStore, err = configureSessions(); err != nil {
+		log.Fatal(err)
+	}
+	if AuthProvider, err = configureAuth(os.Getenv("AUTH_PROVIDER")); err != nil {
+		log.Fatal(err)
+	}
 
-func main() {
 	//Start the web server, set the port to listen to 8080. Without assumes localhost.
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -118,17 +220,85 @@ func registerHandlers() {
 	r.Methods("GET").Path("/media/list").Handler(appHandler(listHandler))
 	r.Methods("GET").Path("/media/{id:[0-9]+}").
 		Handler(appHandler(detailHandler))
+	r.Methods("GET").Path("/media/{id:[0-9]+}/poster.svg").Handler(appHandler(posterHandler))
+	// Changes need permission, see roles.go.
 	r.Methods("GET").Path("/media/add").
-		Handler(appHandler(addFormHandler))
+		Handler(appHandler(authorized(canAddMedia, addFormHandler)))
 	r.Methods("GET").Path("/media/{id:[0-9]+}/edit").
-		Handler(appHandler(editFormHandler))
+		Handler(appHandler(authorized(canEditMedia, editFormHandler)))
 
 	r.Methods("POST").Path("/media").
-		Handler(appHandler(createHandler))
+		Handler(appHandler(authorized(canAddMedia, createHandler)))
 	r.Methods("POST", "PUT").Path("/media/{id:[0-9]+}").
-		Handler(appHandler(updateHandler))
+		Handler(appHandler(authorized(canEditMedia, updateHandler)))
 	r.Methods("POST").Path("/media/{id:[0-9]+}:delete").
-		Handler(appHandler(deleteHandler)).Name("delete")
+		Handler(appHandler(authorized(canDeleteMedia, deleteHandler))).Name("delete")
+
+	r.Methods("GET").Path("/media/mine").Handler(appHandler(myMediaHandler))
+
+	// History, see revisions.go.
+	r.Methods("GET").Path("/media/{id:[0-9]+}/history").Handler(appHandler(historyHandler))
+	r.Methods("POST").Path("/media/{id:[0-9]+}/history/{revision:[0-9]+}:revert").
+		Handler(appHandler(authorized(canEditMedia, revertHandler)))
+
+	// Trash, see trash.go.
+	r.Methods("GET").Path("/media/trash").
+		Handler(appHandler(authorized(requireRole(RoleModerator), trashHandler)))
+	r.Methods("POST").Path("/media/{id:[0-9]+}:restore").
+		Handler(appHandler(authorized(requireRole(RoleModerator), restoreHandler)))
+
+	// Moderation, see submissions.go.
+	r.Methods("GET").Path("/moderation").
+		Handler(appHandler(authorized(requireRole(RoleModerator), moderationHandler)))
+	r.Methods("GET").Path("/submissions").Handler(appHandler(mySubmissionsHandler))
+	r.Methods("GET").Path("/submissions/{id:[0-9]+}").
+		Handler(appHandler(authorized(canViewSubmission, submissionHandler)))
+	r.Methods("GET").Path("/submissions/{id:[0-9]+}/edit").
+		Handler(appHandler(authorized(canEditSubmission, editSubmissionFormHandler)))
+	r.Methods("POST").Path("/submissions/{id:[0-9]+}").
+		Handler(appHandler(authorized(canEditSubmission, resubmitHandler)))
+	r.Methods("POST").Path("/submissions/{id:[0-9]+}:{action:approve|reject|request-changes}").
+		Handler(appHandler(authorized(requireRole(RoleModerator), reviewHandler)))
+
+	r.Methods("GET").Path("/characters/{id:[0-9]+}").
+		Handler(appHandler(characterHandler))
+	r.Methods("GET").Path("/characters/{id:[0-9]+}.json").
+		Handler(appHandler(characterJSONHandler))
+	r.Methods("GET").Path("/characters/{id:[0-9]+}/edit").
+		Handler(appHandler(authorized(canEditCharacter, editCharacterFormHandler)))
+	r.Methods("POST", "PUT").Path("/characters/{id:[0-9]+}").
+		Handler(appHandler(authorized(canEditCharacter, updateCharacterHandler)))
+
+	r.Methods("GET").Path("/admin/users").
+		Handler(appHandler(authorized(requireRole(RoleAdmin), usersHandler)))
+	r.Methods("POST").Path("/admin/users/{id:[0-9]+}").
+		Handler(appHandler(authorized(requireRole(RoleAdmin), updateRoleHandler)))
+
+	// Search, see search.go.
+	fieldPattern := "{field:title|actor|director|character}"
+	r.Methods("GET").Path("/find").Handler(appHandler(searchHandler))
+	r.Methods("GET").Path("/find.json").Handler(appHandler(searchJSONHandler))
+	r.Methods("GET").Path("/search/" + fieldPattern).Handler(appHandler(searchHandler))
+	r.Methods("GET").Path("/search/" + fieldPattern + ".json").Handler(appHandler(searchJSONHandler))
+
+	// Logging in, see auth.go.
+	r.Methods("GET").Path("/login").Handler(appHandler(loginHandler))
+	r.Methods("GET").Path("/auth/callback").Handler(appHandler(authCallbackHandler))
+	r.Methods("POST").Path("/logout").Handler(appHandler(logoutHandler))
+	if LocalOIDC != nil {
+		r.PathPrefix("/local-oidc/").Handler(LocalOIDC)
+	}
+
+	// Poster variants, see thumbnails.go, and images uploaded to a local
+	// directory, see images.go.
+	r.Methods("GET").Path("/images/{hash:[0-9a-f]{64}}/{size:[0-9]+}").
+		Handler(appHandler(imageVariantHandler))
+	if store, ok := Images.(*localBlobStore); ok {
+		r.PathPrefix(localImagePath).Handler(store)
+	}
+
+	// JSON API, see api.go.
+	registerAPIHandlers(r)
 
 	// Respond to App Engine and Compute Engine health checks.
 	// Indicate the server is healthy.
@@ -161,11 +331,22 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// appErrorf returns a server error, or a not found error if err wraps
+// errNotFound.
 func appErrorf(err error, format string, v ...interface{}) error {
+	code := http.StatusInternalServerError
+	if errors.Is(err, errNotFound) {
+		code = http.StatusNotFound
+	}
+	return appErrorCodef(code, err, format, v...)
+}
+
+// appErrorCodef returns an error answered with the given HTTP status code.
+func appErrorCodef(code int, err error, format string, v ...interface{}) error {
 	return &appError{
 		cause:   err,
 		message: fmt.Sprintf(format, v...),
-		code:    500,
+		code:    code,
 	}
 }
 
@@ -215,19 +396,81 @@ func detailHandlerBQ(w http.ResponseWriter, r *http.Request) error {
 
 //index is the start page
 func indexHandler(w http.ResponseWriter, r *http.Request) error {
-	log.Printf("INDEX HANDLER")
 	return indexTmpl.Execute(w, r, nil)
 }
 
-// listHandler displays a list with summaries media in the database.
+// mediaListPage is what list.html shows: the listed media, the query that
+// selected them and the facets to refine it with.
+type mediaListPage struct {
+	Media        []*Media
+	PageSubTitle string
+
+	Query  *MediaQuery
+	Facets []Facet
+	Sorts  []FacetValue
+
+	// HideFlaggedURL toggles hiding disqualified media; ClearURL drops all
+	// filters.
+	HideFlaggedURL string
+	ClearURL       string
+
+	// FirstURL is the first page, when this is not it; NextURL the next
+	// page, if any.
+	FirstURL string
+	NextURL  string
+}
+
+// listHandler displays a page of summaries of the media in the database. The
+// query parameters filter and sort the list (see media-query.go); cursor and
+// size page through it.
 func listHandler(w http.ResponseWriter, r *http.Request) error {
-	log.Printf("LIST HANDLER")
-	media, err := DB.ListMedia()
+	q, err := mediaQueryFromForm(r)
+	if err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
+	size, err := pageSizeFromForm(r)
+	if err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
+	page := &mediaListPage{PageSubTitle: "Media List", Query: q}
+
+	cursor := r.FormValue("cursor")
+	mp, err := DB.PageMedia(q, cursor, size)
+	if errors.Is(err, errBadCursor) {
+		return appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
 	if err != nil {
 		return appErrorf(err, "could not list media: %v", err)
 	}
-	media[0].PageSubTitle = "Media List"
-	return listTmpl.Execute(w, r, media)
+	page.Media = mp.Media
+	if cursor != "" {
+		page.FirstURL = q.pageURL("/media/list", "", size)
+	}
+	if mp.Next != "" {
+		page.NextURL = q.pageURL("/media/list", mp.Next, size)
+	}
+	if err := loadCredits(DB, page.Media...); err != nil {
+		return appErrorf(err, "could not list media credits: %v", err)
+	}
+	if page.Facets, err = mediaFacets(r.Context(), DB, *q); err != nil {
+		return appErrorf(err, "could not count media: %v", err)
+	}
+
+	for _, s := range mediaSorts {
+		sorted := *q
+		sorted.Sort = s.Sort
+		page.Sorts = append(page.Sorts, FacetValue{
+			Label:    s.Label,
+			Selected: q.Sort == s.Sort || q.Sort == "" && s.Sort == sortTitle,
+			URL:      sorted.URL(),
+		})
+	}
+	hide := *q
+	hide.HideFlagged = !q.HideFlagged
+	page.HideFlaggedURL = hide.URL()
+	page.ClearURL = MediaQuery{Sort: q.Sort}.URL()
+
+	return listTmpl.Execute(w, r, page)
 }
 
 // bookFromRequest retrieves media from the database given a media ID in the
@@ -239,7 +482,10 @@ func mediaFromRequest(r *http.Request) (*Media, error) {
 	}
 	media, err := DB.GetMedia(id)
 	if err != nil {
-		return nil, fmt.Errorf("could not find media: %v", err)
+		return nil, fmt.Errorf("could not find media: %w", err)
+	}
+	if err := loadCredits(DB, media); err != nil {
+		return nil, err
 	}
 	return media, nil
 }
@@ -250,15 +496,50 @@ func detailHandler(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return appErrorf(err, "could not list media detail: %v", err)
 	}
+	user, err := userFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
 	media.PageSubTitle = "Media Details"
+	media.CanEdit, media.CanDelete = user.CanEditMedia(media), user.CanDeleteMedia(media)
 	return detailTmpl.Execute(w, r, media)
 }
 
 
+// mediaForm is what edit.html shows: the media, where to post it, and the
+// justification for the submission (see submissions.go).
+type mediaForm struct {
+	*Media
+	Action                string
+	Justification         string
+	JustificationRequired bool
+
+	// Reason is why a moderator asked for changes, if they did.
+	Reason string
+}
+
+// newMediaForm returns the form posting media to its URL, asking users who
+// are not moderators to justify their changes.
+func newMediaForm(r *http.Request, m *Media) (*mediaForm, error) {
+	u, err := userFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	f := &mediaForm{Media: m, Action: "/media", JustificationRequired: !u.Is(RoleModerator)}
+	if m.ID != 0 {
+		f.Action = fmt.Sprintf("/media/%d", m.ID)
+	}
+	return f, nil
+}
+
 // addFormHandler displays a form that captures details of a new item to add to
 // the database.
 func addFormHandler(w http.ResponseWriter, r *http.Request) error {
-	return editTmpl.Execute(w, r, nil)
+	form, err := newMediaForm(r, &Media{PageSubTitle: "Add Media"})
+	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+	return editTmpl.Execute(w, r, form)
 }
 
 // editFormHandler displays a form that allows the user to edit the details of
@@ -270,33 +551,17 @@ func editFormHandler(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	media.PageSubTitle = "Edit Media"
-	return editTmpl.Execute(w, r, media)
+	form, err := newMediaForm(r, media)
+	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+	return editTmpl.Execute(w, r, form)
 }
 
 // mediaFromForm populates the fields of a Book from form values
-// (see templates/edit.html).
+// (see templates/edit.html). The poster uploaded with them is left to
+// uploadPosterFromForm.
 func mediaFromForm(r *http.Request) (*Media, error) {
-	/*TODO confirm exists or doesn't*/
-	log.Printf(" MEDIA FROM FORM")
-
-	/*imageURL, err := uploadFileFromForm(r) TODO store form & image and return image link
-	if err != nil {
-		return nil, fmt.Errorf("could not upload file: %v", err)
-	}
-	if imageURL == "" {
-		imageURL = r.FormValue("imageURL")
-	}*/
-
-/*	actorID, _ := strconv.ParseInt(r.FormValue("actorID"), 10, 64)
-	characterID, _ := strconv.ParseInt(r.FormValue("characterID"), 10, 64)
-	dirctorID, _ := strconv.ParseInt(r.FormValue("dirctorID"), 10, 64)
-	bechdel, _ := strconv.ParseBool(r.FormValue("bechdel"))
-*/
-	actorID, _ := strconv.ParseInt(strconv.Itoa(rand.Intn(30)), 10, 64)
-	characterID, _ := strconv.ParseInt(strconv.Itoa(rand.Intn(30)), 10, 64)
-	dirctorID, _ := strconv.ParseInt(strconv.Itoa(rand.Intn(30)), 10, 64)
-	bechdel := false
-
 		media := &Media{
 		Title:         r.FormValue("title"),
 		Description:   r.FormValue("description"),
@@ -304,105 +569,121 @@ func mediaFromForm(r *http.Request) (*Media, error) {
 		Industry:	   r.FormValue("industry"),
 		ReleaseDate:   r.FormValue("releaseDate"),
 
-		ActorID:	   actorID,
-		CharacterID:   characterID,
-		DirectorID:    dirctorID,
+		Credits:	   parseCredits(r.FormValue("directors"), r.FormValue("cast")),
 
 		ImageURL:      r.FormValue("imageURL"),
 
-		Bechdel:	   bechdel,
-		WikiURL:	   r.FormValue("imageURL"),
-		IMDBURL:	   r.FormValue("imageURL"),
-		RottenTomURL:  r.FormValue("imageURL"),
-
-		CreatedBy:     r.FormValue("createdBy"),
+		Bechdel:	   bechdelFromForm(r),
+		Tags:          parseTags(r.FormValue("tags")),
+		WikiURL:	   r.FormValue("wikiURL"),
+		IMDBURL:	   r.FormValue("imdbURL"),
+		RottenTomURL:  r.FormValue("rottenTomURL"),
 	}
 
-	log.Printf(" MEDIA | %v", media)
-
-	// Anonymous if the createdBy is empty
-	if media.CreatedBy == "" {
-		media.SetCreatorAnonymous()
-	} else {
-		media.CreatedByID, _ = strconv.ParseInt(strconv.Itoa(rand.Intn(30)), 10, 64)
-		//Assume if empty z
-		media.CreatedDate = time.Now().Format("02-01-2006")
+	rubric := currentRubric()
+	if v := r.FormValue("rubricVersion"); v != "" {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad rubric version: %v", err)
+		}
+		var ok bool
+		if rubric, ok = rubricVersion(version); !ok {
+			return nil, fmt.Errorf("no rubric version %d", version)
+		}
 	}
-
+	media.RubricVersion = rubric.Version
+	var err error
+	if media.Assessments, err = evaluationsFromForm(r, rubric.Criteria()); err != nil {
+		return nil, err
+	}
+	media.scoreRubric()
 	return media, nil
 }
 
+// uploadPosterFromForm stores the poster uploaded with the form, if there is
+// one, as the image of m, replacing the one it had (see images.go). It is
+// called once the rest of the request has been checked, so requests that
+// fail leave no image behind.
+func uploadPosterFromForm(r *http.Request, m *Media) error {
+	imageURL, err := uploadFileFromForm(r)
+	if err != nil {
+		return fmt.Errorf("could not upload image: %w", err)
+	}
+	if imageURL != "" {
+		m.ImageURL = imageURL
+	}
+	return nil
+}
 
-// createHandler adds a media to the database.
+// createHandler submits new media for moderation.
 func createHandler(w http.ResponseWriter, r *http.Request) error {
 	media, err := mediaFromForm(r)
 	if err != nil {
-		return appErrorf(err, "could not parse media from form: %v", err)
+		return appErrorCodef(http.StatusBadRequest, err, "could not parse media from form: %v", err)
+	}
+	return submitFromForm(w, r, media)
+}
+
+// submitFromForm submits media from the form for moderation, and shows the
+// media if it was approved straight away, the submission otherwise.
+func submitFromForm(w http.ResponseWriter, r *http.Request, media *Media) error {
+	user, err := userFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+	justification := r.FormValue("justification")
+	if err := checkSubmission(user, justification); err != nil {
+		return submissionErrorf(err)
 	}
-	id, err := DB.AddMedia(media)
+	if err := uploadPosterFromForm(r, media); err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
+	s, err := submitMedia(DB, user, media, justification)
 	if err != nil {
-		return appErrorf(err, "could not save media: %v", err)
+		return submissionErrorf(err)
+	}
+	if s.Status == submissionApproved {
+		http.Redirect(w, r, fmt.Sprintf("/media/%d", s.MediaID), http.StatusFound)
+		return nil
 	}
-/*	TODO go publishUpdate(id)
-*/	http.Redirect(w, r, fmt.Sprintf("/media/%d", id), http.StatusFound)
+	http.Redirect(w, r, fmt.Sprintf("/submissions/%d", s.ID), http.StatusFound)
 	return nil
 }
 
-// updateHandler updates the details of a given book.
+// updateHandler submits changes to the details of a given media for
+// moderation.
 func updateHandler(w http.ResponseWriter, r *http.Request) error {
 	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
 		return appErrorf(err, "bad media id: %v", err)
 	}
 
+	if _, err := DB.GetMedia(id); err != nil {
+		return appErrorf(err, "could not find media: %v", err)
+	}
 	media, err := mediaFromForm(r)
 	if err != nil {
-		return appErrorf(err, "could not parse media from form: %v", err)
+		return appErrorCodef(http.StatusBadRequest, err, "could not parse media from form: %v", err)
 	}
 	media.ID = id
-
-	err = DB.UpdateMedia(media)
-	if err != nil {
-		return appErrorf(err, "could not save media: %v", err)
-	}
-/*	TODO go publishUpdate(media.ID)
-*/
-	media.PageSubTitle = "Media Update"
-	http.Redirect(w, r, fmt.Sprintf("/media/%d", media.ID), http.StatusFound)
-	return nil
+	return submitFromForm(w, r, media)
 }
 
-// deleteHandler deletes a given book.
+// deleteHandler deletes a given book, keeping it in its history.
 func deleteHandler(w http.ResponseWriter, r *http.Request) error {
 	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
 		return appErrorf(err, "bad media id: %v", err)
 	}
-	err = DB.DeleteMedia(id)
+	user, err := userFromRequest(r)
 	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+	rev := &Revision{MediaID: id, AuthorID: user.ID, Author: user.DisplayName(), Summary: r.FormValue("reason")}
+	if err := deleteMedia(DB, rev); err != nil {
 		return appErrorf(err, "could not delete media: %v", err)
 	}
 	http.Redirect(w, r, "/media", http.StatusFound)
 	return nil
 }
 
-// publishUpdate notifies Pub/Sub subscribers that the media identified with
-// the given ID has been added/modified.
-func publishUpdate(mediaID int64) {
-	if PubsubClient == nil {
-		return
-	}
-
-	ctx := context.Background()
-
-	m, err := json.Marshal(mediaID)
-	if err != nil {
-		return
-	}
-	topic := PubsubClient.Topic(PubsubTopicID)
-	_, err = topic.Publish(ctx, &pubsub.Message{Data: m}).Get(ctx)
-	log.Printf("Published update to Pub/Sub for Media ID %d: %v", mediaID, err)
-}
-
-
-
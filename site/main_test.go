@@ -0,0 +1,138 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+// registerOnce registers the site's handlers, which go on
+// http.DefaultServeMux, for the first test that needs them.
+var registerOnce sync.Once
+
+// useDB makes db the site's database for the rest of the test.
+func useDB(t *testing.T, db MediaDatabase) {
+	t.Helper()
+	old := DB
+	DB = db
+	t.Cleanup(func() { DB = old })
+}
+
+// addTestUser adds a user with the given role to DB.
+func addTestUser(t *testing.T, role Role) *User {
+	t.Helper()
+	u := &User{Issuer: "test", Subject: string(role), Name: "Test " + string(role), Role: role}
+	id, err := DB.AddUser(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.ID = id
+	return u
+}
+
+// testCSRFToken is the CSRF token of the sessions of serveAs.
+const testCSRFToken = "test csrf token"
+
+// serveAs runs req through the site's handlers, logged in as u unless it is
+// nil, and returns the response. The request carries the session's CSRF
+// token.
+func serveAs(t *testing.T, req *http.Request, u *User) *httptest.ResponseRecorder {
+	t.Helper()
+	req.Header.Set(csrfHeader, testCSRFToken)
+	return serveWithoutToken(t, req, u)
+}
+
+// serveWithoutToken is serveAs for requests that carry the CSRF token
+// themselves, if at all.
+func serveWithoutToken(t *testing.T, req *http.Request, u *User) *httptest.ResponseRecorder {
+	t.Helper()
+	registerOnce.Do(registerHandlers)
+	if SessionStore == nil {
+		SessionStore = sessions.NewCookieStore([]byte("test session key"))
+	}
+	if u != nil {
+		rec := httptest.NewRecorder()
+		session, err := SessionStore.New(req, sessionName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session.Values[sessionUserID] = u.ID
+		session.Values[sessionCSRFToken] = testCSRFToken
+		if err := session.Save(req, rec); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range rec.Result().Cookies() {
+			req.AddCookie(c)
+		}
+	}
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, req)
+	return w
+}
+
+// TestUpdateMediaLinks edits the links of media with the form, which are
+// saved as they are posted: a link left empty is removed.
+func TestUpdateMediaLinks(t *testing.T) {
+	useDB(t, newMemoryDB())
+	moderator := addTestUser(t, RoleModerator)
+	id, err := DB.AddMedia(&Media{
+		Title:        "Alien",
+		WikiURL:      "https://en.wikipedia.org/wiki/Alien_(film)",
+		IMDBURL:      "https://www.imdb.com/title/tt0078748/",
+		RottenTomURL: "https://www.rottentomatoes.com/m/alien",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/media/%d", id)
+
+	w := serveAs(t, httptest.NewRequest("GET", path+"/edit", nil), moderator)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `name="imdbURL"`) {
+		t.Fatalf("GET %s/edit = %d, want a form with the links", path, w.Code)
+	}
+
+	form := url.Values{
+		"title":    {"Alien"},
+		"imageURL": {"https://example.com/alien.jpg"},
+		"wikiURL":  {"https://en.wikipedia.org/wiki/Alien_(film)"},
+		"imdbURL":  {"https://www.imdb.com/title/tt0078748/reference"},
+	}
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w := serveAs(t, req, moderator); w.Code != http.StatusFound {
+		t.Fatalf("POST %s = %d %s, want a redirect", path, w.Code, w.Body.String())
+	}
+	m, err := DB.GetMedia(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Media{
+		WikiURL:      "https://en.wikipedia.org/wiki/Alien_(film)",
+		IMDBURL:      "https://www.imdb.com/title/tt0078748/reference",
+		RottenTomURL: "",
+	}
+	if m.WikiURL != want.WikiURL || m.IMDBURL != want.IMDBURL || m.RottenTomURL != want.RottenTomURL {
+		t.Errorf("links = %q, %q, %q, want %q, %q, %q", m.WikiURL, m.IMDBURL, m.RottenTomURL,
+			want.WikiURL, want.IMDBURL, want.RottenTomURL)
+	}
+}
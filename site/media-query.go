@@ -0,0 +1,665 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*---------------------------  Tags  ---------------------------*/
+
+// parseTags splits a comma-separated list of tags, lower-casing them and
+// dropping blanks and repeats.
+func parseTags(s string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	return tags
+}
+
+// TagList returns the tags as parseTags reads them, for edit.html.
+func (m *Media) TagList() string {
+	return strings.Join(m.Tags, ", ")
+}
+
+// hasTag reports whether m is tagged with tag.
+func (m *Media) hasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+/*---------------------------  Queries  ---------------------------*/
+
+// Orders of MediaQuery.Sort.
+const (
+	sortTitle   = "title"   // A to Z.
+	sortRelease = "release" // Most recently released first.
+	sortAdded   = "added"   // Most recently added first.
+	sortScore   = "score"   // Highest inclusion score first.
+)
+
+// mediaSorts are the sort orders, as offered on /media/list.
+var mediaSorts = []struct{ Sort, Label string }{
+	{sortTitle, "Title"},
+	{sortRelease, "Release date"},
+	{sortAdded, "Date added"},
+	{sortScore, "Score"},
+}
+
+// MediaQuery selects and orders media for MediaDatabase.QueryMedia. Zero
+// fields do not filter.
+type MediaQuery struct {
+	MediaType   string
+	Industry    string
+	Decade      int    // First year of the decade, e.g. 1990.
+	Bechdel     string // A key of bechdelFilters.
+	MinScore    int
+	HideFlagged bool
+	Tags        []string // Media must have all of them.
+	Sort        string   // Defaults to sortTitle.
+}
+
+// mediaQueryFromForm reads a query from the parameters of /media/list.
+func mediaQueryFromForm(r *http.Request) (*MediaQuery, error) {
+	q := &MediaQuery{
+		MediaType: r.FormValue("mediaType"),
+		Industry:  r.FormValue("industry"),
+		Bechdel:   r.FormValue("bechdel"),
+		Sort:      r.FormValue("sort"),
+	}
+	// FormValue has parsed the form.
+	q.Tags = parseTags(strings.Join(r.Form["tag"], ","))
+	if v := r.FormValue("decade"); v != "" {
+		decade, err := strconv.Atoi(v)
+		if err != nil || decade%10 != 0 {
+			return nil, fmt.Errorf("bad decade %q", v)
+		}
+		q.Decade = decade
+	}
+	if _, ok := bechdelFilters[q.Bechdel]; !ok {
+		return nil, fmt.Errorf("bad bechdel filter %q", q.Bechdel)
+	}
+	if v := r.FormValue("minScore"); v != "" {
+		score, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad minScore: %v", err)
+		}
+		q.MinScore = score
+	}
+	if v := r.FormValue("hideFlagged"); v != "" {
+		hide, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad hideFlagged: %v", err)
+		}
+		q.HideFlagged = hide
+	}
+	if _, ok := mediaSortKeys[q.Sort]; !ok {
+		return nil, fmt.Errorf("bad sort %q", q.Sort)
+	}
+	return q, nil
+}
+
+// values returns the parameters of /media/list that give q.
+func (q MediaQuery) values() url.Values {
+	v := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	set("mediaType", q.MediaType)
+	set("industry", q.Industry)
+	if q.Decade != 0 {
+		v.Set("decade", strconv.Itoa(q.Decade))
+	}
+	set("bechdel", q.Bechdel)
+	if q.MinScore != 0 {
+		v.Set("minScore", strconv.Itoa(q.MinScore))
+	}
+	if q.HideFlagged {
+		v.Set("hideFlagged", "true")
+	}
+	for _, t := range q.Tags {
+		v.Add("tag", t)
+	}
+	if q.Sort != sortTitle {
+		set("sort", q.Sort)
+	}
+	return v
+}
+
+// URL returns the /media/list URL that lists q.
+func (q MediaQuery) URL() string {
+	return q.pageURL("/media/list", "", defaultPageSize)
+}
+
+// pageURL returns the URL of the list at path of the page of q following
+// cursor.
+func (q MediaQuery) pageURL(path, cursor string, size int) string {
+	v := q.values()
+	if cursor != "" {
+		v.Set("cursor", cursor)
+	}
+	if size != defaultPageSize {
+		v.Set("size", strconv.Itoa(size))
+	}
+	if len(v) == 0 {
+		return path
+	}
+	return path + "?" + v.Encode()
+}
+
+// matches reports whether m is selected by q.
+func (q *MediaQuery) matches(m *Media) bool {
+	switch {
+	case q.MediaType != "" && m.MediaType != q.MediaType,
+		q.Industry != "" && m.Industry != q.Industry,
+		q.Decade != 0 && (m.ReleaseYear() < q.Decade || m.ReleaseYear() >= q.Decade+10),
+		!bechdelFilters[q.Bechdel](m.Bechdel),
+		m.InclusionScore < q.MinScore,
+		q.HideFlagged && m.Disqualified:
+		return false
+	}
+	for _, t := range q.Tags {
+		if !m.hasTag(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortKey is a key of a sort order: its value for media, in Go and as an
+// SQL expression over the media columns, and its direction.
+type sortKey struct {
+	sql   string
+	value func(m *Media) interface{} // A string or an int64.
+	desc  bool
+}
+
+var (
+	titleKey = sortKey{sql: "COALESCE(title, '')", value: func(m *Media) interface{} { return m.Title }}
+	idKey    = sortKey{sql: "id", value: func(m *Media) interface{} { return m.ID }}
+)
+
+// mediaSortKeys are the keys of each sort order. The last is unique, so media
+// have a place in every order that cursors can point at.
+var mediaSortKeys = map[string][]sortKey{
+	"":        {titleKey, idKey},
+	sortTitle: {titleKey, idKey},
+	sortRelease: {
+		{
+			sql:   "COALESCE(releaseYear, 0)",
+			value: func(m *Media) interface{} { return int64(m.ReleaseYear()) },
+			desc:  true,
+		},
+		titleKey, idKey,
+	},
+	sortAdded: {
+		{
+			// CreatedDate is day-month-year, so it is turned around.
+			sql: `substr(COALESCE(createdDate, ''), 7, 4) ||
+				substr(COALESCE(createdDate, ''), 4, 2) ||
+				substr(COALESCE(createdDate, ''), 1, 2)`,
+			value: func(m *Media) interface{} {
+				d := m.CreatedDate
+				return substr(d, 7, 4) + substr(d, 4, 2) + substr(d, 1, 2)
+			},
+			desc: true,
+		},
+		{sql: idKey.sql, value: idKey.value, desc: true},
+	},
+	sortScore: {
+		{
+			sql:   "inclusionScore",
+			value: func(m *Media) interface{} { return int64(m.InclusionScore) },
+			desc:  true,
+		},
+		titleKey, idKey,
+	},
+}
+
+// substr is SQL's substr: n bytes of s from the 1-based start.
+func substr(s string, start, n int) string {
+	if start > len(s) {
+		return ""
+	}
+	s = s[start-1:]
+	if n < len(s) {
+		s = s[:n]
+	}
+	return s
+}
+
+// compareKeys compares key values a and b of the same type, as -1, 0 or +1.
+func compareKeys(a, b interface{}) int {
+	switch a := a.(type) {
+	case string:
+		return strings.Compare(a, b.(string))
+	case int64:
+		switch b := b.(int64); {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	}
+	return 0
+}
+
+// compareMedia compares m with the key values of another media in the given
+// order, as -1 if m comes first, 0 or +1.
+func compareMedia(keys []sortKey, m *Media, values []interface{}) int {
+	for i, k := range keys {
+		c := compareKeys(k.value(m), values[i])
+		if k.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// sortValues returns the values of m for keys.
+func sortValues(keys []sortKey, m *Media) []interface{} {
+	values := make([]interface{}, len(keys))
+	for i, k := range keys {
+		values[i] = k.value(m)
+	}
+	return values
+}
+
+// filterMedia returns the media matching q, in the order it asks for. It is
+// QueryMedia for databases that cannot run queries themselves.
+func filterMedia(media []*Media, q *MediaQuery) []*Media {
+	var matched []*Media
+	for _, m := range media {
+		if q.matches(m) {
+			matched = append(matched, m)
+		}
+	}
+	keys := mediaSortKeys[q.Sort]
+	sort.Slice(matched, func(i, j int) bool {
+		return compareMedia(keys, matched[i], sortValues(keys, matched[j])) < 0
+	})
+	return matched
+}
+
+/*---------------------------  Pages  ---------------------------*/
+
+// Page sizes of MediaDatabase.PageMedia callers.
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// MediaPage is a page of media listed by MediaDatabase.PageMedia.
+type MediaPage struct {
+	Media []*Media
+	// Next is the cursor of the following page, empty on the last page.
+	Next string
+}
+
+// errBadCursor is wrapped by the errors PageMedia returns for cursors it did
+// not hand out, or handed out for another sort order.
+var errBadCursor = errors.New("bad cursor")
+
+// mediaCursor is what cursors hold: the sort key values of the last media of
+// a page. Clients see it base64-encoded, and should not rely on what it is.
+type mediaCursor struct {
+	Sort   string
+	Values []interface{}
+}
+
+// encodeCursor returns the cursor of the page following m.
+func encodeCursor(order string, m *Media) string {
+	b, err := json.Marshal(mediaCursor{order, sortValues(mediaSortKeys[order], m)})
+	if err != nil {
+		// The values are strings and integers.
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor returns the sort key values in a cursor for the order, or nil
+// for the empty cursor of the first page.
+func decodeCursor(cursor, order string) ([]interface{}, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var c mediaCursor
+	keys := mediaSortKeys[order]
+	if err := dec.Decode(&c); err != nil || c.Sort != order || len(c.Values) != len(keys) {
+		return nil, errBadCursor
+	}
+	for i, k := range keys {
+		var ok bool
+		switch k.value(&Media{}).(type) {
+		case string:
+			_, ok = c.Values[i].(string)
+		case int64:
+			var n json.Number
+			if n, ok = c.Values[i].(json.Number); ok {
+				c.Values[i], err = n.Int64()
+				ok = err == nil
+			}
+		}
+		if !ok {
+			return nil, errBadCursor
+		}
+	}
+	return c.Values, nil
+}
+
+// trimPage returns the page of size starting media, which holds at least one
+// more media when there is a following page.
+func trimPage(media []*Media, q *MediaQuery, size int) *MediaPage {
+	if len(media) <= size {
+		return &MediaPage{Media: media}
+	}
+	media = media[:size]
+	return &MediaPage{Media: media, Next: encodeCursor(q.Sort, media[size-1])}
+}
+
+// pageSizeFromForm reads the size parameter of paged lists.
+func pageSizeFromForm(r *http.Request) (int, error) {
+	v := r.FormValue("size")
+	if v == "" {
+		return defaultPageSize, nil
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil || size < 1 || size > maxPageSize {
+		return 0, fmt.Errorf("bad size %q, want 1 to %d", v, maxPageSize)
+	}
+	return size, nil
+}
+
+/*---------------------------  Facets  ---------------------------*/
+
+// Facet is a filter on /media/list with, for each of its values, the number
+// of media choosing that value would list.
+type Facet struct {
+	Label  string
+	Values []FacetValue
+}
+
+// FacetValue is a value of a facet. URL lists the media with the value
+// chosen, or with it cleared if it already is.
+type FacetValue struct {
+	Label    string
+	Count    int
+	Selected bool
+	URL      string
+}
+
+// Facets counted by MediaDatabase.CountMedia, named after the parameters of
+// /media/list that filter on them.
+const (
+	facetMediaType = "mediaType"
+	facetIndustry  = "industry"
+	facetDecade    = "decade"
+	facetBechdel   = "bechdel"
+	facetScore     = "minScore"
+	facetTag       = "tag"
+)
+
+// scoreThresholds are the values of the score facet.
+var scoreThresholds = []string{"25", "50", "75", "100"}
+
+// facetValues returns the values of each facet that media has, as
+// MediaDatabase.CountMedia counts them. A decade is its first year, the
+// Bechdel test is a key of bechdelFilters, and the score facet has each of
+// scoreThresholds the media meets.
+var facetValues = map[string]func(m *Media) []string{
+	facetMediaType: func(m *Media) []string { return nonEmpty(m.MediaType) },
+	facetIndustry:  func(m *Media) []string { return nonEmpty(m.Industry) },
+	facetDecade: func(m *Media) []string {
+		if year := m.ReleaseYear(); year != 0 {
+			return []string{strconv.Itoa(year / 10 * 10)}
+		}
+		return nil
+	},
+	facetBechdel: func(m *Media) []string {
+		for _, v := range []string{"pass", "fail", "unrated"} {
+			if bechdelFilters[v](m.Bechdel) {
+				return []string{v}
+			}
+		}
+		return nil
+	},
+	facetScore: func(m *Media) []string {
+		var met []string
+		for _, v := range scoreThresholds {
+			if t, _ := strconv.Atoi(v); m.InclusionScore >= t {
+				met = append(met, v)
+			}
+		}
+		return met
+	},
+	facetTag: func(m *Media) []string { return m.Tags },
+}
+
+// facetDef describes a facet of /media/list: how to clear its filter from a
+// query, which of its values a query chooses, and how choosing a value
+// changes a query.
+type facetDef struct {
+	label    string
+	facet    string // What MediaDatabase.CountMedia counts.
+	clear    func(q *MediaQuery)
+	selected func(q MediaQuery, v string) bool
+	toggle   func(q MediaQuery, v string) MediaQuery
+	name     func(v string) string
+	// fixed lists the values in order, even those no media has. Otherwise
+	// values are listed in sorted order.
+	fixed []string
+}
+
+var facetDefs = []facetDef{
+	{
+		label: "Type",
+		facet: facetMediaType,
+		clear: func(q *MediaQuery) { q.MediaType = "" },
+		selected: func(q MediaQuery, v string) bool {
+			return q.MediaType == v
+		},
+		toggle: func(q MediaQuery, v string) MediaQuery {
+			if q.MediaType == v {
+				v = ""
+			}
+			q.MediaType = v
+			return q
+		},
+	},
+	{
+		label: "Industry",
+		facet: facetIndustry,
+		clear: func(q *MediaQuery) { q.Industry = "" },
+		selected: func(q MediaQuery, v string) bool {
+			return q.Industry == v
+		},
+		toggle: func(q MediaQuery, v string) MediaQuery {
+			if q.Industry == v {
+				v = ""
+			}
+			q.Industry = v
+			return q
+		},
+	},
+	{
+		label: "Decade",
+		facet: facetDecade,
+		clear: func(q *MediaQuery) { q.Decade = 0 },
+		selected: func(q MediaQuery, v string) bool {
+			return strconv.Itoa(q.Decade) == v
+		},
+		toggle: func(q MediaQuery, v string) MediaQuery {
+			decade, _ := strconv.Atoi(v)
+			if q.Decade == decade {
+				decade = 0
+			}
+			q.Decade = decade
+			return q
+		},
+		name: func(v string) string { return v + "s" },
+	},
+	{
+		label: "Bechdel test",
+		facet: facetBechdel,
+		clear: func(q *MediaQuery) { q.Bechdel = "" },
+		selected: func(q MediaQuery, v string) bool {
+			return q.Bechdel == v
+		},
+		toggle: func(q MediaQuery, v string) MediaQuery {
+			if q.Bechdel == v {
+				v = ""
+			}
+			q.Bechdel = v
+			return q
+		},
+		name: func(v string) string {
+			return map[string]string{"pass": "Passes", "fail": "Fails", "unrated": "Not rated"}[v]
+		},
+		fixed: []string{"pass", "fail", "unrated"},
+	},
+	{
+		label: "Score",
+		facet: facetScore,
+		clear: func(q *MediaQuery) { q.MinScore = 0 },
+		selected: func(q MediaQuery, v string) bool {
+			return strconv.Itoa(q.MinScore) == v
+		},
+		toggle: func(q MediaQuery, v string) MediaQuery {
+			score, _ := strconv.Atoi(v)
+			if q.MinScore == score {
+				score = 0
+			}
+			q.MinScore = score
+			return q
+		},
+		name: func(v string) string {
+			if v == "100" {
+				return v
+			}
+			return v + "+"
+		},
+		fixed: scoreThresholds,
+	},
+	{
+		// Tags narrow the list down together, so they are counted among the
+		// media matching all the chosen tags.
+		label: "Tags",
+		facet: facetTag,
+		clear: func(q *MediaQuery) {},
+		selected: func(q MediaQuery, v string) bool {
+			for _, t := range q.Tags {
+				if t == v {
+					return true
+				}
+			}
+			return false
+		},
+		toggle: func(q MediaQuery, v string) MediaQuery {
+			tags := make([]string, 0, len(q.Tags)+1)
+			found := false
+			for _, t := range q.Tags {
+				if t == v {
+					found = true
+					continue
+				}
+				tags = append(tags, t)
+			}
+			if !found {
+				tags = append(tags, v)
+			}
+			q.Tags = tags
+			return q
+		},
+	},
+}
+
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+// mediaFacets returns the facets of /media/list for q. Each facet counts the
+// media matching the other facets' filters, so its counts are what choosing
+// each value would list. The database counts them without reading the
+// media.
+func mediaFacets(ctx context.Context, db MediaDatabase, q MediaQuery) ([]Facet, error) {
+	var facets []Facet
+	for _, def := range facetDefs {
+		other := q
+		def.clear(&other)
+		counts, err := db.CountMedia(ctx, &other, def.facet)
+		if err != nil {
+			return nil, err
+		}
+
+		values := def.fixed
+		if values == nil {
+			for v := range counts {
+				values = append(values, v)
+			}
+			sort.Strings(values)
+		}
+
+		f := Facet{Label: def.label}
+		for _, v := range values {
+			name := v
+			if def.name != nil {
+				name = def.name(v)
+			}
+			f.Values = append(f.Values, FacetValue{
+				Label:    name,
+				Count:    counts[v],
+				Selected: def.selected(q, v),
+				URL:      def.toggle(q, v).URL(),
+			})
+		}
+		facets = append(facets, f)
+	}
+	return facets, nil
+}
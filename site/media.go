@@ -14,21 +14,30 @@
 
 package main
 
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+)
+
 // Media holds metadata about a Media.
+//
+// Fields are stored as Datastore properties of the same name (see
+// db-datastore.go); the struct tags skip page-only fields and keep long text
+// out of the Datastore indexes.
 type Media struct {
 	ID            int64
 	Title         string
-	Description   string
+	Description   string `datastore:",noindex"`
 	MediaType 	  string
 	Industry	  string
 	ReleaseDate	  string
 
-	ActorID		  int64
-	CharacterID	  int64
-	DirectorID	  int64
-
 	ImageURL	  string
-	Bechdel		  bool
+	Bechdel		  Bechdel
 	WikiURL		  string
 	IMDBURL		  string
 	RottenTomURL  string
@@ -37,7 +46,31 @@ type Media struct {
 	CreatedBy     string
 	CreatedDate	  string
 
-	PageSubTitle  string
+	// Assessments against the rubric RubricVersion (see rubric.go).
+	// InclusionScore and Disqualified are derived from them by scoreRubric.
+	RubricVersion  int
+	Assessments    []Evaluation
+	InclusionScore int
+	Disqualified   bool
+
+	// Tags are lower case, see parseTags.
+	Tags []string
+
+	// DeletedAt is when the media was moved to the trash, and DeletedBy by
+	// whom. It is zero for media that is not deleted (see trash.go).
+	DeletedAt     time.Time `json:"-"`
+	DeletedByID   int64     `json:"-"`
+	DeletedBy     string    `json:"-"`
+
+	// Credits are stored separately (see PeopleDatabase) and filled in by
+	// loadCredits.
+	Credits       []*Credit `datastore:"-"`
+
+	PageSubTitle  string `datastore:"-" json:"-"`
+
+	// CanEdit and CanDelete are whether the user viewing the page may.
+	CanEdit       bool `datastore:"-" json:"-"`
+	CanDelete     bool `datastore:"-" json:"-"`
 
 }
 
@@ -56,7 +89,29 @@ func (m *Media) SetCreatorAnonymous() {
 	m.CreatedByID = 0000
 }
 
+// releaseYearPattern finds the year in release dates such as "1979",
+// "1979-05-25" and "25 May 1979".
+var releaseYearPattern = regexp.MustCompile(`(?:^|\D)((?:18|19|20)\d\d)(?:\D|$)`)
+
+// ReleaseYear returns the year of the release date, or 0 if it has none.
+func (m *Media) ReleaseYear() int {
+	match := releaseYearPattern.FindStringSubmatch(m.ReleaseDate)
+	if match == nil {
+		return 0
+	}
+	year, _ := strconv.Atoi(match[1])
+	return year
+}
+
+// errNotFound is wrapped by the errors GetMedia returns for media that does
+// not exist, so handlers can answer 404.
+var errNotFound = errors.New("not found")
+
 // MediaDatabase provides thread-safe access to a database of media.
+//
+// Deleted media is kept in the trash until it is purged. Only
+// ListDeletedMedia, RestoreMedia and PurgeMedia see it; to the other methods
+// it does not exist.
 type MediaDatabase interface {
 	// ListMedia returns a list of Medias, ordered by title.
 	ListMedia() ([]*Media, error)
@@ -65,18 +120,85 @@ type MediaDatabase interface {
 	// the user who created the Media entry.
 	ListMediaCreatedBy(userID int64) ([]*Media, error)
 
-	// GetMedia retrieves a Media by its ID.
+	// QueryMedia returns the media matching q, in the order it asks for (see
+	// media-query.go).
+	QueryMedia(q *MediaQuery) ([]*Media, error)
+
+	// CountMedia returns the number of media matching q that have each
+	// value of facet (see facetValues), leaving out values no media has.
+	// A backend may count only the most used tags, and those q asks for. It
+	// is called for every facet of every list page, so ctx is the request's.
+	CountMedia(ctx context.Context, q *MediaQuery, facet string) (map[string]int, error)
+
+	// PageMedia returns up to size media matching q, in the order it asks
+	// for, following the page the cursor was handed out with. The empty
+	// cursor is the first page's. The error wraps errBadCursor for cursors
+	// that were not handed out for q's order.
+	PageMedia(q *MediaQuery, cursor string, size int) (*MediaPage, error)
+
+	// GetMedia retrieves a Media by its ID. The error wraps errNotFound if
+	// there is none.
 	GetMedia(id int64) (*Media, error)
 
-	// AddMedia saves a given media, assigning it a new ID.
-	AddMedia(m *Media) (id int64, err error)
+	// AddMedia saves a given media, assigning it a new ID. The events,
+	// given the ID too, are added to the outbox with it (see events.go).
+	AddMedia(m *Media, events ...*Event) (id int64, err error)
+
+	// DeleteMedia moves a given media to the trash, recording that the
+	// user byID, named by, deleted it now. byID is 0 for the import tools.
+	DeleteMedia(id int64, byID int64, by string, events ...*Event) error
+
+	// ListDeletedMedia returns the media in the trash, most recently
+	// deleted first.
+	ListDeletedMedia() ([]*Media, error)
+
+	// RestoreMedia takes a given media out of the trash. The error wraps
+	// errNotFound if it is not there.
+	RestoreMedia(id int64, events ...*Event) error
+
+	// PurgeMedia permanently removes a given media in the trash, with its
+	// characters and credits. The error wraps errNotFound if it is not
+	// there.
+	PurgeMedia(id int64) error
 
-	// DeleteMedia removes a given media by its ID.
-	DeleteMedia(id int64) error
+	// UpdateMedia updates the entry for a given media. The error wraps
+	// errNotFound if it does not exist or is in the trash.
+	UpdateMedia(m *Media, events ...*Event) error
 
-	// UpdateMedia updates the entry for a given media.
-	UpdateMedia(m *Media) error
+	// ChangeMedia reads a given media and saves the changes change makes
+	// to it, in one transaction, so changes saved meanwhile are not lost.
+	// change reports whether it changed anything, and returns the events
+	// added to the outbox with the change. The error wraps errNotFound if
+	// the media does not exist or is in the trash.
+	ChangeMedia(id int64, change func(m *Media) (changed bool, events []*Event)) error
 
 	// Close closes the database, freeing up any available resources.
 	Close()
+
+	// The people and characters credited on media are kept in the same
+	// database (see people.go), as are users (see users.go), the
+	// submissions waiting for moderation (see submissions.go), the
+	// revisions of media (see revisions.go) and the events waiting to be
+	// published (see events.go).
+	PeopleDatabase
+	UserDatabase
+	SubmissionDatabase
+	RevisionDatabase
+	OutboxDatabase
+}
+
+// marshalMedia and unmarshalMedia store a copy of media, with its credits,
+// in a single column as JSON, as submissions and revisions keep it.
+func marshalMedia(m *Media) (string, error) {
+	b, err := json.Marshal(m)
+	return string(b), err
+}
+
+func unmarshalMedia(s string) (*Media, error) {
+	m := &Media{}
+	if s == "" {
+		return m, nil
+	}
+	err := json.Unmarshal([]byte(s), m)
+	return m, err
 }
\ No newline at end of file
@@ -0,0 +1,341 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Roles a person can be credited with on media.
+const (
+	roleActor    = "actor"
+	roleDirector = "director"
+	roleWriter   = "writer"
+)
+
+// Person is someone credited on media: an actor, a director, a writer.
+type Person struct {
+	ID   int64
+	Name string
+	Bio  string `datastore:",noindex"`
+}
+
+// Character is a character appearing in a media item. The actors playing it
+// are linked through credits.
+type Character struct {
+	ID      int64
+	MediaID int64
+	Name    string
+	Bio     string `datastore:",noindex"`
+
+	// Evaluations against the README criteria (see characters.go).
+	Evaluations []Evaluation
+}
+
+// Credit links a person to media in a given role. Actors may also be linked
+// to the character they play.
+type Credit struct {
+	ID          int64
+	MediaID     int64
+	PersonID    int64
+	Role        string
+	CharacterID int64
+
+	// Person and Character are filled in by loadCredits for display.
+	Person    *Person    `datastore:"-"`
+	Character *Character `datastore:"-"`
+}
+
+// PeopleDatabase provides thread-safe access to the people and characters
+// credited on media. Every MediaDatabase is also a PeopleDatabase.
+//
+// Deleting media deletes its characters and credits; deleting a person or a
+// character deletes the credits that reference them.
+type PeopleDatabase interface {
+	// ListPeople returns a list of people, ordered by name.
+	ListPeople() ([]*Person, error)
+
+	// GetPerson retrieves a Person by its ID. The error wraps errNotFound if
+	// there is none.
+	GetPerson(id int64) (*Person, error)
+
+	// AddPerson saves a given person, assigning it a new ID.
+	AddPerson(p *Person) (id int64, err error)
+
+	// UpdatePerson updates the entry for a given person. The error wraps
+	// errNotFound if it does not exist.
+	UpdatePerson(p *Person) error
+
+	// DeletePerson removes a given person, and their credits, by ID. The
+	// error wraps errNotFound if it does not exist.
+	DeletePerson(id int64) error
+
+	// ListCharacters returns the characters of the given media, ordered by
+	// name.
+	ListCharacters(mediaID int64) ([]*Character, error)
+
+	// GetCharacter retrieves a Character by its ID. The error wraps
+	// errNotFound if there is none.
+	GetCharacter(id int64) (*Character, error)
+
+	// AddCharacter saves a given character, assigning it a new ID.
+	AddCharacter(c *Character) (id int64, err error)
+
+	// UpdateCharacter updates the entry for a given character. The error
+	// wraps errNotFound if it does not exist.
+	UpdateCharacter(c *Character) error
+
+	// DeleteCharacter removes a given character by its ID. The error wraps
+	// errNotFound if it does not exist.
+	DeleteCharacter(id int64) error
+
+	// ListCredits returns the credits of the given media, ordered by ID.
+	// A mediaID of 0 returns the credits of all media.
+	ListCredits(mediaID int64) ([]*Credit, error)
+
+	// ListPersonCredits returns the credits of the given person, ordered by
+	// ID.
+	ListPersonCredits(personID int64) ([]*Credit, error)
+
+	// AddCredit saves a given credit, assigning it a new ID.
+	AddCredit(c *Credit) (id int64, err error)
+
+	// DeleteCredit removes a given credit by its ID. The error wraps
+	// errNotFound if it does not exist.
+	DeleteCredit(id int64) error
+}
+
+/*---------------------------  Display  ---------------------------*/
+
+// creditNames returns the names of the people credited in role.
+func (m *Media) creditNames(role string) []string {
+	var names []string
+	for _, c := range m.Credits {
+		if c.Role == role && c.Person != nil {
+			names = append(names, c.Person.Name)
+		}
+	}
+	return names
+}
+
+// DirectorNames returns the directors of the media, comma separated.
+func (m *Media) DirectorNames() string {
+	return strings.Join(m.creditNames(roleDirector), ", ")
+}
+
+// ActorName returns the actors of the media, comma separated.
+func (m *Media) ActorName() string {
+	return strings.Join(m.creditNames(roleActor), ", ")
+}
+
+// Cast returns the actor credits of the media.
+func (m *Media) Cast() []*Credit {
+	var cast []*Credit
+	for _, c := range m.Credits {
+		if c.Role == roleActor {
+			cast = append(cast, c)
+		}
+	}
+	return cast
+}
+
+// CastLines returns the cast in the "Actor as Character" form, one per line,
+// that the edit form accepts.
+func (m *Media) CastLines() string {
+	var lines []string
+	for _, c := range m.Cast() {
+		if c.Person == nil {
+			continue
+		}
+		line := c.Person.Name
+		if c.Character != nil {
+			line += " as " + c.Character.Name
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+/*---------------------------  Loading/Saving  ---------------------------*/
+
+// loadCredits fills in the Credits of each media, with their Person and
+// Character, using one query per table rather than one per media.
+func loadCredits(db MediaDatabase, mediaList ...*Media) error {
+	if len(mediaList) == 0 {
+		return nil
+	}
+
+	var mediaID int64
+	if len(mediaList) == 1 {
+		mediaID = mediaList[0].ID
+	}
+	credits, err := db.ListCredits(mediaID)
+	if err != nil {
+		return fmt.Errorf("could not list credits: %v", err)
+	}
+	people, err := db.ListPeople()
+	if err != nil {
+		return fmt.Errorf("could not list people: %v", err)
+	}
+	peopleByID := make(map[int64]*Person, len(people))
+	for _, p := range people {
+		peopleByID[p.ID] = p
+	}
+
+	byMedia := make(map[int64]*Media, len(mediaList))
+	for _, m := range mediaList {
+		m.Credits = nil
+		byMedia[m.ID] = m
+	}
+	characters := make(map[int64]map[int64]*Character)
+	for _, c := range credits {
+		m, ok := byMedia[c.MediaID]
+		if !ok {
+			continue
+		}
+		c.Person = peopleByID[c.PersonID]
+		if c.CharacterID != 0 {
+			if characters[m.ID] == nil {
+				chars, err := db.ListCharacters(m.ID)
+				if err != nil {
+					return fmt.Errorf("could not list characters: %v", err)
+				}
+				characters[m.ID] = make(map[int64]*Character, len(chars))
+				for _, ch := range chars {
+					characters[m.ID][ch.ID] = ch
+				}
+			}
+			c.Character = characters[m.ID][c.CharacterID]
+		}
+		m.Credits = append(m.Credits, c)
+	}
+	return nil
+}
+
+// parseCredits turns the directors and cast fields of the edit form into
+// unsaved credits. Directors are comma separated. The cast has one actor per
+// line, optionally followed by " as " and the character they play.
+func parseCredits(directors, cast string) []*Credit {
+	var credits []*Credit
+	for _, name := range strings.Split(directors, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			credits = append(credits, &Credit{Role: roleDirector, Person: &Person{Name: name}})
+		}
+	}
+	for _, line := range strings.Split(cast, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		c := &Credit{Role: roleActor}
+		name := line
+		if i := strings.Index(line, " as "); i >= 0 {
+			name = strings.TrimSpace(line[:i])
+			c.Character = &Character{Name: strings.TrimSpace(line[i+len(" as "):])}
+		}
+		c.Person = &Person{Name: name}
+		credits = append(credits, c)
+	}
+	return credits
+}
+
+// creditKey is what a credit credits, to match credits with stored ones.
+type creditKey struct {
+	personID    int64
+	role        string
+	characterID int64
+}
+
+// saveCredits replaces the stored credits of m with m.Credits. People and
+// characters are matched by name, case-insensitively, and created when they
+// do not exist yet. Stored credits that m still has are kept, and the new
+// ones are added before the others are deleted, so saving again after a
+// failure finishes the change without losing credits.
+func saveCredits(db MediaDatabase, m *Media) error {
+	old, err := db.ListCredits(m.ID)
+	if err != nil {
+		return fmt.Errorf("could not list credits: %v", err)
+	}
+	stored := make(map[creditKey][]*Credit, len(old))
+	for _, c := range old {
+		k := creditKey{c.PersonID, c.Role, c.CharacterID}
+		stored[k] = append(stored[k], c)
+	}
+
+	people, err := db.ListPeople()
+	if err != nil {
+		return fmt.Errorf("could not list people: %v", err)
+	}
+	peopleByName := make(map[string]*Person, len(people))
+	for _, p := range people {
+		peopleByName[strings.ToLower(p.Name)] = p
+	}
+	chars, err := db.ListCharacters(m.ID)
+	if err != nil {
+		return fmt.Errorf("could not list characters: %v", err)
+	}
+	charsByName := make(map[string]*Character, len(chars))
+	for _, ch := range chars {
+		charsByName[strings.ToLower(ch.Name)] = ch
+	}
+
+	for _, c := range m.Credits {
+		if c.Person == nil {
+			continue
+		}
+		p, ok := peopleByName[strings.ToLower(c.Person.Name)]
+		if !ok {
+			p = &Person{Name: c.Person.Name}
+			if p.ID, err = db.AddPerson(p); err != nil {
+				return fmt.Errorf("could not add person %q: %v", p.Name, err)
+			}
+			peopleByName[strings.ToLower(p.Name)] = p
+		}
+		c.Person, c.PersonID = p, p.ID
+
+		c.CharacterID = 0
+		if c.Character != nil {
+			ch, ok := charsByName[strings.ToLower(c.Character.Name)]
+			if !ok {
+				ch = &Character{MediaID: m.ID, Name: c.Character.Name}
+				if ch.ID, err = db.AddCharacter(ch); err != nil {
+					return fmt.Errorf("could not add character %q: %v", ch.Name, err)
+				}
+				charsByName[strings.ToLower(ch.Name)] = ch
+			}
+			c.Character, c.CharacterID = ch, ch.ID
+		}
+
+		c.MediaID = m.ID
+		k := creditKey{c.PersonID, c.Role, c.CharacterID}
+		if same := stored[k]; len(same) > 0 {
+			c.ID, stored[k] = same[0].ID, same[1:]
+			continue
+		}
+		if c.ID, err = db.AddCredit(c); err != nil {
+			return fmt.Errorf("could not add credit: %v", err)
+		}
+	}
+
+	for _, list := range stored {
+		for _, c := range list {
+			if err := db.DeleteCredit(c.ID); err != nil {
+				return fmt.Errorf("could not delete credit: %v", err)
+			}
+		}
+	}
+	return nil
+}
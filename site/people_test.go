@@ -0,0 +1,100 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestParseCredits(t *testing.T) {
+	credits := parseCredits(" Ridley Scott ,, ", "Sigourney Weaver as Ripley\n\n  Tom Skerritt  \n")
+	if len(credits) != 3 {
+		t.Fatalf("parseCredits = %v, want 3 credits", credits)
+	}
+	for i, want := range []struct{ role, person, character string }{
+		{roleDirector, "Ridley Scott", ""},
+		{roleActor, "Sigourney Weaver", "Ripley"},
+		{roleActor, "Tom Skerritt", ""},
+	} {
+		c := credits[i]
+		character := ""
+		if c.Character != nil {
+			character = c.Character.Name
+		}
+		if c.Role != want.role || c.Person.Name != want.person || character != want.character {
+			t.Errorf("credit %d = %s %q as %q, want %s %q as %q", i, c.Role, c.Person.Name, character,
+				want.role, want.person, want.character)
+		}
+	}
+}
+
+// TestSaveCredits saves the credits of two media, sharing a person, then
+// changes and loads them back.
+func TestSaveCredits(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db MediaDatabase) {
+		ids := addTitles(t, db, "Alien", "Aliens")
+		alien := &Media{ID: ids[0], Credits: parseCredits("Ridley Scott", "Sigourney Weaver as Ripley\nTom Skerritt as Dallas")}
+		aliens := &Media{ID: ids[1], Credits: parseCredits("James Cameron", "sigourney weaver as Ripley")}
+		for _, m := range []*Media{alien, aliens} {
+			if err := saveCredits(db, m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		people, err := db.ListPeople()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(people) != 4 {
+			t.Errorf("people = %v, want Sigourney Weaver once among 4", people)
+		}
+		weaver := alien.Credits[1].PersonID
+		if weaver == 0 || aliens.Credits[1].PersonID != weaver {
+			t.Errorf("Sigourney Weaver is person %d and %d, want the same", weaver, aliens.Credits[1].PersonID)
+		}
+		if alien.Credits[1].CharacterID == aliens.Credits[1].CharacterID {
+			t.Error("the two Ripleys are the same character, want one per media")
+		}
+
+		// Dropping Tom Skerritt keeps the other credits as they were.
+		kept := alien.Credits[1].ID
+		alien.Credits = parseCredits("Ridley Scott", "Sigourney Weaver as Ripley")
+		if err := saveCredits(db, alien); err != nil {
+			t.Fatal(err)
+		}
+		m := &Media{ID: alien.ID}
+		if err := loadCredits(db, m); err != nil {
+			t.Fatal(err)
+		}
+		if m.DirectorNames() != "Ridley Scott" || m.CastLines() != "Sigourney Weaver as Ripley" {
+			t.Errorf("loaded credits = %q, %q, want Ridley Scott and Sigourney Weaver as Ripley", m.DirectorNames(), m.CastLines())
+		}
+		if m.Credits[1].ID != kept {
+			t.Errorf("Sigourney Weaver's credit is %d, want %d kept", m.Credits[1].ID, kept)
+		}
+
+		// Deleting a person deletes their credits.
+		if err := db.DeletePerson(weaver); err != nil {
+			t.Fatal(err)
+		}
+		credits, err := db.ListPersonCredits(weaver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(credits) != 0 {
+			t.Errorf("credits of a deleted person = %v, want none", credits)
+		}
+		if credits, _ = db.ListCredits(aliens.ID); len(credits) != 1 {
+			t.Errorf("credits of Aliens = %v, want only James Cameron's", credits)
+		}
+	})
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Media without an image of its own is shown with a placeholder poster: its
+// title on a background whose color is derived from its ID, so the same media
+// always looks the same and neighbours in a list look different.
+
+// placeholderURL returns the URL of the placeholder poster of the media with
+// the given ID.
+func placeholderURL(id int64) string {
+	return fmt.Sprintf("/media/%d/poster.svg", id)
+}
+
+// posterColor returns the background color of the placeholder of the media
+// with the given ID, as hue, saturation and lightness. Successive IDs are a
+// golden angle apart on the color wheel.
+func posterColor(id int64) (h, s, l float64) {
+	const goldenAngle = 137.50776405
+	return math.Mod(float64(id)*goldenAngle, 360), 0.55, 0.32
+}
+
+// hslColor returns the CSS hex color for the hue h in degrees and the
+// saturation s and lightness l in [0, 1].
+func hslColor(h, s, l float64) string {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	channel := func(v float64) int { return int(math.Round((v + m) * 255)) }
+	return fmt.Sprintf("#%02x%02x%02x", channel(r), channel(g), channel(b))
+}
+
+// posterLineLength and posterLines are how many characters the title is
+// wrapped at, and on how many lines at most.
+const (
+	posterLineLength = 14
+	posterLines      = 6
+)
+
+// wrapTitle breaks title into lines at spaces, ending it with an ellipsis if
+// it does not fit. Words longer than a line are kept whole.
+func wrapTitle(title string) []string {
+	var lines []string
+	for _, word := range strings.Fields(title) {
+		last := len(lines) - 1
+		if last >= 0 && utf8.RuneCountInString(lines[last])+1+utf8.RuneCountInString(word) <= posterLineLength {
+			lines[last] += " " + word
+			continue
+		}
+		if len(lines) == posterLines {
+			lines[last] += "…"
+			break
+		}
+		lines = append(lines, word)
+	}
+	return lines
+}
+
+// placeholderPoster renders the placeholder poster of m as SVG, 200 by 300.
+func placeholderPoster(m *Media) []byte {
+	h, s, l := posterColor(m.ID)
+	top, bottom := hslColor(h, s, l+0.08), hslColor(h, s, l-0.14)
+
+	lines := wrapTitle(m.Title)
+	if len(lines) == 0 {
+		lines = []string{"Untitled"}
+	}
+	longest := 1
+	for _, line := range lines {
+		if n := utf8.RuneCountInString(line); n > longest {
+			longest = n
+		}
+	}
+	// Serif characters are about half as wide as they are tall.
+	size := 170 / (0.55 * float64(longest))
+	if size > 28 {
+		size = 28
+	} else if size < 9 {
+		size = 9
+	}
+	lead := size * 1.2
+	y := 140 - lead*float64(len(lines)-1)/2
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="200" height="300" viewBox="0 0 200 300">`)
+	fmt.Fprintf(&b, `<defs><linearGradient id="bg" x1="0" y1="0" x2="0" y2="1">`+
+		`<stop offset="0" stop-color="%s"/><stop offset="1" stop-color="%s"/></linearGradient></defs>`, top, bottom)
+	fmt.Fprintf(&b, `<rect width="200" height="300" fill="url(#bg)"/>`)
+	fmt.Fprintf(&b, `<rect x="10" y="10" width="180" height="280" fill="none" stroke="#fff" stroke-opacity="0.35"/>`)
+	fmt.Fprintf(&b, `<text x="100" font-family="Georgia, 'Times New Roman', serif" font-size="%.1f" fill="#fff" text-anchor="middle">`, size)
+	for i, line := range lines {
+		fmt.Fprintf(&b, `<tspan x="100" y="%.1f">%s</tspan>`, y+float64(i)*lead, html.EscapeString(line))
+	}
+	fmt.Fprintf(&b, `</text>`)
+	if year := m.ReleaseYear(); year != 0 {
+		fmt.Fprintf(&b, `<text x="100" y="270" font-family="Helvetica, Arial, sans-serif" font-size="12" fill="#fff" fill-opacity="0.75" text-anchor="middle">%d</text>`, year)
+	}
+	fmt.Fprintf(&b, `</svg>`)
+	return b.Bytes()
+}
+
+// posterHandler serves the placeholder poster of a media item. It changes
+// with the title, so it is only cached for a while.
+func posterHandler(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return appErrorf(err, "bad media id: %v", err)
+	}
+	m, err := DB.GetMedia(id)
+	if err != nil {
+		return appErrorf(err, "could not find media: %v", err)
+	}
+	svg := placeholderPoster(m)
+	sum := sha256.Sum256(svg)
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(svg))
+	return nil
+}
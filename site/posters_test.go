@@ -0,0 +1,130 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// checkSVG fails t unless svg is well-formed XML.
+func checkSVG(t *testing.T, svg []byte) {
+	t.Helper()
+	d := xml.NewDecoder(bytes.NewReader(svg))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("placeholder is not well-formed: %v\n%s", err, svg)
+		}
+	}
+}
+
+func TestPlaceholderPosterIsDeterministic(t *testing.T) {
+	alien := &Media{ID: 1, Title: "Alien"}
+	svg := placeholderPoster(alien)
+	checkSVG(t, svg)
+	if !bytes.Equal(placeholderPoster(&Media{ID: 1, Title: "Alien"}), svg) {
+		t.Error("the placeholder of the same media differs between renders")
+	}
+	if bytes.Equal(placeholderPoster(&Media{ID: 2, Title: "Alien"}), svg) {
+		t.Error("the placeholders of media 1 and 2 are the same, want their colors to differ")
+	}
+	if bytes.Equal(placeholderPoster(&Media{ID: 1, Title: "Aliens"}), svg) {
+		t.Error("the placeholder does not change with the title")
+	}
+	if !bytes.Contains(svg, []byte(">Alien</tspan>")) {
+		t.Errorf("placeholder does not show the title:\n%s", svg)
+	}
+	if !bytes.Contains(placeholderPoster(&Media{ID: 3}), []byte(">Untitled</tspan>")) {
+		t.Error("placeholder of media without a title does not say so")
+	}
+}
+
+func TestPlaceholderPosterEscapesTitle(t *testing.T) {
+	svg := placeholderPoster(&Media{ID: 1, Title: `<script>alert("x")</script> & Co`})
+	checkSVG(t, svg)
+	if bytes.Contains(svg, []byte("<script")) {
+		t.Errorf("placeholder has the title's markup:\n%s", svg)
+	}
+	if !bytes.Contains(svg, []byte("&lt;script&gt;")) || !bytes.Contains(svg, []byte("&amp;")) {
+		t.Errorf("placeholder does not show the title escaped:\n%s", svg)
+	}
+}
+
+func TestWrapTitle(t *testing.T) {
+	for _, test := range []struct {
+		title string
+		want  []string
+	}{
+		{"Alien", []string{"Alien"}},
+		{"  Portrait of a  Lady on Fire ", []string{"Portrait of a", "Lady on Fire"}},
+		{"Supercalifragilisticexpialidocious", []string{"Supercalifragilisticexpialidocious"}},
+		{strings.Repeat("Lorem ipsum dolor ", 6), []string{"Lorem ipsum", "dolor Lorem", "ipsum dolor", "Lorem ipsum", "dolor Lorem", "ipsum dolor…"}},
+	} {
+		if got := wrapTitle(test.title); strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("wrapTitle(%q) = %q, want %q", test.title, got, test.want)
+		}
+	}
+}
+
+func TestPosterHandler(t *testing.T) {
+	useDB(t, newMemoryDB())
+	m := &Media{Title: "Alien"}
+	id, err := DB.AddMedia(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serveAs(t, httptest.NewRequest("GET", placeholderURL(id), nil), nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Fatalf("GET placeholder = %d %q, want an SVG image", w.Code, w.Header().Get("Content-Type"))
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Cache-Control") != "public, max-age=3600" {
+		t.Errorf("placeholder served with ETag %q, Cache-Control %q; want both", etag, w.Header().Get("Cache-Control"))
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte(">Alien</tspan>")) {
+		t.Errorf("placeholder does not show the title:\n%s", w.Body)
+	}
+
+	// Browsers that have it are told it has not changed.
+	req := httptest.NewRequest("GET", placeholderURL(id), nil)
+	req.Header.Set("If-None-Match", etag)
+	if w := serveAs(t, req, nil); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("GET placeholder If-None-Match its ETag = %d with %d bytes, want 304 and none", w.Code, w.Body.Len())
+	}
+
+	// Until the title changes.
+	m.ID, m.Title = id, "Aliens"
+	if err := DB.UpdateMedia(m); err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest("GET", placeholderURL(id), nil)
+	req.Header.Set("If-None-Match", etag)
+	if w := serveAs(t, req, nil); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("GET placeholder of a retitled media = %d with ETag %q, want 200 and a new one", w.Code, w.Header().Get("ETag"))
+	}
+
+	if w := serveAs(t, httptest.NewRequest("GET", placeholderURL(id+1), nil), nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET placeholder of unknown media = %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Revision is a copy of media as it was after a change, kept so the history
+// of community edits can be seen and mistakes and vandalism undone. Revisions
+// are never changed once added.
+type Revision struct {
+	ID      int64
+	MediaID int64
+
+	// Media is the media, with its credits, as the change left it. It is
+	// stored as JSON, see marshalMedia.
+	Media *Media `datastore:"-"`
+
+	// Deleted is whether the change deleted the media; Media is then how it
+	// was before.
+	Deleted bool
+
+	// SubmissionID is the approved submission that made the change, 0 for
+	// changes made otherwise.
+	SubmissionID int64
+
+	// Who made the change, when, and why. AuthorID is 0 for changes made by
+	// the import tools.
+	AuthorID int64
+	Author   string
+	Date     time.Time
+	Summary  string `datastore:",noindex"`
+
+	// Number counts the revisions of the media from 1, Changes are the fields
+	// it changed from the revision before, and CanRevert is whether the user
+	// viewing the page may go back to it.
+	Number    int            `datastore:"-" json:"-"`
+	Changes   []*FieldChange `datastore:"-" json:"-"`
+	CanRevert bool           `datastore:"-" json:"-"`
+}
+
+// When returns the time of the revision for people.
+func (r *Revision) When() string {
+	return r.Date.Format("02-01-2006 15:04")
+}
+
+// AuthorName returns a string appropriate for displaying who made the
+// revision.
+func (r *Revision) AuthorName() string {
+	if r.Author == "" {
+		return "Anonymous"
+	}
+	return r.Author
+}
+
+// sortRevisions orders revisions oldest first, for the backends that cannot
+// sort by ID alone.
+func sortRevisions(list []*Revision) {
+	sort.Slice(list, func(i, j int) bool {
+		if a, b := list[i].Date, list[j].Date; !a.Equal(b) {
+			return a.Before(b)
+		}
+		return list[i].ID < list[j].ID
+	})
+}
+
+// RevisionDatabase provides thread-safe access to the revisions of media.
+// Every MediaDatabase is also a RevisionDatabase. Revisions outlive the media
+// they are of.
+type RevisionDatabase interface {
+	// GetRevision retrieves a revision by its ID. The error wraps
+	// errNotFound if there is none.
+	GetRevision(id int64) (*Revision, error)
+
+	// ListRevisions returns the revisions of the given media, oldest first.
+	ListRevisions(mediaID int64) ([]*Revision, error)
+
+	// AddRevision saves a given revision, assigning it a new ID.
+	AddRevision(r *Revision) (id int64, err error)
+}
+
+/*---------------------------  Recording  ---------------------------*/
+
+// recordRevision adds r, a change to r.Media by r.Author, to the history of
+// the media. Credits are loaded first if the media has none, so the copy kept
+// is complete.
+func recordRevision(db MediaDatabase, r *Revision) error {
+	m := *r.Media
+	if m.Credits == nil {
+		if err := loadCredits(db, &m); err != nil {
+			return fmt.Errorf("could not load credits: %v", err)
+		}
+	}
+	r.Media, r.MediaID = &m, m.ID
+	r.Date = time.Now()
+	if _, err := db.AddRevision(r); err != nil {
+		return fmt.Errorf("could not save revision: %v", err)
+	}
+	return nil
+}
+
+// deleteMedia moves the media r.MediaID to the trash, recording the deletion
+// as r so the media it was is kept in its history. The deletion is only
+// recorded once the media is in the trash.
+func deleteMedia(db MediaDatabase, r *Revision) error {
+	m, err := db.GetMedia(r.MediaID)
+	if err != nil {
+		return fmt.Errorf("could not find media: %w", err)
+	}
+	if err := loadCredits(db, m); err != nil {
+		return fmt.Errorf("could not load credits: %v", err)
+	}
+	event := newMediaEvent(EventMediaDeleted, m, r.AuthorID, r.Author)
+	if err := db.DeleteMedia(m.ID, r.AuthorID, r.Author, event); err != nil {
+		return fmt.Errorf("could not delete media: %w", err)
+	}
+	r.Media, r.Deleted = m, true
+	if r.Summary == "" {
+		r.Summary = "Deleted"
+	}
+	return recordRevision(db, r)
+}
+
+/*---------------------------  Diffs  ---------------------------*/
+
+// FieldChange is a field changed by a revision.
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// mediaFields are the fields of media compared by diffMedia, in the order
+// they are shown.
+var mediaFields = []struct {
+	name  string
+	value func(m *Media) string
+}{
+	{"Title", func(m *Media) string { return m.Title }},
+	{"Type", func(m *Media) string { return m.MediaType }},
+	{"Industry", func(m *Media) string { return m.Industry }},
+	{"Released", func(m *Media) string { return m.ReleaseDate }},
+	{"Description", func(m *Media) string { return m.Description }},
+	{"Directors", (*Media).DirectorNames},
+	{"Cast", (*Media).CastLines},
+	{"Tags", (*Media).TagList},
+	{"Bechdel test", func(m *Media) string { return m.Bechdel.Summary() }},
+	{"Assessments", assessmentLines},
+	{"Score", func(m *Media) string { return strconv.Itoa(m.InclusionScore) }},
+	{"Image", func(m *Media) string { return m.ImageURL }},
+	{"Wikipedia", func(m *Media) string { return m.WikiURL }},
+	{"IMDb", func(m *Media) string { return m.IMDBURL }},
+	{"Rotten Tomatoes", func(m *Media) string { return m.RottenTomURL }},
+}
+
+// assessmentLines returns the rubric assessments of m, one per line.
+func assessmentLines(m *Media) string {
+	var lines []string
+	for _, e := range m.Assessments {
+		line := e.Label() + ": " + e.Verdict
+		if e.Justification != "" {
+			line += " (" + e.Justification + ")"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// diffMedia returns the fields that differ between old and new. old is nil
+// for the first revision, whose every field is new.
+func diffMedia(old, new *Media) []*FieldChange {
+	if old == nil {
+		old = &Media{}
+	}
+	var changes []*FieldChange
+	for _, f := range mediaFields {
+		if o, n := f.value(old), f.value(new); o != n {
+			changes = append(changes, &FieldChange{Field: f.name, Old: o, New: n})
+		}
+	}
+	return changes
+}
+
+/*---------------------------  Handlers  ---------------------------*/
+
+// historyPage is what history.html shows.
+type historyPage struct {
+	MediaID      int64
+	Title        string
+	Revisions    []*Revision
+	PageSubTitle string
+}
+
+// mediaHistory returns the revisions of the media, newest first, numbered and
+// with their changes filled in.
+func mediaHistory(db MediaDatabase, mediaID int64) ([]*Revision, error) {
+	list, err := db.ListRevisions(mediaID)
+	if err != nil {
+		return nil, err
+	}
+	var prev *Media
+	for i, r := range list {
+		r.Number = i + 1
+		if !r.Deleted {
+			r.Changes = diffMedia(prev, r.Media)
+		}
+		prev = r.Media
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list, nil
+}
+
+// historyHandler lists the revisions of a media item with what each changed.
+// The history of deleted media can still be seen.
+func historyHandler(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return appErrorf(err, "bad media id: %v", err)
+	}
+	m, err := DB.GetMedia(id)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return appErrorf(err, "could not find media: %v", err)
+	}
+	list, err := mediaHistory(DB, id)
+	if err != nil {
+		return appErrorf(err, "could not list revisions: %v", err)
+	}
+	if m == nil && len(list) == 0 {
+		return appErrorf(errNotFound, "media %d not found", id)
+	}
+	u, err := userFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+
+	page := &historyPage{MediaID: id, Revisions: list}
+	if m != nil {
+		page.Title = m.Title
+		// The newest revision is how the media is now.
+		for i, rev := range list {
+			rev.CanRevert = i > 0 && !rev.Deleted && u.CanEditMedia(m)
+		}
+	} else {
+		page.Title = list[0].Media.Title
+	}
+	page.PageSubTitle = "History of " + page.Title
+	return historyTmpl.Execute(w, r, page)
+}
+
+// revertHandler submits the media as it was at a revision, as a change like
+// any other: moderators' reverts are made straight away, contributors' wait
+// for moderation.
+func revertHandler(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return appErrorf(err, "bad media id: %v", err)
+	}
+	revID, err := strconv.ParseInt(mux.Vars(r)["revision"], 10, 64)
+	if err != nil {
+		return appErrorf(err, "bad revision id: %v", err)
+	}
+	list, err := mediaHistory(DB, id)
+	if err != nil {
+		return appErrorf(err, "could not list revisions: %v", err)
+	}
+	var rev *Revision
+	for _, l := range list {
+		if l.ID == revID {
+			rev = l
+		}
+	}
+	if rev == nil {
+		return appErrorf(errNotFound, "media %d has no revision %d", id, revID)
+	}
+	if rev.Deleted {
+		return appErrorCodef(http.StatusBadRequest, nil, "revision %d deleted the media", rev.Number)
+	}
+	u, err := userFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+
+	m := rev.Media
+	m.ID = id
+	s, err := submitMedia(DB, u, m, fmt.Sprintf("Revert to revision %d", rev.Number))
+	if err != nil {
+		return submissionErrorf(err)
+	}
+	if s.Status == submissionApproved {
+		http.Redirect(w, r, fmt.Sprintf("/media/%d/history", id), http.StatusFound)
+		return nil
+	}
+	http.Redirect(w, r, fmt.Sprintf("/submissions/%d", s.ID), http.StatusFound)
+	return nil
+}
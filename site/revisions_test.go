@@ -0,0 +1,90 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// failingTrashDB is a memoryDB that fails to move media in or out of the
+// trash while fail is set.
+type failingTrashDB struct {
+	*memoryDB
+	fail bool
+}
+
+func (db *failingTrashDB) DeleteMedia(id int64, byID int64, by string, events ...*Event) error {
+	if db.fail {
+		return errors.New("trash is full")
+	}
+	return db.memoryDB.DeleteMedia(id, byID, by, events...)
+}
+
+func (db *failingTrashDB) RestoreMedia(id int64, events ...*Event) error {
+	if db.fail {
+		return errors.New("trash is stuck")
+	}
+	return db.memoryDB.RestoreMedia(id, events...)
+}
+
+// TestDeleteRestoreRevisions checks deleting and restoring media records a
+// revision only when it happens.
+func TestDeleteRestoreRevisions(t *testing.T) {
+	db := &failingTrashDB{memoryDB: newMemoryDB()}
+	id, err := db.AddMedia(&Media{Title: "Alien"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	summaries := func() []string {
+		t.Helper()
+		revisions, err := db.ListRevisions(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list []string
+		for _, r := range revisions {
+			list = append(list, r.Summary)
+		}
+		return list
+	}
+
+	for _, step := range []struct {
+		name    string
+		do      func() error
+		fail    bool
+		wantErr bool
+		want    int // Revisions afterwards.
+	}{
+		{"failed delete", func() error { return deleteMedia(db, &Revision{MediaID: id}) }, true, true, 0},
+		{"delete", func() error { return deleteMedia(db, &Revision{MediaID: id}) }, false, false, 1},
+		{"delete again", func() error { return deleteMedia(db, &Revision{MediaID: id}) }, false, true, 1},
+		{"failed restore", func() error { return restoreMedia(db, &Revision{MediaID: id}) }, true, true, 1},
+		{"restore", func() error { return restoreMedia(db, &Revision{MediaID: id}) }, false, false, 2},
+		{"restore again", func() error { return restoreMedia(db, &Revision{MediaID: id}) }, false, true, 2},
+	} {
+		db.fail = step.fail
+		err := step.do()
+		if (err != nil) != step.wantErr {
+			t.Errorf("%s: err = %v, want error %v", step.name, err, step.wantErr)
+		}
+		if got := summaries(); len(got) != step.want {
+			t.Errorf("%s: revisions %q, want %d", step.name, got, step.want)
+		}
+	}
+	if got := summaries(); got[0] != "Deleted" || got[1] != "Restored" {
+		t.Errorf("revisions %q, want Deleted then Restored", got)
+	}
+}
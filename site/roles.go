@@ -0,0 +1,279 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+/*---------------------------  Roles  ---------------------------*/
+
+// Role is what a user may do on the site. Each role may do everything the
+// roles before it in roles may.
+type Role string
+
+const (
+	// RoleViewer may only look.
+	RoleViewer Role = "viewer"
+	// RoleContributor may add media, and edit the media they added.
+	RoleContributor Role = "contributor"
+	// RoleModerator may edit and delete any media.
+	RoleModerator Role = "moderator"
+	// RoleAdmin may also change the roles of other users.
+	RoleAdmin Role = "admin"
+)
+
+// roles lists the roles from least to most trusted.
+var roles = []Role{RoleViewer, RoleContributor, RoleModerator, RoleAdmin}
+
+// defaultRole is the role of new users, and of users saved before there were
+// roles.
+const defaultRole = RoleContributor
+
+// rank returns the position of r in roles, or -1 if it is not a role.
+func (r Role) rank() int {
+	if r == "" {
+		r = defaultRole
+	}
+	for i, role := range roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseRole returns the role named s.
+func parseRole(s string) (Role, error) {
+	r := Role(strings.ToLower(strings.TrimSpace(s)))
+	if r == "" || r.rank() < 0 {
+		return "", fmt.Errorf("unknown role %q", s)
+	}
+	return r, nil
+}
+
+// adminEmails are the emails of users who are made admins when they log in
+// with them verified, from the comma separated ADMIN_EMAILS environment
+// variable. They let the first admin in.
+var adminEmails = strings.Split(strings.ToLower(os.Getenv("ADMIN_EMAILS")), ",")
+
+// isAdminEmail reports whether email is one of adminEmails.
+func isAdminEmail(email string) bool {
+	email = strings.ToLower(strings.TrimSpace(email))
+	for _, e := range adminEmails {
+		if email != "" && strings.TrimSpace(e) == email {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdminIdentity reports whether id has one of adminEmails, verified by the
+// identity provider. Anyone can claim an email they do not own.
+func isAdminIdentity(id *Identity) bool {
+	return id.EmailVerified && isAdminEmail(id.Email)
+}
+
+// Is reports whether u has at least the given role. Nobody logged in has no
+// role at all.
+func (u *User) Is(role Role) bool {
+	return u != nil && u.Role.rank() >= role.rank()
+}
+
+// CanAddMedia reports whether u may add media.
+func (u *User) CanAddMedia() bool {
+	return u.Is(RoleContributor)
+}
+
+// CanEditMedia reports whether u may edit m: moderators may edit anything,
+// contributors only what they added.
+func (u *User) CanEditMedia(m *Media) bool {
+	return u.Is(RoleModerator) || u.Is(RoleContributor) && m.CreatedByID == u.ID
+}
+
+// CanDeleteMedia reports whether u may delete m.
+func (u *User) CanDeleteMedia(m *Media) bool {
+	return u.Is(RoleModerator)
+}
+
+// CanManageUsers reports whether u may change the roles of users.
+func (u *User) CanManageUsers() bool {
+	return u.Is(RoleAdmin)
+}
+
+/*---------------------------  Permissions  ---------------------------*/
+
+// permission reports whether u may make the request r.
+type permission func(u *User, r *http.Request) (bool, error)
+
+// authorized wraps a handler so only the users with permission can reach it;
+// others get a 403, as do requests that change anything without the CSRF
+// token of their session (see checkCSRF). It works for both appHandler and
+// apiHandler.
+func authorized(can permission, h func(http.ResponseWriter, *http.Request) error) func(http.ResponseWriter, *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u, err := userFromRequest(r)
+		if err != nil {
+			return appErrorf(err, "could not get user: %v", err)
+		}
+		ok, err := can(u, r)
+		if err != nil {
+			return appErrorf(err, "%v", err)
+		}
+		if !ok {
+			if u == nil {
+				return appErrorCodef(http.StatusForbidden, nil, "log in to do this")
+			}
+			return appErrorCodef(http.StatusForbidden, nil, "%s is not allowed to do this", u.DisplayName())
+		}
+		if err := checkCSRF(r); err != nil {
+			return appErrorCodef(http.StatusForbidden, err, "%v", err)
+		}
+		return h(w, r)
+	}
+}
+
+// requireRole returns the permission of users with at least the given role.
+func requireRole(role Role) permission {
+	return func(u *User, r *http.Request) (bool, error) {
+		return u.Is(role), nil
+	}
+}
+
+// canAddMedia is the permission to add media.
+func canAddMedia(u *User, r *http.Request) (bool, error) {
+	return u.CanAddMedia(), nil
+}
+
+// canEditMedia is the permission to edit the media whose ID is in the path.
+func canEditMedia(u *User, r *http.Request) (bool, error) {
+	m, err := mediaInPath(u, r)
+	if m == nil {
+		return false, err
+	}
+	return u.CanEditMedia(m), nil
+}
+
+// canDeleteMedia is the permission to delete the media whose ID is in the
+// path.
+func canDeleteMedia(u *User, r *http.Request) (bool, error) {
+	m, err := mediaInPath(u, r)
+	if m == nil {
+		return false, err
+	}
+	return u.CanDeleteMedia(m), nil
+}
+
+// canEditCharacter is the permission to edit the character whose ID is in the
+// path, which is the permission to edit its media.
+func canEditCharacter(u *User, r *http.Request) (bool, error) {
+	if u == nil {
+		return false, nil
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("bad character id: %v", err)
+	}
+	c, err := DB.GetCharacter(id)
+	if err != nil {
+		return false, fmt.Errorf("could not find character: %w", err)
+	}
+	m, err := DB.GetMedia(c.MediaID)
+	if err != nil {
+		return false, fmt.Errorf("could not find character media: %w", err)
+	}
+	return u.CanEditMedia(m), nil
+}
+
+// mediaInPath returns the media whose ID is in the path, or nil without an
+// error when nobody is logged in, since they may do nothing to it anyway.
+func mediaInPath(u *User, r *http.Request) (*Media, error) {
+	if u == nil {
+		return nil, nil
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad media id: %v", err)
+	}
+	m, err := DB.GetMedia(id)
+	if err != nil {
+		return nil, fmt.Errorf("could not find media: %w", err)
+	}
+	return m, nil
+}
+
+/*---------------------------  Handlers  ---------------------------*/
+
+// usersPage is what users.html shows.
+type usersPage struct {
+	Users        []*User
+	Roles        []Role
+	Me           *User
+	PageSubTitle string
+}
+
+// usersHandler lists the users and their roles, for admins to change.
+func usersHandler(w http.ResponseWriter, r *http.Request) error {
+	users, err := DB.ListUsers()
+	if err != nil {
+		return appErrorf(err, "could not list users: %v", err)
+	}
+	me, err := userFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+	for _, u := range users {
+		if u.Role == "" {
+			u.Role = defaultRole
+		}
+	}
+	return usersTmpl.Execute(w, r, &usersPage{Users: users, Roles: roles, Me: me, PageSubTitle: "Users"})
+}
+
+// updateRoleHandler sets the role of a user. Admins cannot change their own
+// role, so there is always one left.
+func updateRoleHandler(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return appErrorf(err, "bad user id: %v", err)
+	}
+	role, err := parseRole(r.FormValue("role"))
+	if err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
+	me, err := userFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+	if me != nil && me.ID == id {
+		return appErrorCodef(http.StatusForbidden, nil, "admins cannot change their own role")
+	}
+	u, err := DB.GetUser(id)
+	if err != nil {
+		return appErrorf(err, "could not find user: %v", err)
+	}
+	u.Role = role
+	if err := DB.UpdateUser(u); err != nil {
+		return appErrorf(err, "could not save user: %v", err)
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+	return nil
+}
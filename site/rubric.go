@@ -0,0 +1,212 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Rubric is a versioned set of the README's inclusion criteria. Media is
+// assessed against the Include criteria, which make up its inclusion score,
+// and the Exclude criteria, any of which disqualifies it.
+type Rubric struct {
+	Version int
+	Include []Criterion
+	Exclude []Criterion
+}
+
+// rubrics are every published rubric, oldest first. Assessments record the
+// version they were made against, so never change a published rubric: append
+// a new version instead.
+var rubrics = []*Rubric{
+	{
+		Version: 1,
+		// The character criteria as they were when version 1 was
+		// published, copied so that changing those does not change it.
+		Include: []Criterion{
+			{"protagonist", "Protagonist"},
+			{"breaks-stereotypes", "Breaks stereotypes"},
+			{"agency", "Agency | power"},
+			{"goals", "Goals (beyond finding or supporting a man)"},
+			{"journey", "On a journey"},
+			{"independent-ideas", "Independent ideas"},
+			{"more-than-one-woman", "More than one woman"},
+			{"assertive", "Assertive, intelligent, self-reliant characteristics"},
+			{"survivor", "Survivor"},
+			{"positive-impact", "Positive impact"},
+			{"helps-others", "Helping herself or others that is not a man"},
+			{"robust", "Robust character"},
+		},
+		Exclude: []Criterion{
+			{"saved-by-man", "Saved by a man"},
+			{"man-decides", "Man makes most decisions for the character"},
+			{"helps-man", "Only goal/value is to help a man achieve his goal"},
+			{"objectified", "Exists only to be objectified"},
+			{"gratuitous-nudity", "Gratuitous nudity"},
+			{"love-story", "Standard love story | only has value or is complete when finds a man"},
+			{"stereotypical-archetype", "Stereotypical archetype (manic pixie dream girl)"},
+			{"women-against-women", "Pits women against women"},
+			{"strong-woman-crazy", "Treats a strong woman as crazy or a psychopath"},
+			{"serial-killers", "Serial killers"},
+		},
+	},
+}
+
+// currentRubric returns the rubric new assessments are made against.
+func currentRubric() *Rubric {
+	return rubrics[len(rubrics)-1]
+}
+
+// rubricVersion returns the rubric with the given version.
+func rubricVersion(version int) (*Rubric, bool) {
+	for _, r := range rubrics {
+		if r.Version == version {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// Criteria returns the Include criteria followed by the Exclude criteria.
+func (rb *Rubric) Criteria() []Criterion {
+	criteria := make([]Criterion, 0, len(rb.Include)+len(rb.Exclude))
+	criteria = append(criteria, rb.Include...)
+	return append(criteria, rb.Exclude...)
+}
+
+// Score returns the percentage, from 0 to 100, of the Include criteria that
+// assessments meet. Unknown criteria count as not met.
+func (rb *Rubric) Score(assessments []Evaluation) int {
+	if len(rb.Include) == 0 {
+		return 0
+	}
+	met := 0
+	for _, e := range evaluationsFor(rb.Include, assessments) {
+		if e.Verdict == verdictMet {
+			met++
+		}
+	}
+	return met * 100 / len(rb.Include)
+}
+
+// Flags returns the Exclude criteria that assessments meet.
+func (rb *Rubric) Flags(assessments []Evaluation) []Criterion {
+	var flags []Criterion
+	for i, e := range evaluationsFor(rb.Exclude, assessments) {
+		if e.Verdict == verdictMet {
+			flags = append(flags, rb.Exclude[i])
+		}
+	}
+	return flags
+}
+
+// check returns an error if an assessment is not against one of the
+// rubric's criteria, or has an unknown verdict.
+func (rb *Rubric) check(assessments []Evaluation) error {
+	for _, e := range assessments {
+		found := false
+		for _, c := range rb.Criteria() {
+			found = found || c.Key == e.Criterion
+		}
+		if !found {
+			return fmt.Errorf("rubric %d has no criterion %q", rb.Version, e.Criterion)
+		}
+		switch e.Verdict {
+		case verdictMet, verdictNotMet, verdictUnknown:
+		default:
+			return fmt.Errorf("bad verdict %q for %s", e.Verdict, e.Criterion)
+		}
+	}
+	return nil
+}
+
+// evaluationsFor returns one evaluation per criterion, in order, taken from
+// evals. Criteria missing from evals are unknown.
+func evaluationsFor(criteria []Criterion, evals []Evaluation) []Evaluation {
+	out := make([]Evaluation, 0, len(criteria))
+	for _, crit := range criteria {
+		e := Evaluation{Criterion: crit.Key, Verdict: verdictUnknown}
+		for _, ev := range evals {
+			if ev.Criterion == crit.Key {
+				e = ev
+			}
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// evaluationsFromForm reads the verdict-<key> and justification-<key> form
+// fields of each criterion (see templates/character-edit.html and
+// templates/edit.html). Unknown criteria without a justification are left
+// out.
+func evaluationsFromForm(r *http.Request, criteria []Criterion) ([]Evaluation, error) {
+	var evals []Evaluation
+	for _, crit := range criteria {
+		e := Evaluation{
+			Criterion:     crit.Key,
+			Verdict:       r.FormValue("verdict-" + crit.Key),
+			Justification: r.FormValue("justification-" + crit.Key),
+		}
+		switch e.Verdict {
+		case verdictMet, verdictNotMet:
+		case "", verdictUnknown:
+			if e.Justification == "" {
+				continue
+			}
+			e.Verdict = verdictUnknown
+		default:
+			return nil, fmt.Errorf("bad verdict %q for %s", e.Verdict, crit.Label)
+		}
+		evals = append(evals, e)
+	}
+	return evals, nil
+}
+
+/*---------------------------  Media  ---------------------------*/
+
+// Rubric returns the rubric the media was assessed against, or the current
+// rubric if it has not been assessed.
+func (m *Media) Rubric() *Rubric {
+	if rb, ok := rubricVersion(m.RubricVersion); ok {
+		return rb
+	}
+	return currentRubric()
+}
+
+// IncludeAssessments and ExcludeAssessments return one assessment per
+// criterion of the media's rubric, in order.
+func (m *Media) IncludeAssessments() []Evaluation {
+	return evaluationsFor(m.Rubric().Include, m.Assessments)
+}
+
+func (m *Media) ExcludeAssessments() []Evaluation {
+	return evaluationsFor(m.Rubric().Exclude, m.Assessments)
+}
+
+// DisqualifyingFlags returns the Exclude criteria the media meets.
+func (m *Media) DisqualifyingFlags() []Criterion {
+	return m.Rubric().Flags(m.Assessments)
+}
+
+// scoreRubric stores the inclusion score and disqualification of the
+// media's assessments, so backends can filter and sort on them.
+func (m *Media) scoreRubric() {
+	rb := m.Rubric()
+	m.RubricVersion = rb.Version
+	m.InclusionScore = rb.Score(m.Assessments)
+	m.Disqualified = len(rb.Flags(m.Assessments)) > 0
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestScoreRubric(t *testing.T) {
+	rb, ok := rubricVersion(1)
+	if !ok {
+		t.Fatal("there is no rubric version 1")
+	}
+	for _, tt := range []struct {
+		name             string
+		assessments      []Evaluation
+		wantScore        int
+		wantDisqualified bool
+	}{
+		{"unassessed", nil, 0, false},
+		{"some met", []Evaluation{
+			{Criterion: "protagonist", Verdict: verdictMet},
+			{Criterion: "agency", Verdict: verdictMet},
+			{Criterion: "survivor", Verdict: verdictMet},
+			{Criterion: "goals", Verdict: verdictNotMet},
+			{Criterion: "journey", Verdict: verdictUnknown},
+		}, 3 * 100 / len(rb.Include), false},
+		{"flagged", []Evaluation{
+			{Criterion: "protagonist", Verdict: verdictMet},
+			{Criterion: "saved-by-man", Verdict: verdictMet},
+			{Criterion: "objectified", Verdict: verdictNotMet},
+		}, 100 / len(rb.Include), true},
+	} {
+		m := &Media{Assessments: tt.assessments}
+		m.scoreRubric()
+		if m.RubricVersion != currentRubric().Version || m.InclusionScore != tt.wantScore || m.Disqualified != tt.wantDisqualified {
+			t.Errorf("%s: scored version %d, %d, disqualified %v, want version %d, %d, %v", tt.name,
+				m.RubricVersion, m.InclusionScore, m.Disqualified, currentRubric().Version, tt.wantScore, tt.wantDisqualified)
+		}
+		if err := rb.check(tt.assessments); err != nil {
+			t.Errorf("%s: check: %v", tt.name, err)
+		}
+	}
+
+	m := &Media{Assessments: []Evaluation{{Criterion: "saved-by-man", Verdict: verdictMet}}}
+	if flags := m.DisqualifyingFlags(); len(flags) != 1 || flags[0].Key != "saved-by-man" {
+		t.Errorf("DisqualifyingFlags = %v, want saved-by-man", flags)
+	}
+	if got := m.ExcludeAssessments(); len(got) != len(rb.Exclude) || got[1].Verdict != verdictUnknown {
+		t.Errorf("ExcludeAssessments = %v, want one per criterion, unknown unless assessed", got)
+	}
+
+	for _, bad := range []Evaluation{
+		{Criterion: "flying", Verdict: verdictMet},
+		{Criterion: "protagonist", Verdict: "maybe"},
+	} {
+		if err := rb.check([]Evaluation{bad}); err == nil {
+			t.Errorf("check(%+v) succeeded", bad)
+		}
+	}
+}
+
+// TestRubricVersionsAreFixed changes the character criteria, which rubric
+// version 1 started as a copy of.
+func TestRubricVersionsAreFixed(t *testing.T) {
+	old := characterCriteria[0]
+	characterCriteria[0] = Criterion{"lead", "Lead"}
+	defer func() { characterCriteria[0] = old }()
+
+	rb, _ := rubricVersion(1)
+	if rb.Include[0] != old {
+		t.Errorf("rubric 1 starts with %v, want %v", rb.Include[0], old)
+	}
+}
@@ -0,0 +1,603 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+/*---------------------------  Text analysis  ---------------------------*/
+
+// searchStopWords are left out of the index and of queries.
+var searchStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "as": true, "at": true, "by": true,
+	"for": true, "in": true, "is": true, "it": true, "of": true, "on": true,
+	"or": true, "the": true, "to": true, "with": true,
+}
+
+// tokenize splits folded text into words, dropping stop words.
+func tokenize(s string) []string {
+	words := strings.FieldsFunc(foldText(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	tokens := words[:0]
+	for _, w := range words {
+		if !searchStopWords[w] {
+			tokens = append(tokens, w)
+		}
+	}
+	return tokens
+}
+
+// stem reduces an English word to a stem by removing common suffixes, so
+// "heroines" finds "heroine" and "fighting" finds "fight". It is deliberately
+// light: names and titles are much of what is searched.
+func stem(w string) string {
+	if len(w) <= 3 {
+		return w
+	}
+	switch {
+	case strings.HasSuffix(w, "ies") && len(w) > 4:
+		return w[:len(w)-3] + "y"
+	case strings.HasSuffix(w, "sses"):
+		return w[:len(w)-2]
+	case strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss") &&
+		!strings.HasSuffix(w, "us") && !strings.HasSuffix(w, "is"):
+		return w[:len(w)-1]
+	}
+	for _, suffix := range []string{"ing", "ed", "ly"} {
+		if !strings.HasSuffix(w, suffix) || len(w)-len(suffix) < 3 {
+			continue
+		}
+		w = w[:len(w)-len(suffix)]
+		// "running" -> "runn" -> "run".
+		if n := len(w); w[n-1] == w[n-2] && !strings.ContainsRune("aeiouslz", rune(w[n-1])) {
+			w = w[:n-1]
+		}
+		break
+	}
+	return w
+}
+
+// editDistance returns the optimal string alignment distance between a and
+// b: the Levenshtein distance, with swapping adjacent letters counting as one
+// edit.
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	d := make([][]int, len(s)+1)
+	for i := range d {
+		d[i] = make([]int, len(t)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			d[i][j] = minInt(d[i-1][j]+1, minInt(d[i][j-1]+1, d[i-1][j-1]+cost))
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(s)][len(t)]
+}
+
+// maxEdits is how many typos a query word of the given length may have.
+func maxEdits(n int) int {
+	switch {
+	case n < 4:
+		return 0
+	case n < 7:
+		return 1
+	}
+	return 2
+}
+
+/*---------------------------  Index  ---------------------------*/
+
+// BM25 parameters, and how much a match in each field counts.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+var searchFieldWeights = map[string]float64{
+	searchTitle:     3,
+	searchActor:     2,
+	searchDirector:  2,
+	searchCharacter: 2,
+	"description":   1,
+}
+
+// How much inexact matches of a query word count, relative to its stem.
+const (
+	prefixMatchWeight = 0.7
+	fuzzyMatchWeight  = 0.5
+)
+
+// indexedDoc is the indexed form of one media item.
+type indexedDoc struct {
+	media  *Media
+	fields []searchField
+	terms  map[string][]string // field -> stemmed tokens
+}
+
+// searchIndex is an in-memory full-text index of the media in a database,
+// ranked with BM25. It is kept in sync by indexedDB, which marks changed
+// media dirty, and by the media events of other processes (see subscribe);
+// dirty media is read back from the database before the next search.
+//
+// The database is read without holding mu, and searches only hold it for
+// reading, so they run alongside each other.
+type searchIndex struct {
+	db MediaDatabase
+
+	mu       sync.RWMutex
+	built    bool
+	docs     map[int64]*indexedDoc
+	postings map[string]map[string]map[int64]int // field -> term -> media ID -> count
+	lengths  map[string]int                      // field -> total tokens
+	credits  map[int64]int64                     // credit ID -> media ID
+
+	// dirty maps the media changed since it was indexed to when it was
+	// last marked, counted by marks, so a refresh that read the media
+	// before a later change does not take it off.
+	dirty map[int64]uint64
+	marks uint64
+}
+
+// newSearchIndex returns an index of the media in db. It is built on first
+// use.
+func newSearchIndex(db MediaDatabase) *searchIndex {
+	return &searchIndex{db: db, dirty: make(map[int64]uint64)}
+}
+
+// rebuild indexes all the media in the database from scratch. Media marked
+// dirty meanwhile stays dirty, as the listing may predate its change.
+func (ix *searchIndex) rebuild() error {
+	media, err := ix.db.ListMedia()
+	if err != nil {
+		return fmt.Errorf("search: could not list media: %v", err)
+	}
+	if err := loadCredits(ix.db, media...); err != nil {
+		return fmt.Errorf("search: %v", err)
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.docs = make(map[int64]*indexedDoc, len(media))
+	ix.postings = make(map[string]map[string]map[int64]int)
+	ix.lengths = make(map[string]int)
+	ix.credits = make(map[int64]int64)
+	for _, m := range media {
+		ix.add(m)
+	}
+	ix.built = true
+	return nil
+}
+
+// markDirty notes that the media with the given ID has changed.
+func (ix *searchIndex) markDirty(id int64) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.marks++
+	ix.dirty[id] = ix.marks
+}
+
+// mediaOfCredit returns the media a credit in the index belongs to.
+func (ix *searchIndex) mediaOfCredit(id int64) (int64, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	mediaID, ok := ix.credits[id]
+	return mediaID, ok
+}
+
+// refresh builds the index, or re-reads the dirty media.
+func (ix *searchIndex) refresh() error {
+	ix.mu.RLock()
+	built := ix.built
+	marked := make(map[int64]uint64, len(ix.dirty))
+	for id, mark := range ix.dirty {
+		marked[id] = mark
+	}
+	ix.mu.RUnlock()
+	if !built {
+		return ix.rebuild()
+	}
+	if len(marked) == 0 {
+		return nil
+	}
+
+	read := make(map[int64]*Media, len(marked)) // nil for media that is gone
+	for id := range marked {
+		m, err := ix.db.GetMedia(id)
+		if errors.Is(err, errNotFound) {
+			read[id] = nil
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("search: %v", err)
+		}
+		if err := loadCredits(ix.db, m); err != nil {
+			return fmt.Errorf("search: %v", err)
+		}
+		read[id] = m
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for id, m := range read {
+		mark, ok := ix.dirty[id]
+		if !ok {
+			// Another refresh got here first.
+			continue
+		}
+		ix.remove(id)
+		if m != nil {
+			ix.add(m)
+		}
+		if mark == marked[id] {
+			delete(ix.dirty, id)
+		}
+	}
+	return nil
+}
+
+// searchSubscriptionPrefix starts the name of the subscription through which
+// each site instance hears of media changes, followed by the instance. Every
+// instance needs its own to hear of every change; Pub/Sub deletes those of
+// instances that are gone after a month without use.
+const searchSubscriptionPrefix = "search-index-"
+
+// subscribe marks the media that bus announces as changed dirty, until ctx
+// is done, so the index sees changes made by other processes, such as
+// workers.
+func (ix *searchIndex) subscribe(ctx context.Context, bus EventBus) error {
+	types := []EventType{EventMediaCreated, EventMediaUpdated, EventMediaDeleted}
+	return bus.Subscribe(ctx, searchSubscriptionPrefix+instanceName(), types, func(ctx context.Context, e *Event) error {
+		ix.markDirty(e.MediaID)
+		return nil
+	})
+}
+
+// instanceName names the running instance of the site: the App Engine
+// instance, or the host, in the characters subscription names may have.
+func instanceName() string {
+	name := os.Getenv("GAE_INSTANCE")
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	return strings.Map(func(r rune) rune {
+		if r < 128 && (unicode.IsLetter(r) || unicode.IsDigit(r)) || strings.ContainsRune("-_.~+", r) {
+			return r
+		}
+		return '-'
+	}, name)
+}
+
+// add indexes m, whose credits must be loaded.
+func (ix *searchIndex) add(m *Media) {
+	doc := &indexedDoc{media: m, fields: searchFields(m, ""), terms: make(map[string][]string)}
+	for _, f := range doc.fields {
+		for _, t := range tokenize(f.Text) {
+			doc.terms[f.Field] = append(doc.terms[f.Field], stem(t))
+		}
+	}
+	for field, terms := range doc.terms {
+		if ix.postings[field] == nil {
+			ix.postings[field] = make(map[string]map[int64]int)
+		}
+		for _, t := range terms {
+			if ix.postings[field][t] == nil {
+				ix.postings[field][t] = make(map[int64]int)
+			}
+			ix.postings[field][t][m.ID]++
+		}
+		ix.lengths[field] += len(terms)
+	}
+	for _, c := range m.Credits {
+		ix.credits[c.ID] = m.ID
+	}
+	ix.docs[m.ID] = doc
+}
+
+// remove takes the media with the given ID out of the index.
+func (ix *searchIndex) remove(id int64) {
+	doc, ok := ix.docs[id]
+	if !ok {
+		return
+	}
+	for field, terms := range doc.terms {
+		for _, t := range terms {
+			delete(ix.postings[field][t], id)
+			if len(ix.postings[field][t]) == 0 {
+				delete(ix.postings[field], t)
+			}
+		}
+		ix.lengths[field] -= len(terms)
+	}
+	for _, c := range doc.media.Credits {
+		delete(ix.credits, c.ID)
+	}
+	delete(ix.docs, id)
+}
+
+// termMatch is an indexed term that a query word matches, and how much the
+// match counts.
+type termMatch struct {
+	term   string
+	weight float64
+}
+
+// expand returns the terms of field that word matches: its stem, terms it is
+// a prefix of, and terms within maxEdits typos.
+func (ix *searchIndex) expand(field, word string) []termMatch {
+	s := stem(word)
+	var matches []termMatch
+	for term := range ix.postings[field] {
+		switch {
+		case term == s:
+			matches = append(matches, termMatch{term, 1})
+		case len(word) >= 3 && strings.HasPrefix(term, word):
+			matches = append(matches, termMatch{term, prefixMatchWeight})
+		case maxEdits(len(word)) > 0 && abs(len(term)-len(s)) <= maxEdits(len(word)) &&
+			editDistance(term, s) <= maxEdits(len(word)):
+			matches = append(matches, termMatch{term, fuzzyMatchWeight})
+		}
+	}
+	return matches
+}
+
+// search returns the media matching every word of query, in the given field
+// or any field when field is empty, best match first.
+func (ix *searchIndex) search(query, field string) ([]searchResult, error) {
+	if err := ix.refresh(); err != nil {
+		return nil, err
+	}
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	words := tokenize(query)
+	results := []searchResult{}
+	if len(words) == 0 || len(ix.docs) == 0 {
+		return results, nil
+	}
+
+	fields := []string{field}
+	if field == "" {
+		fields = fields[:0]
+		for f := range searchFieldWeights {
+			fields = append(fields, f)
+		}
+	}
+
+	scores := make(map[int64]float64)
+	matched := make(map[int64]map[string]bool) // media ID -> fields matched
+	hits := make(map[int64]int)                // media ID -> words matched
+	n := float64(len(ix.docs))
+	for _, w := range words {
+		wordHit := make(map[int64]bool)
+		for _, f := range fields {
+			avgLen := float64(ix.lengths[f]) / n
+			for _, tm := range ix.expand(f, w) {
+				docs := ix.postings[f][tm.term]
+				idf := math.Log(1 + (n-float64(len(docs))+0.5)/(float64(len(docs))+0.5))
+				for id, tf := range docs {
+					dl := float64(len(ix.docs[id].terms[f]))
+					norm := float64(tf) * (bm25K1 + 1) /
+						(float64(tf) + bm25K1*(1-bm25B+bm25B*dl/avgLen))
+					scores[id] += searchFieldWeights[f] * tm.weight * idf * norm
+					wordHit[id] = true
+					if matched[id] == nil {
+						matched[id] = make(map[string]bool)
+					}
+					matched[id][f] = true
+				}
+			}
+		}
+		for id := range wordHit {
+			hits[id]++
+		}
+	}
+
+	for id, h := range hits {
+		if h < len(words) {
+			continue
+		}
+		doc := ix.docs[id]
+		r := searchResult{Media: doc.media, Score: scores[id]}
+		for _, f := range doc.fields {
+			if matched[id][f.Field] {
+				r.Matches = append(r.Matches, f)
+			}
+		}
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Media.Title < results[j].Media.Title
+	})
+	return results, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+/*---------------------------  Database hooks  ---------------------------*/
+
+// indexedDB is a MediaDatabase that keeps a searchIndex in sync with the
+// changes made through it.
+type indexedDB struct {
+	MediaDatabase
+	index *searchIndex
+}
+
+// Ensure indexedDB conforms to the MediaDatabase interface.
+var _ MediaDatabase = &indexedDB{}
+
+// newIndexedDB wraps db with a search index.
+func newIndexedDB(db MediaDatabase) *indexedDB {
+	return &indexedDB{MediaDatabase: db, index: newSearchIndex(db)}
+}
+
+// searchIndexFor returns the search index of db, or a new index for a
+// database that does not keep one.
+func searchIndexFor(db MediaDatabase) *searchIndex {
+	if idb, ok := db.(*indexedDB); ok {
+		return idb.index
+	}
+	return newSearchIndex(db)
+}
+
+// AddMedia saves a given media, assigning it a new ID.
+func (db *indexedDB) AddMedia(m *Media, events ...*Event) (id int64, err error) {
+	id, err = db.MediaDatabase.AddMedia(m, events...)
+	if err == nil {
+		db.index.markDirty(id)
+	}
+	return id, err
+}
+
+// AddSubmittedMedia saves the media of a submission of new media.
+func (db *indexedDB) AddSubmittedMedia(s *Submission, m *Media, events ...*Event) (id int64, err error) {
+	id, err = db.MediaDatabase.AddSubmittedMedia(s, m, events...)
+	if err == nil {
+		db.index.markDirty(id)
+	}
+	return id, err
+}
+
+// UpdateMedia updates the entry for a given media.
+func (db *indexedDB) UpdateMedia(m *Media, events ...*Event) error {
+	err := db.MediaDatabase.UpdateMedia(m, events...)
+	if err == nil {
+		db.index.markDirty(m.ID)
+	}
+	return err
+}
+
+// ChangeMedia reads a given media and saves the changes change makes to it.
+func (db *indexedDB) ChangeMedia(id int64, change func(m *Media) (bool, []*Event)) error {
+	err := db.MediaDatabase.ChangeMedia(id, change)
+	if err == nil {
+		db.index.markDirty(id)
+	}
+	return err
+}
+
+// DeleteMedia moves a given media to the trash.
+func (db *indexedDB) DeleteMedia(id int64, byID int64, by string, events ...*Event) error {
+	err := db.MediaDatabase.DeleteMedia(id, byID, by, events...)
+	if err == nil {
+		db.index.markDirty(id)
+	}
+	return err
+}
+
+// RestoreMedia takes a given media out of the trash.
+func (db *indexedDB) RestoreMedia(id int64, events ...*Event) error {
+	err := db.MediaDatabase.RestoreMedia(id, events...)
+	if err == nil {
+		db.index.markDirty(id)
+	}
+	return err
+}
+
+// UpdatePerson updates the entry for a given person, and the media
+// crediting them.
+func (db *indexedDB) UpdatePerson(p *Person) error {
+	err := db.MediaDatabase.UpdatePerson(p)
+	if err == nil {
+		db.markPersonDirty(p.ID)
+	}
+	return err
+}
+
+// DeletePerson removes a given person, and their credits, by ID.
+func (db *indexedDB) DeletePerson(id int64) error {
+	db.markPersonDirty(id)
+	return db.MediaDatabase.DeletePerson(id)
+}
+
+func (db *indexedDB) markPersonDirty(id int64) {
+	credits, err := db.MediaDatabase.ListPersonCredits(id)
+	if err != nil {
+		// Stale results are better than failing the change.
+		return
+	}
+	for _, c := range credits {
+		db.index.markDirty(c.MediaID)
+	}
+}
+
+// UpdateCharacter updates the entry for a given character.
+func (db *indexedDB) UpdateCharacter(c *Character) error {
+	err := db.MediaDatabase.UpdateCharacter(c)
+	if err == nil {
+		db.index.markDirty(c.MediaID)
+	}
+	return err
+}
+
+// DeleteCharacter removes a given character by its ID.
+func (db *indexedDB) DeleteCharacter(id int64) error {
+	if c, err := db.MediaDatabase.GetCharacter(id); err == nil {
+		db.index.markDirty(c.MediaID)
+	}
+	return db.MediaDatabase.DeleteCharacter(id)
+}
+
+// AddCredit saves a given credit, assigning it a new ID.
+func (db *indexedDB) AddCredit(c *Credit) (id int64, err error) {
+	id, err = db.MediaDatabase.AddCredit(c)
+	if err == nil {
+		db.index.markDirty(c.MediaID)
+	}
+	return id, err
+}
+
+// DeleteCredit removes a given credit by its ID.
+func (db *indexedDB) DeleteCredit(id int64) error {
+	if mediaID, ok := db.index.mediaOfCredit(id); ok {
+		db.index.markDirty(mediaID)
+	}
+	return db.MediaDatabase.DeleteCredit(id)
+}
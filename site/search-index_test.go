@@ -0,0 +1,109 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// searchTitles returns the titles of the media ix finds for query, best
+// match first.
+func searchTitles(t *testing.T, ix *searchIndex, query, field string) []string {
+	t.Helper()
+	results, err := ix.search(query, field)
+	if err != nil {
+		t.Fatalf("search(%q): %v", query, err)
+	}
+	var titles []string
+	for _, r := range results {
+		titles = append(titles, r.Media.Title)
+	}
+	return titles
+}
+
+func TestSearchTypos(t *testing.T) {
+	db := newIndexedDB(newMemoryDB())
+	// Titles as the list spells them, "A Seperation" included.
+	for _, title := range []string{"A Seperation", "Agent Carter", "A Fantastic Woman", "Carter", "Separate Tables"} {
+		if _, err := db.AddMedia(&Media{Title: title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"A Seperation", []string{"A Seperation"}},
+		// Spelt right, it still finds the list's spelling.
+		{"A Separation", []string{"A Seperation"}},
+		{"Agent Carter", []string{"Agent Carter"}},
+		{"Agnet Carter", []string{"Agent Carter"}},
+		{"agent cartr", []string{"Agent Carter"}},
+		{"Agnet Cartre", []string{"Agent Carter"}},
+		// The start of a word finds it too.
+		{"Agen", []string{"Agent Carter"}},
+		{"fantastik woman", []string{"A Fantastic Woman"}},
+	} {
+		if got := searchTitles(t, db.index, tt.query, searchTitle); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("search(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+// TestSearchEvents changes media behind the index's back, as another
+// process would, and tells it through the bus.
+func TestSearchEvents(t *testing.T) {
+	mem := newMemoryDB()
+	db := newIndexedDB(mem)
+	id, err := db.AddMedia(&Media{Title: "Agent Carter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := searchTitles(t, db.index, "carter", ""); len(got) != 1 {
+		t.Fatalf("search = %q, want Agent Carter", got)
+	}
+
+	bus := newChannelBus()
+	defer bus.Close()
+	if err := db.index.subscribe(context.Background(), bus); err != nil {
+		t.Fatal(err)
+	}
+	m := &Media{ID: id, Title: "Peggy Carter"}
+	if err := mem.UpdateMedia(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Publish(context.Background(), newMediaEvent(EventMediaUpdated, m, 0, "worker")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := searchTitles(t, db.index, "peggy", "")
+		if reflect.DeepEqual(got, []string{"Peggy Carter"}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("search after the event = %q, want Peggy Carter", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := searchTitles(t, db.index, "agent", ""); got != nil {
+		t.Errorf("search for the old title = %q, want nothing", got)
+	}
+}
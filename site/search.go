@@ -0,0 +1,138 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Search fields, as in /search/{field}. /find searches all of them, and
+// descriptions.
+const (
+	searchTitle     = "title"
+	searchActor     = "actor"
+	searchDirector  = "director"
+	searchCharacter = "character"
+)
+
+// foldText lowercases s and strips its accents, so "Amélie" matches "amelie".
+func foldText(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+// searchField is a piece of media text that can be searched.
+type searchField struct {
+	Field string // searchTitle, searchActor, ... or "description".
+	Text  string
+}
+
+// searchFields returns the text of m that a search on field looks at, all of
+// it when field is empty. m's credits must be loaded.
+func searchFields(m *Media, field string) []searchField {
+	var fields []searchField
+	add := func(f, text string) {
+		if text == "" || field != "" && field != f {
+			return
+		}
+		for _, sf := range fields {
+			if sf.Field == f && sf.Text == text {
+				return
+			}
+		}
+		fields = append(fields, searchField{f, text})
+	}
+	add(searchTitle, m.Title)
+	add("description", m.Description)
+	for _, c := range m.Credits {
+		if c.Person != nil {
+			switch c.Role {
+			case roleActor:
+				add(searchActor, c.Person.Name)
+			case roleDirector:
+				add(searchDirector, c.Person.Name)
+			}
+		}
+		if c.Character != nil {
+			add(searchCharacter, c.Character.Name)
+		}
+	}
+	return fields
+}
+
+// searchResult is media matching a search, with the text that matched and
+// how well it matched.
+type searchResult struct {
+	Media   *Media
+	Matches []searchField
+	Score   float64
+}
+
+// searchPage is what search.html and the JSON view show.
+type searchPage struct {
+	Query        string
+	Field        string
+	Results      []searchResult
+	PageSubTitle string `json:"-"`
+}
+
+// searchFromRequest runs the search given by the q query parameter and the
+// field in the URL's path, best match first.
+func searchFromRequest(r *http.Request) (*searchPage, error) {
+	page := &searchPage{
+		Query: r.FormValue("q"),
+		Field: mux.Vars(r)["field"],
+	}
+	results, err := searchIndexFor(DB).search(page.Query, page.Field)
+	if err != nil {
+		return nil, err
+	}
+	page.Results = results
+	return page, nil
+}
+
+// searchHandler displays the results of /find and /search/{field}.
+func searchHandler(w http.ResponseWriter, r *http.Request) error {
+	page, err := searchFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not search media: %v", err)
+	}
+	page.PageSubTitle = "Search"
+	if page.Field != "" {
+		page.PageSubTitle = "Search by " + page.Field
+	}
+	return searchTmpl.Execute(w, r, page)
+}
+
+// searchJSONHandler writes the results of /find.json and
+// /search/{field}.json.
+func searchJSONHandler(w http.ResponseWriter, r *http.Request) error {
+	page, err := searchFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not search media: %v", err)
+	}
+	writeJSON(w, http.StatusOK, page)
+	return nil
+}
@@ -0,0 +1,499 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Submission is a change to the media list waiting for a moderator, as
+// CONTRIBUTING.md asks: the media as the contributor wants it, and how it fits
+// the criteria. Media only changes when a submission is approved, so the
+// media list only ever shows approved entries.
+type Submission struct {
+	ID int64
+
+	// MediaID is the media the submission changes, 0 for new media until it
+	// is approved.
+	MediaID int64
+
+	// Media is the media as submitted. It is stored as JSON, see
+	// marshalMedia.
+	Media *Media `datastore:"-"`
+
+	// Justification is how the submission fits the criteria.
+	Justification string `datastore:",noindex"`
+
+	Status        SubmissionStatus
+	SubmittedByID int64
+	SubmittedBy   string
+	SubmittedDate string
+
+	// Who last reviewed the submission, and why they rejected it or asked
+	// for changes.
+	ReviewedByID int64
+	ReviewedBy   string
+	ReviewedDate string
+	Reason       string `datastore:",noindex"`
+
+	// CanReview and CanEdit are whether the user viewing the page may.
+	CanReview bool `datastore:"-" json:"-"`
+	CanEdit   bool `datastore:"-" json:"-"`
+}
+
+// SubmissionStatus is where a submission is in moderation.
+type SubmissionStatus string
+
+const (
+	submissionPending          SubmissionStatus = "pending"
+	submissionApproved         SubmissionStatus = "approved"
+	submissionRejected         SubmissionStatus = "rejected"
+	submissionChangesRequested SubmissionStatus = "changes-requested"
+)
+
+// submissionStatuses lists the statuses in the order the moderation
+// dashboard shows them.
+var submissionStatuses = []SubmissionStatus{
+	submissionPending, submissionChangesRequested, submissionApproved, submissionRejected,
+}
+
+// Label returns the status for people.
+func (s SubmissionStatus) Label() string {
+	switch s {
+	case submissionChangesRequested:
+		return "Changes requested"
+	case "":
+		return ""
+	}
+	return strings.ToUpper(string(s[:1])) + string(s[1:])
+}
+
+// IsNew reports whether the submission adds media that has not been approved
+// yet.
+func (s *Submission) IsNew() bool {
+	return s.MediaID == 0
+}
+
+// Open reports whether the submission can still be changed and reviewed.
+func (s *Submission) Open() bool {
+	return s.Status == submissionPending || s.Status == submissionChangesRequested
+}
+
+// sortSubmissions orders submissions by the day they were submitted, then by
+// ID, for the backends that cannot sort by ID alone.
+func sortSubmissions(list []*Submission, newestFirst bool) {
+	day := func(s *Submission) string {
+		// SubmittedDate is day-month-year, so it is turned around.
+		d := s.SubmittedDate
+		return substr(d, 7, 4) + substr(d, 4, 2) + substr(d, 1, 2)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if a, b := day(list[i]), day(list[j]); a != b {
+			return a < b != newestFirst
+		}
+		return list[i].ID < list[j].ID != newestFirst
+	})
+}
+
+// SubmissionDatabase provides thread-safe access to the submissions waiting
+// for, or done with, moderation. Every MediaDatabase is also a
+// SubmissionDatabase.
+type SubmissionDatabase interface {
+	// GetSubmission retrieves a submission by its ID. The error wraps
+	// errNotFound if there is none.
+	GetSubmission(id int64) (*Submission, error)
+
+	// ListSubmissions returns the submissions with the given status, oldest
+	// first.
+	ListSubmissions(status SubmissionStatus) ([]*Submission, error)
+
+	// ListSubmissionsBy returns the submissions of the given user, newest
+	// first.
+	ListSubmissionsBy(userID int64) ([]*Submission, error)
+
+	// AddSubmission saves a given submission, assigning it a new ID.
+	AddSubmission(s *Submission) (id int64, err error)
+
+	// UpdateSubmission updates the entry for a given submission, adding
+	// the events to the outbox with it.
+	UpdateSubmission(s *Submission, events ...*Event) error
+
+	// AddSubmittedMedia saves m, the media of the submission s of new
+	// media, assigning it a new ID, and updates s to have it as its MediaID,
+	// together. The events are added to the outbox with them.
+	AddSubmittedMedia(s *Submission, m *Media, events ...*Event) (id int64, err error)
+}
+
+/*---------------------------  Moderation  ---------------------------*/
+
+// errBadSubmission is wrapped by the errors for submissions that cannot be
+// made or reviewed as asked, so handlers can answer 400.
+var errBadSubmission = errors.New("bad submission")
+
+// submitMedia submits m, the media as u wants it, for moderation. m.ID is the
+// media it changes, 0 for new media. Moderators need not justify their
+// changes, which are approved straight away.
+func submitMedia(db MediaDatabase, u *User, m *Media, justification string) (*Submission, error) {
+	if err := checkSubmission(u, justification); err != nil {
+		return nil, err
+	}
+	justification = strings.TrimSpace(justification)
+	if m.ID == 0 {
+		m.SetCreator(u)
+	}
+	s := &Submission{
+		MediaID:       m.ID,
+		Media:         m,
+		Justification: justification,
+		Status:        submissionPending,
+		SubmittedByID: u.ID,
+		SubmittedBy:   u.DisplayName(),
+		SubmittedDate: time.Now().Format("02-01-2006"),
+	}
+	if _, err := db.AddSubmission(s); err != nil {
+		return nil, fmt.Errorf("could not save submission: %v", err)
+	}
+	if u.Is(RoleModerator) {
+		if err := reviewSubmission(db, s, u, submissionApproved, ""); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// resubmit replaces the media and justification of an open submission, and
+// puts it back in the queue.
+func resubmit(db MediaDatabase, s *Submission, m *Media, justification string) error {
+	if err := checkResubmission(s, justification); err != nil {
+		return err
+	}
+	justification = strings.TrimSpace(justification)
+	m.ID = s.MediaID
+	m.CreatedByID, m.CreatedBy = s.Media.CreatedByID, s.Media.CreatedBy
+	s.Media, s.Justification, s.Status = m, justification, submissionPending
+	if err := db.UpdateSubmission(s); err != nil {
+		return fmt.Errorf("could not save submission: %v", err)
+	}
+	return nil
+}
+
+// checkSubmission returns the error submitMedia gives for the submission by
+// u with the given justification, before anything is saved.
+func checkSubmission(u *User, justification string) error {
+	if strings.TrimSpace(justification) == "" && !u.Is(RoleModerator) {
+		return fmt.Errorf("%w: explain how the media fits the criteria", errBadSubmission)
+	}
+	return nil
+}
+
+// checkResubmission returns the error resubmit gives for s with the given
+// justification, before anything is saved.
+func checkResubmission(s *Submission, justification string) error {
+	if !s.Open() {
+		return fmt.Errorf("%w: submission %d is %s", errBadSubmission, s.ID, s.Status)
+	}
+	if strings.TrimSpace(justification) == "" {
+		return fmt.Errorf("%w: explain how the media fits the criteria", errBadSubmission)
+	}
+	return nil
+}
+
+// reviewSubmission moves a pending submission to status, on behalf of the
+// moderator u. Approving it applies it to the media; rejecting it or asking
+// for changes needs a reason.
+func reviewSubmission(db MediaDatabase, s *Submission, u *User, status SubmissionStatus, reason string) error {
+	if s.Status != submissionPending {
+		return fmt.Errorf("%w: submission %d is %s, not pending", errBadSubmission, s.ID, s.Status)
+	}
+	reason = strings.TrimSpace(reason)
+	if status != submissionApproved && reason == "" {
+		return fmt.Errorf("%w: give a reason", errBadSubmission)
+	}
+	if status == submissionApproved {
+		if err := applySubmission(db, s); err != nil {
+			return err
+		}
+	}
+	s.Status, s.Reason = status, reason
+	s.ReviewedByID, s.ReviewedBy = u.ID, u.DisplayName()
+	s.ReviewedDate = time.Now().Format("02-01-2006")
+	var events []*Event
+	if status == submissionApproved {
+		events = append(events, newSubmissionEvent(EventSubmissionApproved, s, u))
+	}
+	if err := db.UpdateSubmission(s, events...); err != nil {
+		return fmt.Errorf("could not save submission: %v", err)
+	}
+	log.Printf("submission %d %s by %s", s.ID, status, u.DisplayName())
+	return nil
+}
+
+// applySubmission saves the submitted media, adding it if it is new, with an
+// event on behalf of the submitter (see events.go), and records the change in
+// its history. Who created media and when stay as they were.
+//
+// Each step can be done again: new media is saved with its ID on s, credits
+// are matched with the stored ones, and the revision is recorded once per
+// submission. A submission whose approval failed part way can be approved
+// again to finish it.
+func applySubmission(db MediaDatabase, s *Submission) error {
+	m := *s.Media
+	summary := s.Justification
+	if summary == "" && s.Media.ID == 0 {
+		summary = "Added"
+	}
+	if s.MediaID == 0 {
+		m.ID = 0
+		m.CreatedDate = time.Now().Format("02-01-2006")
+		if _, err := db.AddSubmittedMedia(s, &m, newMediaEvent(EventMediaCreated, &m, s.SubmittedByID, s.SubmittedBy)); err != nil {
+			return fmt.Errorf("could not save media: %v", err)
+		}
+	} else {
+		old, err := db.GetMedia(s.MediaID)
+		if err != nil {
+			return fmt.Errorf("could not find media: %w", err)
+		}
+		m.ID = old.ID
+		m.CreatedByID, m.CreatedBy, m.CreatedDate = old.CreatedByID, old.CreatedBy, old.CreatedDate
+		if err := db.UpdateMedia(&m, newMediaEvent(EventMediaUpdated, &m, s.SubmittedByID, s.SubmittedBy)); err != nil {
+			return fmt.Errorf("could not save media: %v", err)
+		}
+	}
+	if err := saveCredits(db, &m); err != nil {
+		return fmt.Errorf("could not save media credits: %v", err)
+	}
+	if summary == "" {
+		summary = "Edited"
+	}
+	revisions, err := db.ListRevisions(m.ID)
+	if err != nil {
+		return fmt.Errorf("could not list revisions: %v", err)
+	}
+	for _, r := range revisions {
+		if r.SubmissionID == s.ID {
+			s.Media = &m
+			return nil
+		}
+	}
+	if err := recordRevision(db, &Revision{
+		Media:        &m,
+		SubmissionID: s.ID,
+		AuthorID:     s.SubmittedByID,
+		Author:       s.SubmittedBy,
+		Summary:      summary,
+	}); err != nil {
+		return err
+	}
+	s.Media = &m
+	return nil
+}
+
+/*---------------------------  Permissions  ---------------------------*/
+
+// submissionInPath returns the submission whose ID is in the path.
+func submissionInPath(r *http.Request) (*Submission, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad submission id: %v", err)
+	}
+	s, err := DB.GetSubmission(id)
+	if err != nil {
+		return nil, fmt.Errorf("could not find submission: %w", err)
+	}
+	return s, nil
+}
+
+// canViewSubmission is the permission to see the submission whose ID is in
+// the path: moderators see every submission, others their own.
+func canViewSubmission(u *User, r *http.Request) (bool, error) {
+	if u == nil {
+		return false, nil
+	}
+	s, err := submissionInPath(r)
+	if err != nil {
+		return false, err
+	}
+	return u.Is(RoleModerator) || s.SubmittedByID == u.ID, nil
+}
+
+// canEditSubmission is the permission to change the submission whose ID is in
+// the path, which only its submitter has.
+func canEditSubmission(u *User, r *http.Request) (bool, error) {
+	if u == nil {
+		return false, nil
+	}
+	s, err := submissionInPath(r)
+	if err != nil {
+		return false, err
+	}
+	return s.SubmittedByID == u.ID, nil
+}
+
+/*---------------------------  Handlers  ---------------------------*/
+
+// submissionsPage is what submissions.html shows.
+type submissionsPage struct {
+	Submissions  []*Submission
+	PageSubTitle string
+
+	// Statuses are the tabs of the moderation dashboard, nil elsewhere.
+	Statuses []FacetValue
+}
+
+// submissionErrorf returns the error for err from the moderation functions.
+func submissionErrorf(err error) error {
+	if errors.Is(err, errBadSubmission) {
+		return appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
+	return appErrorf(err, "%v", err)
+}
+
+// moderationHandler lists the submissions with the status in the query,
+// pending by default, for moderators to review.
+func moderationHandler(w http.ResponseWriter, r *http.Request) error {
+	status := SubmissionStatus(r.FormValue("status"))
+	if status == "" {
+		status = submissionPending
+	}
+	page := &submissionsPage{PageSubTitle: "Moderation"}
+	known := false
+	for _, s := range submissionStatuses {
+		known = known || s == status
+		page.Statuses = append(page.Statuses, FacetValue{
+			Label:    s.Label(),
+			Selected: s == status,
+			URL:      "/moderation?status=" + string(s),
+		})
+	}
+	if !known {
+		return appErrorCodef(http.StatusBadRequest, nil, "unknown status %q", status)
+	}
+
+	var err error
+	if page.Submissions, err = DB.ListSubmissions(status); err != nil {
+		return appErrorf(err, "could not list submissions: %v", err)
+	}
+	return submissionsTmpl.Execute(w, r, page)
+}
+
+// mySubmissionsHandler lists the submissions of the logged in user.
+func mySubmissionsHandler(w http.ResponseWriter, r *http.Request) error {
+	u, err := userFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+	if u == nil {
+		http.Redirect(w, r, loginURL(r.URL.RequestURI()), http.StatusFound)
+		return nil
+	}
+	page := &submissionsPage{PageSubTitle: "My Submissions"}
+	if page.Submissions, err = DB.ListSubmissionsBy(u.ID); err != nil {
+		return appErrorf(err, "could not list submissions: %v", err)
+	}
+	return submissionsTmpl.Execute(w, r, page)
+}
+
+// submissionHandler shows a submission, with the moderation actions to those
+// who may take them.
+func submissionHandler(w http.ResponseWriter, r *http.Request) error {
+	s, err := submissionInPath(r)
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	u, err := userFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+	s.CanReview = s.Status == submissionPending && u.Is(RoleModerator)
+	s.CanEdit = s.Open() && u != nil && s.SubmittedByID == u.ID
+	return submissionTmpl.Execute(w, r, s)
+}
+
+// editSubmissionFormHandler displays the media form for changing an open
+// submission.
+func editSubmissionFormHandler(w http.ResponseWriter, r *http.Request) error {
+	s, err := submissionInPath(r)
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	if !s.Open() {
+		return appErrorCodef(http.StatusBadRequest, nil, "submission %d is %s", s.ID, s.Status)
+	}
+	s.Media.PageSubTitle = "Change Submission"
+	return editTmpl.Execute(w, r, &mediaForm{
+		Media:                 s.Media,
+		Action:                fmt.Sprintf("/submissions/%d", s.ID),
+		Justification:         s.Justification,
+		Reason:                s.Reason,
+		JustificationRequired: true,
+	})
+}
+
+// resubmitHandler saves the changes to a submission from the media form, and
+// puts it back in the queue.
+func resubmitHandler(w http.ResponseWriter, r *http.Request) error {
+	s, err := submissionInPath(r)
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	m, err := mediaFromForm(r)
+	if err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "could not parse media from form: %v", err)
+	}
+	justification := r.FormValue("justification")
+	if err := checkResubmission(s, justification); err != nil {
+		return submissionErrorf(err)
+	}
+	if err := uploadPosterFromForm(r, m); err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
+	if err := resubmit(DB, s, m, justification); err != nil {
+		return submissionErrorf(err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/submissions/%d", s.ID), http.StatusFound)
+	return nil
+}
+
+// reviewHandler approves or rejects a submission, or asks for changes, as the
+// action in the path says.
+func reviewHandler(w http.ResponseWriter, r *http.Request) error {
+	s, err := submissionInPath(r)
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	u, err := userFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+	status := map[string]SubmissionStatus{
+		"approve":         submissionApproved,
+		"reject":          submissionRejected,
+		"request-changes": submissionChangesRequested,
+	}[mux.Vars(r)["action"]]
+	if err := reviewSubmission(DB, s, u, status, r.FormValue("reason")); err != nil {
+		return submissionErrorf(err)
+	}
+	http.Redirect(w, r, "/moderation", http.StatusFound)
+	return nil
+}
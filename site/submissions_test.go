@@ -0,0 +1,106 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// failingRevisionsDB is a memoryDB that fails to add revisions while fail
+// is set.
+type failingRevisionsDB struct {
+	*memoryDB
+	fail bool
+}
+
+func (db *failingRevisionsDB) AddRevision(r *Revision) (int64, error) {
+	if db.fail {
+		return 0, errors.New("revisions are down")
+	}
+	return db.memoryDB.AddRevision(r)
+}
+
+// TestApproveSubmissionAgain approves a submission of new media whose first
+// approval failed after the media was added.
+func TestApproveSubmissionAgain(t *testing.T) {
+	db := &failingRevisionsDB{memoryDB: newMemoryDB(), fail: true}
+	contributor := &User{ID: 1, Name: "Ann", Role: RoleContributor}
+	moderator := &User{ID: 2, Name: "Mo", Role: RoleModerator}
+	m := &Media{Title: "Alien", Credits: []*Credit{
+		{Role: roleDirector, Person: &Person{Name: "Ridley Scott"}},
+		{Role: roleActor, Person: &Person{Name: "Sigourney Weaver"}, Character: &Character{Name: "Ripley"}},
+	}}
+	s, err := submitMedia(db, contributor, m, "Ripley")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reviewSubmission(db, s, moderator, submissionApproved, ""); err == nil {
+		t.Fatal("approving without revisions succeeded")
+	}
+	stored, err := db.GetSubmission(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != submissionPending || stored.MediaID == 0 {
+		t.Fatalf("after the failed approval, submission = %+v, want pending with its media", stored)
+	}
+	credits, err := db.ListCredits(stored.MediaID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.fail = false
+	if err := reviewSubmission(db, stored, moderator, submissionApproved, ""); err != nil {
+		t.Fatalf("approving again: %v", err)
+	}
+	list, err := db.ListMedia()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != stored.MediaID {
+		t.Fatalf("media = %v, want only media %d", list, stored.MediaID)
+	}
+	again, err := db.ListCredits(stored.MediaID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != 2 || len(credits) != 2 || again[0].ID != credits[0].ID || again[1].ID != credits[1].ID {
+		t.Errorf("credits = %v, want the ones first saved, %v", again, credits)
+	}
+	people, err := db.ListPeople()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(people) != 2 {
+		t.Errorf("people = %v, want Ridley Scott and Sigourney Weaver once", people)
+	}
+	revisions, err := db.ListRevisions(stored.MediaID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 || revisions[0].SubmissionID != s.ID || revisions[0].Summary != "Ripley" {
+		t.Errorf("revisions = %+v, want one of submission %d", revisions, s.ID)
+	}
+
+	// Applying an approved submission again changes nothing.
+	if err := applySubmission(db, stored); err != nil {
+		t.Fatal(err)
+	}
+	if revisions, _ = db.ListRevisions(stored.MediaID); len(revisions) != 1 {
+		t.Errorf("revisions after applying again = %+v, want one", revisions)
+	}
+}
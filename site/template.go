@@ -31,7 +31,7 @@ func parseTemplate(filename string) *appTemplate {
 
 	pagePath :="content/startbootstrap/"
 
-	tmpl := template.Must(template.ParseFiles(pagePath + "base.html"))
+	tmpl := template.Must(template.New("base.html").Funcs(csrfFuncs("")).ParseFiles(pagePath + "base.html"))
 
 	// Put the named file into a template called "body"
 	path := filepath.Join(pagePath, filename)
@@ -49,6 +49,18 @@ func parseTemplate(filename string) *appTemplate {
 	return &appTemplate{tmpl.Lookup("base.html")}
 }
 
+// csrfFuncs returns the template functions that put the CSRF token in forms.
+// Every form that posts needs {{csrfField}}, as the body templates are given
+// only their page's data.
+func csrfFuncs(token string) template.FuncMap {
+	return template.FuncMap{
+		"csrfField": func() template.HTML {
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+				csrfFormField, template.HTMLEscapeString(token)))
+		},
+	}
+}
+
 // appTemplate is a user login-aware wrapper for a html/template.
 type appTemplate struct {
 	t *template.Template
@@ -61,12 +73,40 @@ func (tmpl *appTemplate) Execute(w http.ResponseWriter, r *http.Request, data in
 		PageTitle   string
 		Date 		string
 		Data        interface{}
+
+		// User is the logged in user, if any. CanLogIn is set when logging
+		// in is configured, and LoginURL comes back to this page.
+		User        *User
+		CanLogIn    bool
+		LoginURL    string
+
+		// What the user may do everywhere, see roles.go.
+		CanAddMedia    bool
+		CanModerate    bool
+		CanManageUsers bool
 	}{
 		PageTitle:	"Flip the Script",
 		Date:		time.Now().Format("02-01-2006"),
 		Data:		data,
+		CanLogIn:	AuthProvider != nil,
+		LoginURL:	loginURL(r.URL.RequestURI()),
+	}
+	var err error
+	if d.User, err = userFromRequest(r); err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+	d.CanAddMedia, d.CanManageUsers = d.User.CanAddMedia(), d.User.CanManageUsers()
+	d.CanModerate = d.User.Is(RoleModerator)
+	token, err := csrfToken(w, r)
+	if err != nil {
+		return appErrorf(err, "could not make CSRF token: %v", err)
+	}
+	// The template is cloned to give it the token of this request's session.
+	t, err := tmpl.t.Clone()
+	if err != nil {
+		return appErrorf(err, "could not clone template: %v", err)
 	}
-	if err := tmpl.t.Execute(w, d); err != nil {
+	if err := t.Funcs(csrfFuncs(token)).Execute(w, d); err != nil {
 		return appErrorf(err, "could not write template: %v", err)
 	}
 	return nil
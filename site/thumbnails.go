@@ -0,0 +1,371 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Pages show posters through variants resized to the widths in posterWidths,
+// served at /images/{hash}/{width}. The variants are made once, when the
+// poster is stored (see storeImage), and for posters stored before by
+// -import-images. Variants are JPEG, whatever the type of the poster, with
+// its EXIF orientation applied.
+
+// posterWidths are the widths, in pixels, of the variants made of each
+// poster, and defaultPosterWidth the one used where srcset is not.
+var posterWidths = []int{160, 320, 640, 1280}
+
+const defaultPosterWidth = 640
+
+// posterQuality is the JPEG quality of the variants.
+const posterQuality = 82
+
+// storedPosterPattern matches the URLs of the images kept in Images, see
+// imageName.
+var storedPosterPattern = regexp.MustCompile(`images/([0-9a-f]{64})(\.[a-z]+)$`)
+
+// storedPoster returns the hash of the image m.ImageURL if it is kept in
+// Images, and so has variants.
+func (m *Media) storedPoster() (hash string, ok bool) {
+	if Images == nil || !strings.HasPrefix(m.ImageURL, Images.URL("images/")) {
+		return "", false
+	}
+	match := storedPosterPattern.FindStringSubmatch(m.ImageURL)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// PosterURL returns the URL of the poster of m to show where srcset is not
+// used: a variant if there are some, the image as is otherwise, such as
+// posters linked from other sites, and the placeholder (see posters.go) for
+// media without an image.
+func (m *Media) PosterURL() string {
+	if hash, ok := m.storedPoster(); ok {
+		return posterVariantURL(hash, defaultPosterWidth)
+	}
+	if m.ImageURL == "" {
+		return placeholderURL(m.ID)
+	}
+	return m.ImageURL
+}
+
+// PosterSrcset returns the srcset attribute for the variants of the poster of
+// m, or "" if it has none.
+func (m *Media) PosterSrcset() string {
+	hash, ok := m.storedPoster()
+	if !ok {
+		return ""
+	}
+	var set []string
+	for _, w := range posterWidths {
+		set = append(set, fmt.Sprintf("%s %dw", posterVariantURL(hash, w), w))
+	}
+	return strings.Join(set, ", ")
+}
+
+func posterVariantURL(hash string, width int) string {
+	return fmt.Sprintf("/images/%s/%d", hash, width)
+}
+
+// variantName is the name the variant of the given width is kept under in
+// Images.
+func variantName(hash string, width int) string {
+	return fmt.Sprintf("variants/%s/%d.jpg", hash, width)
+}
+
+/*---------------------------  Processing  ---------------------------*/
+
+// makeVariants stores the variants of the image data, named hash, in store.
+func makeVariants(ctx context.Context, store BlobStore, hash string, data []byte) error {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errBadImage, err)
+	}
+	// Flatten onto white once, for every variant: JPEG has no transparency.
+	b := src.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), src, b.Min, draw.Over)
+	orientation := jpegOrientation(data)
+
+	for _, width := range posterWidths {
+		var buf bytes.Buffer
+		img := orient(shrink(flat, width, orientation > 4), orientation)
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: posterQuality}); err != nil {
+			return fmt.Errorf("could not encode variant: %v", err)
+		}
+		if err := store.Put(ctx, variantName(hash, width), "image/jpeg", &buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeMissingVariants makes the variants of the stored poster named hash if
+// some are missing, as they are for posters stored before variants were
+// made, reporting whether they were. With dryRun set nothing is made.
+func makeMissingVariants(ctx context.Context, store BlobStore, hash string, dryRun bool) (bool, error) {
+	missing := false
+	for _, width := range posterWidths {
+		rc, err := store.Get(ctx, variantName(hash, width))
+		if errors.Is(err, errNotFound) {
+			missing = true
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		rc.Close()
+	}
+	if !missing || dryRun {
+		return missing, nil
+	}
+	name, err := findImage(ctx, store, hash)
+	if err != nil {
+		return false, err
+	}
+	data, err := readBlob(ctx, store, name)
+	if err != nil {
+		return false, err
+	}
+	return true, makeVariants(ctx, store, hash, data)
+}
+
+// shrink returns src scaled down, by averaging, to be width pixels wide once
+// oriented; with sideways set, the orientation swaps width and height. Images
+// already narrower are copied as they are.
+func shrink(src *image.RGBA, width int, sideways bool) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := width, sh*width/sw
+	if sideways {
+		dw, dh = sw*width/sh, width
+	}
+	if dw >= sw || dh >= sh {
+		dw, dh = sw, sh
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, (y+1)*sh/dh
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, (x+1)*sw/dw
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r, g, b, a = r+int(p[0]), g+int(p[1]), b+int(p[2]), a+int(p[3])
+					n++
+				}
+			}
+			i := y*dst.Stride + x*4
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// orient returns img turned the way the EXIF orientation says it is meant to
+// be shown, 1 being as it is.
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if orientation > 4 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:][:4], img.Pix[y*img.Stride+x*4:][:4])
+		}
+	}
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation of JPEG data, or 0 if it has
+// none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 0
+	}
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || size < 2 || i+2+size > len(data) {
+			// The image data starts, there is no more metadata.
+			return 0
+		}
+		segment := data[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 0
+}
+
+// exifOrientation returns the orientation tag in the first IFD of the EXIF
+// (TIFF) data, or 0 if there is none.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 0
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+/*---------------------------  Handlers  ---------------------------*/
+
+// imageVariantHandler serves the variant of a poster of the width asked for.
+// Posters stored before variants were made are redirected to, until
+// -import-images makes them.
+func imageVariantHandler(w http.ResponseWriter, r *http.Request) error {
+	hash := mux.Vars(r)["hash"]
+	width, err := strconv.Atoi(mux.Vars(r)["size"])
+	if err != nil || Images == nil || !isPosterWidth(width) {
+		return appErrorf(errNotFound, "no image variant %s", r.URL.Path)
+	}
+	ctx := r.Context()
+	data, err := readBlob(ctx, Images, variantName(hash, width))
+	if errors.Is(err, errNotFound) {
+		name, err := findImage(ctx, Images, hash)
+		if err != nil {
+			return appErrorf(err, "could not find image: %v", err)
+		}
+		// Not cached, as the variant is on its way.
+		w.Header().Set("Cache-Control", "no-cache")
+		http.Redirect(w, r, Images.URL(name), http.StatusFound)
+		return nil
+	}
+	if err != nil {
+		return appErrorf(err, "could not read image variant: %v", err)
+	}
+
+	// The variants of an image never change.
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, hash, width))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	return nil
+}
+
+func isPosterWidth(width int) bool {
+	for _, w := range posterWidths {
+		if w == width {
+			return true
+		}
+	}
+	return false
+}
+
+// readBlob reads the blob of the given name from store.
+func readBlob(ctx context.Context, store BlobStore, name string) ([]byte, error) {
+	rc, err := store.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// findImage returns the name of the uploaded image in store with the given
+// hash, whatever its type.
+func findImage(ctx context.Context, store BlobStore, hash string) (name string, err error) {
+	for contentType := range imageExtensions {
+		name = imageName(hash, contentType)
+		rc, err := store.Get(ctx, name)
+		if err == nil {
+			rc.Close()
+			return name, nil
+		}
+		if !errors.Is(err, errNotFound) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("image %s: %w", hash, errNotFound)
+}
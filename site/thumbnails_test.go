@@ -0,0 +1,282 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useImages keeps uploaded images in a directory of the test's.
+func useImages(t *testing.T) (*localBlobStore, string) {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := newLocalBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := Images
+	Images = store
+	t.Cleanup(func() { Images = old })
+	return store, dir
+}
+
+// getVariant serves the variant of the given width of the image named hash,
+// returning it decoded.
+func getVariant(t *testing.T, hash string, width int) image.Image {
+	t.Helper()
+	w := serveAs(t, httptest.NewRequest("GET", posterVariantURL(hash, width), nil), nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("GET variant = %d %q, want a JPEG", w.Code, w.Header().Get("Content-Type"))
+	}
+	img, _, err := image.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestWebPPoster(t *testing.T) {
+	store, _ := useImages(t)
+	webp, err := ioutil.ReadFile("testdata/poster.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := storeImage(context.Background(), store, bytes.NewReader(webp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := imageHash(webp)
+	m := &Media{ImageURL: url}
+	if !strings.HasSuffix(url, hash+".webp") || m.PosterURL() != posterVariantURL(hash, defaultPosterWidth) || m.PosterSrcset() == "" {
+		t.Errorf("WebP poster %s shown as %q, srcset %q; want its variants", url, m.PosterURL(), m.PosterSrcset())
+	}
+	// The poster is 150x100, narrower than the variant.
+	if b := getVariant(t, hash, 160).Bounds(); b.Dx() != 150 || b.Dy() != 100 {
+		t.Errorf("variant is %dx%d, want 150x100", b.Dx(), b.Dy())
+	}
+}
+
+// TestStoreImageStripsMetadata stores images of each type with where they
+// were taken in their metadata, which must not be kept.
+func TestStoreImageStripsMetadata(t *testing.T) {
+	store, dir := useImages(t)
+	const secret = "GPS 51.4779N 0.0015W"
+
+	// A JPEG image with EXIF data, taken sideways, and a comment.
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 400, 200)), nil); err != nil {
+		t.Fatal(err)
+	}
+	exif := append(orientationSegment(6), secret...)
+	binary.BigEndian.PutUint16(exif[2:], uint16(len(exif)-2))
+	comment := append([]byte("\xFF\xFE\x00\x00"), secret...)
+	binary.BigEndian.PutUint16(comment[2:], uint16(len(comment)-2))
+	jpegData := append(append(append([]byte("\xFF\xD8"), exif...), comment...), buf.Bytes()[2:]...)
+
+	// A PNG image with a text chunk.
+	buf.Reset()
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 400, 200))); err != nil {
+		t.Fatal(err)
+	}
+	text := append([]byte("\x00\x00\x00\x00tEXtComment\x00"), secret...)
+	binary.BigEndian.PutUint32(text, uint32(len(text)-8))
+	text = binary.BigEndian.AppendUint32(text, crc32.ChecksumIEEE(text[4:]))
+	pngData := append(append(buf.Bytes()[:33:33], text...), buf.Bytes()[33:]...)
+
+	// A GIF image with a comment extension.
+	buf.Reset()
+	if err := gif.Encode(&buf, image.NewPaletted(image.Rect(0, 0, 400, 200), palette.Plan9), nil); err != nil {
+		t.Fatal(err)
+	}
+	gifComment := append(append([]byte{0x21, 0xFE, byte(len(secret))}, secret...), 0)
+	i := 13 + 3<<(buf.Bytes()[10]&7+1) // After the global color table.
+	gifData := append(append(buf.Bytes()[:i:i], gifComment...), buf.Bytes()[i:]...)
+
+	// A WebP image in the extended format, with an EXIF chunk.
+	poster, err := ioutil.ReadFile("testdata/poster.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webpData := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x08\x00\x00\x00\x95\x00\x00\x63\x00\x00")
+	webpData = append(webpData, poster[12:]...)
+	webpData = append(webpData, "EXIF\x14\x00\x00\x00"+secret...)
+	binary.LittleEndian.PutUint32(webpData[4:], uint32(len(webpData)-8))
+
+	for _, test := range []struct {
+		name string
+		data []byte
+		ext  string
+	}{
+		{"JPEG", jpegData, ".jpg"},
+		{"PNG", pngData, ".png"},
+		{"GIF", gifData, ".gif"},
+		{"WebP", webpData, ".webp"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := image.Decode(bytes.NewReader(test.data)); err != nil {
+				t.Fatalf("test image does not decode: %v", err)
+			}
+			url, err := storeImage(context.Background(), store, bytes.NewReader(test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(url, test.ext) {
+				t.Fatalf("stored as %s, want %s", url, test.ext)
+			}
+			stored, err := ioutil.ReadFile(filepath.Join(dir, "images", path.Base(url)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(stored, []byte(secret)) {
+				t.Errorf("stored image still has %q", secret)
+			}
+			if _, _, err := image.Decode(bytes.NewReader(stored)); err != nil {
+				t.Errorf("stored image does not decode: %v", err)
+			}
+			if url != store.URL(imageName(imageHash(stored), "image/"+strings.ToLower(test.name))) {
+				t.Errorf("stored as %s, want named after what is stored", url)
+			}
+		})
+	}
+
+	// The JPEG is still shown the right way up.
+	stored, err := stripMetadata(jpegData, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := jpegOrientation(stored); o != 6 {
+		t.Errorf("orientation of stored JPEG = %d, want 6", o)
+	}
+	if b := getVariant(t, imageHash(stored), 160).Bounds(); b.Dx() != 160 || b.Dy() != 320 {
+		t.Errorf("variant is %dx%d, want 160x320", b.Dx(), b.Dy())
+	}
+}
+
+func TestImportImagesMakesVariants(t *testing.T) {
+	useDB(t, newMemoryDB())
+	store, dir := useImages(t)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 400, 600))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	url, err := storeImage(context.Background(), store, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.AddMedia(&Media{Title: "Alien", ImageURL: url}); err != nil {
+		t.Fatal(err)
+	}
+	// As posters stored before variants were made are.
+	if err := os.RemoveAll(filepath.Join(dir, "variants")); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := importImages(DB, store, &out, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "0 to copy, 1 to make variants of, 0 failed") {
+		t.Errorf("importImages printed:\n%s", out.String())
+	}
+	hash := imageHash(data)
+	if b := getVariant(t, hash, 160).Bounds(); b.Dx() != 160 || b.Dy() != 240 {
+		t.Errorf("variant is %dx%d, want 160x240", b.Dx(), b.Dy())
+	}
+}
+
+// posterForm returns a media form with a poster, as the edit page posts it.
+func posterForm(t *testing.T, path string, fields map[string]string) *http.Request {
+	t.Helper()
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 20, 30))); err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	fw, err := mw.CreateFormFile("image", "poster.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(img.Bytes())
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", path, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// TestFailedEditStoresNoPoster posts posters with requests that fail, which
+// must not store them.
+func TestFailedEditStoresNoPoster(t *testing.T) {
+	useDB(t, newMemoryDB())
+	_, dir := useImages(t)
+	moderator := addTestUser(t, RoleModerator)
+	contributor := addTestUser(t, RoleContributor)
+	ids := addTitles(t, DB, "Alien", "Aliens")
+	if err := DB.DeleteMedia(ids[1], moderator.ID, moderator.DisplayName()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		req  *http.Request
+		u    *User
+		want int
+	}{
+		{"missing media", posterForm(t, fmt.Sprintf("/media/%d", ids[0]+100), map[string]string{"title": "Ghost"}), moderator, http.StatusNotFound},
+		{"trashed media", posterForm(t, fmt.Sprintf("/media/%d", ids[1]), map[string]string{"title": "Aliens"}), moderator, http.StatusNotFound},
+		{"bad form", posterForm(t, fmt.Sprintf("/media/%d", ids[0]), map[string]string{"title": "Alien", "rubricVersion": "x"}), moderator, http.StatusBadRequest},
+		{"unjustified", posterForm(t, "/media", map[string]string{"title": "Alien 3"}), contributor, http.StatusBadRequest},
+	} {
+		if w := serveAs(t, tt.req, tt.u); w.Code != tt.want {
+			t.Errorf("%s: POST %s = %d, want %d", tt.name, tt.req.URL.Path, w.Code, tt.want)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*", "*")); len(files) != 0 {
+		t.Errorf("stored %v, want nothing", files)
+	}
+
+	// The same poster is stored once the request is good.
+	req := posterForm(t, "/media", map[string]string{"title": "Alien 3", "justification": "Ripley"})
+	if w := serveAs(t, req, contributor); w.Code != http.StatusFound {
+		t.Fatalf("POST /media = %d, want a redirect", w.Code)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "images", "*")); len(files) != 1 {
+		t.Errorf("stored %v, want the poster", files)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Deleted media goes to the trash, where moderators can restore it, until it
+// has been there longer than trashRetention and is purged.
+
+// defaultTrashRetention is how long deleted media is kept when
+// TRASH_RETENTION is not set.
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// trashPurgeInterval is how often the site purges the trash.
+const trashPurgeInterval = time.Hour
+
+// trashRetention returns how long deleted media is kept, from the
+// TRASH_RETENTION environment variable, a duration such as "720h".
+func trashRetention() (time.Duration, error) {
+	s := os.Getenv("TRASH_RETENTION")
+	if s == "" {
+		return defaultTrashRetention, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("bad TRASH_RETENTION %q, want a duration such as 720h", s)
+	}
+	return d, nil
+}
+
+// sortDeletedMedia orders media in the trash most recently deleted first, for
+// the backends that cannot sort by it.
+func sortDeletedMedia(list []*Media) {
+	sort.Slice(list, func(i, j int) bool {
+		if a, b := list[i].DeletedAt, list[j].DeletedAt; !a.Equal(b) {
+			return a.After(b)
+		}
+		return list[i].ID > list[j].ID
+	})
+}
+
+// purgeTrash permanently removes the media deleted before the given time,
+// returning how many were.
+func purgeTrash(db MediaDatabase, before time.Time) (int, error) {
+	list, err := db.ListDeletedMedia()
+	if err != nil {
+		return 0, fmt.Errorf("could not list trash: %v", err)
+	}
+	n := 0
+	for _, m := range list {
+		if !m.DeletedAt.Before(before) {
+			continue
+		}
+		if err := db.PurgeMedia(m.ID); err != nil {
+			return n, fmt.Errorf("could not purge media %d: %v", m.ID, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// deletedMedia returns the media in the trash with the given ID. The error
+// wraps errNotFound if it is not there.
+func deletedMedia(db MediaDatabase, id int64) (*Media, error) {
+	list, err := db.ListDeletedMedia()
+	if err != nil {
+		return nil, fmt.Errorf("could not list trash: %v", err)
+	}
+	for _, m := range list {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("media with id %d in the trash %w", id, errNotFound)
+}
+
+// purgeTrashEvery purges the media that has been in the trash longer than
+// retention now and at every interval after. It does not return.
+func purgeTrashEvery(db MediaDatabase, retention, interval time.Duration) {
+	for {
+		n, err := purgeTrash(db, time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("trash: %v", err)
+		} else if n > 0 {
+			log.Printf("trash: purged %d media deleted more than %v ago", n, retention)
+		}
+		time.Sleep(interval)
+	}
+}
+
+/*---------------------------  Handlers  ---------------------------*/
+
+// trashItem is media in the trash as trash.html shows it.
+type trashItem struct {
+	*Media
+	Deleted string
+	Purge   string
+}
+
+// trashPage is what trash.html shows.
+type trashPage struct {
+	Items        []*trashItem
+	Retention    string
+	PageSubTitle string
+}
+
+// trashHandler lists the deleted media for moderators to restore.
+func trashHandler(w http.ResponseWriter, r *http.Request) error {
+	retention, err := trashRetention()
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	list, err := DB.ListDeletedMedia()
+	if err != nil {
+		return appErrorf(err, "could not list trash: %v", err)
+	}
+	page := &trashPage{
+		Retention:    fmt.Sprintf("%d days", int(retention.Hours()/24)),
+		PageSubTitle: "Trash",
+	}
+	for _, m := range list {
+		page.Items = append(page.Items, &trashItem{
+			Media:   m,
+			Deleted: m.DeletedAt.Format("02-01-2006 15:04"),
+			Purge:   m.DeletedAt.Add(retention).Format("02-01-2006"),
+		})
+	}
+	return trashTmpl.Execute(w, r, page)
+}
+
+// restoreHandler takes media out of the trash, recording the restore in its
+// history.
+func restoreHandler(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return appErrorf(err, "bad media id: %v", err)
+	}
+	user, err := userFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "could not get user: %v", err)
+	}
+	rev := &Revision{MediaID: id, AuthorID: user.ID, Author: user.DisplayName()}
+	if err := restoreMedia(DB, rev); err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/media/%d", id), http.StatusFound)
+	return nil
+}
+
+// restoreMedia takes the media r.MediaID out of the trash, recording the
+// restore as r once it is done. It is announced as an update, see events.go.
+func restoreMedia(db MediaDatabase, r *Revision) error {
+	m, err := deletedMedia(db, r.MediaID)
+	if err != nil {
+		return fmt.Errorf("could not find media: %w", err)
+	}
+	if err := loadCredits(db, m); err != nil {
+		return fmt.Errorf("could not load credits: %v", err)
+	}
+	m.DeletedAt, m.DeletedByID, m.DeletedBy = time.Time{}, 0, ""
+	event := newMediaEvent(EventMediaUpdated, m, r.AuthorID, r.Author)
+	if err := db.RestoreMedia(m.ID, event); err != nil {
+		return fmt.Errorf("could not restore media: %w", err)
+	}
+	r.Media = m
+	if r.Summary == "" {
+		r.Summary = "Restored"
+	}
+	return recordRevision(db, r)
+}
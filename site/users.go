@@ -0,0 +1,73 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "fmt"
+
+// User is someone who has logged in through the identity provider (see
+// auth.go). Issuer and Subject identify them there.
+type User struct {
+	ID          int64
+	Issuer      string
+	Subject     string
+	Name        string
+	Email       string
+	CreatedDate string
+
+	// Role is what the user may do, see roles.go.
+	Role Role
+}
+
+// DisplayName returns the name to show for the user.
+func (u *User) DisplayName() string {
+	switch {
+	case u.Name != "":
+		return u.Name
+	case u.Email != "":
+		return u.Email
+	}
+	return fmt.Sprintf("User %d", u.ID)
+}
+
+// SetCreator sets who created m to u, or to anonymous when u is nil.
+func (m *Media) SetCreator(u *User) {
+	if u == nil {
+		m.SetCreatorAnonymous()
+		return
+	}
+	m.CreatedBy = u.DisplayName()
+	m.CreatedByID = u.ID
+}
+
+// UserDatabase provides thread-safe access to the users of the site. Every
+// MediaDatabase is also a UserDatabase.
+type UserDatabase interface {
+	// GetUser retrieves a user by its ID. The error wraps errNotFound if
+	// there is none.
+	GetUser(id int64) (*User, error)
+
+	// GetUserByIdentity retrieves the user with the given identity at the
+	// identity provider. The error wraps errNotFound if there is none.
+	GetUserByIdentity(issuer, subject string) (*User, error)
+
+	// AddUser saves a given user, assigning it a new ID.
+	AddUser(u *User) (id int64, err error)
+
+	// UpdateUser updates the entry for a given user.
+	UpdateUser(u *User) error
+
+	// ListUsers returns all the users, ordered by ID.
+	ListUsers() ([]*User, error)
+}